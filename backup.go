@@ -0,0 +1,108 @@
+package cqkv
+
+import (
+	"github.com/cqkv/cqkv/model"
+	"os"
+	"sort"
+)
+
+// backupFile is a data file or a blob file referenced by the backup, size is its size when the backup starts
+type backupFile struct {
+	fileType string
+	dataFile *model.DataFile
+	size     int64
+}
+
+// Backup copy the data files and the blob files to dir, the db can be opened on dir.
+// the writes after the backup starts are not in it, the db is only locked to list the files
+func (db *DB) Backup(dir string) error {
+	files, err := db.backupFiles()
+	if err != nil {
+		return err
+	}
+	defer releaseBackupFiles(files)
+
+	if err = db.options.fs.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = db.copyBackupFile(dir, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupFiles reference the synced data files and blob files in the order of fid,
+// the caller should release them
+func (db *DB) backupFiles() ([]*backupFile, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.syncActiveFiles(); err != nil {
+		return nil, err
+	}
+
+	var files []*backupFile
+	add := func(fileType string, dataFile *model.DataFile) error {
+		size := dataFile.WriteOffset
+		if dataFile != db.activeFile && dataFile != db.activeBlobFile {
+			var err error
+			if size, err = dataFile.IoManager.Size(); err != nil {
+				return err
+			}
+		}
+		dataFile.Ref()
+		files = append(files, &backupFile{fileType: fileType, dataFile: dataFile, size: size})
+		return nil
+	}
+
+	dataFiles := make([]*model.DataFile, 0, len(db.olderFiles)+1)
+	for _, dataFile := range db.olderFiles {
+		dataFiles = append(dataFiles, dataFile)
+	}
+	if db.activeFile != nil {
+		dataFiles = append(dataFiles, db.activeFile)
+	}
+	sort.Slice(dataFiles, func(i, j int) bool {
+		return dataFiles[i].Fid < dataFiles[j].Fid
+	})
+	for _, dataFile := range dataFiles {
+		if err := add(model.DataFileType, dataFile); err != nil {
+			releaseBackupFiles(files)
+			return nil, err
+		}
+	}
+	for _, blobFile := range db.blobFiles {
+		if err := add(model.BlobFileType, blobFile); err != nil {
+			releaseBackupFiles(files)
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func releaseBackupFiles(files []*backupFile) {
+	for _, file := range files {
+		_ = file.dataFile.Unref()
+	}
+}
+
+// copyBackupFile copy the file to dir
+func (db *DB) copyBackupFile(dir string, file *backupFile) error {
+	fileName := model.GetDataFileName(dir, file.fileType, file.dataFile.Fid)
+	if err := db.options.fs.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ioManager, err := db.options.fs.OpenFile(fileName)
+	if err != nil {
+		return err
+	}
+	dst := model.OpenDataFile(file.dataFile.Fid, ioManager)
+	defer dst.Close()
+
+	if err = dst.WriteFrom(file.dataFile.NewReader(0, file.size), file.size); err != nil {
+		return err
+	}
+	return dst.Sync()
+}
@@ -2,6 +2,7 @@ package cqkv
 
 import (
 	"encoding/binary"
+	"github.com/cqkv/cqkv/codec"
 	"github.com/cqkv/cqkv/model"
 	"sync"
 	"sync/atomic"
@@ -17,33 +18,58 @@ const (
 
 // WriteBatch is the option for write batch
 // the isolation level of the write batch is serializable
+// the records of several keyspaces can be committed in one write batch
 type WriteBatch struct {
 	mu *sync.Mutex
 
 	db            *DB
+	keyspace      *Keyspace // the keyspace of Put and Delete
 	options       *writeBatchOptions
-	pendingWrites map[string]*model.Record
+	pendingWrites map[batchKey]*model.Record
+}
+
+// batchKey is the key of a pending write
+type batchKey struct {
+	keyspace *Keyspace
+	key      string
 }
 
 func (db *DB) NewWriteBatch(options ...WriteBatchOption) *WriteBatch {
-	opts := defaultWriteBatchOptions
+	return db.defaultKeyspace.NewWriteBatch(options...)
+}
+
+// NewWriteBatch create a write batch whose Put and Delete write the keyspace
+func (ks *Keyspace) NewWriteBatch(options ...WriteBatchOption) *WriteBatch {
+	// copy the default options, the options of a batch should not change the others
+	opts := *defaultWriteBatchOptions
 
 	for _, opt := range options {
-		opt(opts)
+		opt(&opts)
 	}
 
 	return &WriteBatch{
 		mu:            new(sync.Mutex),
-		options:       opts,
-		db:            db,
-		pendingWrites: make(map[string]*model.Record),
+		options:       &opts,
+		db:            ks.db,
+		keyspace:      ks,
+		pendingWrites: make(map[batchKey]*model.Record),
 	}
 }
 
 func (wb *WriteBatch) Put(key []byte, value []byte) error {
+	return wb.PutIn(wb.keyspace, key, value)
+}
+
+// PutIn put the key of the keyspace in the write batch
+func (wb *WriteBatch) PutIn(ks *Keyspace, key []byte, value []byte) error {
 	if len(key) == 0 {
 		return ErrEmptyKey
 	}
+	if ks.id != defaultKeyspaceID {
+		if _, ok := wb.db.options.codec.(*codec.CodecImpl); !ok {
+			return ErrKeyspaceNotSupported
+		}
+	}
 
 	if len(wb.pendingWrites) == wb.options.maxBatchNum {
 		return ErrExceedMaxBatchNum
@@ -53,12 +79,17 @@ func (wb *WriteBatch) Put(key []byte, value []byte) error {
 	defer wb.mu.Unlock()
 
 	// store record temporarily
-	record := &model.Record{Key: key, Value: value}
-	wb.pendingWrites[string(key)] = record
+	record := &model.Record{Key: key, Value: value, Keyspace: ks.id}
+	wb.pendingWrites[batchKey{keyspace: ks, key: string(key)}] = record
 	return nil
 }
 
 func (wb *WriteBatch) Delete(key []byte) error {
+	return wb.DeleteIn(wb.keyspace, key)
+}
+
+// DeleteIn delete the key of the keyspace in the write batch
+func (wb *WriteBatch) DeleteIn(ks *Keyspace, key []byte) error {
 	if len(key) == 0 {
 		return ErrEmptyKey
 	}
@@ -71,17 +102,18 @@ func (wb *WriteBatch) Delete(key []byte) error {
 	defer wb.mu.Unlock()
 
 	// if the data does not exist, return directly
-	recordPos := wb.db.options.keydir.Get(key)
+	bk := batchKey{keyspace: ks, key: string(key)}
+	recordPos := ks.keydir.Get(key)
 	if recordPos == nil {
-		if wb.pendingWrites[string(key)] != nil {
-			delete(wb.pendingWrites, string(key))
+		if wb.pendingWrites[bk] != nil {
+			delete(wb.pendingWrites, bk)
 		}
 		return nil
 	}
 
 	// store record temporarily
-	record := &model.Record{Key: key, IsDelete: true}
-	wb.pendingWrites[string(key)] = record
+	record := &model.Record{Key: key, IsDelete: true, Keyspace: ks.id}
+	wb.pendingWrites[bk] = record
 	return nil
 }
 
@@ -89,6 +121,9 @@ func (wb *WriteBatch) Commit() error {
 	if len(wb.pendingWrites) == 0 {
 		return nil
 	}
+	if wb.db.options.readOnly {
+		return ErrReadOnly
+	}
 
 	if len(wb.pendingWrites) > wb.options.maxBatchNum {
 		return ErrExceedMaxBatchNum
@@ -97,22 +132,43 @@ func (wb *WriteBatch) Commit() error {
 	wb.db.mu.Lock()
 	defer wb.db.mu.Unlock()
 
+	var size int64
+	for bk, record := range wb.pendingWrites {
+		if bk.keyspace.dropped {
+			return ErrKeyspaceDropped
+		}
+		if !record.IsDelete {
+			size += int64(len(record.Key)+len(record.Value)) + model.MaxHeaderSize
+		}
+	}
+	// the batch of deletes is allowed, it frees the space after merge
+	if size > 0 {
+		if err := wb.db.checkQuota(size); err != nil {
+			return err
+		}
+	}
+
 	seq := atomic.AddUint64(&wb.db.txSeq, 1)
 
-	positions := make(map[string]*model.RecordPos)
-	for _, record := range wb.pendingWrites {
+	// the records written before a failed one are removed, they take no space of the quota
+	mark := wb.db.markActiveFiles()
+	positions := make(map[batchKey]*model.RecordPos)
+	for bk, record := range wb.pendingWrites {
 		// write record to the file
 		pos, err := wb.db.appendRecord(&model.Record{
 			Key:      addTxSeqPrefix(record.Key, seq),
 			Value:    record.Value,
 			IsDelete: record.IsDelete,
+			Keyspace: record.Keyspace,
+			Prev:     bk.keyspace.prevVersion(record.Key),
 		})
 		if err != nil {
+			wb.db.rollbackTo(mark)
 			return err
 		}
 		// update keydir must after all the records are written to the file
 		// store the position of the record temporarily
-		positions[string(record.Key)] = pos
+		positions[bk] = pos
 	}
 
 	// after all the records are written to the file
@@ -122,26 +178,30 @@ func (wb *WriteBatch) Commit() error {
 		Value: nil,
 	}
 	if _, err := wb.db.appendRecord(finishRecord); err != nil {
+		wb.db.rollbackTo(mark)
 		return err
 	}
 
-	// sync the file
+	// sync the file, the db fails if the sync fails
 	if wb.options.sync && wb.db.activeFile != nil {
-		if err := wb.db.activeFile.Sync(); err != nil {
+		if err := wb.db.syncActiveFiles(); err != nil {
 			return err
 		}
 	}
 
 	// update keydir
-	for _, record := range wb.pendingWrites {
+	for bk, record := range wb.pendingWrites {
 		if record.IsDelete {
-			wb.db.options.keydir.Delete(record.Key)
+			bk.keyspace.deleteKeydir(record.Key)
+			bk.keyspace.setTombstone(record.Key, positions[bk])
 		} else {
-			wb.db.options.keydir.Put(record.Key, positions[string(record.Key)])
+			pos := positions[bk]
+			wb.db.setInlineValue(pos, record.Value)
+			bk.keyspace.putKeydir(record.Key, pos)
 		}
 	}
 
-	wb.pendingWrites = make(map[string]*model.Record)
+	wb.pendingWrites = make(map[batchKey]*model.Record)
 	return nil
 }
 
@@ -45,6 +45,13 @@ func TestWriteBatch(t *testing.T) {
 
 	_, err = db.Get([]byte("key1"))
 	assert.Equal(t, ErrNoRecord, err)
+
+	// the options of a batch do not change the others
+	wb3 := db.NewWriteBatch(WithSync(true), WithMaxBatchNum(1))
+	assert.True(t, wb3.options.sync)
+	wb4 := db.NewWriteBatch()
+	assert.False(t, wb4.options.sync)
+	assert.Equal(t, defaultWriteBatchOptions.maxBatchNum, wb4.options.maxBatchNum)
 }
 
 func TestWriteBatchAfterRestart(t *testing.T) {
@@ -0,0 +1,443 @@
+package cqkv
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/cqkv/cqkv/model"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+blob file: the values not smaller than the blob threshold are written to the blob files named <fid>.blob
+	- blob records: key = record key, keyspace = record keyspace, seq = record seq, value = the real value
+the data record of a blob value has the blob flag and its value is the pointer to the blob record:
+	blob fid (uvarint) | offset (varint)
+merge only moves the small pointer records, the blob files are cleared by GCBlobs.
+*/
+
+// writeBlob write the value of the record to the active blob file
+// and replace the value with the pointer, the caller should hold the lock
+func (db *DB) writeBlob(record *model.Record) error {
+	if db.failed != nil {
+		return ErrDBFailed
+	}
+	data, size, err := db.marshalRecord(&model.Record{
+		Key:      record.Key,
+		Value:    record.Value,
+		Seq:      record.Seq,
+		Keyspace: record.Keyspace,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = db.prepareBlobFile(size); err != nil {
+		return err
+	}
+
+	offset := db.activeBlobFile.WriteOffset
+	if err = db.activeBlobFile.Write(data); err != nil {
+		db.rollback(db.activeBlobFile, offset)
+		return err
+	}
+	db.diskBytes += size
+
+	record.Value = marshalBlobPointer(db.activeBlobFile.Fid, offset)
+	record.IsBlob = true
+	return nil
+}
+
+// prepareBlobFile make sure the active blob file has room for the blob record of size,
+// a big value has its own blob file
+func (db *DB) prepareBlobFile(size int64) error {
+	if db.activeBlobFile == nil ||
+		(db.activeBlobFile.WriteOffset > 0 && db.activeBlobFile.WriteOffset+size > db.options.dataFileSize) {
+		return db.setActiveBlobFile()
+	}
+	return nil
+}
+
+// setActiveBlobFile seal the active blob file and open a new one
+func (db *DB) setActiveBlobFile() error {
+	var fid uint32
+	if db.activeBlobFile != nil {
+		fid = db.activeBlobFile.Fid + 1
+		// the sealed blob file is read only, sync to disk first
+		if err := db.activeBlobFile.Sync(); err != nil {
+			return db.fail(err)
+		}
+		db.sealDataFile(db.activeBlobFile)
+		db.metrics.fileRotations.Inc()
+		db.options.logger.Debug("blob file rotated", "fid", db.activeBlobFile.Fid)
+	}
+
+	ioManager, err := db.options.ioManagerCreator(model.GetDataFileName(db.options.dirPath, model.BlobFileType, fid))
+	if err != nil {
+		return err
+	}
+	db.activeBlobFile = model.OpenDataFile(fid, ioManager)
+	db.blobFiles[fid] = db.activeBlobFile
+	return nil
+}
+
+// loadBlobFiles open the blob files, the latest one is the active blob file
+func (db *DB) loadBlobFiles() error {
+	entries, err := db.options.fs.ReadDir(db.options.dirPath)
+	if err != nil {
+		return err
+	}
+
+	var fids []uint32
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), model.BlobFileSuffix) {
+			id, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), model.BlobFileSuffix))
+			if err != nil {
+				return ErrDataFileCorrupted
+			}
+			fids = append(fids, uint32(id))
+		}
+	}
+	sort.Slice(fids, func(i, j int) bool {
+		return fids[i] < fids[j]
+	})
+
+	for _, fid := range fids {
+		ioManager, err := db.options.ioManagerCreator(model.GetDataFileName(db.options.dirPath, model.BlobFileType, fid))
+		if err != nil {
+			return err
+		}
+		blobFile := model.OpenDataFile(fid, ioManager)
+		if blobFile.WriteOffset, err = ioManager.Size(); err != nil {
+			return err
+		}
+		db.blobFiles[fid] = blobFile
+		if db.activeBlobFile != nil {
+			db.sealDataFile(db.activeBlobFile)
+		}
+		db.activeBlobFile = blobFile
+	}
+
+	// the tail of the active blob file may be torn by a crash, it is truncated like the active data file
+	if db.activeBlobFile != nil {
+		offset, err := db.scanBlobFile(db.activeBlobFile)
+		if err != nil {
+			return err
+		}
+		if err = db.truncateTornTail(db.activeBlobFile, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanBlobFile return the end of the last complete record of the blob file
+func (db *DB) scanBlobFile(blobFile *model.DataFile) (int64, error) {
+	var offset int64
+	for {
+		_, size, err := db.getRecordFromDataFile(blobFile, offset)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err == ErrWrongCrc {
+			db.reportCorruption(blobFile.Fid, offset, err)
+			torn, tailErr := db.isTornTail(blobFile, offset)
+			if tailErr != nil {
+				return 0, tailErr
+			}
+			if torn {
+				return offset, nil
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	}
+}
+
+func marshalBlobPointer(fid uint32, offset int64) []byte {
+	buf := make([]byte, binary.MaxVarintLen32+binary.MaxVarintLen64)
+	var index = 0
+	index += binary.PutUvarint(buf[index:], uint64(fid))
+	index += binary.PutVarint(buf[index:], offset)
+	return buf[:index]
+}
+
+func unmarshalBlobPointer(buf []byte) (uint32, int64, error) {
+	fid, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return 0, 0, ErrDataFileCorrupted
+	}
+	offset, m := binary.Varint(buf[n:])
+	if m <= 0 {
+		return 0, 0, ErrDataFileCorrupted
+	}
+	return uint32(fid), offset, nil
+}
+
+// blobValue return the value the blob pointer points to, the caller should hold the lock
+func (db *DB) blobValue(pointer []byte) ([]byte, error) {
+	fid, offset, err := unmarshalBlobPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	blobFile := db.blobFiles[fid]
+	if blobFile == nil {
+		return nil, ErrNoBlobFile
+	}
+	return db.readBlob(blobFile, offset)
+}
+
+// readBlobValue is blobValue without holding the lock while reading
+func (db *DB) readBlobValue(pointer []byte) ([]byte, error) {
+	fid, offset, err := unmarshalBlobPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	blobFile := db.blobFiles[fid]
+	if blobFile == nil {
+		db.mu.RUnlock()
+		return nil, ErrNoBlobFile
+	}
+	// the blob file may be removed by GCBlobs while reading
+	blobFile.Ref()
+	db.mu.RUnlock()
+	defer blobFile.Unref()
+
+	return db.readBlob(blobFile, offset)
+}
+
+func (db *DB) readBlob(blobFile *model.DataFile, offset int64) ([]byte, error) {
+	record, _, err := db.getRecordFromDataFile(blobFile, offset)
+	if err != nil {
+		if err == io.EOF {
+			err = ErrDataFileCorrupted
+		}
+		db.options.logger.Error("blob file is corrupted", "fid", blobFile.Fid, "offset", offset, "err", err)
+		return nil, err
+	}
+	return record.Value, nil
+}
+
+// resolveBlob replace the pointer of the blob record with the real value, the caller should hold the lock
+func (db *DB) resolveBlob(record *model.Record) error {
+	if !record.IsBlob {
+		return nil
+	}
+	value, err := db.blobValue(record.Value)
+	if err != nil {
+		return err
+	}
+	record.Value, record.IsBlob = value, false
+	return nil
+}
+
+// GCBlobs rewrite the live values of the blob files whose garbage ratio is not less than
+// minGarbageRatio to the active blob file, then remove the old blob files.
+// the older versions of the keys in the removed blob files are cleared.
+func (db *DB) GCBlobs(ctx context.Context, minGarbageRatio float64) error {
+	if db.options.readOnly {
+		return ErrReadOnly
+	}
+	db.mu.Lock()
+	if db.isMerging {
+		db.mu.Unlock()
+		return ErrMergeIsProgress
+	}
+	db.isMerging = true
+	defer func() {
+		db.mu.Lock()
+		db.isMerging = false
+		db.mu.Unlock()
+	}()
+
+	// only the sealed blob files are collected
+	var blobFiles []*model.DataFile
+	for _, blobFile := range db.blobFiles {
+		if blobFile != db.activeBlobFile {
+			blobFiles = append(blobFiles, blobFile)
+		}
+	}
+	if db.activeBlobFile != nil && db.activeBlobFile.WriteOffset > 0 {
+		blobFiles = append(blobFiles, db.activeBlobFile)
+		if err := db.setActiveBlobFile(); err != nil {
+			db.mu.Unlock()
+			return err
+		}
+	}
+	db.mu.Unlock()
+
+	sort.Slice(blobFiles, func(i, j int) bool {
+		return blobFiles[i].Fid < blobFiles[j].Fid
+	})
+	for _, blobFile := range blobFiles {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := db.gcBlobFile(ctx, blobFile, minGarbageRatio); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// liveBlob is a blob record still pointed by the keydir
+type liveBlob struct {
+	keyspace *Keyspace
+	key      []byte
+	offset   int64
+	value    []byte
+}
+
+// gcBlobFile move the live values of the blob file and remove it
+func (db *DB) gcBlobFile(ctx context.Context, blobFile *model.DataFile, minGarbageRatio float64) error {
+	var (
+		blobs    []*liveBlob
+		liveSize int64
+		offset   int64
+	)
+	for {
+		record, size, err := db.getRecordFromDataFile(blobFile, offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		ks := db.getKeyspace(record.Keyspace)
+		realKey, _ := parseTxSeqPrefix(record.Key)
+		db.mu.RLock()
+		live, err := db.isLiveBlob(ks, realKey, record.Seq, blobFile.Fid, offset)
+		db.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+		if live {
+			blobs = append(blobs, &liveBlob{keyspace: ks, key: realKey, offset: offset, value: record.Value})
+			liveSize += size
+		}
+		offset += size
+	}
+
+	if offset > 0 && float64(offset-liveSize)/float64(offset) < minGarbageRatio {
+		return nil
+	}
+
+	for _, blob := range blobs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := db.moveBlob(blobFile.Fid, blob); err != nil {
+			return err
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// the new pointers must be persisted before the old values are removed
+	if err := db.syncActiveFiles(); err != nil {
+		return err
+	}
+	delete(db.blobFiles, blobFile.Fid)
+	db.diskBytes -= blobFile.WriteOffset
+	if err := db.options.fs.Remove(model.GetDataFileName(db.options.dirPath, model.BlobFileType, blobFile.Fid)); err != nil {
+		return err
+	}
+	return blobFile.Unref()
+}
+
+// moveBlob write the live value to the active blob file with a new pointer record
+func (db *DB) moveBlob(fid uint32, blob *liveBlob) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// the key may be written again
+	pos := blob.keyspace.keydir.Get(blob.key)
+	if pos == nil {
+		return nil
+	}
+	record, err := db.get(pos)
+	if err != nil {
+		return err
+	}
+	if live, err := isBlobPointerOf(record, fid, blob.offset); err != nil || !live {
+		return err
+	}
+
+	// the new record keeps the sequence and the write time of the old one
+	newPos, err := db.appendRecord(&model.Record{
+		Key:       addTxSeqPrefix(blob.key, noTransactionSeq),
+		Value:     blob.value,
+		Seq:       record.Seq,
+		Prev:      record.Prev,
+		Timestamp: record.Timestamp,
+		ExpireAt:  record.ExpireAt,
+		Keyspace:  record.Keyspace,
+	})
+	if err != nil {
+		return err
+	}
+
+	db.setInlineValue(newPos, blob.value)
+	if !blob.keyspace.putKeydir(blob.key, newPos) {
+		return ErrUpdateKeydir
+	}
+	return nil
+}
+
+// isLiveBlob check whether the keydir points to the blob record, the caller should hold the lock
+func (db *DB) isLiveBlob(ks *Keyspace, key []byte, seq uint64, fid uint32, offset int64) (bool, error) {
+	if ks == nil {
+		return false, nil
+	}
+	pos := ks.keydir.Get(key)
+	if pos == nil || pos.Seq != seq {
+		return false, nil
+	}
+
+	record, err := db.get(pos)
+	if err != nil {
+		return false, err
+	}
+	return isBlobPointerOf(record, fid, offset)
+}
+
+// isBlobPointerOf check whether the record points to the blob record
+func isBlobPointerOf(record *model.Record, fid uint32, offset int64) (bool, error) {
+	if !record.IsBlob {
+		return false, nil
+	}
+	blobFid, blobOffset, err := unmarshalBlobPointer(record.Value)
+	if err != nil {
+		return false, err
+	}
+	return blobFid == fid && blobOffset == offset, nil
+}
+
+// syncActiveFiles sync the active blob file before the active data file,
+// so the pointers never point to the lost values
+func (db *DB) syncActiveFiles() error {
+	if db.activeBlobFile != nil {
+		if err := db.activeBlobFile.Sync(); err != nil {
+			return db.fail(err)
+		}
+	}
+	if db.activeFile == nil {
+		return nil
+	}
+	if err := db.syncDataFile(db.activeFile); err != nil {
+		return db.fail(err)
+	}
+	return nil
+}
+
+// isBlobSize check whether the value of size should be written to the blob file
+func (db *DB) isBlobSize(size int64) bool {
+	return db.options.blobThreshold > 0 && size >= db.options.blobThreshold
+}
@@ -0,0 +1,173 @@
+package cqkv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/cqkv/cqkv/model"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestDB_BlobThreshold(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(512), WithBlobThreshold(128))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	bigValue := func(i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%v", i%10)), 400)
+	}
+	for i := 0; i < 10; i++ {
+		err = db.Put([]byte(fmt.Sprintf("big-%v", i)), bigValue(i))
+		assert.Nil(t, err)
+		err = db.Put([]byte(fmt.Sprintf("small-%v", i)), []byte("value"))
+		assert.Nil(t, err)
+	}
+	// every big value has its own blob file
+	assert.Equal(t, 10, db.Stat().BlobFileNum)
+
+	check := func(db *DB) {
+		for i := 0; i < 10; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("big-%v", i)))
+			assert.Nil(t, err)
+			assert.Equal(t, bigValue(i), value)
+			value, err = db.Get([]byte(fmt.Sprintf("small-%v", i)))
+			assert.Nil(t, err)
+			assert.Equal(t, "value", string(value))
+		}
+
+		var size int
+		err := db.Fold(func(key, value []byte) error {
+			size += len(value)
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 10*400+10*5, size)
+	}
+	check(db)
+
+	// merge only moves the pointers
+	err = db.MergeWithContext(context.Background(), MergeOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 10, db.Stat().BlobFileNum)
+	check(db)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", WithDataFileSize(512), WithBlobThreshold(128))
+	assert.Nil(t, err)
+	check(db)
+}
+
+func TestDB_GCBlobs(t *testing.T) {
+	db, err := Open("./tmp/", WithBlobThreshold(128))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 10; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%v", i)), bytes.Repeat([]byte("a"), 200))
+		assert.Nil(t, err)
+	}
+	// overwrite most of the values, the old ones are garbage
+	for i := 0; i < 8; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%v", i)), []byte("small"))
+		assert.Nil(t, err)
+	}
+	err = db.Put([]byte("key-9"), bytes.Repeat([]byte("b"), 200))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, db.Stat().BlobFileNum)
+
+	// the sealed blob file is removed, the live values are moved to the new one
+	err = db.GCBlobs(context.Background(), 0.5)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, db.Stat().BlobFileNum)
+	_, err = os.Stat("./tmp/000000000.blob")
+	assert.True(t, os.IsNotExist(err))
+
+	check := func(db *DB) {
+		value, err := db.Get([]byte("key-8"))
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte("a"), 200), value)
+		value, err = db.Get([]byte("key-9"))
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte("b"), 200), value)
+		value, err = db.Get([]byte("key-0"))
+		assert.Nil(t, err)
+		assert.Equal(t, "small", string(value))
+
+		// the version in the removed blob file is cleared
+		versions, err := db.GetVersions([]byte("key-9"), 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(versions))
+	}
+	check(db)
+
+	// nothing to collect in the new blob file
+	err = db.GCBlobs(context.Background(), 0.5)
+	assert.Nil(t, err)
+	check(db)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", WithBlobThreshold(128))
+	assert.Nil(t, err)
+	check(db)
+}
+
+func TestDB_BlobTornTail(t *testing.T) {
+	db, err := Open("./tmp/", WithBlobThreshold(128))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 3; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%v", i)), bytes.Repeat([]byte("a"), 200))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// a torn blob record at the tail of the active blob file
+	fileName := model.GetDataFileName("./tmp/", model.BlobFileType, 0)
+	info, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	data, _, err := db.marshalRecord(&model.Record{Key: addTxSeqPrefix([]byte("key-3"), noTransactionSeq), Value: bytes.Repeat([]byte("a"), 200)})
+	assert.Nil(t, err)
+	data = data[:len(data)/2]
+	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	listener := &testListener{}
+	db, err = Open("./tmp/", WithBlobThreshold(128), WithEventListener(listener))
+	assert.Nil(t, err)
+	assert.Equal(t, [][2]int64{{info.Size(), info.Size() + int64(len(data))}}, listener.truncated)
+
+	// the new blob is appended after the last complete one, the blob file can be collected
+	err = db.Put([]byte("key-0"), []byte("small"))
+	assert.Nil(t, err)
+	err = db.Put([]byte("key-3"), bytes.Repeat([]byte("b"), 200))
+	assert.Nil(t, err)
+	err = db.GCBlobs(context.Background(), 0)
+	assert.Nil(t, err)
+
+	value, err := db.Get([]byte("key-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("a"), 200), value)
+	value, err = db.Get([]byte("key-3"))
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("b"), 200), value)
+	assert.Nil(t, db.Close())
+}
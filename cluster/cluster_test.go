@@ -0,0 +1,353 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/cqkv/cqkv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDir = "./tmp-cluster"
+
+type testCluster struct {
+	t         *testing.T
+	peers     map[string]string
+	threshold uint64
+	nodes     map[string]*Node
+}
+
+func newTestCluster(t *testing.T, size int, threshold uint64) *testCluster {
+	c := &testCluster{t: t, peers: make(map[string]string), threshold: threshold, nodes: make(map[string]*Node)}
+	listeners := make(map[string]net.Listener)
+	for i := 0; i < size; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		id := fmt.Sprintf("node-%d", i)
+		c.peers[id] = ln.Addr().String()
+		listeners[id] = ln
+	}
+	for id, ln := range listeners {
+		c.start(id, ln)
+	}
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			_ = node.Close()
+		}
+		_ = os.RemoveAll(testDir)
+	})
+	return c
+}
+
+// start the node, it listens on its address if ln is nil
+func (c *testCluster) start(id string, ln net.Listener) {
+	node, err := NewNode(Config{
+		ID:                id,
+		Peers:             c.peers,
+		Listener:          ln,
+		Dir:               filepath.Join(testDir, id),
+		ElectionTimeout:   150 * time.Millisecond,
+		SnapshotThreshold: c.threshold,
+		// the data db is kept on the os file system even with a mem fs, the snapshots are sent from it
+		Options: []cqkv.Option{cqkv.WithMemFS(nil)},
+	})
+	require.Nil(c.t, err)
+	c.nodes[id] = node
+}
+
+func (c *testCluster) stop(id string) {
+	require.Nil(c.t, c.nodes[id].Close())
+	delete(c.nodes, id)
+}
+
+// leader wait for a leader among the running nodes not partitioned
+func (c *testCluster) leader() *Node {
+	var found *Node
+	require.Eventually(c.t, func() bool {
+		for _, node := range c.nodes {
+			if node.IsLeader() && !node.transport.isPartitioned() {
+				found = node
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	return found
+}
+
+// waitApplied wait until the data db of the node has the value of the key
+func waitApplied(t *testing.T, node *Node, key, value string) {
+	assert.Eventually(t, func() bool {
+		node.dbMu.RLock()
+		defer node.dbMu.RUnlock()
+		v, err := node.db.Get([]byte(key))
+		return err == nil && string(v) == value
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCluster_Replication(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+
+	assert.Nil(t, leader.Put([]byte("key"), []byte("value")))
+	assert.Nil(t, leader.Batch([]Op{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte("2")},
+		{Delete: true, Key: []byte("key")},
+	}))
+	value, err := leader.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(value))
+	_, err = leader.Get([]byte("key"))
+	assert.ErrorIs(t, err, cqkv.ErrNoRecord)
+	assert.Equal(t, cqkv.ErrEmptyKey, leader.Put(nil, []byte("value")))
+
+	// the followers apply the entries but do not serve the clients
+	for _, node := range c.nodes {
+		waitApplied(t, node, "b", "2")
+		if node == leader {
+			continue
+		}
+		assert.Equal(t, leader.ID(), node.Leader())
+		assert.Equal(t, ErrNotLeader, node.Put([]byte("key"), []byte("value")))
+		_, err = node.Get([]byte("a"))
+		assert.Equal(t, ErrNotLeader, err)
+	}
+}
+
+func TestCluster_Failover(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, leader.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%v", i))))
+	}
+
+	// a new leader has all the committed entries
+	oldID := leader.ID()
+	c.stop(oldID)
+	leader = c.leader()
+	assert.NotEqual(t, oldID, leader.ID())
+	value, err := leader.Get([]byte("key-19"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value-19", string(value))
+	assert.Nil(t, leader.Put([]byte("key-20"), []byte("value-20")))
+
+	// the old leader restarts as a follower and catches up
+	c.start(oldID, nil)
+	waitApplied(t, c.nodes[oldID], "key-20", "value-20")
+	assert.False(t, c.nodes[oldID].IsLeader())
+}
+
+func TestCluster_LeaseRead(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+	assert.Nil(t, leader.Put([]byte("key"), []byte("old")))
+
+	// the partitioned leader stops serving the reads once the lease expires
+	leader.transport.setPartitioned(true)
+	newLeader := c.leader()
+	assert.Nil(t, newLeader.Put([]byte("key"), []byte("new")))
+	assert.Eventually(t, func() bool {
+		return !leader.IsLeader()
+	}, time.Second, 10*time.Millisecond)
+	_, err := leader.Get([]byte("key"))
+	assert.Equal(t, ErrNotLeader, err)
+	assert.Equal(t, ErrNotLeader, leader.Put([]byte("key"), []byte("stale")))
+
+	// it steps down after the partition heals
+	leader.transport.setPartitioned(false)
+	waitApplied(t, leader, "key", "new")
+	assert.False(t, leader.IsLeader())
+	value, err := newLeader.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(value))
+}
+
+func TestCluster_Snapshot(t *testing.T) {
+	c := newTestCluster(t, 3, 10)
+	leader := c.leader()
+
+	var lagging *Node
+	for _, node := range c.nodes {
+		if node != leader {
+			lagging = node
+			break
+		}
+	}
+	lagging.transport.setPartitioned(true)
+	// the value is sent in several chunks
+	big := strings.Repeat("v", snapshotChunkSize*3/2)
+	assert.Nil(t, leader.Put([]byte("big"), []byte(big)))
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, leader.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%v", i))))
+	}
+	leader.mu.Lock()
+	snapIndex := leader.log.snapIndex
+	leader.mu.Unlock()
+	assert.True(t, snapIndex > 10)
+
+	// the lagging follower gets the snapshot instead of the dropped entries
+	lagging.transport.setPartitioned(false)
+	assert.Nil(t, leader.Put([]byte("last"), []byte("1")))
+	waitApplied(t, lagging, "last", "1")
+	waitApplied(t, lagging, "key-00", "value-0")
+	waitApplied(t, lagging, "big", big)
+	lagging.mu.Lock()
+	assert.True(t, lagging.log.snapIndex >= snapIndex)
+	lagging.mu.Unlock()
+	lagging.dbMu.RLock()
+	assert.NotEqual(t, defaultDataName, lagging.dataName)
+	lagging.dbMu.RUnlock()
+
+	// the node restarts from its snapshot and log
+	id := lagging.ID()
+	c.stop(id)
+	c.start(id, nil)
+	assert.Nil(t, c.leader().Put([]byte("last"), []byte("2")))
+	waitApplied(t, c.nodes[id], "last", "2")
+	waitApplied(t, c.nodes[id], "key-49", "value-49")
+}
+
+func TestCluster_InstallSnapshotFailed(t *testing.T) {
+	c := newTestCluster(t, 1, 0)
+	leader := c.leader()
+	assert.Nil(t, leader.Put([]byte("key"), []byte("value")))
+
+	// the received snapshot can not be opened as a db
+	dir := leader.snapshotDir() + "-received"
+	require.Nil(t, os.WriteFile(dir, []byte("broken"), 0644))
+	leader.mu.Lock()
+	request := &installRequest{dir: dir, index: leader.lastApplied + 10, term: leader.term, done: make(chan error, 1)}
+	leader.install = request
+	leader.signalApplier()
+	leader.mu.Unlock()
+
+	// the node stops serving, the received snapshot and the old data db are kept
+	assert.ErrorIs(t, <-request.done, ErrApplyFailed)
+	assert.ErrorIs(t, leader.Err(), ErrApplyFailed)
+	data, err := os.ReadFile(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, "broken", string(data))
+	leader.dbMu.RLock()
+	value, err := leader.db.Get([]byte("key"))
+	leader.dbMu.RUnlock()
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(value))
+}
+
+func TestCluster_SingleNode(t *testing.T) {
+	c := newTestCluster(t, 1, 0)
+	leader := c.leader()
+	assert.Nil(t, leader.Put([]byte("key"), []byte("value")))
+	value, err := leader.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(value))
+}
+
+func TestCommand(t *testing.T) {
+	ops := []Op{
+		{Key: []byte("key"), Value: []byte("value")},
+		{Delete: true, Key: []byte("deleted")},
+	}
+	decoded, err := unmarshalCommand(marshalCommand(ops))
+	assert.Nil(t, err)
+	assert.Equal(t, len(ops), len(decoded))
+	assert.Equal(t, ops[0], decoded[0])
+	assert.True(t, decoded[1].Delete)
+	assert.Equal(t, "deleted", string(decoded[1].Key))
+
+	decoded, err = unmarshalCommand(marshalCommand(nil))
+	assert.Nil(t, err)
+	assert.Empty(t, decoded)
+	_, err = unmarshalCommand([]byte{2, 0, 3})
+	assert.Equal(t, ErrCorrupted, err)
+}
+
+func TestCluster_ApplyFailed(t *testing.T) {
+	c := newTestCluster(t, 1, 0)
+	leader := c.leader()
+	assert.Nil(t, leader.Put([]byte("key"), []byte("value")))
+	assert.Nil(t, leader.Err())
+
+	// the corrupted command can not be applied, the node stops serving
+	err := leader.propose([]byte{2, 0, 3})
+	assert.ErrorIs(t, err, ErrApplyFailed)
+	assert.ErrorIs(t, leader.Err(), ErrApplyFailed)
+	assert.False(t, leader.IsLeader())
+	assert.ErrorIs(t, leader.Put([]byte("key"), []byte("value-2")), ErrApplyFailed)
+	_, err = leader.Get([]byte("key"))
+	assert.ErrorIs(t, err, ErrApplyFailed)
+
+	// it never becomes the leader again
+	time.Sleep(3 * leader.config.ElectionTimeout)
+	assert.False(t, leader.IsLeader())
+}
+
+func TestCluster_ApplyResult(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	node, err := NewNode(Config{
+		ID:              "node-0",
+		Peers:           map[string]string{"node-0": ln.Addr().String()},
+		Listener:        ln,
+		Dir:             filepath.Join(testDir, "node-0"),
+		ElectionTimeout: 150 * time.Millisecond,
+		Options:         []cqkv.Option{cqkv.WithMaxDiskBytes(64 * 1024)},
+	})
+	require.Nil(t, err)
+	defer func() {
+		_ = node.Close()
+		_ = os.RemoveAll(testDir)
+	}()
+	require.Eventually(t, node.IsLeader, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, node.Put([]byte("key"), []byte("value")))
+
+	// the invalid ops fail the same way on every node, it is the result of the entry
+	err = node.propose(marshalCommand([]Op{{Key: nil, Value: []byte("value")}}))
+	assert.Equal(t, cqkv.ErrEmptyKey, err)
+	assert.Nil(t, node.Err())
+	assert.Nil(t, node.Put([]byte("key"), []byte("value-2")))
+
+	// the quota is local to the node, the node stops serving
+	err = node.Put([]byte("big"), make([]byte, 128*1024))
+	assert.ErrorIs(t, err, ErrApplyFailed)
+	assert.ErrorIs(t, err, cqkv.ErrQuotaExceeded)
+	assert.ErrorIs(t, node.Err(), ErrApplyFailed)
+	_, err = node.Get([]byte("big"))
+	assert.ErrorIs(t, err, ErrApplyFailed)
+}
+
+func TestCluster_VoteAfterRestart(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+	assert.Nil(t, leader.Put([]byte("key"), []byte("value")))
+
+	// the restarted node does not know the leader, it refuses the votes in an election timeout
+	var id string
+	for peer := range c.nodes {
+		if peer != leader.ID() {
+			id = peer
+			break
+		}
+	}
+	c.stop(id)
+	c.start(id, nil)
+	node := c.nodes[id]
+	args := &RequestVoteArgs{Term: 100, CandidateID: "candidate", LastLogIndex: 100, LastLogTerm: 100}
+	reply := &RequestVoteReply{}
+	node.handleRequestVote(args, reply)
+	if time.Since(node.started) < node.config.ElectionTimeout {
+		assert.False(t, reply.Granted)
+	}
+
+	// the leader keeps the lease
+	assert.True(t, leader.IsLeader())
+	value, err := leader.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(value))
+}
@@ -0,0 +1,74 @@
+package cluster
+
+import (
+	"encoding/binary"
+)
+
+/*
+command: the writes of an entry, they are applied by one write batch
+	count (uvarint) | op...
+	op: delete (1) | key size (uvarint) | key | value size (uvarint) | value
+the entry of no op is appended by the new leader to commit the entries of the previous terms.
+*/
+
+// Op is a put or a delete of Batch
+type Op struct {
+	Delete bool
+	Key    []byte
+	Value  []byte
+}
+
+func marshalCommand(ops []Op) []byte {
+	size := binary.MaxVarintLen64
+	for _, op := range ops {
+		size += 1 + 2*binary.MaxVarintLen64 + len(op.Key) + len(op.Value)
+	}
+	buf := make([]byte, size)
+	index := binary.PutUvarint(buf, uint64(len(ops)))
+	for _, op := range ops {
+		if op.Delete {
+			buf[index] = 1
+		}
+		index++
+		index += binary.PutUvarint(buf[index:], uint64(len(op.Key)))
+		index += copy(buf[index:], op.Key)
+		index += binary.PutUvarint(buf[index:], uint64(len(op.Value)))
+		index += copy(buf[index:], op.Value)
+	}
+	return buf[:index]
+}
+
+func unmarshalCommand(buf []byte) ([]Op, error) {
+	count, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, ErrCorrupted
+	}
+	buf = buf[n:]
+
+	var ops []Op
+	for i := uint64(0); i < count; i++ {
+		if len(buf) == 0 {
+			return nil, ErrCorrupted
+		}
+		op := Op{Delete: buf[0] == 1}
+		buf = buf[1:]
+
+		var err error
+		if op.Key, buf, err = readBytes(buf); err != nil {
+			return nil, err
+		}
+		if op.Value, buf, err = readBytes(buf); err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+func readBytes(buf []byte) ([]byte, []byte, error) {
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < size {
+		return nil, nil, ErrCorrupted
+	}
+	return buf[n : n+int(size)], buf[n+int(size):], nil
+}
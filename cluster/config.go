@@ -0,0 +1,61 @@
+package cluster
+
+import (
+	"github.com/cqkv/cqkv"
+	"github.com/cqkv/cqkv/fio"
+	"net"
+	"time"
+)
+
+type Config struct {
+	// ID is the id of the node, its address is Peers[ID]
+	ID string
+	// Peers is the addresses of all the nodes of the cluster, including the node itself
+	Peers map[string]string
+	// Listener accepts the rpc of the peers, the node listens on Peers[ID] if it is nil
+	Listener net.Listener
+
+	// Dir keeps the raft log, the data and the snapshot of the node
+	Dir string
+	// Options are the options of the data db, the files are always kept on the os file system:
+	// the snapshots are sent and installed by os, so WithFS and WithMemFS are replaced by fio.OSFS
+	Options []cqkv.Option
+
+	// ElectionTimeout is the minimum time without hearing the leader before an election,
+	// it is also the length of the leader lease
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// Timeout is the time the writes and the reads wait for
+	Timeout time.Duration
+	// SnapshotThreshold is the number of the applied entries after the snapshot triggering a new snapshot
+	SnapshotThreshold uint64
+
+	Logger cqkv.Logger
+}
+
+func (c *Config) setDefaults() {
+	if c.ElectionTimeout <= 0 {
+		c.ElectionTimeout = 300 * time.Millisecond
+	}
+	if c.HeartbeatInterval <= 0 {
+		c.HeartbeatInterval = c.ElectionTimeout / 6
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 3 * time.Second
+	}
+	if c.SnapshotThreshold == 0 {
+		c.SnapshotThreshold = 1024
+	}
+	if c.Logger == nil {
+		c.Logger = nopLogger{}
+	}
+	// copy the options, the slice of the caller is not changed
+	c.Options = append(c.Options[:len(c.Options):len(c.Options)], cqkv.WithFS(fio.OSFS{}))
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
@@ -0,0 +1,19 @@
+package cluster
+
+import (
+	"fmt"
+)
+
+var (
+	ErrNotLeader      = addPrefix("the node is not the leader")
+	ErrLeadershipLost = addPrefix("the leadership is lost before the entry is applied")
+	ErrTimeout        = addPrefix("timeout")
+	ErrClosed         = addPrefix("the node is closed")
+	ErrNoPeer         = addPrefix("the id of the node is not in the peers")
+	ErrCorrupted      = addPrefix("the raft log may be corrupted")
+	ErrApplyFailed    = addPrefix("the committed entries can not be applied, the node should be repaired")
+)
+
+func addPrefix(errStr string) error {
+	return fmt.Errorf("cqkv cluster err: %s", errStr)
+}
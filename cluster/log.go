@@ -0,0 +1,211 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/cqkv/cqkv"
+)
+
+/*
+raft log: the entries and the state of raft are kept in a cqkv db
+	- state: term (8) | voted for
+	- snapshot: index (8) | term (8), the entries not after it are dropped
+	- entry-<index (8, big endian)>: term (8) | command
+*/
+
+var (
+	stateKey    = []byte("state")
+	snapshotKey = []byte("snapshot")
+	entryPrefix = "entry-"
+	// entryEnd is after all the entry keys
+	entryEnd = []byte("entry.")
+)
+
+// appendBatchSize is the entries appended by a write batch
+const appendBatchSize = 256
+
+// Entry is an entry of the raft log
+type Entry struct {
+	Index   uint64
+	Term    uint64
+	Command []byte
+}
+
+type raftLog struct {
+	db *cqkv.DB
+
+	snapIndex uint64
+	snapTerm  uint64
+	// entries are the entries after the snapshot
+	entries []Entry
+}
+
+func entryKey(index uint64) []byte {
+	key := make([]byte, len(entryPrefix)+8)
+	copy(key, entryPrefix)
+	binary.BigEndian.PutUint64(key[len(entryPrefix):], index)
+	return key
+}
+
+// openRaftLog load the log and return the term and the vote
+func openRaftLog(dir string) (*raftLog, uint64, string, error) {
+	db, err := cqkv.Open(dir)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	l := &raftLog{db: db}
+
+	var (
+		term     uint64
+		votedFor string
+	)
+	state, err := db.Get(stateKey)
+	if err == nil {
+		if len(state) < 8 {
+			return nil, 0, "", ErrCorrupted
+		}
+		term, votedFor = binary.BigEndian.Uint64(state), string(state[8:])
+	} else if !errors.Is(err, cqkv.ErrNoRecord) {
+		return nil, 0, "", err
+	}
+
+	snapshot, err := db.Get(snapshotKey)
+	if err == nil {
+		if len(snapshot) != 16 {
+			return nil, 0, "", ErrCorrupted
+		}
+		l.snapIndex, l.snapTerm = binary.BigEndian.Uint64(snapshot), binary.BigEndian.Uint64(snapshot[8:])
+	} else if !errors.Is(err, cqkv.ErrNoRecord) {
+		return nil, 0, "", err
+	}
+
+	for index := l.snapIndex + 1; ; index++ {
+		value, err := db.Get(entryKey(index))
+		if errors.Is(err, cqkv.ErrNoRecord) {
+			break
+		}
+		if err != nil {
+			return nil, 0, "", err
+		}
+		if len(value) < 8 {
+			return nil, 0, "", ErrCorrupted
+		}
+		l.entries = append(l.entries, Entry{Index: index, Term: binary.BigEndian.Uint64(value), Command: value[8:]})
+	}
+	return l, term, votedFor, nil
+}
+
+func (l *raftLog) close() error {
+	return l.db.Close()
+}
+
+func (l *raftLog) lastIndex() uint64 {
+	return l.snapIndex + uint64(len(l.entries))
+}
+
+func (l *raftLog) lastTerm() uint64 {
+	if len(l.entries) == 0 {
+		return l.snapTerm
+	}
+	return l.entries[len(l.entries)-1].Term
+}
+
+// term return the term of the entry of index, ok is false if it is dropped or does not exist
+func (l *raftLog) term(index uint64) (uint64, bool) {
+	if index == l.snapIndex {
+		return l.snapTerm, true
+	}
+	if index < l.snapIndex || index > l.lastIndex() {
+		return 0, false
+	}
+	return l.entries[index-l.snapIndex-1].Term, true
+}
+
+// slice return the entries in [from, to), from should be after the snapshot
+func (l *raftLog) slice(from, to uint64) []Entry {
+	if to > l.lastIndex()+1 {
+		to = l.lastIndex() + 1
+	}
+	if from >= to {
+		return nil
+	}
+	entries := make([]Entry, to-from)
+	copy(entries, l.entries[from-l.snapIndex-1:to-l.snapIndex-1])
+	return entries
+}
+
+func (l *raftLog) saveState(term uint64, votedFor string) error {
+	state := make([]byte, 8+len(votedFor))
+	binary.BigEndian.PutUint64(state, term)
+	copy(state[8:], votedFor)
+	if err := l.db.Put(stateKey, state); err != nil {
+		return err
+	}
+	return l.db.Sync()
+}
+
+// append persist the entries following the last entry
+func (l *raftLog) append(entries ...Entry) error {
+	for start := 0; start < len(entries); start += appendBatchSize {
+		end := start + appendBatchSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		wb := l.db.NewWriteBatch()
+		for _, entry := range entries[start:end] {
+			value := make([]byte, 8+len(entry.Command))
+			binary.BigEndian.PutUint64(value, entry.Term)
+			copy(value[8:], entry.Command)
+			if err := wb.Put(entryKey(entry.Index), value); err != nil {
+				return err
+			}
+		}
+		if err := wb.Commit(); err != nil {
+			return err
+		}
+	}
+	if err := l.db.Sync(); err != nil {
+		return err
+	}
+	l.entries = append(l.entries, entries...)
+	return nil
+}
+
+// truncate drop the entries from index, the entries before the snapshot are never dropped
+func (l *raftLog) truncate(index uint64) error {
+	if err := l.db.DeleteRange(entryKey(index), entryEnd); err != nil {
+		return err
+	}
+	l.entries = l.entries[:index-l.snapIndex-1]
+	return nil
+}
+
+// compact drop the entries not after the snapshot of index and term,
+// the entries after it are kept if the log has the entry of the snapshot, or else the whole log is dropped
+func (l *raftLog) compact(index, term uint64) error {
+	if index <= l.snapIndex {
+		return nil
+	}
+	var entries []Entry
+	if t, ok := l.term(index); ok && t == term {
+		entries = l.entries[index-l.snapIndex:]
+	} else if err := l.db.DeleteRange(entryKey(0), entryEnd); err != nil {
+		return err
+	}
+
+	snapshot := make([]byte, 16)
+	binary.BigEndian.PutUint64(snapshot, index)
+	binary.BigEndian.PutUint64(snapshot[8:], term)
+	if err := l.db.Put(snapshotKey, snapshot); err != nil {
+		return err
+	}
+	if err := l.db.Sync(); err != nil {
+		return err
+	}
+	if err := l.db.DeleteRange(entryKey(0), entryKey(index+1)); err != nil {
+		return err
+	}
+	l.snapIndex, l.snapTerm = index, term
+	l.entries = append([]Entry(nil), entries...)
+	return nil
+}
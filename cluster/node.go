@@ -0,0 +1,482 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/cqkv/cqkv"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	// the applied entry is kept in the meta keyspace of the data db, it is updated with the writes of the entry
+	metaKeyspace = "cqkv-cluster"
+	appliedKey   = []byte("applied")
+)
+
+// Node is a node of the raft replicated cqkv cluster, the writes and the reads are served by the leader
+type Node struct {
+	config Config
+	// peers are the ids of the other nodes
+	peers     []string
+	transport *transport
+
+	mu               sync.Mutex
+	role             role
+	term             uint64
+	votedFor         string
+	leaderID         string
+	log              *raftLog
+	commitIndex      uint64
+	lastApplied      uint64
+	appliedTerm      uint64
+	heard            time.Time // the last time hearing the leader
+	started          time.Time // the leader is unknown after a restart, the votes are refused for a while
+	leaderSince      time.Time
+	electionDeadline time.Time
+	nextIndex        map[string]uint64
+	matchIndex       map[string]uint64
+	acked            map[string]time.Time // the send time of the last AppendEntries acked by the peer
+	waiters          map[uint64]*waiter
+	// appliedCh is closed when an entry is applied
+	appliedCh chan struct{}
+	// install is the snapshot received, it is installed by the applier
+	install *installRequest
+	// err stops the applier, the node does not serve or lead once it is set
+	err error
+
+	// dbMu protects db from being replaced by installing a snapshot
+	dbMu sync.RWMutex
+	db   *cqkv.DB
+	meta *cqkv.Keyspace
+	// dataName is the dir of the data db in config.Dir, it is switched by installing a snapshot
+	dataName string
+
+	// snapMu protects the snapshot dir
+	snapMu sync.RWMutex
+
+	triggers map[string]chan struct{}
+	applyCh  chan struct{}
+	closed   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewNode open the node on config.Dir and start it
+func NewNode(config Config) (*Node, error) {
+	config.setDefaults()
+	if _, ok := config.Peers[config.ID]; !ok {
+		return nil, ErrNoPeer
+	}
+	if err := os.MkdirAll(config.Dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		config:     config,
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		acked:      make(map[string]time.Time),
+		waiters:    make(map[uint64]*waiter),
+		appliedCh:  make(chan struct{}),
+		triggers:   make(map[string]chan struct{}),
+		applyCh:    make(chan struct{}, 1),
+		closed:     make(chan struct{}),
+	}
+	for id := range config.Peers {
+		if id != config.ID {
+			n.peers = append(n.peers, id)
+			n.triggers[id] = make(chan struct{}, 1)
+		}
+	}
+
+	var err error
+	if n.log, n.term, n.votedFor, err = openRaftLog(n.raftDir()); err != nil {
+		return nil, err
+	}
+	if n.dataName, err = loadDataName(config.Dir); err != nil {
+		_ = n.log.close()
+		return nil, err
+	}
+	if n.db, n.meta, n.lastApplied, n.appliedTerm, err = openDB(n.dataDir(), config.Options); err != nil {
+		_ = n.log.close()
+		return nil, err
+	}
+	if err = n.recover(); err != nil {
+		_ = n.close()
+		return nil, err
+	}
+	// the snapshot dir may be older than the log after a crash
+	if n.log.snapIndex > 0 {
+		if err = n.takeSnapshot(); err != nil {
+			_ = n.close()
+			return nil, err
+		}
+	}
+
+	ln := config.Listener
+	if ln == nil {
+		if ln, err = net.Listen("tcp", config.Peers[config.ID]); err != nil {
+			_ = n.close()
+			return nil, err
+		}
+	}
+	if n.transport, err = newTransport(n, ln); err != nil {
+		_ = ln.Close()
+		_ = n.close()
+		return nil, err
+	}
+
+	n.started = time.Now()
+	n.resetElectionTimer()
+	n.wg.Add(3 + len(n.peers))
+	go func() {
+		defer n.wg.Done()
+		n.transport.serve()
+	}()
+	go n.ticker()
+	go n.applier()
+	for _, peer := range n.peers {
+		go n.replicator(peer)
+	}
+	return n, nil
+}
+
+func (n *Node) raftDir() string     { return filepath.Join(n.config.Dir, "raft") }
+func (n *Node) dataDir() string     { return filepath.Join(n.config.Dir, n.dataName) }
+func (n *Node) snapshotDir() string { return filepath.Join(n.config.Dir, "snapshot") }
+
+// openDB open the data db in dir and load the applied entry
+func openDB(dir string, options []cqkv.Option) (db *cqkv.DB, meta *cqkv.Keyspace, index, term uint64, err error) {
+	if db, err = cqkv.Open(dir, options...); err != nil {
+		return nil, nil, 0, 0, err
+	}
+	if meta, err = db.Keyspace(metaKeyspace); err != nil {
+		_ = db.Close()
+		return nil, nil, 0, 0, err
+	}
+	applied, err := meta.Get(appliedKey)
+	if err == nil {
+		if len(applied) != 16 {
+			_ = db.Close()
+			return nil, nil, 0, 0, ErrCorrupted
+		}
+		index, term = binary.BigEndian.Uint64(applied), binary.BigEndian.Uint64(applied[8:])
+	} else if !errors.Is(err, cqkv.ErrNoRecord) {
+		_ = db.Close()
+		return nil, nil, 0, 0, err
+	}
+	return db, meta, index, term, nil
+}
+
+// recover make the log cover the applied entry after a crash
+func (n *Node) recover() error {
+	n.commitIndex = n.lastApplied
+	if n.lastApplied < n.log.snapIndex {
+		// the snapshot is taken from the synced data, it never happens
+		return ErrCorrupted
+	}
+	if term, ok := n.log.term(n.lastApplied); !ok || term != n.appliedTerm {
+		return n.log.compact(n.lastApplied, n.appliedTerm)
+	}
+	return nil
+}
+
+// ID return the id of the node
+func (n *Node) ID() string {
+	return n.config.ID
+}
+
+// Leader return the id of the leader known by the node, it is empty if the leader is unknown
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leaderID
+}
+
+// IsLeader check whether the node is the leader
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == leader
+}
+
+// Err return the error stopping the node applying the committed entries, it wraps ErrApplyFailed.
+// the node is not ready once it is not nil, it should be closed and repaired
+func (n *Node) Err() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.err
+}
+
+func (n *Node) Put(key, value []byte) error {
+	return n.Batch([]Op{{Key: key, Value: value}})
+}
+
+func (n *Node) Delete(key []byte) error {
+	return n.Batch([]Op{{Delete: true, Key: key}})
+}
+
+// Batch apply the ops atomically by a write batch
+func (n *Node) Batch(ops []Op) error {
+	for _, op := range ops {
+		if len(op.Key) == 0 {
+			return cqkv.ErrEmptyKey
+		}
+	}
+	return n.propose(marshalCommand(ops))
+}
+
+// propose append the command to the log of the leader and wait for it to be applied
+func (n *Node) propose(command []byte) error {
+	n.mu.Lock()
+	if n.err != nil {
+		n.mu.Unlock()
+		return n.err
+	}
+	if n.role != leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	entry := Entry{Index: n.log.lastIndex() + 1, Term: n.term, Command: command}
+	if err := n.log.append(entry); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	w := &waiter{term: n.term, ch: make(chan error, 1)}
+	n.waiters[entry.Index] = w
+	n.advanceCommit()
+	n.triggerReplication()
+	n.mu.Unlock()
+
+	timer := time.NewTimer(n.config.Timeout)
+	defer timer.Stop()
+	select {
+	case err := <-w.ch:
+		return err
+	case <-timer.C:
+		n.mu.Lock()
+		delete(n.waiters, entry.Index)
+		n.mu.Unlock()
+		return ErrTimeout
+	case <-n.closed:
+		return ErrClosed
+	}
+}
+
+// Get read the key from the leader, the read is linearizable
+func (n *Node) Get(key []byte) ([]byte, error) {
+	if err := n.waitReadable(); err != nil {
+		return nil, err
+	}
+	n.dbMu.RLock()
+	defer n.dbMu.RUnlock()
+	return n.db.Get(key)
+}
+
+// waitReadable wait until the node is the leader with a valid lease and the committed entries are applied
+func (n *Node) waitReadable() error {
+	deadline := time.NewTimer(n.config.Timeout)
+	defer deadline.Stop()
+	for {
+		n.mu.Lock()
+		if n.err != nil {
+			n.mu.Unlock()
+			return n.err
+		}
+		if n.role != leader {
+			n.mu.Unlock()
+			return ErrNotLeader
+		}
+		// the leader knows the latest committed entry after committing one of its term
+		term, _ := n.log.term(n.commitIndex)
+		readable := term == n.term && n.leaseValid(time.Now())
+		if readable && n.lastApplied >= n.commitIndex {
+			n.mu.Unlock()
+			return nil
+		}
+		if !readable {
+			n.triggerReplication()
+		}
+		wait := n.appliedCh
+		n.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-time.After(n.config.HeartbeatInterval / 2):
+		case <-deadline.C:
+			return ErrTimeout
+		case <-n.closed:
+			return ErrClosed
+		}
+	}
+}
+
+// applier apply the committed entries to the data db in order
+func (n *Node) applier() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.closed:
+			return
+		case <-n.applyCh:
+		}
+
+		for {
+			n.mu.Lock()
+			if install := n.install; install != nil {
+				n.install = nil
+				n.mu.Unlock()
+				if err := n.installSnapshot(install); err != nil {
+					n.config.Logger.Error("install snapshot failed", "id", n.config.ID, "index", install.index, "err", err)
+					n.mu.Lock()
+					n.fail(err)
+					install.done <- n.err
+					n.mu.Unlock()
+					return
+				}
+				install.done <- nil
+				continue
+			}
+			entries := n.log.slice(n.lastApplied+1, n.commitIndex+1)
+			n.mu.Unlock()
+			if len(entries) == 0 {
+				break
+			}
+
+			for i := range entries {
+				result, err := n.apply(&entries[i])
+				if err != nil {
+					n.config.Logger.Error("apply raft entry failed", "id", n.config.ID, "index", entries[i].Index, "err", err)
+					n.mu.Lock()
+					n.fail(err)
+					n.mu.Unlock()
+					return
+				}
+				n.applied(&entries[i], result)
+			}
+		}
+
+		n.mu.Lock()
+		needSnapshot := n.lastApplied-n.log.snapIndex >= n.config.SnapshotThreshold
+		n.mu.Unlock()
+		if needSnapshot {
+			if err := n.takeSnapshot(); err != nil {
+				n.config.Logger.Error("take snapshot failed", "id", n.config.ID, "err", err)
+			}
+		}
+	}
+}
+
+// apply write the ops of the entry and the applied entry by a write batch.
+// if the ops of the command are invalid, only the applied entry is written, every node fails the same way.
+// result is returned to the proposer, err means the data db is broken
+func (n *Node) apply(entry *Entry) (result error, err error) {
+	ops, err := unmarshalCommand(entry.Command)
+	if err != nil {
+		return nil, err
+	}
+	applied := make([]byte, 16)
+	binary.BigEndian.PutUint64(applied, entry.Index)
+	binary.BigEndian.PutUint64(applied[8:], entry.Term)
+
+	n.dbMu.RLock()
+	defer n.dbMu.RUnlock()
+	wb := n.db.NewWriteBatch()
+	for _, op := range ops {
+		if op.Delete {
+			result = wb.Delete(op.Key)
+		} else {
+			result = wb.Put(op.Key, op.Value)
+		}
+		if result != nil {
+			break
+		}
+	}
+	if result == nil {
+		if result = wb.PutIn(n.meta, appliedKey, applied); result == nil {
+			result = wb.Commit()
+		}
+	}
+	if result != nil && !isInvalidCommand(result) {
+		// the quota and the io errors are local to the node, the other nodes may apply the entry
+		return nil, result
+	}
+	if result != nil {
+		wb = n.db.NewWriteBatch()
+		if err = wb.PutIn(n.meta, appliedKey, applied); err != nil {
+			return nil, err
+		}
+		if err = wb.Commit(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// isInvalidCommand report whether the error is caused by the ops of the command,
+// every node gets the same error for the entry
+func isInvalidCommand(err error) bool {
+	return errors.Is(err, cqkv.ErrEmptyKey) || errors.Is(err, cqkv.ErrBigValue) ||
+		errors.Is(err, cqkv.ErrExceedMaxBatchNum)
+}
+
+// fail stop serving after the applier fails, the caller should hold the lock.
+// the leader steps down, and the proposers, the readers and the snapshot installing get the error
+func (n *Node) fail(err error) {
+	n.err = errors.Join(ErrApplyFailed, err)
+	if n.role != follower {
+		_ = n.becomeFollower(n.term)
+	}
+	for index, w := range n.waiters {
+		delete(n.waiters, index)
+		w.ch <- n.err
+	}
+	if n.install != nil {
+		n.install.done <- n.err
+		n.install = nil
+	}
+	n.notifyApplied()
+}
+
+// applied advance the applied entry and notify the proposer
+func (n *Node) applied(entry *Entry, result error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lastApplied, n.appliedTerm = entry.Index, entry.Term
+	if w := n.waiters[entry.Index]; w != nil {
+		delete(n.waiters, entry.Index)
+		if w.term != entry.Term {
+			result = ErrLeadershipLost
+		}
+		w.ch <- result
+	}
+	n.notifyApplied()
+}
+
+// notifyApplied wake up the reads waiting for the applied entries, the caller should hold the lock
+func (n *Node) notifyApplied() {
+	close(n.appliedCh)
+	n.appliedCh = make(chan struct{})
+}
+
+// Close stop the node and close the dbs
+func (n *Node) Close() error {
+	select {
+	case <-n.closed:
+		return nil
+	default:
+	}
+	close(n.closed)
+	n.transport.close()
+	n.wg.Wait()
+	return n.close()
+}
+
+func (n *Node) close() error {
+	n.dbMu.Lock()
+	defer n.dbMu.Unlock()
+	return errors.Join(n.db.Close(), n.log.close())
+}
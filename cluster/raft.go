@@ -0,0 +1,430 @@
+package cluster
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+/*
+raft: the leader appends the writes to its log and replicates them to the followers,
+an entry is committed once a majority has it, then every node applies it to its data db.
+	- a node votes for a candidate only if it has not heard the leader in the election timeout,
+	  so no new leader is elected within the election timeout after the followers ack the leader
+	- the leader steps down if a majority has not acked it in the election timeout
+	- the leader serves the reads while the lease from the last acks of a majority is valid,
+	  the lease is a little shorter than the election timeout for the clock drift
+	- a follower far behind gets the snapshot instead of the dropped entries
+*/
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+func (r role) String() string {
+	switch r {
+	case leader:
+		return "leader"
+	case candidate:
+		return "candidate"
+	default:
+		return "follower"
+	}
+}
+
+// maxAppendEntries is the entries sent by an AppendEntries at most
+const maxAppendEntries = 512
+
+// waiter is the proposer of an entry waiting for it to be applied
+type waiter struct {
+	term uint64
+	ch   chan error
+}
+
+func (n *Node) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+// resetElectionTimer set the deadline of the election to a random time in [timeout, 2*timeout)
+func (n *Node) resetElectionTimer() {
+	timeout := n.config.ElectionTimeout
+	n.electionDeadline = time.Now().Add(timeout + time.Duration(rand.Int63n(int64(timeout))))
+}
+
+// becomeFollower step down to the follower of the term, the caller should hold the lock
+func (n *Node) becomeFollower(term uint64) error {
+	if n.role != follower {
+		n.config.Logger.Info("step down", "id", n.config.ID, "term", term, "role", n.role.String())
+		n.leaderID = ""
+	}
+	n.role = follower
+	if term > n.term {
+		n.term, n.votedFor, n.leaderID = term, "", ""
+		return n.log.saveState(n.term, n.votedFor)
+	}
+	return nil
+}
+
+// startElection vote for itself and request the votes of the peers, the caller should hold the lock
+func (n *Node) startElection() {
+	n.role = candidate
+	n.term++
+	n.votedFor, n.leaderID = n.config.ID, ""
+	n.resetElectionTimer()
+	if err := n.log.saveState(n.term, n.votedFor); err != nil {
+		n.config.Logger.Error("save raft state failed", "id", n.config.ID, "err", err)
+		return
+	}
+	n.config.Logger.Debug("start election", "id", n.config.ID, "term", n.term)
+
+	term := n.term
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	args := &RequestVoteArgs{
+		Term:         term,
+		CandidateID:  n.config.ID,
+		LastLogIndex: n.log.lastIndex(),
+		LastLogTerm:  n.log.lastTerm(),
+	}
+	for _, peer := range n.peers {
+		peer := peer
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			reply := &RequestVoteReply{}
+			if err := n.transport.call(peer, "RequestVote", args, reply, n.config.ElectionTimeout); err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if reply.Term > n.term {
+				_ = n.becomeFollower(reply.Term)
+				return
+			}
+			if n.role != candidate || n.term != term || !reply.Granted {
+				return
+			}
+			if votes++; votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}()
+	}
+}
+
+// becomeLeader append an entry of no op to commit the entries of the previous terms, the caller should hold the lock
+func (n *Node) becomeLeader() {
+	n.role, n.leaderID, n.leaderSince = leader, n.config.ID, time.Now()
+	n.config.Logger.Info("become leader", "id", n.config.ID, "term", n.term)
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.log.lastIndex() + 1
+		n.matchIndex[peer] = 0
+		n.acked[peer] = time.Time{}
+	}
+
+	entry := Entry{Index: n.log.lastIndex() + 1, Term: n.term, Command: marshalCommand(nil)}
+	if err := n.log.append(entry); err != nil {
+		n.config.Logger.Error("append raft log failed", "id", n.config.ID, "err", err)
+		_ = n.becomeFollower(n.term)
+		return
+	}
+	n.advanceCommit()
+	n.triggerReplication()
+}
+
+// triggerReplication wake up the replicators of the peers
+func (n *Node) triggerReplication() {
+	for _, ch := range n.triggers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ticker send the heartbeats of the leader and start the election if the leader is lost
+func (n *Node) ticker() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.closed:
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		// the node failing to apply the entries never starts an election, it can not serve as the leader
+		if n.role == leader {
+			n.checkQuorum(time.Now())
+			n.triggerReplication()
+		} else if n.err == nil && time.Now().After(n.electionDeadline) {
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// replicator send the entries or the snapshot to the peer when it is triggered
+func (n *Node) replicator(peer string) {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.closed:
+			return
+		case <-n.triggers[peer]:
+		}
+		n.replicateTo(peer)
+	}
+}
+
+func (n *Node) replicateTo(peer string) {
+	n.mu.Lock()
+	if n.role != leader {
+		n.mu.Unlock()
+		return
+	}
+	term := n.term
+	next := n.nextIndex[peer]
+	if next <= n.log.snapIndex {
+		n.mu.Unlock()
+		n.sendSnapshot(peer, term)
+		return
+	}
+	prevTerm, _ := n.log.term(next - 1)
+	args := &AppendEntriesArgs{
+		Term:         term,
+		LeaderID:     n.config.ID,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  prevTerm,
+		Entries:      n.log.slice(next, next+maxAppendEntries),
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	sent := time.Now()
+	reply := &AppendEntriesReply{}
+	if err := n.transport.call(peer, "AppendEntries", args, reply, n.config.ElectionTimeout); err != nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if reply.Term > n.term {
+		_ = n.becomeFollower(reply.Term)
+		return
+	}
+	if n.role != leader || n.term != term {
+		return
+	}
+	if sent.After(n.acked[peer]) {
+		n.acked[peer] = sent
+	}
+	if reply.Success {
+		match := args.PrevLogIndex + uint64(len(args.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		n.nextIndex[peer] = n.matchIndex[peer] + 1
+		n.advanceCommit()
+	} else {
+		next = reply.ConflictIndex
+		if next >= args.PrevLogIndex+1 || next == 0 {
+			next = args.PrevLogIndex
+		}
+		if next <= n.matchIndex[peer] {
+			next = n.matchIndex[peer] + 1
+		}
+		n.nextIndex[peer] = next
+	}
+	// send the rest at once
+	if n.nextIndex[peer] <= n.log.lastIndex() {
+		select {
+		case n.triggers[peer] <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// advanceCommit commit the entries of the term on a majority, the caller should hold the lock
+func (n *Node) advanceCommit() {
+	for index := n.log.lastIndex(); index > n.commitIndex; index-- {
+		if term, _ := n.log.term(index); term != n.term {
+			break
+		}
+		count := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.setCommitIndex(index)
+			return
+		}
+	}
+}
+
+// setCommitIndex wake up the applier, the caller should hold the lock
+func (n *Node) setCommitIndex(index uint64) {
+	if index <= n.commitIndex {
+		return
+	}
+	n.commitIndex = index
+	n.signalApplier()
+}
+
+func (n *Node) signalApplier() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// quorumAcked return the time since when a majority acks the leader, the caller should hold the lock
+func (n *Node) quorumAcked(now time.Time) time.Time {
+	acked := []time.Time{now}
+	for _, peer := range n.peers {
+		acked = append(acked, n.acked[peer])
+	}
+	sort.Slice(acked, func(i, j int) bool {
+		return acked[i].After(acked[j])
+	})
+	return acked[n.quorum()-1]
+}
+
+// leaseValid check whether the lease of the leader is valid, the caller should hold the lock
+func (n *Node) leaseValid(now time.Time) bool {
+	lease := n.config.ElectionTimeout * 9 / 10
+	return now.Before(n.quorumAcked(now).Add(lease))
+}
+
+// checkQuorum step down if a majority has not acked the leader in the election timeout,
+// so the partitioned leader stops accepting the writes. the caller should hold the lock
+func (n *Node) checkQuorum(now time.Time) {
+	timeout := n.config.ElectionTimeout
+	if now.Sub(n.leaderSince) > timeout && now.Sub(n.quorumAcked(now)) > timeout {
+		_ = n.becomeFollower(n.term)
+	}
+}
+
+func (n *Node) handleRequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	reply.Term = n.term
+	if args.Term < n.term {
+		return
+	}
+	// the leader is alive, the lease of it must not be broken.
+	// the node restarted in an election timeout does not know the leader, which may still hold the lease
+	timeout := n.config.ElectionTimeout
+	if n.role == leader || (n.leaderID != "" && time.Since(n.heard) < timeout) || time.Since(n.started) < timeout {
+		return
+	}
+	if args.Term > n.term {
+		if err := n.becomeFollower(args.Term); err != nil {
+			return
+		}
+		reply.Term = n.term
+	}
+
+	upToDate := args.LastLogTerm > n.log.lastTerm() ||
+		(args.LastLogTerm == n.log.lastTerm() && args.LastLogIndex >= n.log.lastIndex())
+	if (n.votedFor == "" || n.votedFor == args.CandidateID) && upToDate {
+		n.votedFor = args.CandidateID
+		if err := n.log.saveState(n.term, n.votedFor); err != nil {
+			return
+		}
+		n.resetElectionTimer()
+		reply.Granted = true
+	}
+}
+
+// acceptLeader follow the leader of the term, the caller should hold the lock
+func (n *Node) acceptLeader(term uint64, leaderID string) error {
+	if term > n.term || n.role != follower {
+		if err := n.becomeFollower(term); err != nil {
+			return err
+		}
+	}
+	n.leaderID = leaderID
+	n.heard = time.Now()
+	n.resetElectionTimer()
+	return nil
+}
+
+func (n *Node) handleAppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	reply.Term = n.term
+	if args.Term < n.term {
+		return nil
+	}
+	if err := n.acceptLeader(args.Term, args.LeaderID); err != nil {
+		return err
+	}
+	reply.Term = n.term
+
+	if args.PrevLogIndex > n.log.lastIndex() {
+		reply.ConflictIndex = n.log.lastIndex() + 1
+		return nil
+	}
+	entries := args.Entries
+	if args.PrevLogIndex < n.log.snapIndex {
+		// the entries in the snapshot are committed, they match
+		skip := n.log.snapIndex - args.PrevLogIndex
+		if skip > uint64(len(entries)) {
+			skip = uint64(len(entries))
+		}
+		entries = entries[skip:]
+	} else if term, _ := n.log.term(args.PrevLogIndex); term != args.PrevLogTerm {
+		// retry from the first entry of the conflicting term
+		index := args.PrevLogIndex
+		for index-1 > n.log.snapIndex {
+			if t, _ := n.log.term(index - 1); t != term {
+				break
+			}
+			index--
+		}
+		reply.ConflictIndex = index
+		return nil
+	}
+
+	for i, entry := range entries {
+		if entry.Index <= n.log.lastIndex() {
+			if term, _ := n.log.term(entry.Index); term == entry.Term {
+				continue
+			}
+			if entry.Index <= n.commitIndex {
+				return ErrCorrupted
+			}
+			if err := n.log.truncate(entry.Index); err != nil {
+				return err
+			}
+		}
+		if err := n.log.append(entries[i:]...); err != nil {
+			return err
+		}
+		break
+	}
+
+	if args.LeaderCommit > n.commitIndex {
+		last := args.PrevLogIndex + uint64(len(args.Entries))
+		if args.LeaderCommit < last {
+			last = args.LeaderCommit
+		}
+		n.setCommitIndex(last)
+	}
+	reply.Success = true
+	return nil
+}
@@ -0,0 +1,359 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+snapshot: the backup of the data db at the applied entry, it is kept in the snapshot dir.
+	- the log is compacted to the snapshot after it is taken
+	- the leader sends the files of the snapshot in chunks to the follower missing the dropped entries,
+	  the follower replaces its data db with them and takes its own snapshot from the new data db
+	- the follower opens the snapshot in a new data dir, the data name file is switched to it at once,
+	  a crash keeps either the old data db or the new one
+*/
+
+// snapshotChunkSize is the size of the data of an InstallSnapshot at most
+const snapshotChunkSize = 1024 * 1024
+
+const (
+	// defaultDataName is the dir of the data db before installing a snapshot,
+	// the snapshot of index is installed in the dir defaultDataName-<index>
+	defaultDataName = "data"
+	// dataNameFile keep the dir name of the data db
+	dataNameFile = "data-name"
+)
+
+// installRequest is a snapshot received by the follower
+type installRequest struct {
+	dir   string
+	index uint64
+	term  uint64
+	done  chan error
+}
+
+// takeSnapshot backup the data db to the snapshot dir and compact the log, it is called by the applier
+func (n *Node) takeSnapshot() error {
+	n.snapMu.Lock()
+	defer n.snapMu.Unlock()
+
+	n.mu.Lock()
+	index, term := n.lastApplied, n.appliedTerm
+	n.mu.Unlock()
+
+	if err := n.saveSnapshot(); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	err := n.log.compact(index, term)
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	n.config.Logger.Info("snapshot taken", "id", n.config.ID, "index", index, "term", term)
+	return nil
+}
+
+// sendSnapshot send the files of the snapshot to the peer
+func (n *Node) sendSnapshot(peer string, term uint64) {
+	n.snapMu.RLock()
+	defer n.snapMu.RUnlock()
+
+	n.mu.Lock()
+	args := InstallSnapshotArgs{Term: term, LeaderID: n.config.ID, LastIndex: n.log.snapIndex, LastTerm: n.log.snapTerm}
+	n.mu.Unlock()
+
+	entries, err := os.ReadDir(n.snapshotDir())
+	if err != nil {
+		n.config.Logger.Warn("read snapshot failed", "id", n.config.ID, "err", err)
+		return
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	send := func(chunk InstallSnapshotArgs) bool {
+		reply := &InstallSnapshotReply{}
+		if err := n.transport.call(peer, "InstallSnapshot", &chunk, reply, n.config.Timeout); err != nil {
+			return false
+		}
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if reply.Term > n.term {
+			_ = n.becomeFollower(reply.Term)
+			return false
+		}
+		return n.role == leader && n.term == term
+	}
+
+	first := true
+	if len(names) == 0 {
+		chunk := args
+		chunk.First, chunk.Done = true, true
+		if !send(chunk) {
+			return
+		}
+	}
+	// the chunks are read one by one, the files are not loaded into memory
+	buf := make([]byte, snapshotChunkSize)
+	sendFile := func(name string, last bool) bool {
+		file, err := os.Open(filepath.Join(n.snapshotDir(), name))
+		if err != nil {
+			n.config.Logger.Warn("read snapshot failed", "id", n.config.ID, "err", err)
+			return false
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			n.config.Logger.Warn("read snapshot failed", "id", n.config.ID, "err", err)
+			return false
+		}
+		size := info.Size()
+		for offset := int64(0); ; offset += snapshotChunkSize {
+			end := min(offset+snapshotChunkSize, size)
+			data := buf[:end-offset]
+			if _, err = file.ReadAt(data, offset); err != nil {
+				n.config.Logger.Warn("read snapshot failed", "id", n.config.ID, "err", err)
+				return false
+			}
+			chunk := args
+			chunk.First = first
+			chunk.Done = last && end == size
+			chunk.Name, chunk.Offset, chunk.Data = name, offset, data
+			if !send(chunk) {
+				return false
+			}
+			first = false
+			if end == size {
+				return true
+			}
+		}
+	}
+	for i, name := range names {
+		if !sendFile(name, i == len(names)-1) {
+			return
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role == leader && n.term == term {
+		if args.LastIndex > n.matchIndex[peer] {
+			n.matchIndex[peer] = args.LastIndex
+		}
+		n.nextIndex[peer] = n.matchIndex[peer] + 1
+		n.advanceCommit()
+	}
+}
+
+func (n *Node) handleInstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	n.mu.Lock()
+	reply.Term = n.term
+	if args.Term < n.term {
+		n.mu.Unlock()
+		return nil
+	}
+	if err := n.acceptLeader(args.Term, args.LeaderID); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	reply.Term = n.term
+	n.mu.Unlock()
+
+	dir := n.snapshotDir() + "-received"
+	if args.First {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+	if args.Name != "" {
+		if err := writeChunk(filepath.Join(dir, filepath.Base(args.Name)), args.Offset, args.Data); err != nil {
+			return err
+		}
+	}
+	if !args.Done {
+		return nil
+	}
+
+	request := &installRequest{dir: dir, index: args.LastIndex, term: args.LastTerm, done: make(chan error, 1)}
+	n.mu.Lock()
+	if n.err != nil {
+		n.mu.Unlock()
+		return n.err
+	}
+	if args.LastIndex <= n.lastApplied {
+		n.mu.Unlock()
+		return os.RemoveAll(dir)
+	}
+	n.install = request
+	n.signalApplier()
+	n.mu.Unlock()
+
+	select {
+	case err := <-request.done:
+		return err
+	case <-n.closed:
+		return ErrClosed
+	}
+}
+
+func writeChunk(path string, offset int64, data []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.WriteAt(data, offset); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// installSnapshot replace the data db with the snapshot received, it is called by the applier.
+// the snapshot is opened in a new data dir and the data name file is switched to it by a rename,
+// the old data db is kept until then, and the received snapshot is kept if it can not be opened
+func (n *Node) installSnapshot(request *installRequest) error {
+	n.snapMu.Lock()
+	defer n.snapMu.Unlock()
+
+	name := fmt.Sprintf("data-%d", request.index)
+	dir := filepath.Join(n.config.Dir, name)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Rename(request.dir, dir); err != nil {
+		return err
+	}
+	db, meta, _, _, err := openDB(dir, n.config.Options)
+	if err != nil {
+		_ = os.Rename(dir, request.dir)
+		return err
+	}
+	if err = writeDataName(n.config.Dir, name); err != nil {
+		_ = db.Close()
+		_ = os.Rename(dir, request.dir)
+		return err
+	}
+
+	n.dbMu.Lock()
+	old, oldDir := n.db, n.dataDir()
+	n.db, n.meta, n.dataName = db, meta, name
+	n.dbMu.Unlock()
+	if err = old.Close(); err != nil {
+		n.config.Logger.Warn("close the old data db failed", "id", n.config.ID, "err", err)
+	}
+	// the old data db is needed if the rename is lost by a crash
+	if err = syncDir(n.config.Dir); err != nil {
+		return err
+	}
+	if err = os.RemoveAll(oldDir); err != nil {
+		n.config.Logger.Warn("remove the old data db failed", "id", n.config.ID, "err", err)
+	}
+
+	n.mu.Lock()
+	if err = n.log.compact(request.index, request.term); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	n.lastApplied, n.appliedTerm = request.index, request.term
+	if n.commitIndex < request.index {
+		n.commitIndex = request.index
+	}
+	// the entries of the proposers are replaced by the snapshot
+	for index, w := range n.waiters {
+		if index <= request.index {
+			delete(n.waiters, index)
+			w.ch <- ErrLeadershipLost
+		}
+	}
+	n.notifyApplied()
+	n.mu.Unlock()
+	n.config.Logger.Info("snapshot installed", "id", n.config.ID, "index", request.index, "term", request.term)
+
+	// keep the snapshot for sending it as the leader, it is taken again after a restart if it fails
+	if err = n.saveSnapshot(); err != nil {
+		n.config.Logger.Warn("save the installed snapshot failed", "id", n.config.ID, "err", err)
+	}
+	return nil
+}
+
+// saveSnapshot backup the data db to the snapshot dir, the caller should hold snapMu
+func (n *Node) saveSnapshot() error {
+	tempDir := n.snapshotDir() + "-temp"
+	if err := os.RemoveAll(tempDir); err != nil {
+		return err
+	}
+	n.dbMu.RLock()
+	err := n.db.Backup(tempDir)
+	n.dbMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err = os.RemoveAll(n.snapshotDir()); err != nil {
+		return err
+	}
+	return os.Rename(tempDir, n.snapshotDir())
+}
+
+// loadDataName return the dir of the data db in dir, and remove the other data dirs
+// left by a crash while installing a snapshot
+func loadDataName(dir string) (string, error) {
+	name := defaultDataName
+	data, err := os.ReadFile(filepath.Join(dir, dataNameFile))
+	if err == nil {
+		name = string(data)
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		stale := entry.Name() == defaultDataName || strings.HasPrefix(entry.Name(), defaultDataName+"-")
+		if !entry.IsDir() || entry.Name() == name || !stale {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+// writeDataName switch the data db to the dir name by renaming the data name file
+func writeDataName(dir, name string) error {
+	path := filepath.Join(dir, dataNameFile)
+	if err := os.Remove(path + "-temp"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := writeChunk(path+"-temp", 0, []byte(name)); err != nil {
+		return err
+	}
+	return os.Rename(path+"-temp", path)
+}
+
+// syncDir make the renames in dir durable
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
@@ -0,0 +1,229 @@
+package cluster
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type RequestVoteArgs struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type RequestVoteReply struct {
+	Term    uint64
+	Granted bool
+}
+
+type AppendEntriesArgs struct {
+	Term         uint64
+	LeaderID     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+type AppendEntriesReply struct {
+	Term    uint64
+	Success bool
+	// ConflictIndex is where the leader retries from if it fails
+	ConflictIndex uint64
+}
+
+// InstallSnapshotArgs is a chunk of a file of the snapshot
+type InstallSnapshotArgs struct {
+	Term      uint64
+	LeaderID  string
+	LastIndex uint64
+	LastTerm  uint64
+
+	// First is the first chunk of the snapshot, Done is the last one
+	First  bool
+	Done   bool
+	Name   string
+	Offset int64
+	Data   []byte
+}
+
+type InstallSnapshotReply struct {
+	Term uint64
+}
+
+// raftService is the rpc service of the node
+type raftService struct {
+	node *Node
+}
+
+func (s *raftService) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	if s.node.transport.isPartitioned() {
+		return errPartitioned
+	}
+	s.node.handleRequestVote(args, reply)
+	return nil
+}
+
+func (s *raftService) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	if s.node.transport.isPartitioned() {
+		return errPartitioned
+	}
+	return s.node.handleAppendEntries(args, reply)
+}
+
+func (s *raftService) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	if s.node.transport.isPartitioned() {
+		return errPartitioned
+	}
+	return s.node.handleInstallSnapshot(args, reply)
+}
+
+// errPartitioned is returned by the rpc of a partitioned node in the tests
+var errPartitioned = errors.New("partitioned")
+
+// transport send the rpc to the peers and serve the rpc of them over tcp
+type transport struct {
+	peers  map[string]string
+	ln     net.Listener
+	server *rpc.Server
+
+	mu      sync.Mutex
+	clients map[string]*rpc.Client
+	conns   map[net.Conn]struct{}
+	closed  bool
+	wg      sync.WaitGroup
+
+	// partitioned drop all the rpc of the node, it is only used by the tests
+	partitioned int32
+}
+
+func newTransport(node *Node, ln net.Listener) (*transport, error) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Raft", &raftService{node: node}); err != nil {
+		return nil, err
+	}
+	return &transport{
+		peers:   node.config.Peers,
+		ln:      ln,
+		server:  server,
+		clients: make(map[string]*rpc.Client),
+		conns:   make(map[net.Conn]struct{}),
+	}, nil
+}
+
+func (t *transport) serve() {
+	for {
+		conn, err := t.ln.Accept()
+		if err != nil {
+			return
+		}
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		t.conns[conn] = struct{}{}
+		t.wg.Add(1)
+		t.mu.Unlock()
+
+		go func() {
+			defer t.wg.Done()
+			t.server.ServeConn(conn)
+			t.mu.Lock()
+			delete(t.conns, conn)
+			t.mu.Unlock()
+		}()
+	}
+}
+
+func (t *transport) isPartitioned() bool {
+	return atomic.LoadInt32(&t.partitioned) == 1
+}
+
+func (t *transport) setPartitioned(partitioned bool) {
+	var v int32
+	if partitioned {
+		v = 1
+	}
+	atomic.StoreInt32(&t.partitioned, v)
+}
+
+// call the method of the peer, the connection is dropped if it fails
+func (t *transport) call(peer, method string, args, reply any, timeout time.Duration) error {
+	if t.isPartitioned() {
+		return errPartitioned
+	}
+	client, err := t.client(peer, timeout)
+	if err != nil {
+		return err
+	}
+
+	call := client.Go("Raft."+method, args, reply, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		if call.Error != nil && !isServerError(call.Error) {
+			t.dropClient(peer, client)
+		}
+		return call.Error
+	case <-timer.C:
+		t.dropClient(peer, client)
+		return ErrTimeout
+	}
+}
+
+// isServerError check whether the error is returned by the method rather than the connection
+func isServerError(err error) bool {
+	var serverError rpc.ServerError
+	return errors.As(err, &serverError)
+}
+
+func (t *transport) client(peer string, timeout time.Duration) (*rpc.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, ErrClosed
+	}
+	if client := t.clients[peer]; client != nil {
+		return client, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", t.peers[peer], timeout)
+	if err != nil {
+		return nil, err
+	}
+	client := rpc.NewClient(conn)
+	t.clients[peer] = client
+	return client, nil
+}
+
+func (t *transport) dropClient(peer string, client *rpc.Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.clients[peer] == client {
+		delete(t.clients, peer)
+	}
+	_ = client.Close()
+}
+
+func (t *transport) close() {
+	t.mu.Lock()
+	t.closed = true
+	_ = t.ln.Close()
+	for conn := range t.conns {
+		_ = conn.Close()
+	}
+	for peer, client := range t.clients {
+		_ = client.Close()
+		delete(t.clients, peer)
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+}
@@ -15,9 +15,13 @@ func NewCodecImpl() *CodecImpl {
 
 /*
 default codec:
-	- header: crc(4) + isDelete(1) + keySize(varint) + valueSize(varint) (max 15 bytes)
+	- header: crc(4) + flags(1) + keySize(varint) + valueSize(varint) + [seq(uvarint)]
+	  + [prevSeq(uvarint) + prevFid(uvarint) + prevOffset(varint)] + [timestamp(varint)] + [expireAt(varint)]
+	  + [keyspace(uvarint)]
 	- record: key + value (record raw data, you can implement your own codec to marshal/unmarshal record data)
-	crc | isDelete | keySize | valueSize | key | value
+	crc | flags | keySize | valueSize | seq | prev | timestamp | expireAt | keyspace | key | value
+the flags tell whether the record is a tombstone, a range tombstone or a blob pointer and whether the optional fields exist,
+so the header without version is the same as the old format.
 */
 
 // MarshalRecordHeader return header data and data size
@@ -27,16 +31,62 @@ func (cl *CodecImpl) MarshalRecordHeader(header *model.RecordHeader) ([]byte, in
 	// crc
 	binary.BigEndian.PutUint32(data[:4], header.Crc)
 
-	// isDelete
+	// flags
+	var flags byte
 	if header.IsDelete {
-		data[4] = 1
+		flags |= model.DeleteFlag
 	}
+	if header.Seq != 0 {
+		flags |= model.SeqFlag
+	}
+	if header.Prev != nil {
+		flags |= model.PrevFlag
+	}
+	if header.Timestamp != 0 {
+		flags |= model.TimestampFlag
+	}
+	if header.ExpireAt != 0 {
+		flags |= model.ExpireFlag
+	}
+	if header.IsRangeDelete {
+		flags |= model.RangeDeleteFlag
+	}
+	if header.Keyspace != 0 {
+		flags |= model.KeyspaceFlag
+	}
+	if header.IsBlob {
+		flags |= model.BlobFlag
+	}
+	data[4] = flags
 
 	// key size and value size
 	idx := 5
 	idx += binary.PutVarint(data[idx:], header.KeySize)
 	idx += binary.PutVarint(data[idx:], header.ValueSize)
 
+	// version
+	if header.Seq != 0 {
+		idx += binary.PutUvarint(data[idx:], header.Seq)
+	}
+	if header.Prev != nil {
+		idx += binary.PutUvarint(data[idx:], header.Prev.Seq)
+		idx += binary.PutUvarint(data[idx:], uint64(header.Prev.Fid))
+		idx += binary.PutVarint(data[idx:], header.Prev.Offset)
+	}
+
+	// time
+	if header.Timestamp != 0 {
+		idx += binary.PutVarint(data[idx:], header.Timestamp)
+	}
+	if header.ExpireAt != 0 {
+		idx += binary.PutVarint(data[idx:], header.ExpireAt)
+	}
+
+	// keyspace
+	if header.Keyspace != 0 {
+		idx += binary.PutUvarint(data[idx:], uint64(header.Keyspace))
+	}
+
 	return data, int64(idx), nil
 }
 
@@ -48,12 +98,8 @@ func (cl *CodecImpl) UnmarshalRecordHeader(headerData []byte, header *model.Reco
 	// get crc
 	crc := binary.BigEndian.Uint32(headerData[:4])
 
-	// get isDelete
-	var isDelete bool
-	switch headerData[4] {
-	case 1:
-		isDelete = true
-	}
+	// get flags
+	flags := headerData[4]
 
 	// get key size and value size
 	idx := 5
@@ -64,10 +110,46 @@ func (cl *CodecImpl) UnmarshalRecordHeader(headerData []byte, header *model.Reco
 	idx += n
 
 	header.Crc = crc
-	header.IsDelete = isDelete
+	header.IsDelete = flags&model.DeleteFlag != 0
+	header.IsRangeDelete = flags&model.RangeDeleteFlag != 0
+	header.IsBlob = flags&model.BlobFlag != 0
 	header.KeySize = keySize
 	header.ValueSize = valueSize
 
+	// get version
+	if flags&model.SeqFlag != 0 {
+		header.Seq, n = binary.Uvarint(headerData[idx:])
+		idx += n
+	}
+	if flags&model.PrevFlag != 0 {
+		prev := new(model.RecordVersion)
+		prev.Seq, n = binary.Uvarint(headerData[idx:])
+		idx += n
+		fid, n := binary.Uvarint(headerData[idx:])
+		idx += n
+		prev.Fid = uint32(fid)
+		prev.Offset, n = binary.Varint(headerData[idx:])
+		idx += n
+		header.Prev = prev
+	}
+
+	// get time
+	if flags&model.TimestampFlag != 0 {
+		header.Timestamp, n = binary.Varint(headerData[idx:])
+		idx += n
+	}
+	if flags&model.ExpireFlag != 0 {
+		header.ExpireAt, n = binary.Varint(headerData[idx:])
+		idx += n
+	}
+
+	// get keyspace
+	if flags&model.KeyspaceFlag != 0 {
+		keyspace, n := binary.Uvarint(headerData[idx:])
+		idx += n
+		header.Keyspace = uint32(keyspace)
+	}
+
 	return int64(idx), nil
 }
 
@@ -87,12 +169,15 @@ func (cl *CodecImpl) UnmarshalRecord(data []byte, header *model.RecordHeader, re
 }
 
 func (cl *CodecImpl) MarshalRecordPos(pos *model.RecordPos) ([]byte, error) {
-	buf := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64)
+	buf := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64*3)
 	var index = 0
 	index += binary.PutVarint(buf[index:], int64(pos.Fid))
 	index += binary.PutVarint(buf[index:], pos.Offset)
 	index += binary.PutVarint(buf[index:], int64(pos.Size))
-	return buf[:index], nil
+	index += binary.PutUvarint(buf[index:], pos.Seq)
+	index += binary.PutVarint(buf[index:], pos.ExpireAt)
+	// the inline value is stored after the position
+	return append(buf[:index], pos.Value...), nil
 }
 
 func (cl *CodecImpl) UnmarshalRecordPos(buf []byte, pos *model.RecordPos) error {
@@ -101,9 +186,19 @@ func (cl *CodecImpl) UnmarshalRecordPos(buf []byte, pos *model.RecordPos) error
 	index += n
 	offset, n := binary.Varint(buf[index:])
 	index += n
-	size, _ := binary.Varint(buf[index:])
+	size, n := binary.Varint(buf[index:])
+	index += n
+	seq, n := binary.Uvarint(buf[index:])
+	index += n
+	expireAt, n := binary.Varint(buf[index:])
+	index += n
 	pos.Fid = uint32(fileId)
 	pos.Offset = offset
 	pos.Size = uint32(size)
+	pos.Seq = seq
+	pos.ExpireAt = expireAt
+	if index < len(buf) {
+		pos.Value = buf[index:]
+	}
 	return nil
 }
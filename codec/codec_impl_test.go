@@ -3,6 +3,7 @@ package codec
 import (
 	"github.com/cqkv/cqkv/model"
 	"github.com/stretchr/testify/assert"
+	"math"
 	"testing"
 )
 
@@ -64,3 +65,67 @@ func TestCodecImpl_UnmarshalRecord(t *testing.T) {
 	assert.Equal(t, []byte("key"), record.Key)
 	assert.Equal(t, []byte("value"), record.Value)
 }
+
+func TestCodecImpl_MarshalRecordPos(t *testing.T) {
+	cl := newCodecImpl()
+	pos := &model.RecordPos{
+		Fid:    1,
+		Size:   20,
+		Offset: 300,
+		Seq:    1000,
+	}
+	data, err := cl.MarshalRecordPos(pos)
+	assert.Nil(t, err)
+
+	decodePos := &model.RecordPos{}
+	err = cl.UnmarshalRecordPos(data, decodePos)
+	assert.Nil(t, err)
+	assert.Equal(t, pos, decodePos)
+
+	// pos with inline value
+	pos.Value = []byte("value")
+	data, err = cl.MarshalRecordPos(pos)
+	assert.Nil(t, err)
+
+	decodePos = &model.RecordPos{}
+	err = cl.UnmarshalRecordPos(data, decodePos)
+	assert.Nil(t, err)
+	assert.Equal(t, pos, decodePos)
+}
+
+func TestCodecImpl_RecordHeaderWithVersion(t *testing.T) {
+	cl := newCodecImpl()
+	header := &model.RecordHeader{
+		Crc:       123,
+		IsDelete:  true,
+		IsBlob:    true,
+		KeySize:   10,
+		ValueSize: 20,
+		Seq:       1 << 40,
+		Prev: &model.RecordVersion{
+			Seq:    1<<40 - 1,
+			Fid:    3,
+			Offset: 1 << 30,
+		},
+		Timestamp: math.MaxInt64,
+		ExpireAt:  math.MaxInt64,
+		Keyspace:  math.MaxUint32,
+	}
+	data, size, err := cl.MarshalRecordHeader(header)
+	assert.Nil(t, err)
+	assert.True(t, size <= model.MaxHeaderSize)
+
+	decodeHeader := &model.RecordHeader{}
+	decodeSize, err := cl.UnmarshalRecordHeader(data, decodeHeader)
+	assert.Nil(t, err)
+	assert.Equal(t, size, decodeSize)
+	assert.Equal(t, header, decodeHeader)
+
+	// the header without version is the same as the old format
+	header.Seq, header.Prev = 0, nil
+	header.Timestamp, header.ExpireAt, header.Keyspace = 0, 0, 0
+	header.IsBlob = false
+	_, size, err = cl.MarshalRecordHeader(header)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), size)
+}
@@ -0,0 +1,240 @@
+package cqkv
+
+import (
+	"context"
+	"fmt"
+	"github.com/cqkv/cqkv/fio"
+	"github.com/cqkv/cqkv/fio/faulty"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+/*
+crash consistency: the random Put, Delete, WriteBatch and Merge run on faulty.FS,
+some of them fail with the injected faults, then the file system crashes and drops the data not synced.
+the crash may also happen in the middle of a write, leaving a torn record.
+the db opened again should be in the state after a prefix of the acknowledged writes,
+and the prefix should contain every acknowledged synced write.
+the writes are synced by the options of the db and the batches, or by Sync after every write.
+*/
+
+const (
+	crashKeys   = 16
+	crashOps    = 150
+	crashRounds = 3
+)
+
+// crashState is the values of the keys after some writes
+type crashState map[string]string
+
+func (s crashState) clone() crashState {
+	c := make(crashState, len(s))
+	for k, v := range s {
+		c[k] = v
+	}
+	return c
+}
+
+// crashSync is how the writes of the crash test are synced
+type crashSync int
+
+const (
+	// syncBatch only syncs the write batches with WithSync(true)
+	syncBatch crashSync = iota
+	// syncWrites syncs every write by WithSyncFrequency(1)
+	syncWrites
+	// syncExplicit calls Sync after every write
+	syncExplicit
+)
+
+func TestDB_CrashConsistency(t *testing.T) {
+	modes := map[string]crashSync{"batch": syncBatch, "writes": syncWrites, "explicit": syncExplicit}
+	for name, mode := range modes {
+		for seed := int64(0); seed < 10; seed++ {
+			t.Run(fmt.Sprintf("%s/seed-%d", name, seed), func(t *testing.T) {
+				testCrashConsistency(t, mode, seed)
+			})
+		}
+	}
+}
+
+func testCrashConsistency(t *testing.T, mode crashSync, seed int64) {
+	rnd := rand.New(rand.NewSource(seed))
+	fsys := faulty.NewFS(fio.NewMemFS(), seed)
+	opts := []Option{WithFS(fsys), WithDataFileSize(1024), WithSyncFrequency(1024)}
+	if mode == syncWrites {
+		opts = []Option{WithFS(fsys), WithDataFileSize(1024), WithSyncFrequency(1)}
+	}
+
+	db, err := Open("./tmp-crash/", opts...)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// states[0] is durable, states[i] is the state after the i-th acknowledged write
+	states := []crashState{{}}
+	for round := 0; round < crashRounds; round++ {
+		synced := 0
+		for i := 0; i < crashOps; i++ {
+			// fail one of the next writes, or crash at it
+			crashes := fsys.Crashes()
+			if rnd.Intn(10) == 0 {
+				fsys.SetFaults(faulty.Faults{
+					FailWrites:  true,
+					FailAfter:   rnd.Intn(4),
+					ShortWrite:  rnd.Intn(2) == 0,
+					CrashOnFail: rnd.Intn(4) == 0,
+				})
+			}
+
+			state := states[len(states)-1].clone()
+			key := fmt.Sprintf("key-%02d", rnd.Intn(crashKeys))
+			value := fmt.Sprintf("value-%d-%d", round, i)
+			var isSynced bool
+
+			switch n := rnd.Intn(20); {
+			case n < 10:
+				err = db.Put([]byte(key), []byte(value))
+				state[key] = value
+				isSynced = mode == syncWrites
+			case n < 14:
+				err = db.Delete([]byte(key))
+				delete(state, key)
+				isSynced = mode == syncWrites
+			case n < 19:
+				isSynced = rnd.Intn(2) == 0
+				wb := db.NewWriteBatch(WithSync(isSynced), WithMaxBatchNum(16))
+				isSynced = isSynced || mode == syncWrites
+				for j := 0; j < 1+rnd.Intn(4); j++ {
+					key = fmt.Sprintf("key-%02d", rnd.Intn(crashKeys))
+					if rnd.Intn(3) == 0 {
+						assert.Nil(t, wb.Delete([]byte(key)))
+						delete(state, key)
+					} else {
+						assert.Nil(t, wb.Put([]byte(key), []byte(value)))
+						state[key] = value
+					}
+				}
+				// the batch of the deletes of the missing keys writes nothing, and syncs nothing
+				if len(wb.pendingWrites) == 0 {
+					isSynced = mode == syncWrites
+				}
+				err = wb.Commit()
+			default:
+				// merge does not change the state
+				err = db.MergeWithContext(context.Background(), MergeOptions{})
+				state = nil
+			}
+			fsys.SetFaults(faulty.Faults{})
+
+			// the write crashing in the middle may or may not be applied
+			if fsys.Crashes() != crashes {
+				if state != nil {
+					states = append(states, state)
+				}
+				break
+			}
+			if err != nil || state == nil {
+				continue
+			}
+			states = append(states, state)
+			if mode == syncExplicit {
+				if !assert.Nil(t, db.Sync()) {
+					return
+				}
+				isSynced = true
+			}
+			if isSynced {
+				synced = len(states) - 1
+			}
+		}
+
+		if fsys.Crashes() == round {
+			assert.Nil(t, fsys.Crash())
+		}
+		// the async hint files belong to the crashed db
+		db.hintWg.Wait()
+
+		db, err = Open("./tmp-crash/", opts...)
+		if !assert.Nil(t, err) {
+			return
+		}
+		recovered := crashState{}
+		for _, key := range db.defaultKeyspace.ListKeys() {
+			value, err := db.Get(key)
+			if !assert.Nil(t, err) {
+				return
+			}
+			recovered[string(key)] = string(value)
+		}
+
+		// the recovered state is after a prefix containing all the acknowledged synced writes
+		matched := -1
+		for i := len(states) - 1; i >= synced; i-- {
+			if reflect.DeepEqual(states[i], recovered) {
+				matched = i
+				break
+			}
+		}
+		if !assert.True(t, matched >= 0, "round %d: the state is not after any prefix from the write %d", round, synced) {
+			return
+		}
+		states = []crashState{recovered}
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_BitFlip(t *testing.T) {
+	fsys := faulty.NewFS(fio.NewMemFS(), 0)
+	db, err := Open("./tmp-flip/", WithFS(fsys), WithDataFileSize(1024))
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		assert.Nil(t, err)
+	}
+
+	// the flipped record is never returned
+	fsys.SetFaults(faulty.Faults{FlipRate: 0.5})
+	var failed int
+	for i := 0; i < 100; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("key-%02d", i)))
+		if err != nil {
+			failed++
+			continue
+		}
+		assert.Equal(t, fmt.Sprintf("value-%d", i), string(value))
+	}
+	assert.True(t, failed > 0)
+
+	fsys.SetFaults(faulty.Faults{})
+	for i := 0; i < 100; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("key-%02d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("value-%d", i), string(value))
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_CloseCrash(t *testing.T) {
+	fsys := faulty.NewFS(fio.NewMemFS(), 0)
+	db, err := Open("./tmp-close/", WithFS(fsys), WithDataFileSize(1024), WithSyncFrequency(1024))
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		assert.Nil(t, err)
+	}
+
+	// the writes acknowledged before Close are kept after the crash
+	assert.Nil(t, db.Close())
+	assert.Nil(t, fsys.Crash())
+	db, err = Open("./tmp-close/", WithFS(fsys), WithDataFileSize(1024), WithSyncFrequency(1024))
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("key-%02d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("value-%d", i), string(value))
+	}
+	assert.Nil(t, db.Close())
+}
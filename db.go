@@ -8,11 +8,14 @@ import (
 	"github.com/cqkv/cqkv/utils"
 	"io"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type DB struct {
@@ -22,10 +25,43 @@ type DB struct {
 	olderFiles map[uint32]*model.DataFile // older files, read only
 	fileIds    []uint32                   // only used in loading keydir
 
-	txSeq uint64 // transaction sequence number
+	activeBlobFile *model.DataFile            // big values will append to active blob file
+	blobFiles      map[uint32]*model.DataFile // all the blob files, including the active one
+
+	txSeq     uint64 // transaction sequence number
+	recordSeq uint64 // sequence of the last record
 
 	isMerging bool // whether is merging
 
+	// closed when a record is appended or the active file is rotated, the replication waits for it
+	appendCh      chan struct{}
+	appendWaiting int32
+
+	spoolSeq uint64 // the sequence of the temp files of PutStream
+
+	inlineBytes int64 // total size of the values inlined in keydir
+	diskBytes   int64 // size of the data files and the blob files
+	// failed is the error of the failed sync or rollback, the data files may not be what was written,
+	// so the writes are rejected until the db is opened again. protected by mu
+	failed error
+
+	hintWg *sync.WaitGroup // wait for the data hint files writing
+
+	liveMu   *sync.Mutex
+	liveSize map[uint32]int64 // the size of valid records in each data file
+	// keptSize is the size of the tombstones and the old versions kept by the last merge of each data file,
+	// they are not counted as garbage, or else the same files are merged again and again
+	keptSize map[uint32]int64
+
+	ksMu            *sync.RWMutex
+	keyspaces       map[uint32]*Keyspace // all the keyspaces by id
+	keyspaceNames   map[string]*Keyspace // the named keyspaces
+	keyspaceSeq     uint32               // the max id of the keyspaces
+	defaultKeyspace *Keyspace            // the keyspace of the DB methods
+	catalog         *Keyspace            // the names of the keyspaces
+
+	metrics *dbMetrics
+
 	options *options
 }
 
@@ -34,54 +70,88 @@ func Open(dirPath string, ops ...Option) (*DB, error) {
 	return newDB(dirPath, ops)
 }
 
-func newDB(dirPath string, o []Option) (*DB, error) {
+func newDB(dirPath string, o []Option) (db *DB, err error) {
 	// create options
 	ops := newDefaultOptions()
 	if dirPath != "" {
 		ops.dirPath = dirPath
 	}
-	fileLock := fio.NewFlock(dirPath)
-	ops.fileLock = fileLock
 
 	for _, fn := range o {
 		fn(ops)
 	}
 
-	// if ioManager is fio.FileIO, check dir
+	// if ioManager is replaced, the dir is managed by the caller
 	if reflect.ValueOf(ops.ioManagerCreator).Pointer() != reflect.ValueOf(defaultIOManagerCreator).Pointer() {
 		// check file lock
-		if ops.fileLock == fileLock {
+		if ops.fileLock == nil {
 			return nil, ErrNeedFileLock
 		}
 	} else {
-		if _, err := os.Stat(dirPath); !os.IsExist(err) {
+		if _, isOS := ops.fs.(fio.OSFS); !isOS {
+			ops.ioManagerCreator = ops.fs.OpenFile
+			ops.bufferSize = 0
+		}
+		if ops.fileLock == nil {
+			ops.fileLock = ops.fs.Locker(ops.dirPath)
+		}
+
+		if _, err := ops.fs.Stat(dirPath); !os.IsExist(err) {
 			// create dir
-			if err = os.MkdirAll(dirPath, os.ModePerm); err != nil {
+			if err = ops.fs.MkdirAll(dirPath, os.ModePerm); err != nil {
 				return nil, err
 			}
 		}
 
 		// check whether current dir is used
-		// TODO: fix the file lock
-		_, err := ops.fileLock.TryLock()
+		var success bool
+		success, err = ops.fileLock.TryLock()
 		if err != nil {
 			return nil, err
 		}
-		//if !success {
-		//	return nil, ErrDirIsUsing
-		//}
+		if !success {
+			return nil, ErrDirIsUsing
+		}
+		defer func() {
+			// the dir is not used if the db fails to open
+			if err != nil {
+				_ = ops.fileLock.Unlock()
+			}
+		}()
 
-		if _, err = os.ReadDir(dirPath); err != nil {
+		if _, err = ops.fs.ReadDir(dirPath); err != nil {
 			return nil, err
 		}
 	}
 
-	db := &DB{
+	db = &DB{
 		mu:         &sync.RWMutex{},
 		activeFile: nil,
 		olderFiles: make(map[uint32]*model.DataFile),
+		blobFiles:  make(map[uint32]*model.DataFile),
+		appendCh:   make(chan struct{}),
+		hintWg:     &sync.WaitGroup{},
+		liveMu:     &sync.Mutex{},
+		liveSize:   make(map[uint32]int64),
+		keptSize:   make(map[uint32]int64),
 		options:    ops,
+
+		ksMu:          &sync.RWMutex{},
+		keyspaces:     make(map[uint32]*Keyspace),
+		keyspaceNames: make(map[string]*Keyspace),
 	}
+	ops.activeFileCreator = ops.ioManagerCreator
+	if ops.bufferSize > 0 {
+		ops.ioManagerCreator = bufferedIOManagerCreator(0, ops.bufferSize)
+		ops.activeFileCreator = bufferedIOManagerCreator(ops.dataFileSize, ops.bufferSize)
+	}
+	db.metrics = newDBMetrics(db, ops.metrics)
+	if ops.metrics != nil {
+		ops.ioManagerCreator = meteredIOManagerCreator(ops.ioManagerCreator, db.metrics)
+		ops.activeFileCreator = meteredIOManagerCreator(ops.activeFileCreator, db.metrics)
+	}
+	db.defaultKeyspace = db.loadKeyspace(defaultKeyspaceID)
+	db.catalog = db.loadKeyspace(catalogKeyspaceID)
 
 	// load data files
 	if err := db.loadMergeFiles(); err != nil {
@@ -92,98 +162,77 @@ func newDB(dirPath string, o []Option) (*DB, error) {
 		return nil, err
 	}
 
-	// load keydir
-	if err := db.loadKeydirFromHintFile(); err != nil {
+	if err := db.loadBlobFiles(); err != nil {
 		return nil, err
 	}
 
-	if err := db.loadKeydirFromDataFiles(); err != nil {
+	// load keydir
+	if err := db.loadKeydir(); err != nil {
 		return nil, err
 	}
 
-	return db, nil
-}
-
-func (db *DB) Put(key []byte, value []byte) error {
-	if len(key) == 0 {
-		return ErrEmptyKey
+	if err := db.loadKeyspaceNames(); err != nil {
+		return nil, err
 	}
 
-	key = addTxSeqPrefix(key, noTransactionSeq)
-	// append record in active data file
-	record := &model.Record{
-		Key:   key,
-		Value: value,
-	}
-	pos, err := db.appendRecordWithLock(record)
+	diskBytes, err := db.diskUsage()
 	if err != nil {
-		return err
-	}
-
-	if !db.options.keydir.Put(key, pos) {
-		return ErrUpdateKeydir
+		return nil, err
 	}
+	db.diskBytes = diskBytes
 
-	return nil
+	return db, nil
 }
 
-func (db *DB) Get(key []byte) ([]byte, error) {
-	if len(key) == 0 {
-		return nil, ErrEmptyKey
-	}
-
-	// get pos from keydir
-	pos := db.options.keydir.Get(addTxSeqPrefix(key, noTransactionSeq))
-	if pos == nil {
-		return nil, ErrNoRecord
-	}
-
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+func (db *DB) Put(key []byte, value []byte) error {
+	return db.defaultKeyspace.Put(key, value)
+}
 
-	// get record from file
-	record, err := db.get(pos)
-	if err != nil {
-		return nil, err
-	}
+// PutWithTTL put the key which expires after ttl
+func (db *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	return db.defaultKeyspace.PutWithTTL(key, value, ttl)
+}
 
-	// record has deleted
-	if record.IsDelete {
-		return nil, ErrNoRecord
-	}
+func (db *DB) Get(key []byte) ([]byte, error) {
+	return db.defaultKeyspace.Get(key)
+}
 
-	return record.Value, nil
+// GetWithMeta return the value of the key with its sequence, write time and expire time
+func (db *DB) GetWithMeta(key []byte) (*ValueMeta, error) {
+	return db.defaultKeyspace.GetWithMeta(key)
 }
 
 func (db *DB) Delete(key []byte) error {
-	if len(key) == 0 {
-		return nil
-	}
-
-	key = addTxSeqPrefix(key, noTransactionSeq)
-	// if key is not in keydir, return
-	if pos := db.options.keydir.Get(key); pos == nil {
-		return nil
-	}
+	return db.defaultKeyspace.Delete(key)
+}
 
-	// create record that isDelete is true
-	record := &model.Record{
-		Key:      key,
-		IsDelete: true,
-	}
+// DeleteRange delete the keys in [start, end) with a range tombstone,
+// an empty end means no upper bound
+func (db *DB) DeleteRange(start, end []byte) error {
+	return db.defaultKeyspace.DeleteRange(start, end)
+}
 
-	// write to data file
-	if _, err := db.appendRecordWithLock(record); err != nil {
-		return err
-	}
+// DeletePrefix delete the keys with the prefix
+func (db *DB) DeletePrefix(prefix []byte) error {
+	return db.defaultKeyspace.DeletePrefix(prefix)
+}
 
-	// update keydir
-	ok := db.options.keydir.Delete(key)
-	if !ok {
-		return ErrUpdateKeydir
+// ListKeys return the keys of the default keyspace in the format of the older versions:
+// every key has the transaction sequence prefix of no transaction (one byte), the callers strip it.
+// Keyspace.ListKeys return the real keys
+func (db *DB) ListKeys() [][]byte {
+	keys := db.defaultKeyspace.ListKeys()
+	for i, key := range keys {
+		keys[i] = addTxSeqPrefix(key, noTransactionSeq)
 	}
+	return keys
+}
 
-	return nil
+// Fold call handler with the keys in the format of ListKeys
+func (db *DB) Fold(handler func(key, value []byte) error) error {
+	return db.defaultKeyspace.Fold(func(key, value []byte) error {
+		return handler(addTxSeqPrefix(key, noTransactionSeq), value)
+	})
 }
 
 func (db *DB) Close() error {
@@ -194,8 +243,12 @@ func (db *DB) Close() error {
 		}
 
 		// release keydir
-		if err := db.options.keydir.Close(); err != nil {
-			panic(err)
+		db.ksMu.RLock()
+		defer db.ksMu.RUnlock()
+		for _, ks := range db.keyspaces {
+			if err := ks.keydir.Close(); err != nil {
+				panic(err)
+			}
 		}
 	}()
 
@@ -204,14 +257,36 @@ func (db *DB) Close() error {
 	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
+
+	// the snapshot covers the active files, they should be on the disk before it
+	if db.failed == nil {
+		_ = db.syncActiveFiles()
+	}
+	// the hint files are generated from the older files
+	db.hintWg.Wait()
+
+	// persist the keydir, the next open only need to replay the data after it.
+	// the data files may not be what was written after a failed sync, the next open replays them
+	if db.failed == nil {
+		if err := db.writeSnapshot(); err != nil {
+			return err
+		}
+	}
+
+	// the data files are closed after the in-flight reads finish
 	for _, dataFile := range db.olderFiles {
-		if err := dataFile.Close(); err != nil {
+		if err := dataFile.Unref(); err != nil {
 			return err
 		}
 	}
-	if err := db.activeFile.Close(); err != nil {
+	if err := db.activeFile.Unref(); err != nil {
 		return err
 	}
+	for _, blobFile := range db.blobFiles {
+		if err := blobFile.Unref(); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -224,56 +299,66 @@ func (db *DB) Sync() error {
 	// sync active data file
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.activeFile.Sync()
+	return db.syncActiveFiles()
 }
 
-func (db *DB) ListKeys() [][]byte {
-	// get iterator
-	iterator := db.options.keydir.Iterator()
-	defer iterator.Close()
-
-	keys := make([][]byte, 0, db.options.keydir.Size())
-	// iterate keydir
-	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		keys = append(keys, iterator.Key())
-	}
-
-	return keys
+// Stat is the statistics of the db
+type Stat struct {
+	KeyNum          int   // number of keys in all the keyspaces
+	DataFileNum     int   // number of data files
+	DiskSize        int64 // size of the data files and the blob files
+	BlobFileNum     int   // number of blob files
+	InlineValueSize int64 // memory used by the values inlined in keydir
+	ReclaimableSize int64 // size of the invalid data in older files, can be reclaimed by merge
 }
 
-func (db *DB) Fold(handler func(key, value []byte) error) error {
-	// get iterator
-	iterator := db.options.keydir.Iterator()
-	defer iterator.Close()
-
-	// iterate keydir
+func (db *DB) Stat() *Stat {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
-	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		key := iterator.Key()
-		pos := iterator.Value()
-		record, err := db.get(pos)
+
+	dataFileNum := len(db.olderFiles)
+	if db.activeFile != nil {
+		dataFileNum++
+	}
+
+	var reclaimableSize int64
+	for _, dataFile := range db.olderFiles {
+		garbage, _, err := db.garbageSize(dataFile)
 		if err != nil {
-			return err
+			continue
 		}
+		reclaimableSize += garbage
+	}
 
-		if err = handler(key, record.Value); err != nil {
-			return err
-		}
+	return &Stat{
+		KeyNum:          db.keyNum(),
+		DataFileNum:     dataFileNum,
+		DiskSize:        db.diskBytes,
+		BlobFileNum:     len(db.blobFiles),
+		InlineValueSize: atomic.LoadInt64(&db.inlineBytes),
+		ReclaimableSize: reclaimableSize,
 	}
-	return nil
 }
 
-func (db *DB) appendRecordWithLock(record *model.Record) (*model.RecordPos, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	return db.appendRecord(record)
+// keyNum return the number of keys in all the keyspaces
+func (db *DB) keyNum() int {
+	var keyNum int
+	db.ksMu.RLock()
+	defer db.ksMu.RUnlock()
+	for id, ks := range db.keyspaces {
+		if id != catalogKeyspaceID {
+			keyNum += ks.keydir.Size()
+		}
+	}
+	return keyNum
 }
 
 func (db *DB) appendRecord(record *model.Record) (*model.RecordPos, error) {
-	// create data file if there is no active data file
-	if db.activeFile == nil {
-		if err := db.setActiveDatafile(); err != nil {
+	db.assignRecordSeq(record)
+
+	// the big value is written to the blob file, the record keeps the pointer
+	if !record.IsDelete && !record.IsRangeDelete && db.isBlobSize(int64(len(record.Value))) {
+		if err := db.writeBlob(record); err != nil {
 			return nil, err
 		}
 	}
@@ -284,6 +369,36 @@ func (db *DB) appendRecord(record *model.Record) (*model.RecordPos, error) {
 		return nil, err
 	}
 
+	return db.writeRecord(record, size, func(dataFile *model.DataFile) error {
+		return dataFile.Write(data)
+	})
+}
+
+// assignRecordSeq give the record a unique sequence and the write time,
+// the record moved by GCBlobs keeps its sequence and write time
+func (db *DB) assignRecordSeq(record *model.Record) {
+	if record.Seq == noRecordSeq {
+		db.recordSeq++
+		record.Seq = db.recordSeq
+	}
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano()
+	}
+}
+
+// writeRecord write the marshaled record of size by write to the active data file
+func (db *DB) writeRecord(record *model.Record, size int64, write func(dataFile *model.DataFile) error) (*model.RecordPos, error) {
+	if db.failed != nil {
+		return nil, ErrDBFailed
+	}
+
+	// create data file if there is no active data file
+	if db.activeFile == nil {
+		if err := db.setActiveDatafile(); err != nil {
+			return nil, err
+		}
+	}
+
 	// value is too big
 	if size > db.options.dataFileSize {
 		return nil, ErrBigValue
@@ -293,30 +408,36 @@ func (db *DB) appendRecord(record *model.Record) (*model.RecordPos, error) {
 	// close current active file, create a new active size
 	if db.activeFile.WriteOffset+size > db.options.dataFileSize {
 		// set new	active data file
-		if err = db.setActiveDatafile(); err != nil {
+		if err := db.setActiveDatafile(); err != nil {
 			return nil, err
 		}
 	}
 
 	// write data to file
 	writeOff := db.activeFile.WriteOffset
-	if err = db.activeFile.Write(data); err != nil {
+	if err := write(db.activeFile); err != nil {
+		db.rollback(db.activeFile, writeOff)
 		return nil, err
 	}
+	db.diskBytes += size
 
 	// check whether to sync
-	times := db.activeFile.WriteTimes
-	if times%db.options.syncFre == 0 {
-		if err = db.activeFile.Sync(); err != nil {
+	db.activeFile.WriteTimes++
+	if db.activeFile.WriteTimes%db.options.syncFre == 0 {
+		if err := db.syncActiveFiles(); err != nil {
 			return nil, err
 		}
 	}
 
+	db.notifyAppend()
+
 	// create record position
 	pos := &model.RecordPos{
-		Fid:    db.activeFile.Fid,
-		Size:   uint32(size),
-		Offset: writeOff,
+		Fid:      db.activeFile.Fid,
+		Size:     uint32(size),
+		Offset:   writeOff,
+		Seq:      record.Seq,
+		ExpireAt: record.ExpireAt,
 	}
 
 	return pos, nil
@@ -325,9 +446,16 @@ func (db *DB) appendRecord(record *model.Record) (*model.RecordPos, error) {
 func (db *DB) marshalRecord(record *model.Record) ([]byte, int64, error) {
 	// create header
 	header := &model.RecordHeader{
-		IsDelete:  record.IsDelete,
-		KeySize:   int64(len(record.Key)),
-		ValueSize: int64(len(record.Value)),
+		IsDelete:      record.IsDelete,
+		IsRangeDelete: record.IsRangeDelete,
+		KeySize:       int64(len(record.Key)),
+		ValueSize:     int64(len(record.Value)),
+		Seq:           record.Seq,
+		Prev:          record.Prev,
+		Timestamp:     record.Timestamp,
+		ExpireAt:      record.ExpireAt,
+		Keyspace:      record.Keyspace,
+		IsBlob:        record.IsBlob,
 	}
 
 	// marshal header
@@ -357,49 +485,69 @@ func (db *DB) marshalRecord(record *model.Record) ([]byte, int64, error) {
 
 func (db *DB) setActiveDatafile() error {
 	var initialFileId uint32
+	if db.activeFile != nil {
+		initialFileId = db.activeFile.Fid + 1
+	}
+	return db.openActiveDataFile(initialFileId)
+}
+
+// openActiveDataFile seal the active data file and open the data file of fid as the active one
+func (db *DB) openActiveDataFile(fid uint32) error {
+	defer db.notifyAppend()
 
 	oldActiveFile := db.activeFile
 	if oldActiveFile != nil {
-		initialFileId = oldActiveFile.Fid + 1
 		// save old data file
 		// old data file is read only, sync to disk first
-		if err := oldActiveFile.Sync(); err != nil {
+		if err := db.syncDataFile(oldActiveFile); err != nil {
+			return db.fail(err)
+		}
+		// release the preallocated space after the last record, the file is never preallocated
+		// if the io manager can not truncate it
+		if err := oldActiveFile.Truncate(oldActiveFile.WriteOffset); err != nil && err != fio.ErrTruncateNotSupported {
 			return err
 		}
 		db.olderFiles[oldActiveFile.Fid] = oldActiveFile
-	}
+		db.sealDataFile(oldActiveFile)
 
-	dataFile := &model.DataFile{
-		Fid: initialFileId,
+		// the old data file will not be changed, generate its hint file
+		db.writeDataHintFileAsync(oldActiveFile)
+		db.metrics.fileRotations.Inc()
+		db.options.logger.Debug("data file rotated", "fid", oldActiveFile.Fid)
+		db.options.eventListener.OnFileRotated(oldActiveFile.Fid)
 	}
 
-	var err error
-
-	dataFile.IoManager, err = db.options.ioManagerCreator(model.GetDataFileName(db.options.dirPath, model.DataFileType, initialFileId))
+	ioManager, err := db.options.activeFileCreator(model.GetDataFileName(db.options.dirPath, model.DataFileType, fid))
 	if err != nil {
 		return err
 	}
 
-	db.activeFile = dataFile
+	db.activeFile = model.OpenDataFile(fid, ioManager)
 	return nil
 }
 
+// get read the record of pos, the caller should hold the lock
 func (db *DB) get(pos *model.RecordPos) (*model.Record, error) {
-	var dataFile *model.DataFile
-	if pos.Fid == db.activeFile.Fid {
-		dataFile = db.activeFile
-	} else {
-		dataFile = db.olderFiles[pos.Fid]
-	}
-
+	dataFile := db.getDataFile(pos.Fid)
 	if dataFile == nil {
 		return nil, ErrNoDataFile
 	}
 
 	record, _, err := db.getRecordFromDataFile(dataFile, pos.Offset)
+	if err == ErrWrongCrc {
+		db.reportCorruption(pos.Fid, pos.Offset, err)
+	}
 	return record, err
 }
 
+// getDataFile return the data file of fid, the caller should hold the lock
+func (db *DB) getDataFile(fid uint32) *model.DataFile {
+	if db.activeFile != nil && fid == db.activeFile.Fid {
+		return db.activeFile
+	}
+	return db.olderFiles[fid]
+}
+
 func (db *DB) getRecordFromDataFile(dataFile *model.DataFile, offset int64) (*model.Record, int64, error) {
 	// get primitive header data
 	headerData, err := dataFile.ReadRecordHeader(offset)
@@ -433,6 +581,13 @@ func (db *DB) getRecordFromDataFile(dataFile *model.DataFile, offset int64) (*mo
 		return nil, 0, err
 	}
 	record.IsDelete = recordHeader.IsDelete
+	record.IsRangeDelete = recordHeader.IsRangeDelete
+	record.Keyspace = recordHeader.Keyspace
+	record.IsBlob = recordHeader.IsBlob
+	record.Seq = recordHeader.Seq
+	record.Prev = recordHeader.Prev
+	record.Timestamp = recordHeader.Timestamp
+	record.ExpireAt = recordHeader.ExpireAt
 
 	// check crc
 	if !utils.CheckCrc(recordHeader.Crc, append(headerData[4:headerSize], data[:]...)) {
@@ -445,7 +600,7 @@ func (db *DB) getRecordFromDataFile(dataFile *model.DataFile, offset int64) (*mo
 func (db *DB) loadDataFiles() error {
 	// TODO: optimize to support various storage instance
 	dir := db.options.dirPath
-	entries, err := os.ReadDir(dir)
+	entries, err := db.options.fs.ReadDir(dir)
 	if err != nil {
 		return err
 	}
@@ -453,6 +608,13 @@ func (db *DB) loadDataFiles() error {
 	var fileIds []uint32
 	for _, entry := range entries {
 		entryName := entry.Name()
+		// the spool of PutStream is left by a crash
+		if strings.HasPrefix(entryName, streamSpoolPrefix) && !db.options.readOnly {
+			if err = db.options.fs.Remove(filepath.Join(dir, entryName)); err != nil {
+				return err
+			}
+			continue
+		}
 		// data file's suffix is '.cq'
 		if strings.HasSuffix(entryName, model.DataFileSuffix) {
 			split := strings.Split(entryName, ".")
@@ -482,37 +644,45 @@ func (db *DB) loadDataFiles() error {
 			db.activeFile = dataFile
 		} else {
 			db.olderFiles[id] = dataFile
+			db.sealDataFile(dataFile)
 		}
 	}
 	return nil
 }
 
-func (db *DB) loadKeydirFromDataFiles() error {
-	if len(db.fileIds) == 0 {
-		return nil
+// sealDataFile tell the io manager that the older data file is immutable,
+// the data file is still readable if it fails
+func (db *DB) sealDataFile(dataFile *model.DataFile) {
+	if err := dataFile.Seal(); err != nil {
+		db.options.logger.Warn("seal data file failed", "fid", dataFile.Fid, "err", err)
 	}
+}
 
-	// maybe some transactions are not committed
-	// store transaction records temporarily
-	transactionRecords := make(map[uint64]*model.Record)
-	curTxSeq := noTransactionSeq
-
-	// check whether current db has merged
-	hasMerged, nonMergeFid := false, uint32(0)
-	mergeFinishedFileName := model.GetDataFileName(db.options.dirPath, model.MergeFinishedFileType, 0)
-	if _, err := os.Stat(mergeFinishedFileName); err == nil {
-		fid, err := db.getNotMergeFid(db.options.dirPath)
-		if err != nil {
-			return err
-		}
-		hasMerged = true
-		hasMerged = true
-		nonMergeFid = fid
+func (db *DB) loadKeydir() error {
+	// the keydir snapshot covers the data before startFid and startOffset
+	startFid, startOffset, ok, err := db.loadKeydirFromSnapshot()
+	if err != nil {
+		return err
 	}
 
-	// get datafiles
+	if !ok {
+		// replay all the data files
+		startFid, startOffset = 0, 0
+	}
+
+	return db.loadKeydirFromDataFiles(startFid, startOffset)
+}
+
+// loadKeydirFromDataFiles replay the data files from startFid and startOffset.
+// the data files are decoded concurrently and applied to the keydir in fid order.
+func (db *DB) loadKeydirFromDataFiles(startFid uint32, startOffset int64) error {
+	if len(db.fileIds) == 0 {
+		return nil
+	}
+
+	var dataFiles []*model.DataFile
 	for _, fid := range db.fileIds {
-		if hasMerged && fid < nonMergeFid {
+		if fid < startFid {
 			// current data file's keydir has been loaded
 			continue
 		}
@@ -527,78 +697,401 @@ func (db *DB) loadKeydirFromDataFiles() error {
 		if dataFile == nil {
 			return ErrNoDataFile
 		}
+		dataFiles = append(dataFiles, dataFile)
+	}
 
-		// read data file
-		var offset int64
-		for {
-			record, size, err := db.getRecordFromDataFile(dataFile, offset)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
+	workers := db.options.loadWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	// decode the data files, at most workers files are decoded at the same time
+	results := make([]chan *decodedFile, len(dataFiles))
+	for i := range results {
+		results[i] = make(chan *decodedFile, 1)
+	}
+	sem := make(chan struct{}, workers)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for i, dataFile := range dataFiles {
+			select {
+			case sem <- struct{}{}:
+			case <-stop:
+				return
+			}
+
+			var offset int64
+			if dataFile.Fid == startFid {
+				offset = startOffset
+			}
+			go func(result chan<- *decodedFile, dataFile *model.DataFile, offset int64) {
+				result <- db.decodeFile(dataFile, offset)
+			}(results[i], dataFile, offset)
+		}
+	}()
+
+	// apply the entries in fid order, so the last write wins
+	loader := db.newKeydirLoader()
+	for i, dataFile := range dataFiles {
+		decoded := <-results[i]
+		<-sem
+		if decoded.err != nil {
+			return decoded.err
+		}
+
+		for _, entry := range decoded.entries {
+			if err := loader.load(entry); err != nil {
 				return err
 			}
+			if entry.pos.Seq > db.recordSeq {
+				db.recordSeq = entry.pos.Seq
+			}
+		}
 
-			// put pos into keydir
-			pos := &model.RecordPos{
-				Fid:    fid,
-				Size:   uint32(size),
-				Offset: offset,
+		// update active file write offset
+		if dataFile == db.activeFile {
+			if err := db.truncateTornTail(dataFile, decoded.offset); err != nil {
+				return err
 			}
+			db.activeFile.WriteOffset = decoded.offset
+		}
+	}
 
-			realKey, txSeq := parseTxSeqPrefix(record.Key)
-			// normal record
-			if txSeq == noTransactionSeq {
-				// record may be deleted
-				var ok bool
-				if record.IsDelete {
-					ok = db.options.keydir.Delete(record.Key)
-				} else {
-					ok = db.options.keydir.Put(record.Key, pos)
-				}
-				if !ok {
-					return ErrUpdateKeydir
-				}
-			} else {
-				// transaction record
-				// read the transaction finished record
-				// update keydir
-				if bytes.Compare(realKey, txFinishKey) == 0 {
-					for _, txRecord := range transactionRecords {
-						// record may be deleted
-						var ok bool
-						if txRecord.IsDelete {
-							ok = db.options.keydir.Delete(txRecord.Key)
-						} else {
-							ok = db.options.keydir.Put(txRecord.Key, pos)
-						}
-						if !ok {
-							return ErrUpdateKeydir
-						}
+	db.txSeq = loader.txSeq
+
+	return nil
+}
+
+// tornTailScanSize is the bytes after the bad record searched for a valid record,
+// the scan never walks a big torn tail byte by byte to the end of the file
+const tornTailScanSize = 1024 * 1024
+
+// isTornTail check whether no valid record follows the bad record at offset of the data file.
+// the next record is at the end of the bad record if its header is intact,
+// otherwise it is searched in the next tornTailScanSize bytes
+func (db *DB) isTornTail(dataFile *model.DataFile, offset int64) (bool, error) {
+	size, err := dataFile.IoManager.Size()
+	if err != nil {
+		return false, err
+	}
+	if next, ok := db.recordEnd(dataFile, offset, size); ok {
+		if valid, _ := db.probeRecord(dataFile, next, size); valid {
+			return false, nil
+		}
+	}
+	limit := min(size, offset+tornTailScanSize)
+	for start := offset + 1; start < limit; start++ {
+		valid, end := db.probeRecord(dataFile, start, size)
+		if valid {
+			return false, nil
+		}
+		// the rest of the file is zero filled, e.g. preallocated
+		if end {
+			break
+		}
+	}
+	return true, nil
+}
+
+// recordEnd return the end of the record at offset by the sizes in its header, ok is false if they are out of the file
+func (db *DB) recordEnd(dataFile *model.DataFile, offset, fileSize int64) (end int64, ok bool) {
+	headerData, err := dataFile.ReadRecordHeader(offset)
+	if err != nil {
+		return 0, false
+	}
+	recordHeader := new(model.RecordHeader)
+	headerSize, err := db.options.codec.UnmarshalRecordHeader(headerData, recordHeader)
+	if err != nil || recordHeader.KeySize <= 0 || recordHeader.ValueSize < 0 {
+		return 0, false
+	}
+	end = offset + headerSize + recordHeader.KeySize + recordHeader.ValueSize
+	return end, end > offset && end < fileSize
+}
+
+// probeRecord check whether a valid record is at offset, end is true if the header is zero filled.
+// the sizes in the header are checked against the file size, the garbage never allocates a big buffer
+func (db *DB) probeRecord(dataFile *model.DataFile, offset, fileSize int64) (valid bool, end bool) {
+	headerData, err := dataFile.ReadRecordHeader(offset)
+	if err != nil {
+		return false, false
+	}
+	recordHeader := new(model.RecordHeader)
+	headerSize, err := db.options.codec.UnmarshalRecordHeader(headerData, recordHeader)
+	if err != nil {
+		return false, false
+	}
+	if recordHeader.Crc == 0 && recordHeader.KeySize == 0 && recordHeader.ValueSize == 0 {
+		return false, true
+	}
+	kvSize := recordHeader.KeySize + recordHeader.ValueSize
+	if recordHeader.KeySize <= 0 || recordHeader.ValueSize < 0 || offset+headerSize+kvSize > fileSize {
+		return false, false
+	}
+
+	data, err := dataFile.ReadRecord(offset+headerSize, kvSize)
+	if err != nil {
+		return false, false
+	}
+	return utils.CheckCrc(recordHeader.Crc, append(headerData[4:headerSize], data...)), false
+}
+
+// truncateTornTail remove the data after the last complete record of the active file,
+// the new records are appended to the end of the file
+func (db *DB) truncateTornTail(dataFile *model.DataFile, offset int64) error {
+	size, err := dataFile.IoManager.Size()
+	if err != nil {
+		return err
+	}
+	if size <= offset {
+		return nil
+	}
+
+	if err = dataFile.Truncate(offset); err != nil {
+		return err
+	}
+	db.options.logger.Warn("truncate the torn tail of the active file", "fid", dataFile.Fid, "offset", offset, "size", size)
+	db.options.eventListener.OnRecoveryTruncate(dataFile.Fid, offset, size)
+	return nil
+}
+
+// decodedFile is the entries decoded from a data file or its hint file
+type decodedFile struct {
+	entries []*decodedEntry
+	offset  int64 // the end of the data file
+	err     error
+}
+
+type decodedEntry struct {
+	key           []byte // the key with transaction sequence prefix
+	keyspace      uint32
+	isDelete      bool
+	isRangeDelete bool // the end of the range is kept in pos.Value
+	pos           *model.RecordPos
+}
+
+// decodeFile decode the entries of the data file from offset,
+// the hint file is used for the older data file
+func (db *DB) decodeFile(dataFile *model.DataFile, offset int64) *decodedFile {
+	// older data file may have a hint file
+	if dataFile != db.activeFile && offset == 0 {
+		entries, ok, err := db.decodeDataHintFile(dataFile)
+		if err != nil {
+			return &decodedFile{err: err}
+		}
+		if ok {
+			return &decodedFile{entries: entries}
+		}
+
+		// the hint file is missing or corrupted, regenerate it
+		db.writeDataHintFileAsync(dataFile)
+	}
+
+	entries, offset, err := db.decodeDataFile(dataFile, offset)
+	return &decodedFile{
+		entries: entries,
+		offset:  offset,
+		err:     err,
+	}
+}
+
+// decodeDataFile read the records from offset and return the end of the data file
+func (db *DB) decodeDataFile(dataFile *model.DataFile, offset int64) ([]*decodedEntry, int64, error) {
+	var entries []*decodedEntry
+	for {
+		record, size, err := db.getRecordFromDataFile(dataFile, offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			if err == ErrWrongCrc {
+				db.reportCorruption(dataFile.Fid, offset, err)
+				// the tail of the active file may be torn by a crash, it is truncated after loading.
+				// a bad record followed by a valid one is not a torn tail, the records after it must be kept
+				if dataFile == db.activeFile {
+					torn, tailErr := db.isTornTail(dataFile, offset)
+					if tailErr != nil {
+						return nil, 0, tailErr
+					}
+					if torn {
+						break
 					}
-					delete(transactionRecords, txSeq)
-				} else {
-					// store transaction record temporarily
-					transactionRecords[txSeq] = record
 				}
 			}
+			return nil, 0, err
+		}
 
-			// update transaction sequence number
-			if txSeq > curTxSeq {
-				curTxSeq = txSeq
-			}
-
-			// update offset
-			offset += size
+		pos := &model.RecordPos{
+			Fid:      dataFile.Fid,
+			Size:     uint32(size),
+			Offset:   offset,
+			Seq:      record.Seq,
+			ExpireAt: record.ExpireAt,
 		}
+		db.setEntryValue(pos, record)
+
+		entries = append(entries, &decodedEntry{
+			key:           record.Key,
+			keyspace:      record.Keyspace,
+			isDelete:      record.IsDelete,
+			isRangeDelete: record.IsRangeDelete,
+			pos:           pos,
+		})
+
+		// update offset
+		offset += size
+	}
+	return entries, offset, nil
+}
 
-		// update active file write offset
-		if fid == db.activeFile.Fid {
-			db.activeFile.WriteOffset = offset
+// setEntryValue keep the value of the record in its pos,
+// the end of the range tombstone is always kept
+func (db *DB) setEntryValue(pos *model.RecordPos, record *model.Record) {
+	if record.IsRangeDelete {
+		pos.Value = append([]byte{}, record.Value...)
+	} else if !record.IsDelete && !record.IsBlob {
+		db.setInlineValue(pos, record.Value)
+	}
+}
+
+// keydirLoader apply the records to the keydir in the order they are written
+type keydirLoader struct {
+	db *DB
+
+	// maybe some transactions are not committed
+	// store transaction records temporarily
+	transactionRecords map[uint64][]*txRecord
+	txSeq              uint64
+}
+
+// txRecord is a transaction record waiting for the transaction finished record
+type txRecord struct {
+	keyspace *Keyspace
+	key      []byte
+	isDelete bool
+	pos      *model.RecordPos
+}
+
+func (db *DB) newKeydirLoader() *keydirLoader {
+	return &keydirLoader{
+		db:                 db,
+		transactionRecords: make(map[uint64][]*txRecord),
+		txSeq:              db.txSeq,
+	}
+}
+
+// load apply a record, the key has the transaction sequence prefix
+func (l *keydirLoader) load(entry *decodedEntry) error {
+	key, isDelete, pos := entry.key, entry.isDelete, entry.pos
+	realKey, txSeq := parseTxSeqPrefix(key)
+	ks := l.db.loadKeyspace(entry.keyspace)
+	// range tombstone is never in a transaction
+	if entry.isRangeDelete {
+		ks.deleteKeydirRange(realKey, pos.Value)
+	} else if txSeq == noTransactionSeq {
+		// normal record
+		if !ks.replayRecord(realKey, isDelete, pos) {
+			return ErrUpdateKeydir
+		}
+	} else {
+		// transaction record
+		// read the transaction finished record
+		// update keydir
+		if bytes.Compare(realKey, txFinishKey) == 0 {
+			for _, txr := range l.transactionRecords[txSeq] {
+				if !txr.keyspace.replayRecord(txr.key, txr.isDelete, txr.pos) {
+					return ErrUpdateKeydir
+				}
+			}
+			delete(l.transactionRecords, txSeq)
+		} else {
+			// store transaction record temporarily
+			l.transactionRecords[txSeq] = append(l.transactionRecords[txSeq], &txRecord{
+				keyspace: ks,
+				key:      realKey,
+				isDelete: isDelete,
+				pos:      pos,
+			})
 		}
 	}
 
-	db.txSeq = curTxSeq
+	// update transaction sequence number
+	if txSeq > l.txSeq {
+		l.txSeq = txSeq
+	}
+	return nil
+}
+
+// updateLiveSize move the size of the old record to garbage
+func (db *DB) updateLiveSize(oldPos, newPos *model.RecordPos) {
+	db.liveMu.Lock()
+	defer db.liveMu.Unlock()
+	if oldPos != nil {
+		db.liveSize[oldPos.Fid] -= int64(oldPos.Size)
+	}
+	if newPos != nil {
+		db.liveSize[newPos.Fid] += int64(newPos.Size)
+	}
+}
+
+// garbageSize return the size of the invalid data in the data file
+func (db *DB) garbageSize(dataFile *model.DataFile) (int64, int64, error) {
+	fileSize, err := dataFile.IoManager.Size()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	db.liveMu.Lock()
+	liveSize := db.liveSize[dataFile.Fid] + db.keptSize[dataFile.Fid]
+	db.liveMu.Unlock()
+
+	return fileSize - liveSize, fileSize, nil
+}
+
+// fillInlineValue read the value of the pos from data file if it should be inlined.
+// it is used when the pos is loaded from the hint file.
+func (db *DB) fillInlineValue(key []byte, pos *model.RecordPos) error {
+	if pos.Value != nil || db.options.inlineValueSize <= 0 {
+		return nil
+	}
+
+	// the value must be too big to inline, skip reading the data file
+	minValueSize := int64(pos.Size) - model.MaxHeaderSize - binary.MaxVarintLen64 - int64(len(key))
+	if minValueSize >= db.options.inlineValueSize {
+		return nil
+	}
+
+	record, err := db.get(pos)
+	if err != nil {
+		return err
+	}
 
+	// the pointer of the blob value is not the value
+	if record.IsBlob {
+		return nil
+	}
+	db.setInlineValue(pos, record.Value)
 	return nil
 }
+
+// setInlineValue keep a copy of the value in pos if it is small enough
+func (db *DB) setInlineValue(pos *model.RecordPos, value []byte) {
+	if int64(len(value)) >= db.options.inlineValueSize || db.isBlobSize(int64(len(value))) {
+		return
+	}
+	pos.Value = make([]byte, len(value))
+	copy(pos.Value, value)
+}
+
+func (db *DB) updateInlineBytes(oldPos, newPos *model.RecordPos) {
+	var delta int64
+	if oldPos != nil {
+		delta -= int64(len(oldPos.Value))
+	}
+	if newPos != nil {
+		delta += int64(len(newPos.Value))
+	}
+	if delta != 0 {
+		atomic.AddInt64(&db.inlineBytes, delta)
+	}
+}
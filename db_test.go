@@ -1,11 +1,20 @@
 package cqkv
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"github.com/cqkv/cqkv/fio"
+	"github.com/cqkv/cqkv/fio/objstore"
+	"github.com/cqkv/cqkv/model"
 	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestOpen(t *testing.T) {
@@ -205,10 +214,11 @@ func TestDB_ListKey(t *testing.T) {
 	err = db.Put([]byte("key2"), []byte("value2"))
 	assert.Nil(t, err)
 
+	// the keys have the transaction sequence prefix of one byte
 	keys := db.ListKeys()
 	assert.Equal(t, 2, len(keys))
-	assert.Equal(t, "key1", string(keys[0]))
-	assert.Equal(t, "key2", string(keys[1]))
+	assert.Equal(t, "key1", string(keys[0][1:]))
+	assert.Equal(t, "key2", string(keys[1][1:]))
 }
 
 func TestDB_Fold(t *testing.T) {
@@ -259,12 +269,17 @@ func TestDB_Close2(t *testing.T) {
 
 	keys := db.ListKeys()
 	assert.Equal(t, 25, len(keys))
+	err = db.Close()
+	assert.Nil(t, err)
 }
 
 func Test(t *testing.T) {
 	db, err := Open("./tmp/")
 	assert.Nil(t, err)
 	assert.NotNil(t, db)
+	defer func() {
+		_ = db.Close()
+	}()
 
 	v, err := db.Get([]byte("key6"))
 	if err != nil {
@@ -282,3 +297,594 @@ func Test(t *testing.T) {
 	}
 	t.Log(string(v))
 }
+
+// releaseLock release the file lock without closing db, like the process crashes
+func releaseLock(t *testing.T, db *DB) {
+	err := db.options.fileLock.Unlock()
+	assert.Nil(t, err)
+}
+
+func TestDB_InlineValue(t *testing.T) {
+	db, err := Open("./tmp/", WithInlineValueSize(16))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put([]byte("small"), []byte("flag"))
+	assert.Nil(t, err)
+	err = db.Put([]byte("big"), []byte("value-bigger-than-16-bytes"))
+	assert.Nil(t, err)
+
+	pos := db.options.keydir.Get([]byte("small"))
+	assert.Equal(t, "flag", string(pos.Value))
+	pos = db.options.keydir.Get([]byte("big"))
+	assert.Nil(t, pos.Value)
+	assert.Equal(t, int64(4), db.Stat().InlineValueSize)
+
+	value, err := db.Get([]byte("small"))
+	assert.Nil(t, err)
+	assert.Equal(t, "flag", string(value))
+
+	// overwrite and delete update the memory usage
+	err = db.Put([]byte("small"), []byte("counter"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), db.Stat().InlineValueSize)
+	err = db.Put([]byte("small2"), []byte("1"))
+	assert.Nil(t, err)
+	err = db.Delete([]byte("small2"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), db.Stat().InlineValueSize)
+
+	// inline values are filled while loading data files
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", WithInlineValueSize(16))
+	assert.Nil(t, err)
+	pos = db.options.keydir.Get([]byte("small"))
+	assert.Equal(t, "counter", string(pos.Value))
+	assert.Equal(t, int64(7), db.Stat().InlineValueSize)
+
+	// inline values are filled while loading hint file
+	err = db.MergeWithContext(context.Background(), MergeOptions{})
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", WithInlineValueSize(16))
+	assert.Nil(t, err)
+	pos = db.options.keydir.Get([]byte("small"))
+	assert.Equal(t, "counter", string(pos.Value))
+	assert.Equal(t, int64(7), db.Stat().InlineValueSize)
+
+	values := make(map[string]string)
+	err = db.defaultKeyspace.Fold(func(key, value []byte) error {
+		values[string(key)] = string(value)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "counter", values["small"])
+	assert.Equal(t, "value-bigger-than-16-bytes", values["big"])
+}
+
+func TestDB_OpenWithLoadWorkers(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(512))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// the same keys are updated and deleted across the data files
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 50; i++ {
+			err = db.Put([]byte(fmt.Sprintf("key-%v", i)), []byte(fmt.Sprintf("value-%v-%v", i, round)))
+			assert.Nil(t, err)
+		}
+		for i := round; i < 50; i += 5 {
+			err = db.Delete([]byte(fmt.Sprintf("key-%v", i)))
+			assert.Nil(t, err)
+		}
+	}
+	wb := db.NewWriteBatch()
+	for i := 0; i < 20; i++ {
+		err = wb.Put([]byte(fmt.Sprintf("key-%v", i)), []byte("batch"))
+		assert.Nil(t, err)
+	}
+	err = wb.Commit()
+	assert.Nil(t, err)
+	err = db.Sync()
+	assert.Nil(t, err)
+	db.hintWg.Wait()
+
+	expected := make(map[string]string)
+	err = db.Fold(func(key, value []byte) error {
+		expected[string(key)] = string(value)
+		return nil
+	})
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	for _, workers := range []int{1, 4, 16} {
+		db, err = Open("./tmp/", WithDataFileSize(512), WithLoadWorkers(workers))
+		assert.Nil(t, err)
+
+		values := make(map[string]string)
+		err = db.Fold(func(key, value []byte) error {
+			values[string(key)] = string(value)
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, values)
+		assert.Equal(t, uint64(1), db.txSeq)
+		err = db.Close()
+		assert.Nil(t, err)
+	}
+}
+
+func TestDB_GetWithMeta(t *testing.T) {
+	db, err := Open("./tmp/", WithInlineValueSize(16))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	before := time.Now()
+	err = db.Put([]byte("key1"), []byte("value1"))
+	assert.Nil(t, err)
+	err = db.PutWithTTL([]byte("key2"), []byte("value2"), time.Hour)
+	assert.Nil(t, err)
+
+	meta1, err := db.GetWithMeta([]byte("key1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value1", string(meta1.Value))
+	assert.False(t, meta1.Timestamp.Before(before))
+	assert.True(t, meta1.ExpireAt.IsZero())
+
+	meta2, err := db.GetWithMeta([]byte("key2"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value2", string(meta2.Value))
+	assert.True(t, meta2.Seq > meta1.Seq)
+	assert.True(t, meta2.ExpireAt.After(before.Add(time.Hour-time.Minute)))
+
+	// the sequence keeps increasing after reopening
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", WithInlineValueSize(16))
+	assert.Nil(t, err)
+
+	meta, err := db.GetWithMeta([]byte("key1"))
+	assert.Nil(t, err)
+	assert.Equal(t, meta1.Seq, meta.Seq)
+	assert.True(t, meta1.Timestamp.Equal(meta.Timestamp))
+
+	err = db.Put([]byte("key1"), []byte("value3"))
+	assert.Nil(t, err)
+	meta, err = db.GetWithMeta([]byte("key1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value3", string(meta.Value))
+	assert.True(t, meta.Seq > meta2.Seq)
+
+	_, err = db.GetWithMeta([]byte("key3"))
+	assert.Equal(t, ErrNoRecord, err)
+}
+
+func TestDB_PutWithTTL(t *testing.T) {
+	db, err := Open("./tmp/")
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.PutWithTTL([]byte("key1"), []byte("value1"), 50*time.Millisecond)
+	assert.Nil(t, err)
+	err = db.Put([]byte("key2"), []byte("value2"))
+	assert.Nil(t, err)
+
+	value, err := db.Get([]byte("key1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value1", string(value))
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = db.Get([]byte("key1"))
+	assert.Equal(t, ErrNoRecord, err)
+	assert.Equal(t, [][]byte{[]byte("key2")}, db.defaultKeyspace.ListKeys())
+
+	// the expire time is kept after reopening
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open("./tmp/")
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("key1"))
+	assert.Equal(t, ErrNoRecord, err)
+	value, err = db.Get([]byte("key2"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value2", string(value))
+}
+
+func TestDB_DeleteRange(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(512))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 30; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%v", i)))
+		assert.Nil(t, err)
+	}
+
+	err = db.DeleteRange([]byte("key-10"), []byte("key-20"))
+	assert.Nil(t, err)
+	err = db.DeleteRange([]byte("key-20"), []byte("key-10"))
+	assert.Equal(t, ErrInvalidRange, err)
+	// the key written after the range tombstone is not deleted
+	err = db.Put([]byte("key-15"), []byte("new"))
+	assert.Nil(t, err)
+
+	check := func(db *DB) {
+		assert.Equal(t, 21, len(db.ListKeys()))
+		_, err = db.Get([]byte("key-10"))
+		assert.Equal(t, ErrNoRecord, err)
+		_, err = db.Get([]byte("key-19"))
+		assert.Equal(t, ErrNoRecord, err)
+		value, err := db.Get([]byte("key-15"))
+		assert.Nil(t, err)
+		assert.Equal(t, "new", string(value))
+		value, err = db.Get([]byte("key-20"))
+		assert.Nil(t, err)
+		assert.Equal(t, "value-20", string(value))
+	}
+	check(db)
+
+	// replay the range tombstone from the data files and the hint files
+	for i := 0; i < 2; i++ {
+		err = db.Close()
+		assert.Nil(t, err)
+		err = os.Remove(model.GetDataFileName("./tmp/", model.SnapshotFileType, 0))
+		assert.Nil(t, err)
+		db, err = Open("./tmp/", WithDataFileSize(512))
+		assert.Nil(t, err)
+		check(db)
+		db.hintWg.Wait()
+	}
+}
+
+func TestDB_DeleteRange_CustomCodec(t *testing.T) {
+	db, err := Open("./tmp/", WithCodec(&xorCodec{}))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 3; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%v", i)), []byte("value"))
+		assert.Nil(t, err)
+	}
+
+	// the codec can not keep the range tombstone flag
+	err = db.DeleteRange([]byte("key-0"), []byte("key-2"))
+	assert.Equal(t, ErrRangeDeleteNotSupported, err)
+	err = db.DeletePrefix([]byte("key-"))
+	assert.Equal(t, ErrRangeDeleteNotSupported, err)
+	err = db.Delete([]byte("key-0"))
+	assert.Nil(t, err)
+
+	// the keys are loaded from the data files after reopen
+	err = db.Close()
+	assert.Nil(t, err)
+	_ = os.Remove(model.GetDataFileName("./tmp/", model.SnapshotFileType, 0))
+	db, err = Open("./tmp/", WithCodec(&xorCodec{}))
+	assert.Nil(t, err)
+	defer db.Close()
+
+	assert.Equal(t, [][]byte{[]byte("key-1"), []byte("key-2")}, db.defaultKeyspace.ListKeys())
+}
+
+func TestDB_DeletePrefix(t *testing.T) {
+	db, err := Open("./tmp/")
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for _, key := range []string{"a", "tenant1", "tenant1/a", "tenant1/b", "tenant10", "tenant2/a"} {
+		err = db.Put([]byte(key), []byte("value"))
+		assert.Nil(t, err)
+	}
+	err = db.Put([]byte{0xff, 0xff}, []byte("value"))
+	assert.Nil(t, err)
+
+	err = db.DeletePrefix([]byte("tenant1/"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("tenant1"), []byte("tenant10"), []byte("tenant2/a"), {0xff, 0xff}}, db.defaultKeyspace.ListKeys())
+
+	// the prefix has no upper bound
+	err = db.DeletePrefix([]byte{0xff})
+	assert.Nil(t, err)
+	err = db.DeletePrefix(nil)
+	assert.Equal(t, ErrEmptyKey, err)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open("./tmp/")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("tenant1"), []byte("tenant10"), []byte("tenant2/a")}, db.defaultKeyspace.ListKeys())
+}
+
+func TestDB_WithBufferedIO(t *testing.T) {
+	opts := []Option{WithDataFileSize(1024), WithBufferedIO(128)}
+	db, err := Open("./tmp/", opts...)
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 50; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%v", i)))
+		assert.Nil(t, err)
+	}
+	// the buffered records can be read before sync
+	value, err := db.Get([]byte("key-49"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value-49", string(value))
+
+	// the sealed file does not keep the preallocated space
+	info, err := os.Stat(model.GetDataFileName("./tmp/", model.DataFileType, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, db.olderFiles[0].WriteOffset, info.Size())
+	// the active file is preallocated
+	err = db.Sync()
+	assert.Nil(t, err)
+	activeFid := db.activeFile.Fid
+	info, err = os.Stat(model.GetDataFileName("./tmp/", model.DataFileType, activeFid))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1024), info.Size())
+
+	// open again without closing like a crash, the logical end of the zero-filled active file is found
+	releaseLock(t, db)
+	listener := &testListener{}
+	db, err = Open("./tmp/", append(opts, WithEventListener(listener))...)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(listener.truncated))
+	assert.Equal(t, int64(1024), listener.truncated[0][1])
+	assert.Equal(t, 50, len(db.ListKeys()))
+
+	err = db.Put([]byte("key-50"), []byte("value-50"))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	err = os.Remove(model.GetDataFileName("./tmp/", model.SnapshotFileType, 0))
+	assert.Nil(t, err)
+
+	db, err = Open("./tmp/", opts...)
+	assert.Nil(t, err)
+	assert.Equal(t, 51, len(db.ListKeys()))
+	for i := 0; i <= 50; i++ {
+		value, err = db.Get([]byte(fmt.Sprintf("key-%02d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("value-%v", i), string(value))
+	}
+
+	// only the new active file is preallocated, the merged files take their real size
+	for i := 0; i < 25; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte("new"))
+		assert.Nil(t, err)
+	}
+	err = db.MergeWithContext(context.Background(), MergeOptions{})
+	assert.Nil(t, err)
+	for fid, dataFile := range db.olderFiles {
+		size, err := dataFile.IoManager.Size()
+		assert.Nil(t, err)
+		info, err := os.Stat(model.GetDataFileName("./tmp/", model.DataFileType, fid))
+		assert.Nil(t, err)
+		assert.Equal(t, size, info.Size(), "fid %v", fid)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_WithMemFS(t *testing.T) {
+	memFS := fio.NewMemFS()
+	opts := []Option{WithMemFS(memFS), WithDataFileSize(512), WithBlobThreshold(256)}
+	db, err := Open("./tmp-mem/", opts...)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// the dir is locked by the db in the process
+	_, err = Open("./tmp-mem/", opts...)
+	assert.Equal(t, ErrDirIsUsing, err)
+
+	for i := 0; i < 50; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%v", i)))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 25; i++ {
+		err = db.Delete([]byte(fmt.Sprintf("key-%02d", i)))
+		assert.Nil(t, err)
+	}
+	bigValue := bytes.Repeat([]byte("v"), 300)
+	err = db.PutStream([]byte("big"), bytes.NewReader(bigValue), int64(len(bigValue)))
+	assert.Nil(t, err)
+	err = db.MergeWithContext(context.Background(), MergeOptions{})
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// nothing is written to the disk
+	_, err = os.Stat("./tmp-mem/")
+	assert.True(t, os.IsNotExist(err))
+
+	// reopen on the same memory file system
+	db, err = Open("./tmp-mem/", opts...)
+	assert.Nil(t, err)
+	assert.Equal(t, 26, len(db.ListKeys()))
+	value, err := db.Get([]byte("key-30"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value-30", string(value))
+	value, err = db.Get([]byte("big"))
+	assert.Nil(t, err)
+	assert.Equal(t, bigValue, value)
+	_, err = db.Get([]byte("key-10"))
+	assert.Equal(t, ErrNoRecord, err)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+// countingFS count the operations of the file system
+type countingFS struct {
+	fio.FS
+	opened  int32
+	renamed int32
+}
+
+func (c *countingFS) OpenFile(name string) (fio.IOManager, error) {
+	atomic.AddInt32(&c.opened, 1)
+	return c.FS.OpenFile(name)
+}
+
+func (c *countingFS) Rename(oldpath, newpath string) error {
+	atomic.AddInt32(&c.renamed, 1)
+	return c.FS.Rename(oldpath, newpath)
+}
+
+func TestDB_WithFS(t *testing.T) {
+	assert.Panics(t, func() {
+		WithFS(nil)(newDefaultOptions())
+	})
+
+	fsys := &countingFS{FS: fio.OSFS{}}
+	opts := []Option{WithFS(fsys), WithDataFileSize(512)}
+	db, err := Open("./tmp/", opts...)
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 30; i++ {
+		err = db.Put([]byte("key"), []byte(fmt.Sprintf("value-%v", i)))
+		assert.Nil(t, err)
+	}
+	err = db.MergeWithContext(context.Background(), MergeOptions{})
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	assert.True(t, atomic.LoadInt32(&fsys.opened) > 0)
+
+	// the merged files are moved when opening
+	db, err = Open("./tmp/", opts...)
+	assert.Nil(t, err)
+	assert.True(t, atomic.LoadInt32(&fsys.renamed) > 0)
+	value, err := db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value-29", string(value))
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_ObjectStorage(t *testing.T) {
+	server := httptest.NewServer(objstore.NewFakeS3())
+	defer server.Close()
+	client := objstore.NewClient(objstore.Config{Endpoint: server.URL, Bucket: "cqkv", AccessKey: "key", SecretKey: "secret"})
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+	}()
+
+	open := func() (*DB, *objstore.FS) {
+		assert.Nil(t, os.MkdirAll("./tmp/", os.ModePerm))
+		fsys, err := objstore.NewFS(fio.OSFS{}, "./tmp/", client, objstore.Options{Prefix: "db/", BlockSize: 128})
+		assert.Nil(t, err)
+		db, err := Open("./tmp/", WithFS(fsys), WithDataFileSize(512))
+		assert.Nil(t, err)
+		return db, fsys
+	}
+	check := func(db *DB) {
+		for i := 0; i < 50; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("key-%02d", i)))
+			assert.Nil(t, err)
+			assert.Equal(t, fmt.Sprintf("value-%d-1", i), string(value))
+		}
+	}
+
+	db, fsys := open()
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 50; i++ {
+			err := db.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%d-%d", i, round)))
+			assert.Nil(t, err)
+		}
+	}
+
+	// the retired data files are uploaded, the active one stays local
+	fsys.WaitUploads()
+	uploaded := fsys.Uploaded()
+	assert.True(t, len(uploaded) > 0)
+	assert.NotContains(t, uploaded, filepath.Base(model.GetDataFileName("./tmp/", model.DataFileType, db.activeFile.Fid)))
+	check(db)
+
+	err := db.MergeWithContext(context.Background(), MergeOptions{})
+	assert.Nil(t, err)
+	fsys.WaitUploads()
+	check(db)
+	assert.Nil(t, db.Close())
+
+	db, fsys = open()
+	check(db)
+	fsys.WaitUploads()
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_ObjectStorage_Blob(t *testing.T) {
+	server := httptest.NewServer(objstore.NewFakeS3())
+	defer server.Close()
+	client := objstore.NewClient(objstore.Config{Endpoint: server.URL, Bucket: "cqkv", AccessKey: "key", SecretKey: "secret"})
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+
+	open := func() (*DB, *objstore.FS) {
+		assert.Nil(t, os.MkdirAll("./tmp/", os.ModePerm))
+		fsys, err := objstore.NewFS(fio.OSFS{}, "./tmp/", client, objstore.Options{Prefix: "db/", BlockSize: 128})
+		assert.Nil(t, err)
+		db, err := Open("./tmp/", WithFS(fsys), WithDataFileSize(512), WithBlobThreshold(64), WithMaxDiskBytes(2048))
+		assert.Nil(t, err)
+		return db, fsys
+	}
+	value := bytes.Repeat([]byte("v"), 100)
+	check := func(db *DB) {
+		for i := 0; i < 50; i++ {
+			v, err := db.Get([]byte(fmt.Sprintf("key-%02d", i)))
+			assert.Nil(t, err)
+			assert.Equal(t, value, v)
+		}
+	}
+
+	// the sealed blob files are uploaded, the uploaded files are not counted by the quota
+	db, fsys := open()
+	for i := 0; i < 50; i++ {
+		err := db.Put([]byte(fmt.Sprintf("key-%02d", i)), value)
+		assert.Nil(t, err)
+		fsys.WaitUploads()
+	}
+	uploaded := fsys.Uploaded()
+	assert.Contains(t, uploaded, filepath.Base(model.GetDataFileName("./tmp/", model.BlobFileType, 0)))
+	assert.NotContains(t, uploaded, filepath.Base(model.GetDataFileName("./tmp/", model.BlobFileType, db.activeBlobFile.Fid)))
+	assert.True(t, db.Stat().DiskSize <= 2048)
+	check(db)
+	assert.Nil(t, db.Close())
+
+	db, fsys = open()
+	check(db)
+	fsys.WaitUploads()
+	assert.Nil(t, db.Close())
+}
@@ -7,17 +7,38 @@ import (
 var (
 	ErrEmptyKey = addPrefix("the key is empty")
 	ErrBigValue = addPrefix("value is too big")
-	ErrNoRecord = addPrefix("no record in keydir")
-	ErrWrongCrc = addPrefix("wrong crc value, data may be corrupted")
+
+	ErrInvalidSize        = addPrefix("the size of the value is negative")
+	ErrStreamNotSupported = addPrefix("the codec does not support streaming values")
+	ErrNoRecord           = addPrefix("no record in keydir")
+
+	ErrInvalidRange            = addPrefix("the start of the range is not less than the end")
+	ErrRangeDeleteNotSupported = addPrefix("the codec does not support range deletes")
+
+	ErrEmptyKeyspace        = addPrefix("the keyspace name is empty")
+	ErrNoKeyspace           = addPrefix("no keyspace")
+	ErrKeyspaceDropped      = addPrefix("the keyspace has been dropped")
+	ErrKeyspaceNotSupported = addPrefix("the codec does not support keyspaces")
+	ErrWrongCrc             = addPrefix("wrong crc value, data may be corrupted")
 
 	ErrNoDataFile        = addPrefix("no data file")
+	ErrNoBlobFile        = addPrefix("no blob file")
 	ErrNoIOManager       = addPrefix("no io manager")
+	ErrNoFS              = addPrefix("no file system")
 	ErrDirIsUsing        = addPrefix("direction is using")
 	ErrNeedFileLock      = addPrefix("need file lock")
 	ErrDataFileCorrupted = addPrefix("data file may be corrupted")
 
 	ErrUpdateKeydir = addPrefix("update keydir failed")
 
+	ErrQuotaExceeded = addPrefix("the size of the data files exceeds the quota")
+	ErrReadOnly      = addPrefix("the db is read only")
+	ErrDBFailed      = addPrefix("the db is read only after a failed sync, it should be opened again")
+
+	ErrReplicationNotSupported = addPrefix("the blob files can not be replicated")
+	ErrReplicaPosition         = addPrefix("invalid replication position")
+	ErrReplicationFrame        = addPrefix("the replication frame is too big")
+
 	ErrMergeIsProgress          = addPrefix("merge is in progress")
 	ErrInvalidMergeFinishedFile = addPrefix("invalid merge finished file")
 
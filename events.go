@@ -0,0 +1,70 @@
+package cqkv
+
+import (
+	"github.com/cqkv/cqkv/model"
+	"time"
+)
+
+// Logger is the structured logger of the db, the args are key-value pairs.
+// *slog.Logger implements it.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// nopLogger is the default logger, the db prints nothing
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// EventListener is notified of the events of the db.
+// the callbacks may be called with the lock of the db held,
+// they should return quickly and must not call the methods of the db.
+type EventListener interface {
+	// OnFileRotated is called after the active data file fid is sealed
+	OnFileRotated(fid uint32)
+	// OnMergeStart is called before merge picks the files
+	OnMergeStart()
+	// OnMergeEnd is called after merge, err is nil if it succeeded
+	OnMergeEnd(err error)
+	// OnSync is called after the data file fid is synced
+	OnSync(fid uint32, duration time.Duration, err error)
+	// OnCorruption is called if the record at offset of the data file fid can not be read
+	OnCorruption(fid uint32, offset int64, err error)
+	// OnRecoveryTruncate is called if the torn tail of the active data file or blob file fid is truncated
+	// from size to offset when opening
+	OnRecoveryTruncate(fid uint32, offset, size int64)
+}
+
+// NopEventListener ignore all the events,
+// it can be embedded to implement only some of the callbacks
+type NopEventListener struct{}
+
+func (NopEventListener) OnFileRotated(uint32)                    {}
+func (NopEventListener) OnMergeStart()                           {}
+func (NopEventListener) OnMergeEnd(error)                        {}
+func (NopEventListener) OnSync(uint32, time.Duration, error)     {}
+func (NopEventListener) OnCorruption(uint32, int64, error)       {}
+func (NopEventListener) OnRecoveryTruncate(uint32, int64, int64) {}
+
+// syncDataFile sync the data file and notify the listener
+func (db *DB) syncDataFile(dataFile *model.DataFile) error {
+	start := time.Now()
+	err := dataFile.Sync()
+	db.options.eventListener.OnSync(dataFile.Fid, time.Since(start), err)
+	if err != nil {
+		db.options.logger.Error("sync data file failed", "fid", dataFile.Fid, "err", err)
+	}
+	return err
+}
+
+// reportCorruption notify the listener that the record at offset of the data file can not be read
+func (db *DB) reportCorruption(fid uint32, offset int64, err error) {
+	db.options.logger.Error("data file is corrupted", "fid", fid, "offset", offset, "err", err)
+	db.options.eventListener.OnCorruption(fid, offset, err)
+}
@@ -0,0 +1,184 @@
+package cqkv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/cqkv/cqkv/model"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testListener struct {
+	NopEventListener
+
+	mu         sync.Mutex
+	rotated    []uint32
+	syncs      int
+	mergeStart int
+	mergeEnd   []error
+	corrupted  []int64
+	truncated  [][2]int64
+}
+
+func (l *testListener) OnFileRotated(fid uint32) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rotated = append(l.rotated, fid)
+}
+
+func (l *testListener) OnSync(uint32, time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.syncs++
+}
+
+func (l *testListener) OnMergeStart() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mergeStart++
+}
+
+func (l *testListener) OnMergeEnd(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mergeEnd = append(l.mergeEnd, err)
+}
+
+func (l *testListener) OnCorruption(_ uint32, offset int64, _ error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.corrupted = append(l.corrupted, offset)
+}
+
+func (l *testListener) OnRecoveryTruncate(_ uint32, offset, size int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.truncated = append(l.truncated, [2]int64{offset, size})
+}
+
+func TestDB_WithEventListener(t *testing.T) {
+	listener := &testListener{}
+	logs := new(bytes.Buffer)
+	logger := slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	db, err := Open("./tmp/", WithDataFileSize(512), WithEventListener(listener), WithLogger(logger))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 30; i++ {
+		err = db.Put([]byte("key"), []byte(fmt.Sprintf("value-%v", i)))
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(listener.rotated) > 0)
+	assert.Equal(t, uint32(0), listener.rotated[0])
+	assert.True(t, listener.syncs > 0)
+
+	err = db.MergeWithContext(context.Background(), MergeOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, listener.mergeStart)
+	assert.Equal(t, []error{nil}, listener.mergeEnd)
+
+	assert.Contains(t, logs.String(), "data file rotated")
+	assert.Contains(t, logs.String(), "merge end")
+}
+
+func TestDB_RecoveryTruncate(t *testing.T) {
+	db, err := Open("./tmp/")
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put([]byte("key-1"), []byte("value"))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// a record with the wrong crc and a torn record at the tail
+	fileName := model.GetDataFileName("./tmp/", model.DataFileType, 0)
+	info, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	data, _, err := db.marshalRecord(&model.Record{Key: addTxSeqPrefix([]byte("key-2"), noTransactionSeq), Value: []byte("value")})
+	assert.Nil(t, err)
+	data[len(data)-1] = 'x'
+	data = append(data, data[:len(data)-2]...)
+	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	listener := &testListener{}
+	db, err = Open("./tmp/", WithEventListener(listener))
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{info.Size()}, listener.corrupted)
+	assert.Equal(t, [][2]int64{{info.Size(), info.Size() + int64(len(data))}}, listener.truncated)
+
+	// the new record is appended after the last complete record
+	err = db.Put([]byte("key-3"), []byte("value"))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	err = os.Remove(model.GetDataFileName("./tmp/", model.SnapshotFileType, 0))
+	assert.Nil(t, err)
+
+	db, err = Open("./tmp/")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("key-1"), []byte("key-3")}, db.defaultKeyspace.ListKeys())
+}
+
+func TestDB_CorruptionInTheMiddle(t *testing.T) {
+	db, err := Open("./tmp/")
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+
+	// offsets are the starts of the records, the next record is further than the torn tail scan
+	offsets := []int64{0}
+	for i := 1; i <= 3; i++ {
+		value := []byte("value")
+		if i == 2 {
+			value = bytes.Repeat(value, tornTailScanSize/2)
+		}
+		err = db.Put([]byte(fmt.Sprintf("key-%v", i)), value)
+		assert.Nil(t, err)
+		offsets = append(offsets, db.activeFile.WriteOffset)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+	err = os.Remove(model.GetDataFileName("./tmp/", model.SnapshotFileType, 0))
+	assert.Nil(t, err)
+
+	// flip a byte of the value of the second record, a valid record follows it
+	fileName := model.GetDataFileName("./tmp/", model.DataFileType, 0)
+	data, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	data[offsets[2]-1] ^= 0xff
+	err = os.WriteFile(fileName, data, 0644)
+	assert.Nil(t, err)
+
+	listener := &testListener{}
+	_, err = Open("./tmp/", WithEventListener(listener))
+	assert.Equal(t, ErrWrongCrc, err)
+	assert.Equal(t, []int64{offsets[1]}, listener.corrupted)
+	assert.Empty(t, listener.truncated)
+
+	// the records after the bad one are not removed
+	info, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), info.Size())
+
+	// the failed open does not keep the dir locked
+	_, err = Open("./tmp/")
+	assert.Equal(t, ErrWrongCrc, err)
+}
@@ -0,0 +1,184 @@
+package fio
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// DefaultBufferSize is the size of the user-space buffer of BufferedIO
+const DefaultBufferSize = 64 * 1024
+
+// BufferedIO preallocate the new file and write through a user-space buffer,
+// the buffer is flushed when it is full or the file is synced.
+// the file is opened without O_APPEND, the writes are appended to the logical end,
+// and the preallocated space after it is zero-filled.
+type BufferedIO struct {
+	mu          sync.RWMutex
+	fd          *os.File
+	buf         []byte
+	bufferSize  int
+	flushed     int64 // the logical size of the data in the file
+	preallocate bool  // whether the file is preallocated, the zero tail is removed on close
+}
+
+// NewBufferedIO open the file, the file is preallocated to preallocSize if it is positive.
+// only the new file to fill should be preallocated, the preallocated space is taken before it is written
+func NewBufferedIO(file string, preallocSize int64, bufferSize int) (*BufferedIO, error) {
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+
+	bio := &BufferedIO{
+		fd:         fd,
+		buf:        make([]byte, 0, bufferSize),
+		bufferSize: bufferSize,
+		flushed:    info.Size(),
+	}
+	// the existing file may be preallocated before a crash,
+	// its logical end is found and truncated by the recovery
+	if preallocSize > 0 {
+		if err = preallocate(fd, preallocSize); err != nil {
+			_ = fd.Close()
+			return nil, err
+		}
+		bio.preallocate = true
+	}
+	return bio, nil
+}
+
+// Read read the flushed data from the file and the rest from the buffer
+func (bio *BufferedIO) Read(p []byte, offset int64) (int, error) {
+	bio.mu.RLock()
+	defer bio.mu.RUnlock()
+
+	var n int
+	if offset < bio.flushed {
+		end := int64(len(p))
+		if offset+end > bio.flushed {
+			end = bio.flushed - offset
+		}
+		m, err := bio.fd.ReadAt(p[:end], offset)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		start := offset + int64(n) - bio.flushed
+		if start < int64(len(bio.buf)) {
+			n += copy(p[n:], bio.buf[start:])
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (bio *BufferedIO) Write(data []byte) (int, error) {
+	bio.mu.Lock()
+	defer bio.mu.Unlock()
+
+	bio.buf = append(bio.buf, data...)
+	if len(bio.buf) >= bio.bufferSize {
+		if err := bio.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// flush write the buffer to the logical end of the file, the caller should hold the lock
+func (bio *BufferedIO) flush() error {
+	if len(bio.buf) == 0 {
+		return nil
+	}
+	n, err := bio.fd.WriteAt(bio.buf, bio.flushed)
+	bio.flushed += int64(n)
+	// the unwritten data is kept, it is written by the next flush or dropped by Truncate
+	bio.buf = bio.buf[:copy(bio.buf, bio.buf[n:])]
+	return err
+}
+
+func (bio *BufferedIO) Sync() error {
+	bio.mu.Lock()
+	defer bio.mu.Unlock()
+	if err := bio.flush(); err != nil {
+		return err
+	}
+	return bio.fd.Sync()
+}
+
+// Close flush the buffer and release the preallocated space after the logical end
+func (bio *BufferedIO) Close() error {
+	bio.mu.Lock()
+	defer bio.mu.Unlock()
+	if err := bio.flush(); err != nil {
+		_ = bio.fd.Close()
+		return err
+	}
+	if bio.preallocate {
+		if err := bio.fd.Truncate(bio.flushed); err != nil {
+			_ = bio.fd.Close()
+			return err
+		}
+	}
+	return bio.fd.Close()
+}
+
+// Size return the logical size, including the buffered data
+func (bio *BufferedIO) Size() (int64, error) {
+	bio.mu.RLock()
+	defer bio.mu.RUnlock()
+	return bio.flushed + int64(len(bio.buf)), nil
+}
+
+// DiskSize return the size of the file on the disk, including the preallocated space
+func (bio *BufferedIO) DiskSize() (int64, error) {
+	bio.mu.RLock()
+	defer bio.mu.RUnlock()
+	size := bio.flushed + int64(len(bio.buf))
+	if !bio.preallocate {
+		return size, nil
+	}
+	info, err := bio.fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() > size {
+		return info.Size(), nil
+	}
+	return size, nil
+}
+
+// Truncate drop the data after size and cut the file at size,
+// the preallocated space after size is released too
+func (bio *BufferedIO) Truncate(size int64) error {
+	bio.mu.Lock()
+	defer bio.mu.Unlock()
+
+	if size < bio.flushed {
+		bio.buf = bio.buf[:0]
+	} else if size-bio.flushed < int64(len(bio.buf)) {
+		bio.buf = bio.buf[:size-bio.flushed]
+	}
+	if err := bio.flush(); err != nil {
+		return err
+	}
+	if err := bio.fd.Truncate(size); err != nil {
+		return err
+	}
+	bio.flushed = size
+	bio.preallocate = false
+	return nil
+}
@@ -0,0 +1,71 @@
+package fio
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestBufferedIO_Write(t *testing.T) {
+	bio, err := NewBufferedIO("./buffered-data", 1024, 8)
+	defer os.Remove("./buffered-data")
+	assert.Nil(t, err)
+	assert.NotNil(t, bio)
+
+	// the new file is preallocated
+	info, err := os.Stat("./buffered-data")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1024), info.Size())
+
+	for i := 0; i < 3; i++ {
+		n, err := bio.Write([]byte("hello"))
+		assert.Nil(t, err)
+		assert.Equal(t, 5, n)
+	}
+	size, err := bio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(15), size)
+
+	// read the flushed data and the buffered data
+	buf := make([]byte, 10)
+	n, err := bio.Read(buf, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, "hellohello", string(buf))
+	n, err = bio.Read(buf, 10)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 5, n)
+
+	// the preallocated space is released on close
+	err = bio.Close()
+	assert.Nil(t, err)
+	info, err = os.Stat("./buffered-data")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(15), info.Size())
+}
+
+func TestBufferedIO_Truncate(t *testing.T) {
+	bio, err := NewBufferedIO("./buffered-data", 1024, 8)
+	defer os.Remove("./buffered-data")
+	assert.Nil(t, err)
+	assert.NotNil(t, bio)
+
+	_, err = bio.Write([]byte("hello world"))
+	assert.Nil(t, err)
+	_, err = bio.Write([]byte("abc"))
+	assert.Nil(t, err)
+
+	// drop the buffered data
+	err = bio.Truncate(11)
+	assert.Nil(t, err)
+	_, err = bio.Write([]byte("!"))
+	assert.Nil(t, err)
+	err = bio.Sync()
+	assert.Nil(t, err)
+
+	data, err := os.ReadFile("./buffered-data")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world!", string(data))
+	assert.Nil(t, bio.Close())
+}
@@ -0,0 +1,353 @@
+// Package faulty injects faults into the files of a fio.FS to test the durability of the db.
+// the files opened by FS can be scripted to fail the writes, write only a part of the data,
+// or flip a bit of the data read, and Crash drops the data that is not synced.
+package faulty
+
+import (
+	"errors"
+	"github.com/cqkv/cqkv/fio"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrInjected = errors.New("faulty: injected fault")
+	ErrCrashed  = errors.New("faulty: the file is opened before the crash")
+)
+
+// Faults is the script of the faults, the zero value injects nothing
+type Faults struct {
+	// FailWrites fail the writes after FailAfter writes succeed, counted from SetFaults
+	FailWrites bool
+	FailAfter  int
+	// WriteErr is returned by the failed writes, ErrInjected is used if it is nil
+	WriteErr error
+	// ShortWrite make the failed writes write half of the data and return no error,
+	// the caller should check the number of the bytes written
+	ShortWrite bool
+	// CrashOnFail crash the file system at the first failed write, like a power loss.
+	// a random part of the data not synced is kept, the write returns ErrCrashed
+	CrashOnFail bool
+	// FlipRate is the probability that a read flips a random bit of the data
+	FlipRate float64
+}
+
+// FS wrap the base fio.FS, the files opened by it are IO.
+// the synced size of every file is tracked, Crash truncates the files to it
+type FS struct {
+	fio.FS
+
+	mu     sync.Mutex
+	faults Faults
+	writes int
+	rand   *rand.Rand
+	// the state of the files by the clean name
+	files map[string]*fileState
+	// the files opened before the crash are of the old generation
+	generation int
+	// the locks held by the process are released by the crash
+	locks []fio.FileLocker
+}
+
+type fileState struct {
+	synced int64
+}
+
+var _ fio.FS = (*FS)(nil)
+
+// NewFS wrap base without faults, seed is used to flip the bits
+func NewFS(base fio.FS, seed int64) *FS {
+	return &FS{
+		FS:     base,
+		faults: Faults{},
+		rand:   rand.New(rand.NewSource(seed)),
+		files:  make(map[string]*fileState),
+	}
+}
+
+// SetFaults replace the script of the faults
+func (f *FS) SetFaults(faults Faults) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = faults
+	f.writes = 0
+}
+
+// Crash drop the data not synced and clear the faults.
+// the files opened before return ErrCrashed, the db should be opened again on f
+func (f *FS) Crash() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.crash(false)
+}
+
+// Crashes return the number of the crashes
+func (f *FS) Crashes() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.generation
+}
+
+// crash truncate the files to the synced size, or to a random size after it if torn,
+// the caller should hold the lock
+func (f *FS) crash(torn bool) error {
+	for name, state := range f.files {
+		ioManager, err := f.FS.OpenFile(name)
+		if err != nil {
+			return err
+		}
+		size := state.synced
+		if torn {
+			if size, err = ioManager.Size(); err != nil {
+				_ = ioManager.Close()
+				return err
+			}
+			if size > state.synced {
+				size = state.synced + f.rand.Int63n(size-state.synced+1)
+			}
+		}
+		if err = fio.Truncate(ioManager, size); err != nil {
+			_ = ioManager.Close()
+			return err
+		}
+		if err = ioManager.Close(); err != nil {
+			return err
+		}
+		state.synced = size
+	}
+	for _, lock := range f.locks {
+		if err := lock.Unlock(); err != nil {
+			return err
+		}
+	}
+	f.locks = nil
+	f.faults = Faults{}
+	f.generation++
+	return nil
+}
+
+func (f *FS) OpenFile(name string) (fio.IOManager, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ioManager, err := f.FS.OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	name = filepath.Clean(name)
+	state, ok := f.files[name]
+	if !ok {
+		// the existing data is synced
+		size, err := ioManager.Size()
+		if err != nil {
+			_ = ioManager.Close()
+			return nil, err
+		}
+		state = &fileState{synced: size}
+		f.files[name] = state
+	}
+	return &IO{fs: f, base: ioManager, state: state, generation: f.generation}, nil
+}
+
+func (f *FS) Rename(oldpath, newpath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.FS.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	if state, ok := f.files[oldpath]; ok {
+		delete(f.files, oldpath)
+		f.files[newpath] = state
+	}
+	return nil
+}
+
+func (f *FS) Remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.FS.Remove(name); err != nil {
+		return err
+	}
+	delete(f.files, filepath.Clean(name))
+	return nil
+}
+
+func (f *FS) RemoveAll(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.FS.RemoveAll(path); err != nil {
+		return err
+	}
+	path = filepath.Clean(path)
+	prefix := path + string(filepath.Separator)
+	for name := range f.files {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(f.files, name)
+		}
+	}
+	return nil
+}
+
+// Locker return the lock of the base, it is released when the file system crashes
+func (f *FS) Locker(dir string) fio.FileLocker {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &locker{fs: f, base: f.FS.Locker(dir), generation: f.generation}
+}
+
+// locker is the lock of the dir taken before a crash
+type locker struct {
+	fs         *FS
+	base       fio.FileLocker
+	generation int
+}
+
+func (l *locker) TryLock() (bool, error) {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+	if l.generation != l.fs.generation {
+		return false, ErrCrashed
+	}
+	success, err := l.base.TryLock()
+	if err != nil || !success {
+		return success, err
+	}
+	l.fs.locks = append(l.fs.locks, l.base)
+	return true, nil
+}
+
+func (l *locker) Unlock() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+	// the lock is already released by the crash
+	if l.generation != l.fs.generation {
+		return nil
+	}
+	for i, lock := range l.fs.locks {
+		if lock == l.base {
+			l.fs.locks = append(l.fs.locks[:i], l.fs.locks[i+1:]...)
+			break
+		}
+	}
+	return l.base.Unlock()
+}
+
+// IO is the IOManager injecting the faults of its FS
+type IO struct {
+	fs         *FS
+	base       fio.IOManager
+	state      *fileState
+	generation int
+}
+
+// check return ErrCrashed if the file is opened before the crash, the caller should hold the lock
+func (io *IO) check() error {
+	if io.generation != io.fs.generation {
+		return ErrCrashed
+	}
+	return nil
+}
+
+func (io *IO) Read(buf []byte, offset int64) (int, error) {
+	io.fs.mu.Lock()
+	defer io.fs.mu.Unlock()
+	if err := io.check(); err != nil {
+		return 0, err
+	}
+
+	n, err := io.base.Read(buf, offset)
+	if n > 0 && io.fs.faults.FlipRate > 0 && io.fs.rand.Float64() < io.fs.faults.FlipRate {
+		bit := io.fs.rand.Intn(n * 8)
+		buf[bit/8] ^= 1 << (bit % 8)
+	}
+	return n, err
+}
+
+func (io *IO) Write(data []byte) (int, error) {
+	io.fs.mu.Lock()
+	defer io.fs.mu.Unlock()
+	if err := io.check(); err != nil {
+		return 0, err
+	}
+
+	faults := io.fs.faults
+	if !faults.FailWrites || io.fs.writes < faults.FailAfter {
+		io.fs.writes++
+		return io.base.Write(data)
+	}
+
+	writeErr := faults.WriteErr
+	if writeErr == nil {
+		writeErr = ErrInjected
+	}
+	var n int
+	if faults.ShortWrite {
+		var err error
+		if n, err = io.base.Write(data[:len(data)/2]); err != nil {
+			return n, err
+		}
+	}
+	if faults.CrashOnFail {
+		if err := io.fs.crash(true); err != nil {
+			return n, err
+		}
+		return n, ErrCrashed
+	}
+	if faults.ShortWrite {
+		return n, nil
+	}
+	return n, writeErr
+}
+
+func (io *IO) Sync() error {
+	io.fs.mu.Lock()
+	defer io.fs.mu.Unlock()
+	if err := io.check(); err != nil {
+		return err
+	}
+
+	if err := io.base.Sync(); err != nil {
+		return err
+	}
+	size, err := io.base.Size()
+	if err != nil {
+		return err
+	}
+	io.state.synced = size
+	return nil
+}
+
+func (io *IO) Close() error {
+	return io.base.Close()
+}
+
+func (io *IO) Size() (int64, error) {
+	io.fs.mu.Lock()
+	defer io.fs.mu.Unlock()
+	if err := io.check(); err != nil {
+		return 0, err
+	}
+	return io.base.Size()
+}
+
+func (io *IO) Truncate(size int64) error {
+	io.fs.mu.Lock()
+	defer io.fs.mu.Unlock()
+	if err := io.check(); err != nil {
+		return err
+	}
+
+	if err := fio.Truncate(io.base, size); err != nil {
+		return err
+	}
+	if io.state.synced > size {
+		io.state.synced = size
+	}
+	return nil
+}
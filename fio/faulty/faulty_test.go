@@ -0,0 +1,87 @@
+package faulty
+
+import (
+	"github.com/cqkv/cqkv/fio"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestFS_Crash(t *testing.T) {
+	f := NewFS(fio.NewMemFS(), 0)
+	ioManager, err := f.OpenFile("./data")
+	assert.Nil(t, err)
+
+	_, err = ioManager.Write([]byte("synced"))
+	assert.Nil(t, err)
+	assert.Nil(t, ioManager.Sync())
+	_, err = ioManager.Write([]byte("lost"))
+	assert.Nil(t, err)
+
+	// the renamed file keeps its synced size
+	err = f.Rename("./data", "./renamed")
+	assert.Nil(t, err)
+	err = f.Crash()
+	assert.Nil(t, err)
+
+	_, err = ioManager.Write([]byte("after"))
+	assert.Equal(t, ErrCrashed, err)
+	ioManager, err = f.OpenFile("./renamed")
+	assert.Nil(t, err)
+	buf := make([]byte, 16)
+	n, err := ioManager.Read(buf, 0)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "synced", string(buf[:n]))
+}
+
+func TestFS_SetFaults(t *testing.T) {
+	f := NewFS(fio.NewMemFS(), 0)
+	ioManager, err := f.OpenFile("./data")
+	assert.Nil(t, err)
+
+	f.SetFaults(Faults{FailWrites: true, FailAfter: 1, ShortWrite: true})
+	n, err := ioManager.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	n, err = ioManager.Write([]byte("world!"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	size, err := ioManager.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(8), size)
+
+	// every read flips a bit
+	f.SetFaults(Faults{FlipRate: 1})
+	buf := make([]byte, 5)
+	_, err = ioManager.Read(buf, 0)
+	assert.Nil(t, err)
+	assert.NotEqual(t, "hello", string(buf))
+
+	f.SetFaults(Faults{})
+	_, err = ioManager.Read(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestFS_CrashOnFail(t *testing.T) {
+	f := NewFS(fio.NewMemFS(), 0)
+	ioManager, err := f.OpenFile("./data")
+	assert.Nil(t, err)
+	_, err = ioManager.Write([]byte("synced"))
+	assert.Nil(t, err)
+	assert.Nil(t, ioManager.Sync())
+
+	f.SetFaults(Faults{FailWrites: true, ShortWrite: true, CrashOnFail: true})
+	n, err := ioManager.Write([]byte("torn-data"))
+	assert.Equal(t, ErrCrashed, err)
+	assert.Equal(t, 4, n)
+	err = fio.Truncate(ioManager, 6)
+	assert.Equal(t, ErrCrashed, err)
+
+	// a part of the short write may be kept
+	ioManager, err = f.OpenFile("./data")
+	assert.Nil(t, err)
+	size, err := ioManager.Size()
+	assert.Nil(t, err)
+	assert.True(t, size >= 6 && size <= 10)
+}
@@ -1,9 +1,7 @@
 package fio
 
 import (
-	"fmt"
 	"os"
-	"time"
 )
 
 // FileIO is the default implement for IOManager
@@ -23,10 +21,6 @@ func (fio *FileIO) Read(buf []byte, offset int64) (int, error) {
 	return fio.fd.ReadAt(buf, offset)
 }
 func (fio *FileIO) Write(data []byte) (int, error) {
-	start := time.Now()
-	defer func() {
-		fmt.Println("write time111:", time.Since(start))
-	}()
 	return fio.fd.Write(data)
 }
 func (fio *FileIO) Sync() error {
@@ -35,6 +29,10 @@ func (fio *FileIO) Sync() error {
 func (fio *FileIO) Close() error {
 	return fio.fd.Close()
 }
+func (fio *FileIO) Truncate(size int64) error {
+	return fio.fd.Truncate(size)
+}
+
 func (fio *FileIO) Size() (int64, error) {
 	info, err := fio.fd.Stat()
 	if err != nil {
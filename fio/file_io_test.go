@@ -21,6 +21,7 @@ func TestFIleIO_Write(t *testing.T) {
 
 func TestFIleIO_Read(t *testing.T) {
 	fio, err := NewFIleIO("./data")
+	defer os.Remove("./data")
 	assert.Nil(t, err)
 	assert.NotNil(t, fio)
 
@@ -40,3 +41,26 @@ func TestFIleIO_Sync(t *testing.T) {
 func TestFIleIO_Close(t *testing.T) {
 
 }
+
+// sizeOnly is an io manager without Truncate
+type sizeOnly struct {
+	IOManager
+}
+
+func TestTruncate(t *testing.T) {
+	fio, err := NewFIleIO("./data")
+	defer os.Remove("./data")
+	assert.Nil(t, err)
+
+	_, err = fio.Write([]byte("hello"))
+	assert.Nil(t, err)
+	err = Truncate(fio, 2)
+	assert.Nil(t, err)
+	size, err := fio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), size)
+
+	err = Truncate(sizeOnly{fio}, 0)
+	assert.Equal(t, ErrTruncateNotSupported, err)
+	assert.Nil(t, fio.Close())
+}
@@ -0,0 +1,61 @@
+package fio
+
+import (
+	"io/fs"
+	"os"
+)
+
+// FS is the file system of the db, all the files and the directory operations go through it.
+// the errors of the missing files should satisfy os.IsNotExist
+type FS interface {
+	// OpenFile open the file as an IOManager, the file is created if not exist
+	OpenFile(name string) (IOManager, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Stat(name string) (fs.FileInfo, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	MkdirAll(path string, perm fs.FileMode) error
+	// Locker return the lock preventing the dir from being opened twice
+	Locker(dir string) FileLocker
+}
+
+var (
+	_ FS = OSFS{}
+	_ FS = (*MemFS)(nil)
+)
+
+// OSFS is the default FS, the files are FileIO
+type OSFS struct{}
+
+func (OSFS) OpenFile(name string) (IOManager, error) {
+	return NewFIleIO(name)
+}
+
+func (OSFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (OSFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (OSFS) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (OSFS) Locker(dir string) FileLocker {
+	return NewFlock(dir)
+}
@@ -1,5 +1,10 @@
 package fio
 
+import "errors"
+
+// ErrTruncateNotSupported is returned by truncating the file of the IOManager not implementing Truncater
+var ErrTruncateNotSupported = errors.New("fio: the io manager does not support truncating")
+
 // IOManager can be custom in options
 type IOManager interface {
 	Read([]byte, int64) (int, error)
@@ -8,3 +13,39 @@ type IOManager interface {
 	Close() error
 	Size() (int64, error)
 }
+
+// Truncater is implemented by the IOManager able to shrink its file,
+// the db needs it to remove the torn tail and the failed writes of the active file
+type Truncater interface {
+	// Truncate change the size of the file, the next write is appended to the new end
+	Truncate(size int64) error
+}
+
+var (
+	_ Truncater = (*FileIO)(nil)
+	_ Truncater = (*BufferedIO)(nil)
+	_ Truncater = (*MemIO)(nil)
+)
+
+// Truncate change the size of the file of ioManager, ErrTruncateNotSupported is returned if it is not a Truncater
+func Truncate(ioManager IOManager, size int64) error {
+	truncater, ok := ioManager.(Truncater)
+	if !ok {
+		return ErrTruncateNotSupported
+	}
+	return truncater.Truncate(size)
+}
+
+// DiskSizer is implemented by the IOManager whose file takes a different space than its size on the disk,
+// e.g. the preallocated file, or the file moved to the object storage
+type DiskSizer interface {
+	// DiskSize return the size the file takes on the disk
+	DiskSize() (int64, error)
+}
+
+// Sealer is implemented by the IOManager handling the immutable files differently,
+// e.g. moving them to the object storage
+type Sealer interface {
+	// Seal is called once the data file will never be written again
+	Seal() error
+}
@@ -0,0 +1,247 @@
+package fio
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS is an in-memory file system, the db opened on it never touches the disk.
+// the data is lost when the MemFS is dropped, reuse it to reopen the db.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+	dirs  map[string]bool
+	// locks are the dirs locked by the dbs
+	locks map[string]bool
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memFile),
+		dirs:  map[string]bool{".": true, "/": true},
+		locks: make(map[string]bool),
+	}
+}
+
+// OpenFile open the file as an IOManager, the file is created if not exist
+func (mfs *MemFS) OpenFile(name string) (IOManager, error) {
+	name = filepath.Clean(name)
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+
+	if mfs.dirs[name] {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+	if !mfs.dirs[filepath.Dir(name)] {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	file, ok := mfs.files[name]
+	if !ok {
+		file = &memFile{}
+		mfs.files[name] = file
+	}
+	return &MemIO{file: file}, nil
+}
+
+// ReadDir return the entries of the dir sorted by name
+func (mfs *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	name = filepath.Clean(name)
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+
+	if !mfs.dirs[name] {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	var entries []fs.DirEntry
+	for path, file := range mfs.files {
+		if filepath.Dir(path) == name {
+			entries = append(entries, &memFileInfo{name: filepath.Base(path), size: memFileSize(file)})
+		}
+	}
+	for path := range mfs.dirs {
+		if path != name && filepath.Dir(path) == name {
+			entries = append(entries, &memFileInfo{name: filepath.Base(path), dir: true})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (mfs *MemFS) Stat(name string) (fs.FileInfo, error) {
+	name = filepath.Clean(name)
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+
+	if mfs.dirs[name] {
+		return &memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	if file, ok := mfs.files[name]; ok {
+		return &memFileInfo{name: filepath.Base(name), size: memFileSize(file)}, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (mfs *MemFS) MkdirAll(path string, _ fs.FileMode) error {
+	path = filepath.Clean(path)
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+
+	for ; !mfs.dirs[path]; path = filepath.Dir(path) {
+		if _, ok := mfs.files[path]; ok {
+			return &fs.PathError{Op: "mkdir", Path: path, Err: fs.ErrExist}
+		}
+		mfs.dirs[path] = true
+	}
+	return nil
+}
+
+// Remove remove the file or the empty dir, the opened MemIO can still read the removed file
+func (mfs *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+
+	if _, ok := mfs.files[name]; ok {
+		delete(mfs.files, name)
+		return nil
+	}
+	if mfs.dirs[name] {
+		for path := range mfs.files {
+			if filepath.Dir(path) == name {
+				return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrExist}
+			}
+		}
+		delete(mfs.dirs, name)
+		return nil
+	}
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+}
+
+// RemoveAll remove the path and its children, it returns nil if the path does not exist
+func (mfs *MemFS) RemoveAll(path string) error {
+	path = filepath.Clean(path)
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+
+	prefix := path + string(filepath.Separator)
+	for name := range mfs.files {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(mfs.files, name)
+		}
+	}
+	for name := range mfs.dirs {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(mfs.dirs, name)
+		}
+	}
+	return nil
+}
+
+// Rename move the file, the file at newpath is replaced
+func (mfs *MemFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+
+	file, ok := mfs.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if !mfs.dirs[filepath.Dir(newpath)] || mfs.dirs[newpath] {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrInvalid}
+	}
+	delete(mfs.files, oldpath)
+	mfs.files[newpath] = file
+	return nil
+}
+
+// Locker return the file lock of the dir, the db in memory is only locked in the process
+func (mfs *MemFS) Locker(dir string) FileLocker {
+	return &memLocker{mfs: mfs, dir: filepath.Clean(dir)}
+}
+
+// memLocker lock the dir in the lock table of the MemFS
+type memLocker struct {
+	mfs    *MemFS
+	dir    string
+	locked bool
+}
+
+func (l *memLocker) TryLock() (bool, error) {
+	l.mfs.mu.Lock()
+	defer l.mfs.mu.Unlock()
+	if l.locked {
+		return true, nil
+	}
+	if l.mfs.locks[l.dir] {
+		return false, nil
+	}
+	l.mfs.locks[l.dir] = true
+	l.locked = true
+	return true, nil
+}
+
+func (l *memLocker) Unlock() error {
+	l.mfs.mu.Lock()
+	defer l.mfs.mu.Unlock()
+	if l.locked {
+		delete(l.mfs.locks, l.dir)
+		l.locked = false
+	}
+	return nil
+}
+
+func memFileSize(file *memFile) int64 {
+	file.mu.RLock()
+	defer file.mu.RUnlock()
+	return int64(len(file.data))
+}
+
+// memFileInfo implement fs.FileInfo and fs.DirEntry
+type memFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (fi *memFileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *memFileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *memFileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (fi *memFileInfo) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (fi *memFileInfo) IsDir() bool {
+	return fi.dir
+}
+
+func (fi *memFileInfo) Sys() any {
+	return nil
+}
+
+func (fi *memFileInfo) Type() fs.FileMode {
+	return fi.Mode().Type()
+}
+
+func (fi *memFileInfo) Info() (fs.FileInfo, error) {
+	return fi, nil
+}
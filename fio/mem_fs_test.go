@@ -0,0 +1,84 @@
+package fio
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestMemFS(t *testing.T) {
+	mfs := NewMemFS()
+	err := mfs.MkdirAll("./db/a", os.ModePerm)
+	assert.Nil(t, err)
+
+	ioManager, err := mfs.OpenFile("./db/a/data")
+	assert.Nil(t, err)
+	n, err := ioManager.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+
+	// the data is shared by the opened files
+	other, err := mfs.OpenFile("db/a/data")
+	assert.Nil(t, err)
+	buf := make([]byte, 8)
+	n, err = other.Read(buf, 0)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+
+	err = Truncate(ioManager, 2)
+	assert.Nil(t, err)
+	size, err := other.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), size)
+
+	_, err = mfs.OpenFile("./none/data")
+	assert.True(t, os.IsNotExist(err))
+
+	entries, err := mfs.ReadDir("./db")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.True(t, entries[0].IsDir())
+
+	err = mfs.Rename("./db/a/data", "./db/data")
+	assert.Nil(t, err)
+	_, err = mfs.Stat("./db/a/data")
+	assert.True(t, os.IsNotExist(err))
+	info, err := mfs.Stat("./db/data")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), info.Size())
+
+	err = mfs.RemoveAll("./db/a")
+	assert.Nil(t, err)
+	entries, err = mfs.ReadDir("./db")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "data", entries[0].Name())
+
+	err = mfs.Remove("./db/data")
+	assert.Nil(t, err)
+	err = mfs.Remove("./db/data")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMemFS_Locker(t *testing.T) {
+	mfs := NewMemFS()
+	lock := mfs.Locker("./db")
+	success, err := lock.TryLock()
+	assert.Nil(t, err)
+	assert.True(t, success)
+
+	// the dir is locked by another locker
+	other := mfs.Locker("db")
+	success, err = other.TryLock()
+	assert.Nil(t, err)
+	assert.False(t, success)
+	err = other.Unlock()
+	assert.Nil(t, err)
+
+	err = lock.Unlock()
+	assert.Nil(t, err)
+	success, err = other.TryLock()
+	assert.Nil(t, err)
+	assert.True(t, success)
+}
@@ -0,0 +1,66 @@
+package fio
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// memFile is the data of a file in MemFS, it is shared by the MemIO opening it
+type memFile struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+// MemIO is the IOManager of a file in MemFS, the data is kept in memory
+type MemIO struct {
+	file *memFile
+}
+
+func (mio *MemIO) Read(buf []byte, offset int64) (int, error) {
+	mio.file.mu.RLock()
+	defer mio.file.mu.RUnlock()
+	if offset >= int64(len(mio.file.data)) {
+		return 0, io.EOF
+	}
+	n := copy(buf, mio.file.data[offset:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (mio *MemIO) Write(data []byte) (int, error) {
+	mio.file.mu.Lock()
+	defer mio.file.mu.Unlock()
+	mio.file.data = append(mio.file.data, data...)
+	return len(data), nil
+}
+
+func (mio *MemIO) Sync() error {
+	return nil
+}
+
+func (mio *MemIO) Close() error {
+	return nil
+}
+
+func (mio *MemIO) Truncate(size int64) error {
+	mio.file.mu.Lock()
+	defer mio.file.mu.Unlock()
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	if size <= int64(len(mio.file.data)) {
+		mio.file.data = mio.file.data[:size]
+		return nil
+	}
+	mio.file.data = append(mio.file.data, make([]byte, size-int64(len(mio.file.data)))...)
+	return nil
+}
+
+func (mio *MemIO) Size() (int64, error) {
+	mio.file.mu.RLock()
+	defer mio.file.mu.RUnlock()
+	return int64(len(mio.file.data)), nil
+}
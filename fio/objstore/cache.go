@@ -0,0 +1,76 @@
+package objstore
+
+import (
+	"container/list"
+	"sync"
+)
+
+type blockKey struct {
+	object string
+	index  int64
+}
+
+type block struct {
+	key  blockKey
+	data []byte
+}
+
+// blockCache is the LRU cache of the blocks of the objects, limited by the bytes of the blocks
+type blockCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List // the front is the most recently used
+	blocks   map[blockKey]*list.Element
+}
+
+func newBlockCache(capacity int64) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		lru:      list.New(),
+		blocks:   make(map[blockKey]*list.Element),
+	}
+}
+
+func (c *blockCache) get(key blockKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.blocks[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*block).data, true
+}
+
+func (c *blockCache) put(key blockKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.blocks[key]; ok || int64(len(data)) > c.capacity {
+		return
+	}
+	c.blocks[key] = c.lru.PushFront(&block{key: key, data: data})
+	c.size += int64(len(data))
+
+	for c.size > c.capacity {
+		elem := c.lru.Back()
+		c.removeElement(elem)
+	}
+}
+
+// removeObject drop the blocks of the object
+func (c *blockCache) removeObject(object string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, elem := range c.blocks {
+		if key.object == object {
+			c.removeElement(elem)
+		}
+	}
+}
+
+func (c *blockCache) removeElement(elem *list.Element) {
+	b := c.lru.Remove(elem).(*block)
+	delete(c.blocks, b.key)
+	c.size -= int64(len(b.data))
+}
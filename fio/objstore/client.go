@@ -0,0 +1,278 @@
+// Package objstore keeps the immutable data files in an S3-compatible bucket.
+// the sealed data files are uploaded in background and read with ranged GETs through a block cache,
+// the active data file and the other files stay on the local file system.
+package objstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoObject = errors.New("objstore: no object")
+	ErrReadOnly = errors.New("objstore: the uploaded file is read only")
+)
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Config is the S3-compatible bucket, the path-style urls are used, e.g. http://127.0.0.1:9000/bucket/key
+type Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// HTTPClient is http.DefaultClient if nil
+	HTTPClient *http.Client
+}
+
+// Object is the key and the size of an object in the bucket
+type Object struct {
+	Key  string
+	Size int64
+}
+
+// Client is a minimal S3 client signing the requests with the signature version 4
+type Client struct {
+	config Config
+	now    func() time.Time
+}
+
+func NewClient(config Config) *Client {
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	return &Client{config: config, now: time.Now}
+}
+
+// PutObject upload size bytes of body as the object of key
+func (c *Client) PutObject(key string, body io.Reader, size int64) error {
+	req, err := c.newRequest(http.MethodPut, key, nil, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	_, err = c.do(req)
+	return err
+}
+
+// GetObjectRange read n bytes of the object from offset
+func (c *Client) GetObjectRange(key string, offset, n int64) ([]byte, error) {
+	req, err := c.newRequest(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+n-1))
+	return c.do(req)
+}
+
+// DeleteObject remove the object, it is not an error if the object does not exist
+func (c *Client) DeleteObject(key string) error {
+	req, err := c.newRequest(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(req)
+	if err == ErrNoObject {
+		return nil
+	}
+	return err
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key  string
+		Size int64
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// ListObjects return the objects whose key has the prefix
+func (c *Client) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+	var token string
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := c.newRequest(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		data, err := c.do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var result listBucketResult
+		if err = xml.Unmarshal(data, &result); err != nil {
+			return nil, err
+		}
+		for _, content := range result.Contents {
+			objects = append(objects, Object{Key: content.Key, Size: content.Size})
+		}
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (c *Client) newRequest(method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	path := "/" + c.config.Bucket
+	if key != "" {
+		path += "/" + key
+	}
+	u, err := url.Parse(c.config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path
+	u.RawPath = uriEncode(path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// do sign and send the request, the body of the response is returned
+func (c *Client) do(req *http.Request) ([]byte, error) {
+	c.sign(req, unsignedPayload)
+	resp, err := c.config.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrNoObject
+	case resp.StatusCode >= 300:
+		return nil, fmt.Errorf("objstore: %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, data)
+	}
+	return data, nil
+}
+
+// sign add the authorization header of the signature version 4
+func (c *Client) sign(req *http.Request, payloadHash string) {
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// the host, the range and the x-amz-* headers are signed
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.config.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.config.SecretKey), date)
+	key = hmacSHA256(key, c.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.config.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// canonicalQuery encode the query sorted by name as signature version 4 requires
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode escape all the bytes except the unreserved characters, '/' is kept unless encodeSlash
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~':
+			b.WriteByte(ch)
+		case ch == '/' && !encodeSlash:
+			b.WriteByte(ch)
+		default:
+			b.WriteString("%" + strings.ToUpper(strconv.FormatUint(uint64(ch)|0x100, 16)[1:]))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,141 @@
+package objstore
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FakeS3 is an in-memory S3-compatible server for the tests, serve it with httptest.NewServer.
+// it supports the PUT, the ranged GET, the DELETE of the objects and the ListObjectsV2 with a prefix,
+// the signatures are not verified
+type FakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte // by "bucket/key"
+	// the number of the requests by the method
+	requests map[string]int
+}
+
+func NewFakeS3() *FakeS3 {
+	return &FakeS3{
+		objects:  make(map[string][]byte),
+		requests: make(map[string]int),
+	}
+}
+
+// Objects return the keys of the objects in the bucket
+func (f *FakeS3) Objects(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var keys []string
+	for name := range f.objects {
+		if key, ok := strings.CutPrefix(name, bucket+"/"); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// RequestCount return the number of the requests of the method
+func (f *FakeS3) RequestCount(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[method]
+}
+
+func (f *FakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[r.Method]++
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, bucket, r.URL.Query().Get("prefix"))
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[bucket+"/"+key] = data
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[bucket+"/"+key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		start, end, ok := parseRange(r.Header.Get("Range"), int64(len(data)))
+		if !ok {
+			http.Error(w, "InvalidRange", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(data[start:end])
+	case r.Method == http.MethodDelete:
+		delete(f.objects, bucket+"/"+key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "NotImplemented", http.StatusNotImplemented)
+	}
+}
+
+func (f *FakeS3) list(w http.ResponseWriter, bucket, prefix string) {
+	var result listBucketResult
+	for name, data := range f.objects {
+		key, ok := strings.CutPrefix(name, bucket+"/")
+		if !ok || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		result.Contents = append(result.Contents, struct {
+			Key  string
+			Size int64
+		}{Key: key, Size: int64(len(data))})
+	}
+	sort.Slice(result.Contents, func(i, j int) bool {
+		return result.Contents[i].Key < result.Contents[j].Key
+	})
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		listBucketResult
+	}{listBucketResult: result})
+}
+
+// parseRange return the [start, end) of the range "bytes=start-end", the whole data if it is empty
+func parseRange(header string, size int64) (int64, int64, bool) {
+	if header == "" {
+		return 0, size, true
+	}
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, 0, false
+	}
+	startStr, endStr, _ := strings.Cut(spec, "-")
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if endStr != "" {
+		if end, err = strconv.ParseInt(endStr, 10, 64); err != nil {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end + 1, true
+}
@@ -0,0 +1,546 @@
+package objstore
+
+import (
+	"github.com/cqkv/cqkv/fio"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBlockSize = 1024 * 1024      // 1mb
+	DefaultCacheSize = 64 * 1024 * 1024 // 64mb
+
+	dataFileSuffix = ".cq"
+	blobFileSuffix = ".blob"
+)
+
+type Options struct {
+	// Prefix is the prefix of the keys of the objects
+	Prefix string
+	// BlockSize is the size of the ranged GETs
+	BlockSize int64
+	// CacheSize is the bytes of the blocks cached in memory
+	CacheSize int64
+}
+
+// FS keep the sealed data files and blob files of the db dir in the bucket, the other files are on the local fio.FS.
+// the object of a data file is named by the file name and an upload id, so an object being read
+// is never replaced, it is deleted after the files reading it are closed.
+// the file failed to upload stays local and is uploaded again when it is sealed at the next opening
+type FS struct {
+	fio.FS
+
+	dir     string
+	client  *Client
+	options Options
+	cache   *blockCache
+
+	mu sync.Mutex
+	// the uploaded data files by the file name
+	remote map[string]*remoteObject
+	// closed when the upload of the data file ends
+	uploads  map[string]chan struct{}
+	uploadID int64
+}
+
+type remoteObject struct {
+	key     string
+	size    int64
+	refs    int
+	removed bool
+}
+
+var _ fio.FS = (*FS)(nil)
+
+// NewFS keep the data files of the db dir in the bucket of client, local is usually fio.OSFS
+func NewFS(local fio.FS, dir string, client *Client, options Options) (*FS, error) {
+	if options.BlockSize <= 0 {
+		options.BlockSize = DefaultBlockSize
+	}
+	if options.CacheSize <= 0 {
+		options.CacheSize = DefaultCacheSize
+	}
+	f := &FS{
+		FS:      local,
+		dir:     filepath.Clean(dir),
+		client:  client,
+		options: options,
+		cache:   newBlockCache(options.CacheSize),
+		remote:  make(map[string]*remoteObject),
+		uploads: make(map[string]chan struct{}),
+	}
+
+	objects, err := client.ListObjects(options.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	// keep the latest upload of each data file, the others are left by the crashes
+	ids := make(map[string]int64)
+	for _, object := range objects {
+		name, id, ok := f.parseObjectKey(object.Key)
+		if !ok {
+			continue
+		}
+		if old, ok := f.remote[name]; ok {
+			stale := old.key
+			if id < ids[name] {
+				stale = object.Key
+			}
+			if err = client.DeleteObject(stale); err != nil {
+				return nil, err
+			}
+			if stale == object.Key {
+				continue
+			}
+		}
+		f.remote[name] = &remoteObject{key: object.Key, size: object.Size}
+		ids[name] = id
+		if id > f.uploadID {
+			f.uploadID = id
+		}
+	}
+	return f, nil
+}
+
+// WaitUploads wait for the uploads started before
+func (f *FS) WaitUploads() {
+	f.mu.Lock()
+	uploads := make([]chan struct{}, 0, len(f.uploads))
+	for _, done := range f.uploads {
+		uploads = append(uploads, done)
+	}
+	f.mu.Unlock()
+
+	for _, done := range uploads {
+		<-done
+	}
+}
+
+// Uploaded return the names of the uploaded data files
+func (f *FS) Uploaded() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := make([]string, 0, len(f.remote))
+	for name := range f.remote {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *FS) OpenFile(name string) (fio.IOManager, error) {
+	if !f.isDataFile(name) {
+		return f.FS.OpenFile(name)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.FS.Stat(name); os.IsNotExist(err) {
+		if object, ok := f.remote[filepath.Base(name)]; ok {
+			object.refs++
+			return &IO{fs: f, name: name, remote: object}, nil
+		}
+	}
+	local, err := f.FS.OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &IO{fs: f, name: name, local: local}, nil
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := f.FS.ReadDir(name)
+	if err != nil || filepath.Clean(name) != f.dir {
+		return entries, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	local := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		local[entry.Name()] = true
+	}
+	for fileName, object := range f.remote {
+		if !local[fileName] {
+			entries = append(entries, &objectInfo{name: fileName, size: object.size})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	info, err := f.FS.Stat(name)
+	if !os.IsNotExist(err) || !f.isDataFile(name) {
+		return info, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if object, ok := f.remote[filepath.Base(name)]; ok {
+		return &objectInfo{name: filepath.Base(name), size: object.size}, nil
+	}
+	return nil, err
+}
+
+// Rename move the local file, the data file uploaded at newpath is removed
+func (f *FS) Rename(oldpath, newpath string) error {
+	if !f.isDataFile(newpath) {
+		return f.FS.Rename(oldpath, newpath)
+	}
+
+	f.lockUploaded(filepath.Base(newpath))
+	defer f.mu.Unlock()
+	if err := f.FS.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	if object, ok := f.remote[filepath.Base(newpath)]; ok {
+		delete(f.remote, filepath.Base(newpath))
+		return f.removeObject(object)
+	}
+	return nil
+}
+
+func (f *FS) Remove(name string) error {
+	if !f.isDataFile(name) {
+		return f.FS.Remove(name)
+	}
+
+	f.lockUploaded(filepath.Base(name))
+	defer f.mu.Unlock()
+	err := f.FS.Remove(name)
+	if object, ok := f.remote[filepath.Base(name)]; ok {
+		delete(f.remote, filepath.Base(name))
+		return f.removeObject(object)
+	}
+	return err
+}
+
+func (f *FS) RemoveAll(path string) error {
+	if err := f.FS.RemoveAll(path); err != nil {
+		return err
+	}
+	if filepath.Clean(path) != f.dir {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name, object := range f.remote {
+		delete(f.remote, name)
+		if err := f.removeObject(object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isDataFile check whether the file is a data file or a blob file of the db dir
+func (f *FS) isDataFile(name string) bool {
+	name = filepath.Clean(name)
+	return filepath.Dir(name) == f.dir && hasDataFileSuffix(name)
+}
+
+func hasDataFileSuffix(name string) bool {
+	return strings.HasSuffix(name, dataFileSuffix) || strings.HasSuffix(name, blobFileSuffix)
+}
+
+// lockUploaded hold the lock after the upload of the data file ends
+func (f *FS) lockUploaded(fileName string) {
+	for {
+		f.mu.Lock()
+		done, ok := f.uploads[fileName]
+		if !ok {
+			return
+		}
+		f.mu.Unlock()
+		<-done
+	}
+}
+
+// objectKey return the key of a new upload of the data file, the caller should hold the lock
+func (f *FS) objectKey(fileName string) string {
+	id := time.Now().UnixNano()
+	if id <= f.uploadID {
+		id = f.uploadID + 1
+	}
+	f.uploadID = id
+	return f.options.Prefix + fileName + "." + strconv.FormatInt(id, 10)
+}
+
+// parseObjectKey return the name of the data file and the upload id of the object
+func (f *FS) parseObjectKey(key string) (string, int64, bool) {
+	key, ok := strings.CutPrefix(key, f.options.Prefix)
+	if !ok {
+		return "", 0, false
+	}
+	i := strings.LastIndexByte(key, '.')
+	if i < 0 || !hasDataFileSuffix(key[:i]) || strings.Contains(key[:i], "/") {
+		return "", 0, false
+	}
+	id, err := strconv.ParseInt(key[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return key[:i], id, true
+}
+
+// removeObject delete the object if no file reads it, the caller should hold the lock
+func (f *FS) removeObject(object *remoteObject) error {
+	object.removed = true
+	if object.refs > 0 {
+		return nil
+	}
+	f.cache.removeObject(object.key)
+	return f.client.DeleteObject(object.key)
+}
+
+// release the object read by the closed file
+func (f *FS) release(object *remoteObject) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object.refs--
+	if object.refs == 0 && object.removed {
+		return f.removeObject(object)
+	}
+	return nil
+}
+
+// readRemote read the object by the blocks
+func (f *FS) readRemote(object *remoteObject, buf []byte, offset int64) (int, error) {
+	if offset >= object.size {
+		return 0, io.EOF
+	}
+	n := len(buf)
+	if rest := object.size - offset; int64(n) > rest {
+		n = int(rest)
+	}
+
+	for read := 0; read < n; {
+		pos := offset + int64(read)
+		index := pos / f.options.BlockSize
+		data, err := f.readBlock(object, index)
+		if err != nil {
+			return read, err
+		}
+		read += copy(buf[read:n], data[pos-index*f.options.BlockSize:])
+	}
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *FS) readBlock(object *remoteObject, index int64) ([]byte, error) {
+	key := blockKey{object: object.key, index: index}
+	if data, ok := f.cache.get(key); ok {
+		return data, nil
+	}
+
+	start := index * f.options.BlockSize
+	size := f.options.BlockSize
+	if rest := object.size - start; size > rest {
+		size = rest
+	}
+	data, err := f.client.GetObjectRange(object.key, start, size)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	f.cache.put(key, data)
+	return data, nil
+}
+
+// IO is the data file on the local file system until it is sealed and uploaded
+type IO struct {
+	fs   *FS
+	name string
+
+	mu     sync.RWMutex
+	local  fio.IOManager
+	remote *remoteObject
+	sealed bool
+	// the upload closes the local file if the file is closed during the upload
+	uploading bool
+	closed    bool
+}
+
+func (oio *IO) Read(buf []byte, offset int64) (int, error) {
+	oio.mu.RLock()
+	defer oio.mu.RUnlock()
+	if oio.remote != nil {
+		return oio.fs.readRemote(oio.remote, buf, offset)
+	}
+	return oio.local.Read(buf, offset)
+}
+
+func (oio *IO) Write(data []byte) (int, error) {
+	oio.mu.RLock()
+	defer oio.mu.RUnlock()
+	if oio.sealed || oio.remote != nil {
+		return 0, ErrReadOnly
+	}
+	return oio.local.Write(data)
+}
+
+func (oio *IO) Sync() error {
+	oio.mu.RLock()
+	defer oio.mu.RUnlock()
+	if oio.remote != nil {
+		return nil
+	}
+	return oio.local.Sync()
+}
+
+func (oio *IO) Size() (int64, error) {
+	oio.mu.RLock()
+	defer oio.mu.RUnlock()
+	if oio.remote != nil {
+		return oio.remote.size, nil
+	}
+	return oio.local.Size()
+}
+
+// DiskSize return the size of the local file, the uploaded file takes no space on the disk
+func (oio *IO) DiskSize() (int64, error) {
+	oio.mu.RLock()
+	defer oio.mu.RUnlock()
+	if oio.remote != nil {
+		return 0, nil
+	}
+	if sizer, ok := oio.local.(fio.DiskSizer); ok {
+		return sizer.DiskSize()
+	}
+	return oio.local.Size()
+}
+
+func (oio *IO) Truncate(size int64) error {
+	oio.mu.RLock()
+	defer oio.mu.RUnlock()
+	if oio.remote != nil {
+		if size == oio.remote.size {
+			return nil
+		}
+		return ErrReadOnly
+	}
+	return fio.Truncate(oio.local, size)
+}
+
+func (oio *IO) Close() error {
+	oio.mu.Lock()
+	defer oio.mu.Unlock()
+	if oio.closed {
+		return nil
+	}
+	oio.closed = true
+	if oio.remote != nil {
+		return oio.fs.release(oio.remote)
+	}
+	if oio.uploading {
+		return nil
+	}
+	return oio.local.Close()
+}
+
+// Seal upload the data file in background, the reads go to the bucket after it is uploaded
+func (oio *IO) Seal() error {
+	oio.mu.Lock()
+	defer oio.mu.Unlock()
+	if oio.sealed || oio.remote != nil || oio.closed {
+		return nil
+	}
+	oio.sealed = true
+	oio.uploading = true
+
+	fileName := filepath.Base(oio.name)
+	done := make(chan struct{})
+	oio.fs.mu.Lock()
+	oio.fs.uploads[fileName] = done
+	key := oio.fs.objectKey(fileName)
+	oio.fs.mu.Unlock()
+
+	go oio.upload(key, done)
+	return nil
+}
+
+func (oio *IO) upload(key string, done chan struct{}) {
+	fileName := filepath.Base(oio.name)
+	defer func() {
+		oio.fs.mu.Lock()
+		delete(oio.fs.uploads, fileName)
+		oio.fs.mu.Unlock()
+		close(done)
+	}()
+
+	size, err := oio.local.Size()
+	if err == nil {
+		err = oio.fs.client.PutObject(key, newSectionReader(oio.local, size), size)
+	}
+
+	oio.mu.Lock()
+	defer oio.mu.Unlock()
+	oio.uploading = false
+	if err != nil {
+		// keep the local file
+		if oio.closed {
+			_ = oio.local.Close()
+		}
+		return
+	}
+
+	object := &remoteObject{key: key, size: size, refs: 1}
+	oio.fs.mu.Lock()
+	if old, ok := oio.fs.remote[fileName]; ok {
+		_ = oio.fs.removeObject(old)
+	}
+	oio.fs.remote[fileName] = object
+	oio.fs.mu.Unlock()
+
+	_ = oio.local.Close()
+	oio.local = nil
+	if oio.closed {
+		_ = oio.fs.release(object)
+	} else {
+		oio.remote = object
+	}
+	_ = oio.fs.FS.Remove(oio.name)
+}
+
+// ioReaderAt read the IOManager as an io.ReaderAt
+type ioReaderAt struct {
+	fio.IOManager
+}
+
+func (r ioReaderAt) ReadAt(buf []byte, offset int64) (int, error) {
+	return r.IOManager.Read(buf, offset)
+}
+
+func newSectionReader(ioManager fio.IOManager, size int64) io.Reader {
+	return io.NewSectionReader(ioReaderAt{ioManager}, 0, size)
+}
+
+// objectInfo implement fs.FileInfo and fs.DirEntry of the uploaded data file
+type objectInfo struct {
+	name string
+	size int64
+}
+
+func (oi *objectInfo) Name() string               { return oi.name }
+func (oi *objectInfo) Size() int64                { return oi.size }
+func (oi *objectInfo) Mode() fs.FileMode          { return 0644 }
+func (oi *objectInfo) ModTime() time.Time         { return time.Time{} }
+func (oi *objectInfo) IsDir() bool                { return false }
+func (oi *objectInfo) Sys() any                   { return nil }
+func (oi *objectInfo) Type() fs.FileMode          { return 0 }
+func (oi *objectInfo) Info() (fs.FileInfo, error) { return oi, nil }
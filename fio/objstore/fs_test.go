@@ -0,0 +1,87 @@
+package objstore
+
+import (
+	"github.com/cqkv/cqkv/fio"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestFS_Seal(t *testing.T) {
+	fake := NewFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := NewClient(Config{Endpoint: server.URL, Bucket: "bucket", AccessKey: "key", SecretKey: "secret"})
+	defer os.RemoveAll("./objstore-data")
+	assert.Nil(t, os.MkdirAll("./objstore-data", os.ModePerm))
+
+	f, err := NewFS(fio.OSFS{}, "./objstore-data", client, Options{Prefix: "db/", BlockSize: 4})
+	assert.Nil(t, err)
+	ioManager, err := f.OpenFile("./objstore-data/000000000.cq")
+	assert.Nil(t, err)
+	_, err = ioManager.Write([]byte("hello world"))
+	assert.Nil(t, err)
+
+	// the sealed file is uploaded and removed from the local dir
+	assert.Nil(t, ioManager.(fio.Sealer).Seal())
+	f.WaitUploads()
+	assert.Equal(t, []string{"000000000.cq"}, f.Uploaded())
+	_, err = os.Stat("./objstore-data/000000000.cq")
+	assert.True(t, os.IsNotExist(err))
+	_, err = ioManager.Write([]byte("!"))
+	assert.Equal(t, ErrReadOnly, err)
+	// the uploaded file takes no space on the disk
+	diskSize, err := ioManager.(fio.DiskSizer).DiskSize()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), diskSize)
+
+	buf := make([]byte, 8)
+	n, err := ioManager.Read(buf, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, "lo world", string(buf[:n]))
+	n, err = ioManager.Read(buf, 6)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "world", string(buf[:n]))
+	// the blocks are cached
+	gets := fake.RequestCount(http.MethodGet)
+	_, err = ioManager.Read(buf, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, gets, fake.RequestCount(http.MethodGet))
+
+	// the uploaded file is listed
+	entries, err := f.ReadDir("./objstore-data")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "000000000.cq", entries[0].Name())
+	info, err := f.Stat("./objstore-data/000000000.cq")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), info.Size())
+
+	// the object is deleted after the file reading it is closed
+	assert.Nil(t, f.Remove("./objstore-data/000000000.cq"))
+	assert.Equal(t, 1, len(fake.Objects("bucket")))
+	n, err = ioManager.Read(buf[:5], 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+	assert.Nil(t, ioManager.Close())
+	assert.Equal(t, 0, len(fake.Objects("bucket")))
+}
+
+func TestNewFS(t *testing.T) {
+	fake := NewFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := NewClient(Config{Endpoint: server.URL, Bucket: "bucket", AccessKey: "key", SecretKey: "secret"})
+	for _, key := range []string{"db/000000001.cq.1", "db/000000001.cq.2", "db/000000002.cq.1", "db/000000000.blob.1", "db/other"} {
+		assert.Nil(t, client.PutObject(key, nil, 0))
+	}
+
+	// the stale uploads are deleted
+	f, err := NewFS(fio.NewMemFS(), "./data", client, Options{Prefix: "db/"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"000000000.blob", "000000001.cq", "000000002.cq"}, f.Uploaded())
+	assert.Equal(t, []string{"db/000000000.blob.1", "db/000000001.cq.2", "db/000000002.cq.1", "db/other"}, fake.Objects("bucket"))
+}
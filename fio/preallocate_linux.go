@@ -0,0 +1,18 @@
+//go:build linux
+
+package fio
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate reserve size bytes of the file with fallocate, the space is zero-filled
+func preallocate(fd *os.File, size int64) error {
+	err := syscall.Fallocate(int(fd.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		// the file system does not support fallocate
+		return fd.Truncate(size)
+	}
+	return err
+}
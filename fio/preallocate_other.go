@@ -0,0 +1,12 @@
+//go:build !linux
+
+package fio
+
+import (
+	"os"
+)
+
+// preallocate extend the file to size, the space is zero-filled but may not be reserved
+func preallocate(fd *os.File, size int64) error {
+	return fd.Truncate(size)
+}
@@ -0,0 +1,202 @@
+package cqkv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/cqkv/cqkv/model"
+	"io"
+	"os"
+)
+
+// dataHintFinishedKey is the key of the last record in the data hint file
+var dataHintFinishedKey = []byte("cqkv-data-hint-finished")
+
+/*
+data hint file: every older data file has a hint file named <fid>.hint
+	- pos records: key = record key, flags = record flags, value = record pos
+	  the pos of a range tombstone keeps the end of the range as the inline value
+	- finished record: key = cqkv-data-hint-finished, value = data file size (varint)
+the records are in the same order as the data file, so the transactions can be replayed.
+a hint file without the finished record is corrupted.
+*/
+
+// writeDataHintFileAsync generate the hint file of an older data file in background
+func (db *DB) writeDataHintFileAsync(dataFile *model.DataFile) {
+	db.hintWg.Add(1)
+	go func() {
+		defer db.hintWg.Done()
+		// the hint file is only used to speed up the opening, ignore the error
+		if err := db.writeDataHintFile(db.options.dirPath, dataFile); err != nil {
+			db.options.logger.Warn("write hint file failed", "fid", dataFile.Fid, "err", err)
+		}
+	}()
+}
+
+// writeDataHintFile write the hint file of the data file to dirPath
+func (db *DB) writeDataHintFile(dirPath string, dataFile *model.DataFile) error {
+	buf := new(bytes.Buffer)
+
+	// read data file
+	var offset int64
+	for {
+		record, size, err := db.getRecordFromDataFile(dataFile, offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		pos := &model.RecordPos{
+			Fid:      dataFile.Fid,
+			Size:     uint32(size),
+			Offset:   offset,
+			Seq:      record.Seq,
+			ExpireAt: record.ExpireAt,
+		}
+		db.setEntryValue(pos, record)
+
+		posValue, err := db.options.codec.MarshalRecordPos(pos)
+		if err != nil {
+			return err
+		}
+		hintRecordData, _, err := db.marshalRecord(&model.Record{
+			Key:           record.Key,
+			Value:         posValue,
+			IsDelete:      record.IsDelete,
+			IsRangeDelete: record.IsRangeDelete,
+			Keyspace:      record.Keyspace,
+		})
+		if err != nil {
+			return err
+		}
+		buf.Write(hintRecordData)
+
+		offset += size
+	}
+
+	// the finished record store the size of the data file
+	sizeBuf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(sizeBuf, offset)
+	finishedRecordData, _, err := db.marshalRecord(&model.Record{
+		Key:   dataHintFinishedKey,
+		Value: sizeBuf[:n],
+	})
+	if err != nil {
+		return err
+	}
+	buf.Write(finishedRecordData)
+
+	hintFileName := model.GetDataFileName(dirPath, model.DataHintFileType, dataFile.Fid)
+	// remove the broken hint file, the file is opened in append mode
+	if err = db.options.fs.Remove(hintFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	hintIoManager, err := db.options.ioManagerCreator(hintFileName)
+	if err != nil {
+		return err
+	}
+	defer hintIoManager.Close()
+	hintFile := model.OpenDataFile(dataFile.Fid, hintIoManager)
+
+	if err = hintFile.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return hintFile.Sync()
+}
+
+// decodeDataHintFile read the entries from the hint file of the data file,
+// ok is false if the hint file is missing or corrupted
+func (db *DB) decodeDataHintFile(dataFile *model.DataFile) ([]*decodedEntry, bool, error) {
+	hintFileName := model.GetDataFileName(db.options.dirPath, model.DataHintFileType, dataFile.Fid)
+	if _, err := db.options.fs.Stat(hintFileName); os.IsNotExist(err) {
+		return nil, false, nil
+	}
+
+	hintIoManager, err := db.options.ioManagerCreator(hintFileName)
+	if err != nil {
+		return nil, false, err
+	}
+	defer hintIoManager.Close()
+	hintFile := model.OpenDataFile(dataFile.Fid, hintIoManager)
+
+	var (
+		entries  []*decodedEntry
+		finished bool
+		offset   int64
+	)
+	for {
+		record, size, err := db.getRecordFromDataFile(hintFile, offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, false, nil
+		}
+		offset += size
+
+		// the finished record must be the last one
+		if finished {
+			return nil, false, nil
+		}
+		if bytes.Equal(record.Key, dataHintFinishedKey) {
+			dataFileSize, n := binary.Varint(record.Value)
+			if n <= 0 {
+				return nil, false, nil
+			}
+			fileSize, err := dataFile.IoManager.Size()
+			if err != nil {
+				return nil, false, err
+			}
+			if dataFileSize != fileSize {
+				return nil, false, nil
+			}
+			finished = true
+			continue
+		}
+
+		pos := new(model.RecordPos)
+		if err = db.options.codec.UnmarshalRecordPos(record.Value, pos); err != nil {
+			return nil, false, nil
+		}
+		entries = append(entries, &decodedEntry{
+			key:           record.Key,
+			keyspace:      record.Keyspace,
+			isDelete:      record.IsDelete,
+			isRangeDelete: record.IsRangeDelete,
+			pos:           pos,
+		})
+	}
+
+	if !finished {
+		return nil, false, nil
+	}
+
+	for _, entry := range entries {
+		if entry.isDelete || entry.isRangeDelete {
+			continue
+		}
+
+		// the inline value size may be changed since the hint file was written
+		pos := entry.pos
+		if int64(len(pos.Value)) >= db.options.inlineValueSize {
+			pos.Value = nil
+		}
+		realKey, _ := parseTxSeqPrefix(entry.key)
+		if err = db.fillInlineValue(realKey, pos); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return entries, true, nil
+}
+
+// removeDataHintFile remove the hint file of the data file
+func (db *DB) removeDataHintFile(dirPath string, fid uint32) error {
+	hintFileName := model.GetDataFileName(dirPath, model.DataHintFileType, fid)
+	if err := db.options.fs.Remove(hintFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
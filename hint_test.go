@@ -0,0 +1,104 @@
+package cqkv
+
+import (
+	"fmt"
+	"github.com/cqkv/cqkv/model"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestDB_DataHintFile(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(1024))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%v", i)), []byte(fmt.Sprintf("value-%v", i)))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 10; i++ {
+		err = db.Delete([]byte(fmt.Sprintf("key-%v", i)))
+		assert.Nil(t, err)
+	}
+
+	// the transaction may cross the data files
+	wb := db.NewWriteBatch()
+	for i := 100; i < 150; i++ {
+		err = wb.Put([]byte(fmt.Sprintf("key-%v", i)), []byte(fmt.Sprintf("value-%v", i)))
+		assert.Nil(t, err)
+	}
+	err = wb.Commit()
+	assert.Nil(t, err)
+	err = db.Sync()
+	assert.Nil(t, err)
+
+	// every older data file has a hint file
+	db.hintWg.Wait()
+	assert.True(t, len(db.olderFiles) > 1)
+	for fid := range db.olderFiles {
+		_, err = os.Stat(model.GetDataFileName("./tmp/", model.DataHintFileType, fid))
+		assert.Nil(t, err)
+
+		_, ok, err := db.decodeDataHintFile(db.olderFiles[fid])
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+
+	// reopen without snapshot
+	releaseLock(t, db)
+	db, err = Open("./tmp/", WithDataFileSize(1024))
+	assert.Nil(t, err)
+	assert.Equal(t, 140, len(db.ListKeys()))
+	for i := 10; i < 150; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("key-%v", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("value-%v", i), string(value))
+	}
+	assert.Equal(t, uint64(1), db.txSeq)
+}
+
+func TestDB_DataHintFile_Corrupted(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(1024))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%v", i)), []byte(fmt.Sprintf("value-%v", i)))
+		assert.Nil(t, err)
+	}
+	err = db.Sync()
+	assert.Nil(t, err)
+	db.hintWg.Wait()
+
+	// truncate the hint file of the first data file
+	hintFileName := model.GetDataFileName("./tmp/", model.DataHintFileType, 0)
+	info, err := os.Stat(hintFileName)
+	assert.Nil(t, err)
+	err = os.Truncate(hintFileName, info.Size()-1)
+	assert.Nil(t, err)
+
+	_, ok, err := db.decodeDataHintFile(db.olderFiles[0])
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// the data file is scanned and the hint file is regenerated
+	releaseLock(t, db)
+	db, err = Open("./tmp/", WithDataFileSize(1024))
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(db.ListKeys()))
+	value, err := db.Get([]byte("key-0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value-0", string(value))
+
+	db.hintWg.Wait()
+	_, ok, err = db.decodeDataHintFile(db.olderFiles[0])
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
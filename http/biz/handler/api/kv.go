@@ -4,7 +4,12 @@ package api
 
 import (
 	"context"
+	"fmt"
 	"github.com/cqkv/cqkv"
+	"github.com/cqkv/cqkv/metrics"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/cloudwego/hertz/pkg/app"
 	"github.com/cloudwego/hertz/pkg/protocol/consts"
@@ -13,9 +18,12 @@ import (
 
 var db *cqkv.DB
 
+// registry hold the metrics of db
+var registry = metrics.NewRegistry()
+
 func init() {
 	var err error
-	db, err = cqkv.Open("./tmp/")
+	db, err = cqkv.Open("./tmp/", cqkv.WithMetrics(registry))
 	if err != nil {
 		panic(err)
 	}
@@ -35,7 +43,25 @@ func Get(ctx context.Context, c *app.RequestContext) {
 	resp := new(api.GetResp)
 	resp.BaseResp = new(api.BaseResp)
 
-	value, err := db.Get([]byte(req.Key))
+	// only the conditional requests need the sequence and the write time of the record,
+	// the others get the value, so the inline values are served from the keydir
+	ifNoneMatch, ifModifiedSince := string(c.GetHeader("If-None-Match")), string(c.GetHeader("If-Modified-Since"))
+	if ifNoneMatch == "" && ifModifiedSince == "" {
+		value, err := db.Get([]byte(req.Key))
+		if err != nil {
+			resp.BaseResp.Code = "500"
+			resp.BaseResp.Msg = err.Error()
+			c.JSON(consts.StatusInternalServerError, resp)
+			return
+		}
+		resp.BaseResp.Code = "0"
+		resp.BaseResp.Msg = "success"
+		resp.Value = string(value)
+		c.JSON(consts.StatusOK, resp)
+		return
+	}
+
+	meta, err := db.GetWithMeta([]byte(req.Key))
 	if err != nil {
 		resp.BaseResp.Code = "500"
 		resp.BaseResp.Msg = err.Error()
@@ -43,13 +69,41 @@ func Get(ctx context.Context, c *app.RequestContext) {
 		return
 	}
 
+	// the sequence changes on every write of the key
+	etag := fmt.Sprintf("\"%d\"", meta.Seq)
+	c.Header("ETag", etag)
+	if !meta.Timestamp.IsZero() {
+		c.Header("Last-Modified", meta.Timestamp.UTC().Format(http.TimeFormat))
+	}
+	if notModified(ifNoneMatch, ifModifiedSince, etag, meta.Timestamp) {
+		c.Status(consts.StatusNotModified)
+		return
+	}
+
 	resp.BaseResp.Code = "0"
 	resp.BaseResp.Msg = "success"
-	resp.Value = string(value)
-
+	resp.Value = string(meta.Value)
 	c.JSON(consts.StatusOK, resp)
 }
 
+// notModified check the conditional headers, If-None-Match is used if both are set
+func notModified(ifNoneMatch, ifModifiedSince, etag string, modified time.Time) bool {
+	if ifNoneMatch != "" {
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			if tag = strings.TrimSpace(tag); tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil || modified.IsZero() {
+		return false
+	}
+	// Last-Modified has the precision of seconds
+	return !modified.Truncate(time.Second).After(since)
+}
+
 // Put .
 // @router /cqkv [POST]
 func Put(ctx context.Context, c *app.RequestContext) {
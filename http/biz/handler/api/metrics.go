@@ -0,0 +1,20 @@
+package api
+
+import (
+	"context"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/common/adaptor"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+)
+
+// Metrics expose the metrics of db in the prometheus text format.
+// @router /metrics [GET]
+func Metrics(ctx context.Context, c *app.RequestContext) {
+	req, err := adaptor.GetCompatRequest(&c.Request)
+	if err != nil {
+		c.String(consts.StatusBadRequest, err.Error())
+		return
+	}
+	registry.Handler().ServeHTTP(adaptor.GetCompatResponseWriter(&c.Response), req)
+}
@@ -5,11 +5,13 @@ package main
 import (
 	"github.com/cloudwego/hertz/pkg/app/server"
 	handler "github.com/cqkv/cqkv/http/biz/handler"
+	"github.com/cqkv/cqkv/http/biz/handler/api"
 )
 
 // customizeRegister registers customize routers.
 func customizedRegister(r *server.Hertz) {
 	r.GET("/ping", handler.Ping)
+	r.GET("/metrics", api.Metrics)
 
 	// your code ...
 }
@@ -2,11 +2,9 @@ package keydir
 
 import (
 	"bytes"
-	"fmt"
 	"github.com/cqkv/cqkv/model"
 	"github.com/google/btree"
 	"sync"
-	"time"
 )
 
 var _ Keydir = (*BTree)(nil)
@@ -49,10 +47,7 @@ func (bt *BTree) Put(key []byte, value *model.RecordPos) bool {
 	}
 	bt.lock.Lock()
 	defer bt.lock.Unlock()
-	start := time.Now()
 	bt.tree.ReplaceOrInsert(item)
-	fmt.Println("btree put time:", time.Since(start))
-	fmt.Println()
 	return true
 }
 
@@ -60,7 +55,9 @@ func (bt *BTree) Get(key []byte) *model.RecordPos {
 	item := &Item{
 		key: key,
 	}
+	bt.lock.RLock()
 	btItem := bt.tree.Get(item)
+	bt.lock.RUnlock()
 	if btItem == nil {
 		return nil
 	}
@@ -77,7 +74,24 @@ func (bt *BTree) Delete(key []byte) bool {
 	return res != nil
 }
 
+func (bt *BTree) Range(start, end []byte, fn func(key []byte, pos *model.RecordPos) bool) {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
+
+	iter := func(item btree.Item) bool {
+		i := item.(*Item)
+		return fn(i.key, i.pos)
+	}
+	if len(end) == 0 {
+		bt.tree.AscendGreaterOrEqual(&Item{key: start}, iter)
+		return
+	}
+	bt.tree.AscendRange(&Item{key: start}, &Item{key: end}, iter)
+}
+
 func (bt *BTree) Size() int {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
 	return bt.tree.Len()
 }
 
@@ -96,6 +110,9 @@ type btreeIterator struct {
 }
 
 func (bt *BTree) newBtreeIterator() *btreeIterator {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
+
 	iterator := &btreeIterator{
 		values: make([]*Item, bt.tree.Len()),
 		curIdx: 0,
@@ -114,3 +114,34 @@ func TestBtree_Put(t *testing.T) {
 		assert.True(t, res)
 	}
 }
+
+func TestBTree_Range(t *testing.T) {
+	bt := NewBTree(32)
+	for _, key := range []string{"a", "b1", "b2", "b3", "c"} {
+		res := bt.Put([]byte(key), &model.RecordPos{Fid: 1})
+		assert.True(t, res)
+	}
+
+	var keys []string
+	bt.Range([]byte("b"), []byte("c"), func(key []byte, pos *model.RecordPos) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	assert.Equal(t, []string{"b1", "b2", "b3"}, keys)
+
+	// no upper bound
+	keys = nil
+	bt.Range([]byte("b2"), nil, func(key []byte, pos *model.RecordPos) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	assert.Equal(t, []string{"b2", "b3", "c"}, keys)
+
+	// stop early
+	keys = nil
+	bt.Range(nil, nil, func(key []byte, pos *model.RecordPos) bool {
+		keys = append(keys, string(key))
+		return len(keys) < 2
+	})
+	assert.Equal(t, []string{"a", "b1"}, keys)
+}
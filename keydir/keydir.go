@@ -18,6 +18,9 @@ type Keydir interface {
 	Delete(key []byte) bool
 	Size() int
 	Iterator() Iterator
+	// Range call fn for the keys in [start, end) in order until fn returns false,
+	// an empty end means no upper bound
+	Range(start, end []byte, fn func(key []byte, pos *model.RecordPos) bool)
 	Close() error
 }
 
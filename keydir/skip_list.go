@@ -28,6 +28,9 @@ func (sl *SkipList) Iterator() Iterator {
 	return nil
 }
 
+func (sl *SkipList) Range(start, end []byte, fn func(key []byte, pos *model.RecordPos) bool) {
+}
+
 func (sl *SkipList) Size() int {
 	return sl.len
 }
@@ -0,0 +1,627 @@
+package cqkv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/cqkv/cqkv/codec"
+	"github.com/cqkv/cqkv/keydir"
+	"github.com/cqkv/cqkv/model"
+	"sort"
+	"time"
+)
+
+const (
+	// defaultKeyspaceID is the keyspace of the DB methods,
+	// its records have no keyspace in the header, the same as the old format
+	defaultKeyspaceID uint32 = 0
+
+	// catalogKeyspaceID keep the named keyspaces: key = name, value = id (uvarint)
+	catalogKeyspaceID uint32 = 1
+)
+
+// Keyspace is a named set of keys isolated from the other keyspaces,
+// every keyspace has its own keydir and all the keyspaces share the data files
+type Keyspace struct {
+	db   *DB
+	id   uint32
+	name string
+	// keydir is keyed by the real key. the keys in the data files have the transaction sequence prefix,
+	// it is removed when the records are loaded, so the keys of the transactions are found by Get
+	keydir keydir.Keydir
+	// tombstones keep the tombstone versions of the deleted keys, the key written again links to it,
+	// so the versions before the delete are reachable. the entries are cleared by merge, protected by db.mu
+	tombstones map[string]*model.RecordVersion
+
+	dropped bool // the keyspace has been dropped, protected by db.mu
+}
+
+// Keyspace return the keyspace of the name, the keyspace is created if it does not exist
+func (db *DB) Keyspace(name string) (*Keyspace, error) {
+	if name == "" {
+		return nil, ErrEmptyKeyspace
+	}
+	// the keyspace id is kept in the record header, a custom codec may not write it
+	// and the keys would be loaded into the default keyspace after reopen
+	if _, ok := db.options.codec.(*codec.CodecImpl); !ok {
+		return nil, ErrKeyspaceNotSupported
+	}
+	if ks := db.getKeyspaceByName(name); ks != nil {
+		return ks, nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// the keyspace may be created while waiting for the lock
+	if ks := db.getKeyspaceByName(name); ks != nil {
+		return ks, nil
+	}
+
+	id := db.keyspaceSeq + 1
+	idBuf := make([]byte, binary.MaxVarintLen32)
+	n := binary.PutUvarint(idBuf, uint64(id))
+	if err := db.catalog.putLocked([]byte(name), idBuf[:n], 0); err != nil {
+		return nil, err
+	}
+
+	ks := db.loadKeyspace(id)
+	db.ksMu.Lock()
+	ks.name = name
+	db.keyspaceNames[name] = ks
+	db.ksMu.Unlock()
+	return ks, nil
+}
+
+// ListKeyspaces return the names of the keyspaces in order
+func (db *DB) ListKeyspaces() []string {
+	db.ksMu.RLock()
+	defer db.ksMu.RUnlock()
+
+	names := make([]string, 0, len(db.keyspaceNames))
+	for name := range db.keyspaceNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DropKeyspace delete all the keys of the keyspace and the keyspace itself,
+// the handles of the keyspace can not be written any more
+func (db *DB) DropKeyspace(name string) error {
+	ks := db.getKeyspaceByName(name)
+	if ks == nil {
+		return ErrNoKeyspace
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if ks.dropped {
+		return ErrNoKeyspace
+	}
+
+	// delete the keys before the keyspace,
+	// so the keys never come back if the id is used again
+	if err := ks.deleteRangeLocked(nil, nil); err != nil {
+		return err
+	}
+	if err := db.catalog.deleteLocked([]byte(name)); err != nil {
+		return err
+	}
+
+	ks.dropped = true
+	db.ksMu.Lock()
+	delete(db.keyspaceNames, name)
+	delete(db.keyspaces, ks.id)
+	db.ksMu.Unlock()
+	return ks.keydir.Close()
+}
+
+// getKeyspace return the keyspace of the id, nil if it does not exist
+func (db *DB) getKeyspace(id uint32) *Keyspace {
+	db.ksMu.RLock()
+	defer db.ksMu.RUnlock()
+	return db.keyspaces[id]
+}
+
+func (db *DB) getKeyspaceByName(name string) *Keyspace {
+	db.ksMu.RLock()
+	defer db.ksMu.RUnlock()
+	return db.keyspaceNames[name]
+}
+
+// loadKeyspace return the keyspace of the id, the keyspace is created if it does not exist
+func (db *DB) loadKeyspace(id uint32) *Keyspace {
+	db.ksMu.Lock()
+	defer db.ksMu.Unlock()
+
+	if ks, ok := db.keyspaces[id]; ok {
+		return ks
+	}
+
+	ks := &Keyspace{db: db, id: id, tombstones: make(map[string]*model.RecordVersion)}
+	if id == defaultKeyspaceID {
+		ks.keydir = db.options.keydir
+	} else {
+		ks.keydir = db.options.newKeydir()
+	}
+	db.keyspaces[id] = ks
+	if id > db.keyspaceSeq {
+		db.keyspaceSeq = id
+	}
+	return ks
+}
+
+// loadKeyspaceNames bind the names in the catalog to the keyspaces after the keydir is loaded,
+// the keyspaces no longer in the catalog are dropped, the caller should hold the lock
+func (db *DB) loadKeyspaceNames() error {
+	names := make(map[string]*Keyspace)
+	iterator := db.catalog.keydir.Iterator()
+	defer iterator.Close()
+
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		value := iterator.Value().Value
+		if value == nil {
+			record, err := db.get(iterator.Value())
+			if err != nil {
+				return err
+			}
+			if err = db.resolveBlob(record); err != nil {
+				return err
+			}
+			value = record.Value
+		}
+
+		id, n := binary.Uvarint(value)
+		if n <= 0 {
+			return ErrDataFileCorrupted
+		}
+		names[string(iterator.Key())] = db.loadKeyspace(uint32(id))
+	}
+
+	db.ksMu.Lock()
+	defer db.ksMu.Unlock()
+	for name, ks := range db.keyspaceNames {
+		if names[name] != ks {
+			ks.dropped = true
+			delete(db.keyspaces, ks.id)
+		}
+	}
+	for name, ks := range names {
+		ks.name = name
+	}
+	db.keyspaceNames = names
+	return nil
+}
+
+// Name return the name of the keyspace, it is empty for the default keyspace
+func (ks *Keyspace) Name() string {
+	return ks.name
+}
+
+func (ks *Keyspace) Put(key []byte, value []byte) error {
+	return ks.put(key, value, 0)
+}
+
+// PutWithTTL put the key which expires after ttl
+func (ks *Keyspace) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	return ks.put(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+func (ks *Keyspace) put(key []byte, value []byte, expireAt int64) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+
+	defer ks.db.metrics.putLatency.ObserveSince(time.Now())
+	ks.db.mu.Lock()
+	defer ks.db.mu.Unlock()
+	return ks.putLocked(key, value, expireAt)
+}
+
+// putLocked write the key, the caller should hold the lock
+func (ks *Keyspace) putLocked(key []byte, value []byte, expireAt int64) error {
+	if ks.db.options.readOnly {
+		return ErrReadOnly
+	}
+	if ks.dropped {
+		return ErrKeyspaceDropped
+	}
+	if err := ks.db.checkQuota(int64(len(key) + len(value))); err != nil {
+		return err
+	}
+
+	// append record in active data file
+	record := &model.Record{
+		Key:      addTxSeqPrefix(key, noTransactionSeq),
+		Value:    value,
+		ExpireAt: expireAt,
+		Keyspace: ks.id,
+		Prev:     ks.prevVersion(key),
+	}
+	pos, err := ks.db.appendRecord(record)
+	if err != nil {
+		return err
+	}
+
+	ks.db.setInlineValue(pos, value)
+	if !ks.putKeydir(key, pos) {
+		return ErrUpdateKeydir
+	}
+
+	return nil
+}
+
+func (ks *Keyspace) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+
+	defer ks.db.metrics.getLatency.ObserveSince(time.Now())
+	record, err := ks.getLiveRecord(key, true)
+	if err != nil {
+		return nil, err
+	}
+	return record.Value, nil
+}
+
+// ValueMeta is the value of the key with the meta of its record
+type ValueMeta struct {
+	Value     []byte
+	Seq       uint64    // the sequence of the write
+	Timestamp time.Time // the write time, zero if it is unknown
+	ExpireAt  time.Time // zero if the key never expires
+}
+
+// GetWithMeta return the value of the key with its sequence, write time and expire time
+func (ks *Keyspace) GetWithMeta(key []byte) (*ValueMeta, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+
+	// the inline value has no write time, read the data file
+	record, err := ks.getLiveRecord(key, false)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &ValueMeta{
+		Value: record.Value,
+		Seq:   record.Seq,
+	}
+	if record.Timestamp != 0 {
+		meta.Timestamp = time.Unix(0, record.Timestamp)
+	}
+	if record.ExpireAt != 0 {
+		meta.ExpireAt = time.Unix(0, record.ExpireAt)
+	}
+	return meta, nil
+}
+
+// getLiveRecord return the record the keydir points to,
+// only the value is set if the inline value is used
+func (ks *Keyspace) getLiveRecord(key []byte, useInline bool) (*model.Record, error) {
+	db := ks.db
+	// the merged data file may replace the old one,
+	// get pos and data file in the lock
+	db.mu.RLock()
+	// get pos from keydir
+	pos := ks.keydir.Get(key)
+	if pos == nil || pos.IsExpired(time.Now().UnixNano()) {
+		db.mu.RUnlock()
+		return nil, ErrNoRecord
+	}
+
+	// small value is inlined in keydir, no need to read the data file
+	if useInline && pos.Value != nil {
+		value := make([]byte, len(pos.Value))
+		copy(value, pos.Value)
+		db.mu.RUnlock()
+		db.metrics.inlineHits.Inc()
+		return &model.Record{Key: key, Value: value}, nil
+	}
+	if useInline {
+		db.metrics.inlineMisses.Inc()
+	}
+
+	dataFile := db.getDataFile(pos.Fid)
+	if dataFile == nil {
+		db.mu.RUnlock()
+		return nil, ErrNoDataFile
+	}
+	// keep the data file open until the read is finished
+	dataFile.Ref()
+	db.mu.RUnlock()
+	defer dataFile.Unref()
+
+	// get record from file
+	record, _, err := db.getRecordFromDataFile(dataFile, pos.Offset)
+	if err == ErrWrongCrc {
+		db.reportCorruption(pos.Fid, pos.Offset, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// record has deleted
+	if record.IsDelete {
+		return nil, ErrNoRecord
+	}
+
+	if record.IsBlob {
+		value, err := db.readBlobValue(record.Value)
+		if err == ErrNoBlobFile && ks.isMoved(key, pos) {
+			// the value is moved by GCBlobs, read the new pointer
+			return ks.getLiveRecord(key, useInline)
+		}
+		if err != nil {
+			return nil, err
+		}
+		record.Value, record.IsBlob = value, false
+	}
+	return record, nil
+}
+
+// isMoved check whether the keydir does not point to pos any more
+func (ks *Keyspace) isMoved(key []byte, pos *model.RecordPos) bool {
+	ks.db.mu.RLock()
+	defer ks.db.mu.RUnlock()
+	return ks.keydir.Get(key) != pos
+}
+
+func (ks *Keyspace) Delete(key []byte) error {
+	if len(key) == 0 {
+		return nil
+	}
+
+	// if key is not in keydir, return
+	if pos := ks.keydir.Get(key); pos == nil {
+		return nil
+	}
+
+	defer ks.db.metrics.deleteLatency.ObserveSince(time.Now())
+	ks.db.mu.Lock()
+	defer ks.db.mu.Unlock()
+	return ks.deleteLocked(key)
+}
+
+// deleteLocked write the tombstone of the key, the caller should hold the lock
+func (ks *Keyspace) deleteLocked(key []byte) error {
+	if ks.db.options.readOnly {
+		return ErrReadOnly
+	}
+	if ks.dropped {
+		return ErrKeyspaceDropped
+	}
+
+	// create record that isDelete is true
+	record := &model.Record{
+		Key:      addTxSeqPrefix(key, noTransactionSeq),
+		IsDelete: true,
+		Keyspace: ks.id,
+		Prev:     ks.prevVersion(key),
+	}
+
+	// write to data file
+	pos, err := ks.db.appendRecord(record)
+	if err != nil {
+		return err
+	}
+
+	// update keydir
+	if !ks.deleteKeydir(key) {
+		return ErrUpdateKeydir
+	}
+	ks.setTombstone(key, pos)
+
+	return nil
+}
+
+// DeleteRange delete the keys in [start, end) with a range tombstone,
+// an empty end means no upper bound
+func (ks *Keyspace) DeleteRange(start, end []byte) error {
+	if len(end) > 0 && bytes.Compare(start, end) >= 0 {
+		return ErrInvalidRange
+	}
+	// the range tombstone flag is kept in the record header, a custom codec may not write it
+	// and the tombstone would be loaded as an ordinary key after reopen
+	if _, ok := ks.db.options.codec.(*codec.CodecImpl); !ok {
+		return ErrRangeDeleteNotSupported
+	}
+
+	ks.db.mu.Lock()
+	defer ks.db.mu.Unlock()
+	return ks.deleteRangeLocked(start, end)
+}
+
+// deleteRangeLocked write the range tombstone, the caller should hold the lock
+func (ks *Keyspace) deleteRangeLocked(start, end []byte) error {
+	if ks.db.options.readOnly {
+		return ErrReadOnly
+	}
+	if ks.dropped {
+		return ErrKeyspaceDropped
+	}
+
+	// no key in the range, return
+	var found bool
+	ks.keydir.Range(start, end, func(key []byte, pos *model.RecordPos) bool {
+		found = true
+		return false
+	})
+	if !found {
+		return nil
+	}
+
+	// the range tombstone: key = start, value = end
+	record := &model.Record{
+		Key:           addTxSeqPrefix(start, noTransactionSeq),
+		Value:         end,
+		IsRangeDelete: true,
+		Keyspace:      ks.id,
+	}
+
+	// write to data file
+	if _, err := ks.db.appendRecord(record); err != nil {
+		return err
+	}
+
+	// update keydir
+	ks.deleteKeydirRange(start, end)
+	return nil
+}
+
+// DeletePrefix delete the keys with the prefix
+func (ks *Keyspace) DeletePrefix(prefix []byte) error {
+	if len(prefix) == 0 {
+		return ErrEmptyKey
+	}
+	return ks.DeleteRange(prefix, prefixEnd(prefix))
+}
+
+// prefixEnd return the smallest key greater than all the keys with the prefix,
+// it is nil if there is no such key
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// ListKeys return the real keys that are not expired
+func (ks *Keyspace) ListKeys() [][]byte {
+	// get iterator
+	iterator := ks.keydir.Iterator()
+	defer iterator.Close()
+
+	keys := make([][]byte, 0, ks.keydir.Size())
+	now := time.Now().UnixNano()
+	// iterate keydir
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if iterator.Value().IsExpired(now) {
+			continue
+		}
+		keys = append(keys, iterator.Key())
+	}
+
+	return keys
+}
+
+func (ks *Keyspace) Fold(handler func(key, value []byte) error) error {
+	// iterate keydir
+	ks.db.mu.RLock()
+	defer ks.db.mu.RUnlock()
+
+	// get iterator
+	iterator := ks.keydir.Iterator()
+	defer iterator.Close()
+
+	now := time.Now().UnixNano()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		key := iterator.Key()
+		pos := iterator.Value()
+		if pos.IsExpired(now) {
+			continue
+		}
+
+		value := pos.Value
+		if value == nil {
+			record, err := ks.db.get(pos)
+			if err != nil {
+				return err
+			}
+			if err = ks.db.resolveBlob(record); err != nil {
+				return err
+			}
+			value = record.Value
+		}
+
+		if err := handler(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prevVersion return the current version of the key, or its tombstone if it has been deleted.
+// the caller should hold the lock
+func (ks *Keyspace) prevVersion(key []byte) *model.RecordVersion {
+	pos := ks.keydir.Get(key)
+	if pos == nil {
+		return ks.tombstones[string(key)]
+	}
+	return &model.RecordVersion{
+		Seq:    pos.Seq,
+		Fid:    pos.Fid,
+		Offset: pos.Offset,
+	}
+}
+
+// replayRecord apply a record read from the data file to the keydir
+func (ks *Keyspace) replayRecord(key []byte, isDelete bool, pos *model.RecordPos) bool {
+	// record may be deleted
+	if isDelete {
+		ks.setTombstone(key, pos)
+		// the key may have not been loaded
+		if ks.keydir.Get(key) == nil {
+			return true
+		}
+		return ks.deleteKeydir(key)
+	}
+	return ks.putKeydir(key, pos)
+}
+
+// putKeydir put the pos into keydir and update the inline value size and live size
+func (ks *Keyspace) putKeydir(key []byte, pos *model.RecordPos) bool {
+	oldPos := ks.keydir.Get(key)
+	if !ks.keydir.Put(key, pos) {
+		return false
+	}
+
+	delete(ks.tombstones, string(key))
+
+	ks.db.updateInlineBytes(oldPos, pos)
+	ks.db.updateLiveSize(oldPos, pos)
+	return true
+}
+
+// setTombstone keep the version of the tombstone of the deleted key
+func (ks *Keyspace) setTombstone(key []byte, pos *model.RecordPos) {
+	// the tombstone written without seq can not be found in the versions
+	if pos.Seq == noRecordSeq {
+		return
+	}
+	ks.tombstones[string(key)] = &model.RecordVersion{
+		Seq:    pos.Seq,
+		Fid:    pos.Fid,
+		Offset: pos.Offset,
+	}
+}
+
+func (ks *Keyspace) deleteKeydir(key []byte) bool {
+	oldPos := ks.keydir.Get(key)
+	if !ks.keydir.Delete(key) {
+		return false
+	}
+
+	ks.db.updateInlineBytes(oldPos, nil)
+	ks.db.updateLiveSize(oldPos, nil)
+	return true
+}
+
+// deleteKeydirRange delete the keys in [start, end) from keydir and return the number of keys
+func (ks *Keyspace) deleteKeydirRange(start, end []byte) int {
+	// collect the keys first, the keydir can not be changed in Range
+	var keys [][]byte
+	ks.keydir.Range(start, end, func(key []byte, pos *model.RecordPos) bool {
+		keys = append(keys, key)
+		return true
+	})
+	for _, key := range keys {
+		ks.deleteKeydir(key)
+	}
+	return len(keys)
+}
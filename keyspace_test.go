@@ -0,0 +1,274 @@
+package cqkv
+
+import (
+	"context"
+	"fmt"
+	"github.com/cqkv/cqkv/model"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestDB_Keyspace(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(512))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	users, err := db.Keyspace("users")
+	assert.Nil(t, err)
+	orders, err := db.Keyspace("orders")
+	assert.Nil(t, err)
+	same, err := db.Keyspace("users")
+	assert.Nil(t, err)
+	assert.Equal(t, users, same)
+	_, err = db.Keyspace("")
+	assert.Equal(t, ErrEmptyKeyspace, err)
+
+	// the same key in different keyspaces
+	err = db.Put([]byte("key"), []byte("default"))
+	assert.Nil(t, err)
+	err = users.Put([]byte("key"), []byte("users"))
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		err = orders.Put([]byte(fmt.Sprintf("order-%02d", i)), []byte(fmt.Sprintf("value-%v", i)))
+		assert.Nil(t, err)
+	}
+	err = orders.Delete([]byte("order-00"))
+	assert.Nil(t, err)
+
+	check := func(db *DB) {
+		assert.Equal(t, []string{"orders", "users"}, db.ListKeyspaces())
+		users, err := db.Keyspace("users")
+		assert.Nil(t, err)
+		orders, err := db.Keyspace("orders")
+		assert.Nil(t, err)
+
+		value, err := db.Get([]byte("key"))
+		assert.Nil(t, err)
+		assert.Equal(t, "default", string(value))
+		value, err = users.Get([]byte("key"))
+		assert.Nil(t, err)
+		assert.Equal(t, "users", string(value))
+		_, err = orders.Get([]byte("key"))
+		assert.Equal(t, ErrNoRecord, err)
+
+		assert.Equal(t, [][]byte{[]byte("key")}, db.defaultKeyspace.ListKeys())
+		assert.Equal(t, 19, len(orders.ListKeys()))
+		var count int
+		err = orders.Fold(func(key, value []byte) error {
+			count++
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 19, count)
+		assert.Equal(t, 21, db.Stat().KeyNum)
+	}
+	check(db)
+
+	// reopen with the snapshot, then replay the data files and the hint files
+	for i := 0; i < 3; i++ {
+		err = db.Close()
+		assert.Nil(t, err)
+		if i > 0 {
+			err = os.Remove(model.GetDataFileName("./tmp/", model.SnapshotFileType, 0))
+			assert.Nil(t, err)
+		}
+		db, err = Open("./tmp/", WithDataFileSize(512))
+		assert.Nil(t, err)
+		check(db)
+		db.hintWg.Wait()
+	}
+}
+
+func TestDB_DropKeyspace(t *testing.T) {
+	db, err := Open("./tmp/")
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	tenant, err := db.Keyspace("tenant")
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		err = tenant.Put([]byte(fmt.Sprintf("key-%v", i)), []byte("value"))
+		assert.Nil(t, err)
+	}
+	err = db.Put([]byte("key-0"), []byte("value"))
+	assert.Nil(t, err)
+
+	err = db.DropKeyspace("tenant")
+	assert.Nil(t, err)
+	err = db.DropKeyspace("tenant")
+	assert.Equal(t, ErrNoKeyspace, err)
+	assert.Equal(t, 0, len(db.ListKeyspaces()))
+
+	// the handle of the dropped keyspace can not be written
+	err = tenant.Put([]byte("key"), []byte("value"))
+	assert.Equal(t, ErrKeyspaceDropped, err)
+	wb := db.NewWriteBatch()
+	err = wb.PutIn(tenant, []byte("key"), []byte("value"))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Equal(t, ErrKeyspaceDropped, err)
+
+	// the keyspace is created again without the old keys
+	tenant, err = db.Keyspace("tenant")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(tenant.ListKeys()))
+	err = tenant.Put([]byte("new"), []byte("value"))
+	assert.Nil(t, err)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	err = os.Remove(model.GetDataFileName("./tmp/", model.SnapshotFileType, 0))
+	assert.Nil(t, err)
+	db, err = Open("./tmp/")
+	assert.Nil(t, err)
+
+	tenant, err = db.Keyspace("tenant")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("new")}, tenant.ListKeys())
+	value, err := db.Get([]byte("key-0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(value))
+}
+
+func TestDB_Keyspace_CustomCodec(t *testing.T) {
+	db, err := Open("./tmp/", WithCodec(&xorCodec{}))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// the codec can not keep the keyspace id of the records
+	tenant, err := db.Keyspace("tenant")
+	assert.Equal(t, ErrKeyspaceNotSupported, err)
+	assert.Nil(t, tenant)
+	assert.Equal(t, 0, len(db.ListKeyspaces()))
+
+	err = db.Put([]byte("key"), []byte("value"))
+	assert.Nil(t, err)
+	wb := db.NewWriteBatch()
+	err = wb.Put([]byte("batch-key"), []byte("value"))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	// the keys are loaded from the data files after reopen
+	err = db.Close()
+	assert.Nil(t, err)
+	_ = os.Remove(model.GetDataFileName("./tmp/", model.SnapshotFileType, 0))
+	db, err = Open("./tmp/", WithCodec(&xorCodec{}))
+	assert.Nil(t, err)
+	defer db.Close()
+
+	assert.Equal(t, 0, len(db.ListKeyspaces()))
+	assert.Equal(t, [][]byte{[]byte("batch-key"), []byte("key")}, db.defaultKeyspace.ListKeys())
+	_, err = db.Keyspace("tenant")
+	assert.Equal(t, ErrKeyspaceNotSupported, err)
+}
+
+func TestWriteBatch_Keyspaces(t *testing.T) {
+	db, err := Open("./tmp/")
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	accounts, err := db.Keyspace("accounts")
+	assert.Nil(t, err)
+	logs, err := db.Keyspace("logs")
+	assert.Nil(t, err)
+	err = logs.Put([]byte("old"), []byte("value"))
+	assert.Nil(t, err)
+
+	wb := accounts.NewWriteBatch()
+	err = wb.Put([]byte("alice"), []byte("90"))
+	assert.Nil(t, err)
+	err = wb.PutIn(logs, []byte("alice"), []byte("-10"))
+	assert.Nil(t, err)
+	err = wb.DeleteIn(logs, []byte("old"))
+	assert.Nil(t, err)
+
+	// nothing is visible before commit
+	_, err = accounts.Get([]byte("alice"))
+	assert.Equal(t, ErrNoRecord, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	check := func(db *DB) {
+		accounts, err := db.Keyspace("accounts")
+		assert.Nil(t, err)
+		logs, err := db.Keyspace("logs")
+		assert.Nil(t, err)
+
+		value, err := accounts.Get([]byte("alice"))
+		assert.Nil(t, err)
+		assert.Equal(t, "90", string(value))
+		value, err = logs.Get([]byte("alice"))
+		assert.Nil(t, err)
+		assert.Equal(t, "-10", string(value))
+		_, err = logs.Get([]byte("old"))
+		assert.Equal(t, ErrNoRecord, err)
+		_, err = db.Get([]byte("alice"))
+		assert.Equal(t, ErrNoRecord, err)
+	}
+	check(db)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	err = os.Remove(model.GetDataFileName("./tmp/", model.SnapshotFileType, 0))
+	assert.Nil(t, err)
+	db, err = Open("./tmp/")
+	assert.Nil(t, err)
+	check(db)
+}
+
+func TestDB_MergeWithContext_Keyspaces(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(512))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	live, err := db.Keyspace("live")
+	assert.Nil(t, err)
+	dropped, err := db.Keyspace("dropped")
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		err = live.Put(key, []byte("value"))
+		assert.Nil(t, err)
+		err = dropped.Put(key, []byte("value"))
+		assert.Nil(t, err)
+		err = db.Put(key, []byte("value"))
+		assert.Nil(t, err)
+	}
+	err = db.DropKeyspace("dropped")
+	assert.Nil(t, err)
+
+	err = db.MergeWithContext(context.Background(), MergeOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 20, len(live.ListKeys()))
+	assert.Equal(t, 20, len(db.ListKeys()))
+	value, err := live.Get([]byte("key-19"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(value))
+
+	err = db.Close()
+	assert.Nil(t, err)
+	err = os.Remove(model.GetDataFileName("./tmp/", model.SnapshotFileType, 0))
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", WithDataFileSize(512))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"live"}, db.ListKeyspaces())
+	assert.Equal(t, 40, db.Stat().KeyNum)
+}
@@ -2,53 +2,114 @@ package cqkv
 
 import (
 	"bytes"
+	"context"
 	"github.com/cqkv/cqkv/model"
+	"github.com/cqkv/cqkv/utils"
 	"io"
-	"log"
 	"os"
 	"path"
-	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	mergeDirPathSuffix = "-cqkv-merge"
 	mergeFinishedKey   = "merge.finished"
+
+	// mergeFlushSize is the buffer size before writing the merged data file
+	mergeFlushSize = 4 * 1024 * 1024
 )
 
-// Merge clear the invalid data and generate the hint file.
-// it is asynchronous.
-func (db *DB) Merge() chan error {
-	done := make(chan error)
-	go db.doMerge(done)
-	return done
+// MergeOptions choose the older files to merge and control the merge speed
+type MergeOptions struct {
+	// MaxFiles is the max number of files to merge, 0 means no limit
+	MaxFiles int
+
+	// MinGarbageRatio is the min ratio of invalid data in a file to merge it
+	MinGarbageRatio float64
+
+	// BytesPerSec limit the bytes read and written by merge, 0 means no limit
+	BytesPerSec int64
+
+	// Progress is called after every file is merged
+	Progress func(MergeProgress)
 }
 
-func (db *DB) doMerge(done chan<- error) {
+// CompactionAction is the action of the compaction filter on a live record
+type CompactionAction uint8
+
+const (
+	// CompactionKeep keep the record as it is
+	CompactionKeep CompactionAction = iota
+	// CompactionDrop delete the record
+	CompactionDrop
+	// CompactionRewrite replace the value of the record with Decision.Value
+	CompactionRewrite
+)
+
+// Decision is returned by the compaction filter
+type Decision struct {
+	Action CompactionAction
+	Value  []byte // the new value for CompactionRewrite
+}
+
+// CompactionFilter is called by merge for every live record of the default keyspace,
+// it should not modify or keep the key and value
+type CompactionFilter func(key, value []byte) Decision
+
+// MergeProgress is the progress of a merge
+type MergeProgress struct {
+	FilesDone      int
+	FilesTotal     int
+	BytesRewritten int64 // size of the merged files
+	BytesReclaimed int64 // size of the invalid data cleared
+}
+
+// MergeWithContext clear the invalid data of the older files with the most garbage,
+// every merged file keeps its file id, and the other files are untouched.
+// the merged files take effect without reopening the db.
+// if the ctx is done before the merged files are switched, the merge is cancelled
+// and the data files are left intact.
+func (db *DB) MergeWithContext(ctx context.Context, opts MergeOptions) (err error) {
+	if db.options.readOnly {
+		return ErrReadOnly
+	}
+	db.mu.Lock()
 	if db.activeFile == nil {
-		sendNil(done)
-		return
+		db.mu.Unlock()
+		return nil
 	}
 
-	db.mu.Lock()
 	if db.isMerging {
 		db.mu.Unlock()
-		sendError(done, ErrMergeIsProgress)
-		return
+		return ErrMergeIsProgress
 	}
 
 	db.isMerging = true
 	defer func() {
+		db.mu.Lock()
 		db.isMerging = false
+		db.mu.Unlock()
+	}()
+	defer db.metrics.mergeDuration.ObserveSince(time.Now())
+
+	db.options.logger.Info("merge start")
+	db.options.eventListener.OnMergeStart()
+	defer func() {
+		if err != nil {
+			db.options.logger.Error("merge failed", "err", err)
+		} else {
+			db.options.logger.Info("merge end")
+		}
+		db.options.eventListener.OnMergeEnd(err)
 	}()
 
 	// sync the current active file
-	if err := db.activeFile.Sync(); err != nil {
+	if err := db.syncDataFile(db.activeFile); err != nil {
 		db.mu.Unlock()
-		sendError(done, err)
-		return
+		return db.fail(err)
 	}
 
 	// change the active file to read-only
@@ -56,124 +117,579 @@ func (db *DB) doMerge(done chan<- error) {
 	// set new active file
 	if err := db.setActiveDatafile(); err != nil {
 		db.mu.Unlock()
-		sendError(done, err)
-		return
+		return err
 	}
 
-	noMergeFid := db.activeFile.Fid
-	mergeFiles := make([]*model.DataFile, 0, len(db.olderFiles))
-	for _, file := range db.olderFiles {
-		mergeFiles = append(mergeFiles, file)
-	}
+	// the hint files may be generating from the files to merge
+	db.hintWg.Wait()
+
+	mergeFiles, keepTombstoneFid, err := db.pickMergeFiles(opts)
 	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
 
-	// old files is read-only, so no need to lock
-	sort.Slice(mergeFiles, func(i, j int) bool {
-		return mergeFiles[i].Fid < mergeFiles[j].Fid
-	})
+	if len(mergeFiles) == 0 {
+		return nil
+	}
 
-	// create a new bitcask dir for the merge
+	// create a new dir for the merge
 	mergeDirPath := db.getMergeDirPath()
 	// remove the old merge dir
-	if _, err := os.Stat(mergeDirPath); err == nil {
-		if err = os.RemoveAll(mergeDirPath); err != nil {
-			sendError(done, err)
-			return
+	if _, err = db.options.fs.Stat(mergeDirPath); err == nil {
+		if err = db.options.fs.RemoveAll(mergeDirPath); err != nil {
+			return err
 		}
 	}
 
 	// create a new merge dir
-	if err := os.MkdirAll(mergeDirPath, os.ModePerm); err != nil {
-		sendError(done, err)
-		return
+	if err = db.options.fs.MkdirAll(mergeDirPath, os.ModePerm); err != nil {
+		return err
 	}
 
-	mergeDb, err := Open(mergeDirPath)
+	versions := newMergedVersions()
+	fids, relocations, err := db.mergeDataFiles(ctx, mergeDirPath, mergeFiles, keepTombstoneFid, opts, versions)
 	if err != nil {
-		sendError(done, err)
-		return
+		// the data files are not changed
+		_ = db.options.fs.RemoveAll(mergeDirPath)
+		return err
 	}
 
-	// write valid records to the merge db and generate the hint file
-	hintIoManage, err := mergeDb.options.ioManagerCreator(model.GetDataFileName(mergeDirPath, model.HintFileType, 0))
-	if err != nil {
-		sendError(done, err)
-		return
-	}
-	defer hintIoManage.Close()
-	hintFile := model.OpenDataFile(0, hintIoManage)
+	// replace the older files with the merged files
+	return db.switchMergeFiles(mergeDirPath, fids, relocations, versions)
+}
+
+// mergeDataFiles write the merged files and the merge finished file to the merge dir
+func (db *DB) mergeDataFiles(ctx context.Context, mergeDirPath string, mergeFiles []*model.DataFile,
+	keepTombstoneFid uint32, opts MergeOptions, versions *mergedVersions) ([]uint32, map[uint32][]*relocation, error) {
+	limiter := utils.NewRateLimiter(opts.BytesPerSec)
+	progress := MergeProgress{FilesTotal: len(mergeFiles)}
+
+	// old files is read-only, so no need to lock
+	fids := make([]uint32, 0, len(mergeFiles))
+	relocations := make(map[uint32][]*relocation, len(mergeFiles))
 	for _, dataFile := range mergeFiles {
-		// read data file
-		var offset int64
-		for {
-			// read record from the data file
-			record, size, err := db.getRecordFromDataFile(dataFile, offset)
+		// the tombstones are useless if all the older files are merged
+		keepTombstone := dataFile.Fid > keepTombstoneFid
+		fileRelocations, mergeSize, err := db.mergeDataFile(ctx, limiter, mergeDirPath, dataFile, keepTombstone, versions)
+		if err != nil {
+			return nil, nil, err
+		}
+		fids = append(fids, dataFile.Fid)
+		relocations[dataFile.Fid] = fileRelocations
+
+		size, err := dataFile.IoManager.Size()
+		if err != nil {
+			return nil, nil, err
+		}
+		progress.FilesDone++
+		progress.BytesRewritten += mergeSize
+		progress.BytesReclaimed += size - mergeSize
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+	}
+
+	// the merge can not be cancelled after the merge finished file is written
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// write the merge finished file
+	if err := db.writeMergeFinishedFile(mergeDirPath, fids); err != nil {
+		return nil, nil, err
+	}
+	return fids, relocations, nil
+}
+
+// relocation is the new position of a valid record in the merged file
+type relocation struct {
+	keyspace *Keyspace
+	key      []byte
+	offset   int64 // offset in the old data file
+	pos      *model.RecordPos
+
+	drop  bool   // the record is expired or dropped by the compaction filter
+	value []byte // the value rewritten by the compaction filter
+}
+
+// switchMergeFiles replace the older files with the merged files while the db is serving.
+// the old files are closed after the in-flight reads finish.
+func (db *DB) switchMergeFiles(mergeDirPath string, fids []uint32, relocations map[uint32][]*relocation,
+	versions *mergedVersions) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// the keydir snapshot is invalid after the data files are merged
+	if err := db.removeSnapshot(); err != nil {
+		return err
+	}
+
+	for _, fid := range fids {
+		removed, err := db.moveMergeFile(mergeDirPath, fid)
+		if err != nil {
+			return err
+		}
+
+		oldFile := db.olderFiles[fid]
+		if removed {
+			// nothing is left in the data file, the fid is freed
+			delete(db.olderFiles, fid)
+		} else {
+			ioManager, err := db.options.ioManagerCreator(model.GetDataFileName(db.options.dirPath, model.DataFileType, fid))
 			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				sendError(done, err)
+				return err
+			}
+			db.olderFiles[fid] = model.OpenDataFile(fid, ioManager)
+			db.sealDataFile(db.olderFiles[fid])
+		}
+		if err = oldFile.Unref(); err != nil {
+			return err
+		}
+
+		// the key may be written again during the merge
+		for _, r := range relocations[fid] {
+			pos := r.keyspace.keydir.Get(r.key)
+			if pos == nil || pos.Fid != fid || pos.Offset != r.offset {
+				continue
+			}
+			if r.drop {
+				r.keyspace.deleteKeydir(r.key)
+				continue
+			}
+			if r.value != nil {
+				db.setInlineValue(r.pos, r.value)
+			} else {
+				r.pos.Value = pos.Value
+			}
+			r.keyspace.putKeydir(r.key, r.pos)
+		}
+		if err = db.resetKeptSize(fid, removed); err != nil {
+			return err
+		}
+	}
+	db.remapTombstones(versions)
+
+	// the space reclaimed by merge can be written again
+	diskBytes, err := db.diskUsage()
+	if err != nil {
+		return err
+	}
+	db.diskBytes = diskBytes
+
+	return db.options.fs.RemoveAll(mergeDirPath)
+}
+
+// remapTombstones move the tombstones of the deleted keys to the merged files,
+// the cleared ones are removed. the caller should hold the lock
+func (db *DB) remapTombstones(versions *mergedVersions) {
+	db.ksMu.RLock()
+	defer db.ksMu.RUnlock()
+	for _, ks := range db.keyspaces {
+		for key, tombstone := range ks.tombstones {
+			if version := versions.remap(tombstone); version != nil {
+				ks.tombstones[key] = version
+			} else {
+				delete(ks.tombstones, key)
+			}
+		}
+	}
+}
+
+// resetKeptSize record the tombstones and the old versions kept by the merge of the data file,
+// they are not garbage until the live records of the file change. the caller should hold the lock
+func (db *DB) resetKeptSize(fid uint32, removed bool) error {
+	db.liveMu.Lock()
+	defer db.liveMu.Unlock()
+	if removed {
+		delete(db.liveSize, fid)
+		delete(db.keptSize, fid)
+		return nil
+	}
+
+	size, err := db.olderFiles[fid].IoManager.Size()
+	if err != nil {
+		return err
+	}
+	db.keptSize[fid] = size - db.liveSize[fid]
+	return nil
+}
+
+// moveMergeFile move the merged data file and its hint file to the db dir.
+// if the merged file is empty, the data file and its hint file are removed and removed is true
+func (db *DB) moveMergeFile(mergeDirPath string, fid uint32) (removed bool, err error) {
+	srcPath := model.GetDataFileName(mergeDirPath, model.DataFileType, fid)
+	dstPath := model.GetDataFileName(db.options.dirPath, model.DataFileType, fid)
+
+	info, err := db.options.fs.Stat(srcPath)
+	if err != nil {
+		return false, err
+	}
+	if info.Size() == 0 {
+		if err = db.removeDataHintFile(db.options.dirPath, fid); err != nil {
+			return false, err
+		}
+		if err = db.options.fs.Remove(dstPath); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		// the empty merged file is removed last, it marks the data file to remove if the db is closed before
+		return true, db.options.fs.Remove(srcPath)
+	}
+
+	// move the hint file first, the old hint file is invalid for the merged file
+	srcHintPath := model.GetDataFileName(mergeDirPath, model.DataHintFileType, fid)
+	if _, err = db.options.fs.Stat(srcHintPath); err == nil {
+		if err = db.options.fs.Rename(srcHintPath, model.GetDataFileName(db.options.dirPath, model.DataHintFileType, fid)); err != nil {
+			return false, err
+		}
+	} else if err = db.removeDataHintFile(db.options.dirPath, fid); err != nil {
+		return false, err
+	}
+
+	return false, db.options.fs.Rename(srcPath, dstPath)
+}
+
+// pickMergeFiles return the older files to merge in fid order,
+// and the min fid of the older files that are not merged.
+// the caller should hold the lock.
+func (db *DB) pickMergeFiles(opts MergeOptions) ([]*model.DataFile, uint32, error) {
+	type candidate struct {
+		dataFile *model.DataFile
+		ratio    float64
+	}
+
+	candidates := make([]*candidate, 0, len(db.olderFiles))
+	// the empty files have no records to delete
+	emptyFiles := make(map[uint32]bool)
+	for _, dataFile := range db.olderFiles {
+		garbage, size, err := db.garbageSize(dataFile)
+		if err != nil {
+			return nil, 0, err
+		}
+		if size == 0 {
+			emptyFiles[dataFile.Fid] = true
+		}
+
+		// all the data is valid
+		if garbage <= 0 || size == 0 {
+			continue
+		}
+
+		ratio := float64(garbage) / float64(size)
+		if ratio < opts.MinGarbageRatio {
+			continue
+		}
+		candidates = append(candidates, &candidate{dataFile: dataFile, ratio: ratio})
+	}
+
+	// the files with the most garbage first
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].ratio != candidates[j].ratio {
+			return candidates[i].ratio > candidates[j].ratio
+		}
+		return candidates[i].dataFile.Fid < candidates[j].dataFile.Fid
+	})
+	if opts.MaxFiles > 0 && len(candidates) > opts.MaxFiles {
+		candidates = candidates[:opts.MaxFiles]
+	}
+
+	mergeFiles := make([]*model.DataFile, 0, len(candidates))
+	picked := make(map[uint32]bool, len(candidates))
+	for _, c := range candidates {
+		mergeFiles = append(mergeFiles, c.dataFile)
+		picked[c.dataFile.Fid] = true
+	}
+	sort.Slice(mergeFiles, func(i, j int) bool {
+		return mergeFiles[i].Fid < mergeFiles[j].Fid
+	})
+
+	// the tombstones may delete the records in the files that are not merged
+	keepTombstoneFid := db.activeFile.Fid
+	for fid := range db.olderFiles {
+		if !picked[fid] && !emptyFiles[fid] && fid < keepTombstoneFid {
+			keepTombstoneFid = fid
+		}
+	}
+
+	return mergeFiles, keepTombstoneFid, nil
+}
+
+// mergeDataFile write the valid records of the data file to the merge dir with the same file id,
+// and generate its hint file. it returns the new positions of the valid puts and the merged file size.
+// the files should be merged in fid order, so the previous versions have been moved.
+func (db *DB) mergeDataFile(ctx context.Context, limiter *utils.RateLimiter, mergeDirPath string,
+	dataFile *model.DataFile, keepTombstone bool, versions *mergedVersions) ([]*relocation, int64, error) {
+	mergeIoManager, err := db.options.ioManagerCreator(model.GetDataFileName(mergeDirPath, model.DataFileType, dataFile.Fid))
+	if err != nil {
+		return nil, 0, err
+	}
+	mergeFile := model.OpenDataFile(dataFile.Fid, mergeIoManager)
+	defer mergeFile.Close()
+	versions.fids[dataFile.Fid] = true
+
+	var (
+		relocations []*relocation
+		offset      int64
+		mergeOffset int64
+	)
+	buf := new(bytes.Buffer)
+	now := time.Now().UnixNano()
+	for {
+		// read record from the data file
+		record, size, err := db.getRecordFromDataFile(dataFile, offset)
+		if err != nil {
+			if err == io.EOF {
+				break
 			}
+			if err == ErrWrongCrc {
+				db.reportCorruption(dataFile.Fid, offset, err)
+			}
+			return nil, 0, err
+		}
 
-			// check if the record is valid
+		// check the ctx and limit the merge speed by the bytes read
+		if err = limiter.WaitN(ctx, size); err != nil {
+			return nil, 0, err
+		}
+
+		keep, err := db.isValidRecord(record, dataFile.Fid, offset, keepTombstone, versions)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var r *relocation
+		if keep {
+			// the transaction has been committed, clear transaction flag
 			realKey, _ := parseTxSeqPrefix(record.Key)
-			pos := db.options.keydir.Get(realKey)
-			if pos != nil &&
-				pos.Fid == dataFile.Fid &&
-				pos.Offset == offset {
-				// clear transaction flag
-				record.Key = addTxSeqPrefix(realKey, noTransactionSeq)
-
-				// write the record to the merge db
-				if _, err = mergeDb.appendRecord(record); err != nil {
-					sendError(done, err)
-					return
+			record.Key = addTxSeqPrefix(realKey, noTransactionSeq)
+
+			// the old versions kept for history are not moved in keydir
+			ks := db.getKeyspace(record.Keyspace)
+			if !record.IsDelete && !record.IsRangeDelete && isLiveRecord(ks, realKey, dataFile.Fid, offset) {
+				r = &relocation{keyspace: ks, key: realKey, offset: offset}
+				relocations = append(relocations, r)
+				if record.ExpireAt > 0 && record.ExpireAt <= now {
+					// the expired key is removed like a dropped one
+					keep = dropRecord(record, r, keepTombstone)
+				} else if db.options.compactionFilter != nil && ks == db.defaultKeyspace {
+					keep = db.applyCompactionFilter(realKey, record, r, keepTombstone)
 				}
+			}
+		}
 
-				posRecordData, err := db.marshalPosRecord(realKey, pos)
-				if err != nil {
-					sendError(done, err)
-					return
+		if keep {
+			// the previous version may be moved or cleared
+			if record.Prev != nil {
+				record.Prev = versions.remap(record.Prev)
+			}
+
+			data, mergeSize, err := db.marshalRecord(record)
+			if err != nil {
+				return nil, 0, err
+			}
+			buf.Write(data)
+
+			if r != nil && !r.drop {
+				r.pos = &model.RecordPos{
+					Fid:      dataFile.Fid,
+					Size:     uint32(mergeSize),
+					Offset:   mergeOffset,
+					Seq:      record.Seq,
+					ExpireAt: record.ExpireAt,
 				}
+			}
+			// the tombstones are versions, the key written again links to them
+			if !record.IsRangeDelete && record.Seq != noRecordSeq {
+				versions.moved[record.Seq] = &model.RecordVersion{
+					Seq:    record.Seq,
+					Fid:    dataFile.Fid,
+					Offset: mergeOffset,
+				}
+			}
+			mergeOffset += mergeSize
 
-				if err = hintFile.Write(posRecordData); err != nil {
-					sendError(done, err)
-					return
+			if buf.Len() >= mergeFlushSize {
+				if err = limiter.WaitN(ctx, int64(buf.Len())); err != nil {
+					return nil, 0, err
+				}
+				if err = mergeFile.Write(buf.Bytes()); err != nil {
+					return nil, 0, err
 				}
+				buf.Reset()
 			}
+		}
 
-			offset += size
+		offset += size
+	}
+
+	if buf.Len() > 0 {
+		if err = limiter.WaitN(ctx, int64(buf.Len())); err != nil {
+			return nil, 0, err
 		}
+		if err = mergeFile.Write(buf.Bytes()); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err = mergeFile.Sync(); err != nil {
+		return nil, 0, err
 	}
 
-	// sync the hint file and the merge db
-	if err = hintFile.Sync(); err != nil {
-		sendError(done, err)
-		return
+	// the empty merged file has no hint file, the data file is removed when switching
+	if mergeOffset > 0 {
+		if err = db.writeDataHintFile(mergeDirPath, mergeFile); err != nil {
+			return nil, 0, err
+		}
 	}
-	if err = mergeDb.Sync(); err != nil {
-		sendError(done, err)
-		return
+	return relocations, mergeOffset, nil
+}
+
+// applyCompactionFilter change the live record by the compaction filter,
+// it returns false if the record should not be written to the merged file
+func (db *DB) applyCompactionFilter(key []byte, record *model.Record, r *relocation, keepTombstone bool) bool {
+	value := record.Value
+	if record.IsBlob {
+		// the blob files are not changed while merging
+		var err error
+		if value, err = db.readBlobValue(record.Value); err != nil {
+			return true
+		}
 	}
 
-	// write the merge finished file
-	if err = db.writeMergeFinishedFile(mergeDirPath, noMergeFid); err != nil {
-		sendError(done, err)
-		return
+	decision := db.options.compactionFilter(key, value)
+	switch decision.Action {
+	case CompactionDrop:
+		return dropRecord(record, r, keepTombstone)
+	case CompactionRewrite:
+		// the rewritten value is never nil, so the relocation can tell it
+		r.value = append([]byte{}, decision.Value...)
+		record.Value = r.value
+		record.IsBlob = false
+	}
+	return true
+}
+
+// dropRecord turn the live record into a tombstone,
+// it returns false if the tombstone should not be written to the merged file
+func dropRecord(record *model.Record, r *relocation, keepTombstone bool) bool {
+	r.drop = true
+	// the tombstone hide the old records of the key in the files that are not merged
+	record.IsDelete = true
+	record.IsBlob = false
+	record.Value = nil
+	record.ExpireAt = 0
+	return keepTombstone
+}
+
+// isValidRecord check whether the record should be kept by merge
+func (db *DB) isValidRecord(record *model.Record, fid uint32, offset int64, keepTombstone bool,
+	versions *mergedVersions) (bool, error) {
+	realKey, txSeq := parseTxSeqPrefix(record.Key)
+
+	// the transaction finished record is useless after clearing the transaction flag
+	if txSeq != noTransactionSeq && bytes.Equal(realKey, txFinishKey) {
+		return false, nil
+	}
+
+	// the range tombstone delete the keys in the files that are not merged
+	if record.IsRangeDelete {
+		return keepTombstone, nil
 	}
 
-	sendNil(done)
+	// the keys of the dropped keyspace are all invalid
+	ks := db.getKeyspace(record.Keyspace)
+	var pos *model.RecordPos
+	if ks != nil {
+		pos = ks.keydir.Get(realKey)
+	}
+	if !record.IsDelete {
+		if isLiveRecord(ks, realKey, fid, offset) {
+			return true, nil
+		}
+		// keep the old versions of the live key
+		if pos != nil && db.options.retainVersions > 1 {
+			return versions.isRetained(ks, realKey, record.Seq)
+		}
+		return false, nil
+	}
+
+	// the tombstone links the key written again to the versions before the delete
+	if pos != nil && db.options.retainVersions > 1 {
+		return versions.isRetained(ks, realKey, record.Seq)
+	}
+	// the key has been written again after the tombstone
+	if !keepTombstone || pos != nil {
+		return false, nil
+	}
+	if txSeq == noTransactionSeq {
+		return true, nil
+	}
+	return db.isTxCommitted(fid, offset, txSeq)
+}
+
+// isLiveRecord check whether the keydir of the keyspace points to the record
+func isLiveRecord(ks *Keyspace, key []byte, fid uint32, offset int64) bool {
+	if ks == nil {
+		return false
+	}
+	pos := ks.keydir.Get(key)
+	return pos != nil && pos.Fid == fid && pos.Offset == offset
 }
 
-func (db *DB) marshalPosRecord(key []byte, pos *model.RecordPos) ([]byte, error) {
+// isTxCommitted check whether the transaction record at the position is committed.
+// the records of a transaction are continuous, and the finished record is the last one.
+func (db *DB) isTxCommitted(fid uint32, offset int64, txSeq uint64) (bool, error) {
+	db.mu.RLock()
+	dataFiles := make([]*model.DataFile, 0, len(db.olderFiles)+1)
+	for _, dataFile := range db.olderFiles {
+		if dataFile.Fid >= fid {
+			dataFiles = append(dataFiles, dataFile)
+		}
+	}
+	dataFiles = append(dataFiles, db.activeFile)
+	db.mu.RUnlock()
+
+	sort.Slice(dataFiles, func(i, j int) bool {
+		return dataFiles[i].Fid < dataFiles[j].Fid
+	})
+
+	for _, dataFile := range dataFiles {
+		if dataFile.Fid != fid {
+			offset = 0
+		}
+
+		for {
+			record, size, err := db.getRecordFromDataFile(dataFile, offset)
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return false, err
+			}
+
+			realKey, seq := parseTxSeqPrefix(record.Key)
+			if seq != txSeq {
+				return false, nil
+			}
+			if bytes.Equal(realKey, txFinishKey) {
+				return true, nil
+			}
+			offset += size
+		}
+	}
+
+	return false, nil
+}
+
+func (db *DB) marshalPosRecord(keyspace uint32, key []byte, pos *model.RecordPos) ([]byte, error) {
 	// write the record pos to the hint file
 	posRecordValue, err := db.options.codec.MarshalRecordPos(pos)
 	if err != nil {
 		return nil, err
 	}
 	posRecord := &model.Record{
-		Key:   key,
-		Value: posRecordValue,
+		Key:      key,
+		Value:    posRecordValue,
+		Keyspace: keyspace,
 	}
 	posRecordData, _, err := db.marshalRecord(posRecord)
 	if err != nil {
@@ -183,7 +699,7 @@ func (db *DB) marshalPosRecord(key []byte, pos *model.RecordPos) ([]byte, error)
 	return posRecordData, nil
 }
 
-func (db *DB) writeMergeFinishedFile(mergeDirPath string, fid uint32) error {
+func (db *DB) writeMergeFinishedFile(mergeDirPath string, fids []uint32) error {
 	// write the merge finished file
 	mergeFinishedIoManager, err := db.options.ioManagerCreator(model.GetDataFileName(mergeDirPath, model.MergeFinishedFileType, 0))
 	if err != nil {
@@ -191,10 +707,15 @@ func (db *DB) writeMergeFinishedFile(mergeDirPath string, fid uint32) error {
 	}
 	defer mergeFinishedIoManager.Close()
 	mergeFinishedDataFile := model.OpenDataFile(0, mergeFinishedIoManager)
-	// the merge finished file store the noMerge id
+
+	// the merge finished file store the merged file ids
+	fidStrs := make([]string, 0, len(fids))
+	for _, fid := range fids {
+		fidStrs = append(fidStrs, strconv.Itoa(int(fid)))
+	}
 	mergeFinishedRecord := &model.Record{
 		Key:   []byte(mergeFinishedKey),
-		Value: []byte(strconv.Itoa(int(fid))),
+		Value: []byte(strings.Join(fidStrs, ",")),
 	}
 	mergeFinishedRecordData, _, err := db.marshalRecord(mergeFinishedRecord)
 	if err != nil {
@@ -220,58 +741,39 @@ func (db *DB) getMergeDirPath() string {
 func (db *DB) loadMergeFiles() error {
 	mergePath := db.getMergeDirPath()
 	// merge dir not exist
-	if _, err := os.Stat(mergePath); os.IsNotExist(err) {
+	if _, err := db.options.fs.Stat(mergePath); os.IsNotExist(err) {
 		return nil
 	}
 	defer func() {
-		_ = os.RemoveAll(mergePath)
+		_ = db.options.fs.RemoveAll(mergePath)
 	}()
 
-	dirEntries, err := os.ReadDir(mergePath)
-	if err != nil {
-		return err
-	}
-
 	// check whether the merge is finished
-	var finished bool
-	mergeFileNames := make([]string, 0)
-	for _, entry := range dirEntries {
-		if entry.Name() == model.MergeFinishedFileName {
-			finished = true
-			mergeFileNames = append(mergeFileNames, entry.Name())
-		}
-
-		if strings.HasSuffix(entry.Name(), model.DataFileSuffix) || strings.HasSuffix(entry.Name(), model.HintFileSuffix) {
-			mergeFileNames = append(mergeFileNames, entry.Name())
-		}
-	}
-
-	if !finished {
+	mergeFinishedFileName := model.GetDataFileName(mergePath, model.MergeFinishedFileType, 0)
+	if _, err := db.options.fs.Stat(mergeFinishedFileName); os.IsNotExist(err) {
 		return nil
 	}
 
-	noMergedFileId, err := db.getNotMergeFid(mergePath)
+	mergedFids, err := db.getMergedFids(mergePath)
 	if err != nil {
 		return err
 	}
 
-	// remove old files
-	var fid uint32
-	for ; fid < noMergedFileId; fid++ {
-		fileName := model.GetDataFileName(db.options.dirPath, model.DataFileType, fid)
-		if _, err = os.Stat(fileName); err == nil {
-			if err = os.Remove(fileName); err != nil {
-				return err
-			}
-		}
+	// the keydir snapshot is invalid after the data files are merged
+	if err = db.removeSnapshot(); err != nil {
+		return err
 	}
 
-	// copy the merge files to the db
-	for _, fileName := range mergeFileNames {
-		srcPath := filepath.Join(mergePath, fileName)
-		dstPath := filepath.Join(db.options.dirPath, fileName)
-		if err = os.Rename(srcPath, dstPath); err != nil {
-			log.Println(err)
+	// the db was closed during switching the merged files, finish it.
+	// replace the data files and their hint files with the merged ones
+	for _, fid := range mergedFids {
+		// the merged file has been moved
+		srcPath := model.GetDataFileName(mergePath, model.DataFileType, fid)
+		if _, err = db.options.fs.Stat(srcPath); os.IsNotExist(err) {
+			continue
+		}
+
+		if _, err = db.moveMergeFile(mergePath, fid); err != nil {
 			return err
 		}
 	}
@@ -279,73 +781,32 @@ func (db *DB) loadMergeFiles() error {
 	return nil
 }
 
-func (db *DB) getNotMergeFid(dir string) (uint32, error) {
+// getMergedFids read the merged file ids from the merge finished file
+func (db *DB) getMergedFids(dir string) ([]uint32, error) {
 	mergeFinishedIoManager, err := db.options.ioManagerCreator(model.GetDataFileName(dir, model.MergeFinishedFileType, 0))
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	defer mergeFinishedIoManager.Close()
 	mergeFinishedDataFile := model.OpenDataFile(0, mergeFinishedIoManager)
 	// read the merge finished file
 	mergeFinishedRecord, _, err := db.getRecordFromDataFile(mergeFinishedDataFile, 0)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	if bytes.Compare(mergeFinishedRecord.Key, []byte(mergeFinishedKey)) != 0 {
-		return 0, ErrInvalidMergeFinishedFile
-	}
-
-	fid, err := strconv.Atoi(string(mergeFinishedRecord.Value))
-	if err != nil {
-		return 0, err
-	}
-
-	return uint32(fid), err
-}
-
-func (db *DB) loadKeydirFromHintFile() error {
-	hintFileName := model.GetDataFileName(db.options.dirPath, model.HintFileType, 0)
-	if _, err := os.Stat(hintFileName); os.IsNotExist(err) {
-		return nil
-	}
-
-	hintFileIoManager, err := db.options.ioManagerCreator(hintFileName)
-	if err != nil {
-		return err
+		return nil, ErrInvalidMergeFinishedFile
 	}
-	defer hintFileIoManager.Close()
 
-	hintFile := model.OpenDataFile(0, hintFileIoManager)
-
-	var offset int64
-	for {
-		// read record from the hint file
-		record, size, err := db.getRecordFromDataFile(hintFile, offset)
+	var fids []uint32
+	for _, fidStr := range strings.Split(string(mergeFinishedRecord.Value), ",") {
+		fid, err := strconv.Atoi(fidStr)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
-		}
-
-		pos := new(model.RecordPos)
-		if err = db.options.codec.UnmarshalRecordPos(record.Value, pos); err != nil {
-			return err
+			return nil, ErrInvalidMergeFinishedFile
 		}
-
-		// put the index to the db
-		db.options.keydir.Put(record.Key, pos)
-		offset += size
+		fids = append(fids, uint32(fid))
 	}
 
-	return nil
-}
-
-func sendError(done chan<- error, err error) {
-	done <- err
-}
-
-func sendNil(done chan<- error) {
-	done <- nil
+	return fids, nil
 }
@@ -1,33 +1,42 @@
 package cqkv
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"github.com/cqkv/cqkv/codec"
+	"github.com/cqkv/cqkv/fio"
+	"github.com/cqkv/cqkv/model"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"math/rand"
 	_ "net/http/pprof"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestDB_Merge_WithNoData(t *testing.T) {
 	db, err := Open("./tmp/")
 	defer func() {
 		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
 	}()
 	assert.Nil(t, err)
 	assert.NotNil(t, db)
 
-	done := db.Merge()
-	select {
-	case err := <-done:
-		assert.Nil(t, err)
-	}
+	err = db.MergeWithContext(context.Background(), MergeOptions{})
+	assert.Nil(t, err)
 }
 
 func TestDB_Merge_WithAllValidData(t *testing.T) {
 	db, err := Open("./tmp/")
 	defer func() {
 		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
 	}()
 	assert.Nil(t, err)
 	assert.NotNil(t, db)
@@ -37,11 +46,8 @@ func TestDB_Merge_WithAllValidData(t *testing.T) {
 		assert.Nil(t, err)
 	}
 
-	done := db.Merge()
-	select {
-	case err := <-done:
-		assert.Nil(t, err)
-	}
+	err = db.MergeWithContext(context.Background(), MergeOptions{})
+	assert.Nil(t, err)
 	assert.Equal(t, 100, len(db.ListKeys()))
 }
 
@@ -49,6 +55,7 @@ func TestDB_Merge_WithSomeInvalidData(t *testing.T) {
 	db, err := Open("./tmp/")
 	defer func() {
 		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
 	}()
 	assert.Nil(t, err)
 	assert.NotNil(t, db)
@@ -64,11 +71,8 @@ func TestDB_Merge_WithSomeInvalidData(t *testing.T) {
 		assert.Nil(t, err)
 	}
 
-	done := db.Merge()
-	select {
-	case err = <-done:
-		assert.Nil(t, err)
-	}
+	err = db.MergeWithContext(context.Background(), MergeOptions{})
+	assert.Nil(t, err)
 
 	err = db.Close()
 	assert.Nil(t, err)
@@ -79,3 +83,788 @@ func TestDB_Merge_WithSomeInvalidData(t *testing.T) {
 
 	assert.Equal(t, 5, len(db.ListKeys()))
 }
+
+func TestDB_MergeWithContext_MaxFiles(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(512))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	value := bytes.Repeat([]byte("v"), 32)
+	for i := 0; i < 40; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%02d", i)), value)
+		assert.Nil(t, err)
+	}
+	// make the first data file dirtiest
+	for i := 0; i < 5; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%02d", i)), value)
+		assert.Nil(t, err)
+	}
+	// make the second data file a little dirty
+	err = db.Put([]byte("key-12"), value)
+	assert.Nil(t, err)
+
+	reclaimable := db.Stat().ReclaimableSize
+	assert.True(t, reclaimable > 0)
+
+	// keep the other data files
+	olderData := make(map[uint32][]byte)
+	for fid := range db.olderFiles {
+		if fid == 0 {
+			continue
+		}
+		data, err := os.ReadFile(model.GetDataFileName("./tmp/", model.DataFileType, fid))
+		assert.Nil(t, err)
+		olderData[fid] = data
+	}
+
+	err = db.MergeWithContext(context.Background(), MergeOptions{MaxFiles: 1})
+	assert.Nil(t, err)
+
+	// the dirtiest data file is rewritten in place
+	_, err = os.Stat(db.getMergeDirPath())
+	assert.True(t, os.IsNotExist(err))
+	assert.True(t, db.Stat().ReclaimableSize < reclaimable)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", WithDataFileSize(512))
+	assert.Nil(t, err)
+
+	// only the dirtiest data file is rewritten
+	for fid, data := range olderData {
+		newData, err := os.ReadFile(model.GetDataFileName("./tmp/", model.DataFileType, fid))
+		assert.Nil(t, err)
+		assert.Equal(t, data, newData)
+	}
+	assert.True(t, db.Stat().ReclaimableSize < reclaimable)
+
+	assert.Equal(t, 40, len(db.ListKeys()))
+	for i := 0; i < 40; i++ {
+		v, err := db.Get([]byte(fmt.Sprintf("key-%02d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, value, v)
+	}
+}
+
+func TestDB_MergeWithContext_KeepTombstone(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(512))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	value := bytes.Repeat([]byte("v"), 24)
+	// the first data file is almost valid
+	err = db.Put([]byte("deleted"), value)
+	assert.Nil(t, err)
+	for i := 0; i < 9; i++ {
+		err = db.Put([]byte(fmt.Sprintf("live-%v", i)), value)
+		assert.Nil(t, err)
+	}
+
+	// the tombstone is in a dirty data file
+	for i := 0; i < 10; i++ {
+		err = db.Put([]byte(fmt.Sprintf("tmp-%v", i)), value)
+		assert.Nil(t, err)
+	}
+	tombstoneFid := db.activeFile.Fid
+	assert.True(t, tombstoneFid > 0)
+	firstData, err := os.ReadFile(model.GetDataFileName("./tmp/", model.DataFileType, 0))
+	assert.Nil(t, err)
+	err = db.Delete([]byte("deleted"))
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		err = db.Put([]byte(fmt.Sprintf("tmp-%v", i)), value)
+		assert.Nil(t, err)
+	}
+
+	tombstoneFileSize, err := db.olderFiles[tombstoneFid].IoManager.Size()
+	assert.Nil(t, err)
+
+	err = db.MergeWithContext(context.Background(), MergeOptions{MinGarbageRatio: 0.5})
+	assert.Nil(t, err)
+
+	// the first data file is not merged
+	newFirstData, err := os.ReadFile(model.GetDataFileName("./tmp/", model.DataFileType, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, firstData, newFirstData)
+	newTombstoneFileSize, err := db.olderFiles[tombstoneFid].IoManager.Size()
+	assert.Nil(t, err)
+	assert.True(t, newTombstoneFileSize < tombstoneFileSize)
+	_, err = db.Get([]byte("deleted"))
+	assert.Equal(t, ErrNoRecord, err)
+
+	// the kept tombstone is not garbage, the merged file is not merged again
+	var merged int
+	err = db.MergeWithContext(context.Background(), MergeOptions{
+		MinGarbageRatio: 0.5,
+		Progress: func(progress MergeProgress) {
+			merged = progress.FilesDone
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, merged)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", WithDataFileSize(512))
+	assert.Nil(t, err)
+
+	_, err = db.Get([]byte("deleted"))
+	assert.Equal(t, ErrNoRecord, err)
+	assert.Equal(t, 19, len(db.ListKeys()))
+}
+
+func TestDB_MergeWithContext_RemoveDeadFiles(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(512))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+	}()
+	assert.Nil(t, err)
+
+	countFiles := func(suffix string) int {
+		matches, err := filepath.Glob("./tmp/*" + suffix)
+		assert.Nil(t, err)
+		return len(matches)
+	}
+
+	// every record of the first data files is overwritten
+	value := bytes.Repeat([]byte("v"), 32)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 20; i++ {
+			err = db.Put([]byte(fmt.Sprintf("key-%02d", i)), value)
+			assert.Nil(t, err)
+		}
+	}
+	db.hintWg.Wait()
+	dataFiles, hintFiles := countFiles(model.DataFileSuffix), countFiles(model.HintFileSuffix)
+	assert.True(t, hintFiles > 0)
+
+	err = db.MergeWithContext(context.Background(), MergeOptions{})
+	assert.Nil(t, err)
+
+	// the dead data files and their hint files are removed, not kept empty
+	assert.True(t, countFiles(model.DataFileSuffix) < dataFiles)
+	assert.True(t, countFiles(model.HintFileSuffix) < hintFiles)
+	for fid, dataFile := range db.olderFiles {
+		size, err := dataFile.IoManager.Size()
+		assert.Nil(t, err)
+		assert.True(t, size > 0, "fid %v", fid)
+	}
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", WithDataFileSize(512))
+	assert.Nil(t, err)
+	assert.Equal(t, 20, len(db.ListKeys()))
+	for i := 0; i < 20; i++ {
+		v, err := db.Get([]byte(fmt.Sprintf("key-%02d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, value, v)
+	}
+}
+
+func TestDB_MergeWithContext_TxTombstone(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(512))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	value := bytes.Repeat([]byte("v"), 32)
+	err = db.Put([]byte("committed"), value)
+	assert.Nil(t, err)
+	err = db.Put([]byte("aborted"), value)
+	assert.Nil(t, err)
+	for i := 0; i < 8; i++ {
+		err = db.Put([]byte(fmt.Sprintf("live-%v", i)), value)
+		assert.Nil(t, err)
+	}
+
+	for i := 0; i < 10; i++ {
+		err = db.Put([]byte(fmt.Sprintf("tmp-%v", i)), value)
+		assert.Nil(t, err)
+	}
+	wb := db.NewWriteBatch()
+	err = wb.Delete([]byte("committed"))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	// the transaction is not committed
+	_, err = db.appendRecord(&model.Record{
+		Key:      addTxSeqPrefix([]byte("aborted"), 100),
+		IsDelete: true,
+	})
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		err = db.Put([]byte(fmt.Sprintf("tmp-%v", i)), value)
+		assert.Nil(t, err)
+	}
+
+	err = db.MergeWithContext(context.Background(), MergeOptions{MinGarbageRatio: 0.5})
+	assert.Nil(t, err)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", WithDataFileSize(512))
+	assert.Nil(t, err)
+
+	_, err = db.Get([]byte("committed"))
+	assert.Equal(t, ErrNoRecord, err)
+	v, err := db.Get([]byte("aborted"))
+	assert.Nil(t, err)
+	assert.Equal(t, value, v)
+}
+
+func TestDB_Merge_Online(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(1024))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%v", i)), []byte(fmt.Sprintf("value-%v", i)))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 50; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%v", i)), []byte(fmt.Sprintf("new-value-%v", i)))
+		assert.Nil(t, err)
+	}
+	for i := 50; i < 60; i++ {
+		err = db.Delete([]byte(fmt.Sprintf("key-%v", i)))
+		assert.Nil(t, err)
+	}
+	oldFile := db.olderFiles[0]
+	reclaimable := db.Stat().ReclaimableSize
+
+	// read and write during the merge
+	stop := make(chan struct{})
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for i := 60; i < 100; i++ {
+				value, err := db.Get([]byte(fmt.Sprintf("key-%v", i)))
+				assert.Nil(t, err)
+				assert.Equal(t, fmt.Sprintf("value-%v", i), string(value))
+			}
+		}
+	}()
+
+	done := make(chan error)
+	go func() {
+		done <- db.MergeWithContext(context.Background(), MergeOptions{})
+	}()
+	for i := 100; i < 120; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%v", i)), []byte(fmt.Sprintf("value-%v", i)))
+		assert.Nil(t, err)
+	}
+	err = <-done
+	assert.Nil(t, err)
+	close(stop)
+	<-readDone
+
+	// the merged files are used without reopening
+	_, err = os.Stat(db.getMergeDirPath())
+	assert.True(t, os.IsNotExist(err))
+	assert.NotEqual(t, oldFile, db.olderFiles[0])
+	assert.True(t, db.Stat().ReclaimableSize < reclaimable)
+
+	assert.Equal(t, 110, len(db.ListKeys()))
+	for i := 0; i < 120; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("key-%v", i)))
+		switch {
+		case i < 50:
+			assert.Nil(t, err)
+			assert.Equal(t, fmt.Sprintf("new-value-%v", i), string(value))
+		case i < 60:
+			assert.Equal(t, ErrNoRecord, err)
+		default:
+			assert.Nil(t, err)
+			assert.Equal(t, fmt.Sprintf("value-%v", i), string(value))
+		}
+	}
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", WithDataFileSize(1024))
+	assert.Nil(t, err)
+	assert.Equal(t, 110, len(db.ListKeys()))
+	value, err := db.Get([]byte("key-0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "new-value-0", string(value))
+}
+
+// xorCodec use fixed size header and mask the record data,
+// the data files can not be read by the default codec
+type xorCodec struct {
+	codec.CodecImpl
+}
+
+const xorHeaderSize = 13
+
+func (xc *xorCodec) MarshalRecordHeader(header *model.RecordHeader) ([]byte, int64, error) {
+	data := make([]byte, xorHeaderSize)
+	binary.BigEndian.PutUint32(data[:4], header.Crc)
+	if header.IsDelete {
+		data[4] = 1
+	}
+	binary.BigEndian.PutUint32(data[5:9], uint32(header.KeySize))
+	binary.BigEndian.PutUint32(data[9:13], uint32(header.ValueSize))
+	return data, xorHeaderSize, nil
+}
+
+func (xc *xorCodec) UnmarshalRecordHeader(data []byte, header *model.RecordHeader) (int64, error) {
+	if len(data) < xorHeaderSize {
+		return 0, io.EOF
+	}
+	header.Crc = binary.BigEndian.Uint32(data[:4])
+	header.IsDelete = data[4] == 1
+	header.KeySize = int64(binary.BigEndian.Uint32(data[5:9]))
+	header.ValueSize = int64(binary.BigEndian.Uint32(data[9:13]))
+	return xorHeaderSize, nil
+}
+
+func (xc *xorCodec) MarshalRecord(record *model.Record) ([]byte, int64, error) {
+	data, size, err := xc.CodecImpl.MarshalRecord(record)
+	xorData(data)
+	return data, size, err
+}
+
+func (xc *xorCodec) UnmarshalRecord(data []byte, header *model.RecordHeader, record *model.Record) error {
+	// the raw data is used to check crc
+	data = append([]byte(nil), data...)
+	xorData(data)
+	return xc.CodecImpl.UnmarshalRecord(data, header, record)
+}
+
+func xorData(data []byte) {
+	for i := range data {
+		data[i] ^= 0x5a
+	}
+}
+
+// countingIOManager count the files opened by the custom io manager creator
+type countingIOManager struct {
+	fio.IOManager
+}
+
+func TestDB_Merge_WithCustomOptions(t *testing.T) {
+	var opened int64
+	ioManagerCreator := func(filePath string) (fio.IOManager, error) {
+		atomic.AddInt64(&opened, 1)
+		ioManager, err := fio.NewFIleIO(filePath)
+		if err != nil {
+			return nil, err
+		}
+		return &countingIOManager{IOManager: ioManager}, nil
+	}
+
+	cases := map[string][]Option{
+		"default":      nil,
+		"codec":        {WithCodec(&xorCodec{})},
+		"io manager":   {WithIOManagerCreator(ioManagerCreator), WithFileLock(fio.NewFlock("./tmp/"))},
+		"file size":    {WithDataFileSize(256)},
+		"inline value": {WithInlineValueSize(16), WithDataFileSize(512)},
+		"buffered io":  {WithBufferedIO(64), WithDataFileSize(256)},
+		"all": {
+			WithCodec(&xorCodec{}),
+			WithIOManagerCreator(ioManagerCreator),
+			WithFileLock(fio.NewFlock("./tmp/")),
+			WithDataFileSize(256),
+			WithInlineValueSize(16),
+		},
+	}
+
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				_ = os.RemoveAll("./tmp/")
+				_ = os.RemoveAll("./tmp-cqkv-merge")
+			}()
+			opened = 0
+
+			// the dir is not created for the custom io manager
+			err := os.MkdirAll("./tmp/", os.ModePerm)
+			assert.Nil(t, err)
+			db, err := Open("./tmp/", opts...)
+			assert.Nil(t, err)
+			assert.NotNil(t, db)
+
+			for i := 0; i < 50; i++ {
+				err = db.Put([]byte(fmt.Sprintf("key-%v", i)), []byte(fmt.Sprintf("value-%v", i)))
+				assert.Nil(t, err)
+			}
+			for i := 0; i < 20; i++ {
+				err = db.Put([]byte(fmt.Sprintf("key-%v", i)), []byte(fmt.Sprintf("new-value-%v", i)))
+				assert.Nil(t, err)
+			}
+			wb := db.NewWriteBatch()
+			for i := 20; i < 30; i++ {
+				err = wb.Delete([]byte(fmt.Sprintf("key-%v", i)))
+				assert.Nil(t, err)
+			}
+			err = wb.Commit()
+			assert.Nil(t, err)
+
+			check := func(db *DB) {
+				assert.Equal(t, 40, len(db.ListKeys()))
+				for i := 0; i < 50; i++ {
+					value, err := db.Get([]byte(fmt.Sprintf("key-%v", i)))
+					switch {
+					case i < 20:
+						assert.Nil(t, err)
+						assert.Equal(t, fmt.Sprintf("new-value-%v", i), string(value))
+					case i < 30:
+						assert.Equal(t, ErrNoRecord, err)
+					default:
+						assert.Nil(t, err)
+						assert.Equal(t, fmt.Sprintf("value-%v", i), string(value))
+					}
+				}
+			}
+
+			err = db.MergeWithContext(context.Background(), MergeOptions{})
+			assert.Nil(t, err)
+			check(db)
+
+			// the merged files respect the data file size
+			for fid := range db.olderFiles {
+				info, err := os.Stat(model.GetDataFileName("./tmp/", model.DataFileType, fid))
+				assert.Nil(t, err)
+				assert.True(t, info.Size() <= db.options.dataFileSize)
+			}
+
+			err = db.Close()
+			assert.Nil(t, err)
+
+			// reopen without snapshot and hint files, the data files are decoded by the codec
+			err = os.Remove(model.GetDataFileName("./tmp/", model.SnapshotFileType, 0))
+			assert.Nil(t, err)
+			hintFiles, err := filepath.Glob(filepath.Join("./tmp/", "*"+model.HintFileSuffix))
+			assert.Nil(t, err)
+			for _, hintFile := range hintFiles {
+				assert.Nil(t, os.Remove(hintFile))
+			}
+
+			db, err = Open("./tmp/", opts...)
+			assert.Nil(t, err)
+			check(db)
+			err = db.Close()
+			assert.Nil(t, err)
+
+			// reopen with the hint files generated by the codec
+			db, err = Open("./tmp/", opts...)
+			assert.Nil(t, err)
+			check(db)
+			err = db.Close()
+			assert.Nil(t, err)
+
+			if name == "io manager" || name == "all" {
+				assert.True(t, atomic.LoadInt64(&opened) > 0)
+			}
+		})
+	}
+}
+
+func TestDB_MergeWithContext_Cancel(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(512))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 50; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%v", i)), []byte(fmt.Sprintf("value-%v", i)))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 50; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%v", i)), []byte(fmt.Sprintf("new-value-%v", i)))
+		assert.Nil(t, err)
+	}
+	reclaimable := db.Stat().ReclaimableSize
+
+	// cancel after the first file is merged
+	ctx, cancel := context.WithCancel(context.Background())
+	var filesDone int
+	err = db.MergeWithContext(ctx, MergeOptions{
+		Progress: func(progress MergeProgress) {
+			filesDone = progress.FilesDone
+			cancel()
+		},
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, filesDone)
+
+	// the data files are not changed
+	_, err = os.Stat(db.getMergeDirPath())
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, reclaimable, db.Stat().ReclaimableSize)
+	for i := 0; i < 50; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("key-%v", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("new-value-%v", i), string(value))
+	}
+
+	// merge again
+	err = db.MergeWithContext(context.Background(), MergeOptions{})
+	assert.Nil(t, err)
+	assert.True(t, db.Stat().ReclaimableSize < reclaimable)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", WithDataFileSize(512))
+	assert.Nil(t, err)
+	assert.Equal(t, 50, len(db.ListKeys()))
+}
+
+func TestDB_MergeWithContext_Progress(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(512))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 50; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%v", i)), []byte(fmt.Sprintf("value-%v", i)))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 25; i++ {
+		err = db.Delete([]byte(fmt.Sprintf("key-%v", i)))
+		assert.Nil(t, err)
+	}
+
+	var totalSize int64
+	for _, dataFile := range db.olderFiles {
+		size, err := dataFile.IoManager.Size()
+		assert.Nil(t, err)
+		totalSize += size
+	}
+	size, err := db.activeFile.IoManager.Size()
+	assert.Nil(t, err)
+	totalSize += size
+
+	// the limit make the merge take about 0.2s
+	bytesPerSec := totalSize * 5
+	var progresses []MergeProgress
+	start := time.Now()
+	err = db.MergeWithContext(context.Background(), MergeOptions{
+		BytesPerSec: bytesPerSec,
+		Progress: func(progress MergeProgress) {
+			progresses = append(progresses, progress)
+		},
+	})
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) >= 150*time.Millisecond)
+
+	assert.True(t, len(progresses) > 0)
+	last := progresses[len(progresses)-1]
+	assert.Equal(t, last.FilesTotal, last.FilesDone)
+	assert.Equal(t, len(progresses), last.FilesTotal)
+	assert.True(t, last.BytesRewritten > 0)
+	assert.True(t, last.BytesReclaimed > 0)
+
+	var mergedSize int64
+	for _, dataFile := range db.olderFiles {
+		size, err := dataFile.IoManager.Size()
+		assert.Nil(t, err)
+		mergedSize += size
+	}
+	assert.Equal(t, totalSize-last.BytesReclaimed, mergedSize)
+}
+
+func TestDB_MergeWithContext_CompactionFilter(t *testing.T) {
+	filter := func(key, value []byte) Decision {
+		switch {
+		case bytes.HasPrefix(key, []byte("drop")):
+			return Decision{Action: CompactionDrop}
+		case bytes.HasPrefix(key, []byte("rewrite")):
+			return Decision{Action: CompactionRewrite, Value: append([]byte("new-"), value...)}
+		}
+		return Decision{Action: CompactionKeep}
+	}
+	db, err := Open("./tmp/", WithDataFileSize(512), WithCompactionFilter(filter), WithInlineValueSize(8))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	value := bytes.Repeat([]byte("v"), 24)
+	// the old value in the first data file which will not be merged
+	err = db.Put([]byte("drop-old"), []byte("old"))
+	assert.Nil(t, err)
+	for i := 0; i < 9; i++ {
+		err = db.Put([]byte(fmt.Sprintf("live-%v", i)), value)
+		assert.Nil(t, err)
+	}
+
+	for i := 0; i < 9; i++ {
+		err = db.Put([]byte(fmt.Sprintf("tmp-%v", i)), value)
+		assert.Nil(t, err)
+	}
+	err = db.Put([]byte("drop-old"), []byte("new"))
+	assert.Nil(t, err)
+	err = db.Put([]byte("drop-new"), value)
+	assert.Nil(t, err)
+	err = db.Put([]byte("rewrite"), []byte("v"))
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		err = db.Put([]byte(fmt.Sprintf("tmp-%v", i)), value)
+		assert.Nil(t, err)
+	}
+
+	err = db.MergeWithContext(context.Background(), MergeOptions{MinGarbageRatio: 0.5})
+	assert.Nil(t, err)
+
+	check := func(db *DB) {
+		_, err = db.Get([]byte("drop-old"))
+		assert.Equal(t, ErrNoRecord, err)
+		_, err = db.Get([]byte("drop-new"))
+		assert.Equal(t, ErrNoRecord, err)
+		v, err := db.Get([]byte("rewrite"))
+		assert.Nil(t, err)
+		assert.Equal(t, "new-v", string(v))
+		v, err = db.Get([]byte("live-0"))
+		assert.Nil(t, err)
+		assert.Equal(t, value, v)
+		assert.Equal(t, 20, len(db.ListKeys()))
+	}
+	check(db)
+	// the rewritten value is inlined
+	assert.Equal(t, "new-v", string(db.options.keydir.Get([]byte("rewrite")).Value))
+
+	// the tombstone hide the old value in the first data file
+	err = db.Close()
+	assert.Nil(t, err)
+	err = os.Remove(model.GetDataFileName("./tmp/", model.SnapshotFileType, 0))
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", WithDataFileSize(512), WithCompactionFilter(filter), WithInlineValueSize(8))
+	assert.Nil(t, err)
+	check(db)
+}
+
+func TestDB_MergeWithContext_Expired(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(512))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	value := bytes.Repeat([]byte("v"), 32)
+	for i := 0; i < 20; i++ {
+		err = db.PutWithTTL([]byte(fmt.Sprintf("expired-%v", i)), value, 50*time.Millisecond)
+		assert.Nil(t, err)
+		err = db.Put([]byte(fmt.Sprintf("live-%v", i)), value)
+		assert.Nil(t, err)
+		// the expired records are not counted as garbage, overwrite a key to merge every file
+		err = db.Put([]byte("tmp"), value)
+		assert.Nil(t, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 41, db.options.keydir.Size())
+
+	var progress MergeProgress
+	err = db.MergeWithContext(context.Background(), MergeOptions{
+		Progress: func(p MergeProgress) { progress = p },
+	})
+	assert.Nil(t, err)
+	assert.True(t, progress.BytesReclaimed > 0)
+
+	// the expired keys are removed from the keydir
+	assert.Equal(t, 21, db.options.keydir.Size())
+	_, err = db.Get([]byte("expired-0"))
+	assert.Equal(t, ErrNoRecord, err)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", WithDataFileSize(512))
+	assert.Nil(t, err)
+	assert.Equal(t, 21, db.options.keydir.Size())
+	v, err := db.Get([]byte("live-19"))
+	assert.Nil(t, err)
+	assert.Equal(t, value, v)
+}
+
+func TestDB_MergeWithContext_RangeTombstone(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(512))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	value := bytes.Repeat([]byte("v"), 24)
+	for i := 0; i < 30; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%02d", i)), value)
+		assert.Nil(t, err)
+	}
+	err = db.DeletePrefix([]byte("key-1"))
+	assert.Nil(t, err)
+
+	countRangeTombstones := func() int {
+		var count int
+		for _, dataFile := range db.olderFiles {
+			var offset int64
+			for {
+				record, size, err := db.getRecordFromDataFile(dataFile, offset)
+				if err == io.EOF {
+					break
+				}
+				assert.Nil(t, err)
+				if record.IsRangeDelete {
+					count++
+				}
+				offset += size
+			}
+		}
+		return count
+	}
+
+	// the range tombstone is kept if the older files are not merged
+	err = db.MergeWithContext(context.Background(), MergeOptions{MaxFiles: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, countRangeTombstones())
+
+	// the range tombstone is dropped if all the older files are merged
+	err = db.Delete([]byte("key-00"))
+	assert.Nil(t, err)
+	err = db.MergeWithContext(context.Background(), MergeOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, countRangeTombstones())
+	assert.Equal(t, 19, len(db.ListKeys()))
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", WithDataFileSize(512))
+	assert.Nil(t, err)
+	assert.Equal(t, 19, len(db.ListKeys()))
+	_, err = db.Get([]byte("key-15"))
+	assert.Equal(t, ErrNoRecord, err)
+}
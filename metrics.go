@@ -0,0 +1,109 @@
+package cqkv
+
+import (
+	"github.com/cqkv/cqkv/fio"
+	"github.com/cqkv/cqkv/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// dbMetrics is the metrics of the engine, they are nil and do nothing without WithMetrics
+type dbMetrics struct {
+	putLatency    *metrics.Histogram
+	getLatency    *metrics.Histogram
+	deleteLatency *metrics.Histogram
+
+	writtenBytes *metrics.Counter
+	readBytes    *metrics.Counter
+	// the count of the histogram is the fsync count
+	fsyncLatency *metrics.Histogram
+
+	fileRotations *metrics.Counter
+	mergeDuration *metrics.Histogram
+
+	// the inline values in keydir are the cache of the data files
+	inlineHits   *metrics.Counter
+	inlineMisses *metrics.Counter
+}
+
+var mergeBuckets = []float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 600}
+
+func newDBMetrics(db *DB, registry *metrics.Registry) *dbMetrics {
+	if registry == nil {
+		return &dbMetrics{}
+	}
+
+	registry.NewGaugeFunc("cqkv_keydir_keys", "Number of keys in the keydir.", func() float64 {
+		return float64(db.keyNum())
+	})
+	registry.NewGaugeFunc("cqkv_inline_value_bytes", "Memory used by the values inlined in the keydir.", func() float64 {
+		return float64(atomic.LoadInt64(&db.inlineBytes))
+	})
+
+	return &dbMetrics{
+		putLatency:    registry.NewHistogram("cqkv_put_seconds", "Latency of Put.", metrics.DefaultBuckets),
+		getLatency:    registry.NewHistogram("cqkv_get_seconds", "Latency of Get.", metrics.DefaultBuckets),
+		deleteLatency: registry.NewHistogram("cqkv_delete_seconds", "Latency of Delete.", metrics.DefaultBuckets),
+		writtenBytes:  registry.NewCounter("cqkv_written_bytes_total", "Bytes written to the files."),
+		readBytes:     registry.NewCounter("cqkv_read_bytes_total", "Bytes read from the files."),
+		fsyncLatency:  registry.NewHistogram("cqkv_fsync_seconds", "Latency of fsync.", metrics.DefaultBuckets),
+		fileRotations: registry.NewCounter("cqkv_file_rotations_total", "Number of the active data and blob files sealed."),
+		mergeDuration: registry.NewHistogram("cqkv_merge_seconds", "Duration of merge.", mergeBuckets),
+		inlineHits:    registry.NewCounter("cqkv_inline_hits_total", "Number of Get served by the values inlined in the keydir."),
+		inlineMisses:  registry.NewCounter("cqkv_inline_misses_total", "Number of Get reading the data files."),
+	}
+}
+
+// meteredIO count the bytes and the fsync of the io manager
+type meteredIO struct {
+	fio.IOManager
+	metrics *dbMetrics
+}
+
+// meteredIOManagerCreator wrap the io managers created by creator
+func meteredIOManagerCreator(creator func(filePath string) (fio.IOManager, error), m *dbMetrics) func(filePath string) (fio.IOManager, error) {
+	return func(filePath string) (fio.IOManager, error) {
+		ioManager, err := creator(filePath)
+		if err != nil {
+			return nil, err
+		}
+		return &meteredIO{IOManager: ioManager, metrics: m}, nil
+	}
+}
+
+func (m *meteredIO) Read(buf []byte, offset int64) (int, error) {
+	n, err := m.IOManager.Read(buf, offset)
+	m.metrics.readBytes.Add(uint64(n))
+	return n, err
+}
+
+func (m *meteredIO) Write(data []byte) (int, error) {
+	n, err := m.IOManager.Write(data)
+	m.metrics.writtenBytes.Add(uint64(n))
+	return n, err
+}
+
+func (m *meteredIO) Sync() error {
+	start := time.Now()
+	err := m.IOManager.Sync()
+	m.metrics.fsyncLatency.ObserveSince(start)
+	return err
+}
+
+func (m *meteredIO) DiskSize() (int64, error) {
+	if sizer, ok := m.IOManager.(fio.DiskSizer); ok {
+		return sizer.DiskSize()
+	}
+	return m.IOManager.Size()
+}
+
+func (m *meteredIO) Truncate(size int64) error {
+	return fio.Truncate(m.IOManager, size)
+}
+
+func (m *meteredIO) Seal() error {
+	if sealer, ok := m.IOManager.(fio.Sealer); ok {
+		return sealer.Seal()
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBuckets is the upper bounds in seconds of the latency histograms
+var DefaultBuckets = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// metric can be written in the prometheus text format
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// Registry hold the metrics and expose them in the prometheus text format,
+// the metrics of the same name are shared
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[string]metric),
+	}
+}
+
+// NewCounter return the counter of the name, it is created if not exist
+func (r *Registry) NewCounter(name, help string) *Counter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.metrics[name].(*Counter); ok {
+		return c
+	}
+	c := &Counter{desc: desc{metricName: name, help: help}}
+	r.metrics[name] = c
+	return c
+}
+
+// NewHistogram return the histogram of the name, it is created with buckets if not exist,
+// buckets should be sorted in increasing order
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if h, ok := r.metrics[name].(*Histogram); ok {
+		return h
+	}
+	h := &Histogram{
+		desc:    desc{metricName: name, help: help},
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+	r.metrics[name] = h
+	return h
+}
+
+// NewGaugeFunc register a gauge whose value is returned by fn when it is exposed,
+// the fn of the same name is replaced
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics[name] = &gaugeFunc{desc: desc{metricName: name, help: help}, fn: fn}
+}
+
+// WritePrometheus write all the metrics in the prometheus text format, sorted by name
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	metrics := make([]metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		metrics = append(metrics, m)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].name() < metrics[j].name()
+	})
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler return the http handler exposing the metrics
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.WritePrometheus(w)
+	})
+}
+
+type desc struct {
+	metricName string
+	help       string
+}
+
+func (d *desc) name() string {
+	return d.metricName
+}
+
+func (d *desc) writeHeader(w *bufio.Writer, typ string) {
+	w.WriteString("# HELP " + d.metricName + " " + d.help + "\n")
+	w.WriteString("# TYPE " + d.metricName + " " + typ + "\n")
+}
+
+// Counter is a monotonically increasing value, a nil counter does nothing
+type Counter struct {
+	desc
+	value uint64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	if c == nil {
+		return
+	}
+	atomic.AddUint64(&c.value, n)
+}
+
+func (c *Counter) Value() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.writeHeader(w, "counter")
+	w.WriteString(c.metricName + " " + strconv.FormatUint(c.Value(), 10) + "\n")
+}
+
+// Histogram count the observed values in buckets, a nil histogram does nothing
+type Histogram struct {
+	desc
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64 // not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	if h == nil {
+		return
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// ObserveSince observe the seconds since start
+func (h *Histogram) ObserveSince(start time.Time) {
+	if h == nil {
+		return
+	}
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Count return the number of the observed values
+func (h *Histogram) Count() uint64 {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	counts := append([]uint64{}, h.counts...)
+	count, sum := h.count, h.sum
+	h.mu.Unlock()
+
+	h.writeHeader(w, "histogram")
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += counts[i]
+		w.WriteString(h.metricName + "_bucket{le=\"" + formatFloat(bound) + "\"} " + strconv.FormatUint(cumulative, 10) + "\n")
+	}
+	w.WriteString(h.metricName + "_bucket{le=\"+Inf\"} " + strconv.FormatUint(count, 10) + "\n")
+	w.WriteString(h.metricName + "_sum " + formatFloat(sum) + "\n")
+	w.WriteString(h.metricName + "_count " + strconv.FormatUint(count, 10) + "\n")
+}
+
+type gaugeFunc struct {
+	desc
+	fn func() float64
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w, "gauge")
+	w.WriteString(g.metricName + " " + formatFloat(g.fn()) + "\n")
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
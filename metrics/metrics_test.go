@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistry_WritePrometheus(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounter("test_total", "Test counter.")
+	counter.Add(2)
+	counter.Inc()
+	// the metric of the same name is shared
+	assert.Equal(t, counter, registry.NewCounter("test_total", "Test counter."))
+
+	histogram := registry.NewHistogram("test_seconds", "Test histogram.", []float64{0.1, 1})
+	histogram.Observe(0.05)
+	histogram.Observe(0.1)
+	histogram.Observe(5)
+	registry.NewGaugeFunc("test_gauge", "Test gauge.", func() float64 {
+		return 1.5
+	})
+
+	buf := new(bytes.Buffer)
+	err := registry.WritePrometheus(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, `# HELP test_gauge Test gauge.
+# TYPE test_gauge gauge
+test_gauge 1.5
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 2
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 5.15
+test_seconds_count 3
+# HELP test_total Test counter.
+# TYPE test_total counter
+test_total 3
+`, buf.String())
+
+	recorder := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, buf.String(), recorder.Body.String())
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", recorder.Header().Get("Content-Type"))
+}
+
+func TestNilMetrics(t *testing.T) {
+	var counter *Counter
+	counter.Inc()
+	assert.Equal(t, uint64(0), counter.Value())
+
+	var histogram *Histogram
+	histogram.Observe(1)
+	assert.Equal(t, uint64(0), histogram.Count())
+}
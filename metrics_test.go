@@ -0,0 +1,54 @@
+package cqkv
+
+import (
+	"bytes"
+	"context"
+	"github.com/cqkv/cqkv/metrics"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestDB_WithMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	db, err := Open("./tmp/", WithDataFileSize(512), WithInlineValueSize(16), WithMetrics(registry))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 20; i++ {
+		err = db.Put([]byte("key"), bytes.Repeat([]byte("a"), 32))
+		assert.Nil(t, err)
+	}
+	err = db.Put([]byte("small"), []byte("value"))
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("key"))
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("small"))
+	assert.Nil(t, err)
+	err = db.Delete([]byte("key"))
+	assert.Nil(t, err)
+	err = db.MergeWithContext(context.Background(), MergeOptions{})
+	assert.Nil(t, err)
+
+	m := db.metrics
+	assert.Equal(t, uint64(21), m.putLatency.Count())
+	assert.Equal(t, uint64(2), m.getLatency.Count())
+	assert.Equal(t, uint64(1), m.deleteLatency.Count())
+	assert.Equal(t, uint64(1), m.inlineHits.Value())
+	assert.Equal(t, uint64(1), m.inlineMisses.Value())
+	assert.Equal(t, uint64(1), m.mergeDuration.Count())
+	assert.True(t, m.writtenBytes.Value() > 20*32)
+	assert.True(t, m.readBytes.Value() > 0)
+	assert.True(t, m.fsyncLatency.Count() > 0)
+	assert.True(t, m.fileRotations.Value() > 0)
+
+	buf := new(bytes.Buffer)
+	err = registry.WritePrometheus(buf)
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), "cqkv_keydir_keys 1\n")
+	assert.Contains(t, buf.String(), "cqkv_put_seconds_count 21\n")
+}
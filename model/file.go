@@ -3,30 +3,43 @@ package model
 import (
 	"fmt"
 	"github.com/cqkv/cqkv/fio"
+	"io"
 	"path/filepath"
+	"sync/atomic"
 )
 
 const (
 	DataFileType          = "data"
-	HintFileType          = "hint"
+	DataHintFileType      = "data-hint"
 	MergeFinishedFileType = "merge-finished"
+	SnapshotFileType      = "snapshot"
+	BlobFileType          = "blob"
 
 	DataFileSuffix        = ".cq"
 	HintFileSuffix        = ".hint"
 	MergeFinishedFileName = "cqkv-merge-finished"
+	SnapshotFileName      = "cqkv-keydir-snapshot"
+	BlobFileSuffix        = ".blob"
 )
 
+// streamBufferSize is the size of the chunks WriteFrom writes
+const streamBufferSize = 64 * 1024
+
 type DataFile struct {
 	Fid         uint32
 	WriteOffset int64 // only active data file use this field
 	WriteTimes  int64
 	IoManager   fio.IOManager
+
+	refs int32 // reference count, the data file is closed when it drops to zero
 }
 
+// OpenDataFile return a data file referenced by the caller
 func OpenDataFile(fid uint32, ioManager fio.IOManager) *DataFile {
 	return &DataFile{
 		Fid:       fid,
 		IoManager: ioManager,
+		refs:      1,
 	}
 }
 
@@ -35,10 +48,14 @@ func GetDataFileName(dirPath, fileType string, fid uint32) string {
 	switch fileType {
 	case DataFileType:
 		filePath = filepath.Join(dirPath, fmt.Sprintf("%09d%s", fid, DataFileSuffix))
-	case HintFileType:
-		filePath = filepath.Join(dirPath, fmt.Sprintf("cqkv%s", HintFileSuffix))
+	case DataHintFileType:
+		filePath = filepath.Join(dirPath, fmt.Sprintf("%09d%s", fid, HintFileSuffix))
 	case MergeFinishedFileType:
 		filePath = filepath.Join(dirPath, MergeFinishedFileName)
+	case SnapshotFileType:
+		filePath = filepath.Join(dirPath, SnapshotFileName)
+	case BlobFileType:
+		filePath = filepath.Join(dirPath, fmt.Sprintf("%09d%s", fid, BlobFileSuffix))
 	}
 	return filePath
 }
@@ -47,6 +64,22 @@ func (df *DataFile) Sync() error {
 	return df.IoManager.Sync()
 }
 
+// Seal tell the io manager that the data file is immutable
+func (df *DataFile) Seal() error {
+	if sealer, ok := df.IoManager.(fio.Sealer); ok {
+		return sealer.Seal()
+	}
+	return nil
+}
+
+// DiskSize return the size the data file takes on the disk, it may be larger than the data if preallocated
+func (df *DataFile) DiskSize() (int64, error) {
+	if sizer, ok := df.IoManager.(fio.DiskSizer); ok {
+		return sizer.DiskSize()
+	}
+	return df.IoManager.Size()
+}
+
 // Write binary data into file
 func (df *DataFile) Write(data []byte) error {
 	size, err := df.IoManager.Write(data)
@@ -54,6 +87,9 @@ func (df *DataFile) Write(data []byte) error {
 		return err
 	}
 	df.WriteOffset += int64(size)
+	if size != len(data) {
+		return io.ErrShortWrite
+	}
 	return nil
 }
 
@@ -64,6 +100,10 @@ func (df *DataFile) ReadRecordHeader(offset int64) ([]byte, error) {
 		return nil, err
 	}
 
+	if offset >= fileSize {
+		return nil, io.EOF
+	}
+
 	var headerBuf int64 = MaxHeaderSize
 	if headerBuf+offset > fileSize {
 		headerBuf = fileSize - offset
@@ -73,9 +113,54 @@ func (df *DataFile) ReadRecordHeader(offset int64) ([]byte, error) {
 }
 
 func (df *DataFile) ReadRecord(off, size int64) (data []byte, err error) {
+	// the record is truncated or the offset is not the start of a record
+	fileSize, err := df.IoManager.Size()
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 || off+size > fileSize {
+		return nil, io.EOF
+	}
 	return df.readNBytes(off, size)
 }
 
+// Truncate remove the data after offset, the next write is appended to offset
+func (df *DataFile) Truncate(offset int64) error {
+	if err := fio.Truncate(df.IoManager, offset); err != nil {
+		return err
+	}
+	df.WriteOffset = offset
+	return nil
+}
+
+// NewReader return a reader of the n bytes from offset, the bytes are read on demand
+func (df *DataFile) NewReader(offset, n int64) io.Reader {
+	return io.NewSectionReader(readerAt{df.IoManager}, offset, n)
+}
+
+// WriteFrom write n bytes of r into file in chunks, so the bytes are never all in memory
+func (df *DataFile) WriteFrom(r io.Reader, n int64) error {
+	bufSize := int64(streamBufferSize)
+	if n < bufSize {
+		bufSize = n
+	}
+	buf := make([]byte, bufSize)
+	for n > 0 {
+		chunk := buf
+		if n < int64(len(chunk)) {
+			chunk = chunk[:n]
+		}
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return err
+		}
+		if err := df.Write(chunk); err != nil {
+			return err
+		}
+		n -= int64(len(chunk))
+	}
+	return nil
+}
+
 func (df *DataFile) readNBytes(offset, n int64) ([]byte, error) {
 	buf := make([]byte, n)
 	_, err := df.IoManager.Read(buf, offset)
@@ -88,3 +173,25 @@ func (df *DataFile) readNBytes(offset, n int64) ([]byte, error) {
 func (df *DataFile) Close() error {
 	return df.IoManager.Close()
 }
+
+// Ref add a reference, the data file will not be closed until Unref is called
+func (df *DataFile) Ref() {
+	atomic.AddInt32(&df.refs, 1)
+}
+
+// Unref release a reference, the data file is closed if no one references it
+func (df *DataFile) Unref() error {
+	if atomic.AddInt32(&df.refs, -1) == 0 {
+		return df.Close()
+	}
+	return nil
+}
+
+// readerAt read the io manager as an io.ReaderAt
+type readerAt struct {
+	ioManager fio.IOManager
+}
+
+func (r readerAt) ReadAt(p []byte, off int64) (int, error) {
+	return r.ioManager.Read(p, off)
+}
@@ -3,6 +3,7 @@ package model
 import (
 	"github.com/cqkv/cqkv/fio"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"os"
 	"testing"
 )
@@ -45,6 +46,29 @@ func TestDataFile_Write(t *testing.T) {
 	assert.Equal(t, int64(9), dataFile.WriteOffset)
 }
 
+// shortIOManager write half of the data without an error
+type shortIOManager struct {
+	fio.IOManager
+}
+
+func (s shortIOManager) Write(data []byte) (int, error) {
+	return s.IOManager.Write(data[:len(data)/2])
+}
+
+func TestDataFile_ShortWrite(t *testing.T) {
+	dir := "./tmp"
+	ioManager, err := fio.NewFIleIO(dir)
+	defer func() {
+		_ = os.Remove(dir)
+	}()
+	assert.Nil(t, err)
+
+	dataFile := OpenDataFile(0, shortIOManager{ioManager})
+	err = dataFile.Write([]byte("aaaa"))
+	assert.Equal(t, io.ErrShortWrite, err)
+	assert.Equal(t, int64(2), dataFile.WriteOffset)
+}
+
 func TestDataFile_ReadRecordHeader(t *testing.T) {
 	dir := "./tmp"
 	ioManager, err := fio.NewFIleIO(dir)
@@ -124,3 +148,33 @@ func TestDataFile_Sync(t *testing.T) {
 	err = dataFile.Sync()
 	assert.Nil(t, err)
 }
+
+func TestDataFile_Unref(t *testing.T) {
+	dir := "./tmp"
+	ioManager, err := fio.NewFIleIO(dir)
+	defer func() {
+		_ = os.Remove(dir)
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, ioManager)
+
+	dataFile := OpenDataFile(0, ioManager)
+	assert.NotNil(t, dataFile)
+
+	err = dataFile.Write([]byte("aaa"))
+	assert.Nil(t, err)
+
+	// the data file is still readable after the owner releases it
+	dataFile.Ref()
+	err = dataFile.Unref()
+	assert.Nil(t, err)
+	data, err := dataFile.ReadRecord(0, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("aaa"), data)
+
+	// the data file is closed by the last reference
+	err = dataFile.Unref()
+	assert.Nil(t, err)
+	_, err = dataFile.ReadRecord(0, 3)
+	assert.NotNil(t, err)
+}
@@ -2,27 +2,81 @@ package model
 
 import "encoding/binary"
 
-// TODO: change isDelete to record type to support more types of records, such as transaction record
-// record header: crc | isDelete | key size | value size
-// len:   		   4        1       max 5        max 5
+// record header: crc | flags | key size | value size | [seq] | [prev seq | prev fid | prev offset] | [timestamp] | [expire at] | [keyspace]
+// len:   		   4      1      max 5        max 5      max 10    max 10     max 5       max 10          max 10        max 10        max 5
+// the optional fields are only written if the flags are set
 
-const MaxHeaderSize = binary.MaxVarintLen32*2 + 5
+const (
+	// DeleteFlag indicate the record is a tombstone
+	DeleteFlag byte = 1 << iota
+	// SeqFlag indicate the header has the sequence of the record
+	SeqFlag
+	// PrevFlag indicate the header has the position of the previous version
+	PrevFlag
+	// TimestampFlag indicate the header has the write time
+	TimestampFlag
+	// ExpireFlag indicate the header has the expire time
+	ExpireFlag
+	// RangeDeleteFlag indicate the record deletes the keys in [key, value)
+	RangeDeleteFlag
+	// KeyspaceFlag indicate the header has the keyspace of the record
+	KeyspaceFlag
+	// BlobFlag indicate the value is a pointer to the blob file
+	BlobFlag
+)
+
+const MaxHeaderSize = binary.MaxVarintLen32*3 + 5 + MaxVersionSize + MaxTimeSize
+
+// MaxVersionSize is the max size of the seq and the previous version in the header
+const MaxVersionSize = binary.MaxVarintLen64*3 + binary.MaxVarintLen32
+
+// MaxTimeSize is the max size of the timestamp and the expire time in the header
+const MaxTimeSize = binary.MaxVarintLen64 * 2
 
 type RecordHeader struct {
-	Crc       uint32 // 4 bytes
-	KeySize   int64  // variable, max len = 5 bytes
-	ValueSize int64  // variable, max len = 5 bytes
-	IsDelete  bool   // 1 byte
+	Crc           uint32         // 4 bytes
+	KeySize       int64          // variable, max len = 5 bytes
+	ValueSize     int64          // variable, max len = 5 bytes
+	IsDelete      bool           // 1 byte
+	IsRangeDelete bool           // in the flags
+	IsBlob        bool           // in the flags
+	Seq           uint64         // variable, 0 means the record has no seq
+	Prev          *RecordVersion // the previous version of the key
+	Timestamp     int64          // variable, unix nano of the write, 0 means unknown
+	ExpireAt      int64          // variable, unix nano, 0 means never expire
+	Keyspace      uint32         // variable, 0 means the default keyspace
 }
 
 type Record struct {
-	Key      []byte
-	Value    []byte
-	IsDelete bool
+	Key           []byte
+	Value         []byte
+	IsDelete      bool
+	IsRangeDelete bool           // the key is the start of the range and the value is the end
+	IsBlob        bool           // the value is the position of the real value in the blob file
+	Seq           uint64         // the sequence of the write, it is unique in the db
+	Prev          *RecordVersion // the previous version of the key
+	Timestamp     int64          // unix nano of the write
+	ExpireAt      int64          // unix nano, 0 means never expire
+	Keyspace      uint32         // the id of the keyspace the key belongs to
 }
 
 type RecordPos struct {
-	Fid    uint32 // file id
-	Size   uint32 // value size
-	Offset int64  // value position
+	Fid      uint32 // file id
+	Size     uint32 // value size
+	Offset   int64  // value position
+	Seq      uint64 // the sequence of the record
+	ExpireAt int64  // unix nano, 0 means never expire
+	Value    []byte // inline value, only small values are kept in keydir
+}
+
+// IsExpired check whether the record is expired at now (unix nano)
+func (pos *RecordPos) IsExpired(now int64) bool {
+	return pos.ExpireAt > 0 && pos.ExpireAt <= now
+}
+
+// RecordVersion point to a version of the key
+type RecordVersion struct {
+	Seq    uint64
+	Fid    uint32
+	Offset int64
 }
@@ -4,7 +4,9 @@ import (
 	"github.com/cqkv/cqkv/codec"
 	"github.com/cqkv/cqkv/fio"
 	"github.com/cqkv/cqkv/keydir"
+	"github.com/cqkv/cqkv/metrics"
 	"os"
+	"runtime"
 )
 
 type options struct {
@@ -14,7 +16,15 @@ type options struct {
 	syncFre int64
 
 	ioManagerCreator func(filePath string) (fio.IOManager, error)
-	fileLock         fio.FileLocker
+	// activeFileCreator creates the new active data files, it preallocates them with the buffered io
+	activeFileCreator func(filePath string) (fio.IOManager, error)
+	fileLock          fio.FileLocker
+	// fs opens the files of the db unless the io manager creator is replaced,
+	// the directory operations always go through it
+	fs fio.FS
+
+	// the size of the buffer of fio.BufferedIO, 0 means fio.FileIO is used
+	bufferSize int
 
 	codec codec.Codec
 
@@ -23,6 +33,33 @@ type options struct {
 	btreeDegree int
 
 	fastOpen bool
+
+	// values smaller than inlineValueSize are kept in keydir
+	inlineValueSize int64
+
+	// loadWorkers is the number of data files decoded concurrently when opening
+	loadWorkers int
+
+	// retainVersions is the number of versions of a key merge keeps
+	retainVersions int
+
+	// values not smaller than blobThreshold are written to the blob files, 0 means never
+	blobThreshold int64
+
+	// metrics record the counters and histograms of the engine, nil means no metrics
+	metrics *metrics.Registry
+
+	// maxDiskBytes is the quota of the data files and the blob files, 0 means no quota
+	maxDiskBytes int64
+
+	// readOnly reject the writes, the followers of the replication are read only
+	readOnly bool
+
+	logger        Logger
+	eventListener EventListener
+
+	// compactionFilter decide whether to keep, drop or rewrite the live records during merge
+	compactionFilter CompactionFilter
 }
 
 func newDefaultOptions() *options {
@@ -31,13 +68,25 @@ func newDefaultOptions() *options {
 		dataFileSize:     1024 * 1024 * 256, // 256mb
 		syncFre:          1024,
 		ioManagerCreator: defaultIOManagerCreator,
+		fs:               fio.OSFS{},
 		codec:            codec.NewCodecImpl(),
 		keydir:           keydir.NewBTree(32),
 		keydirType:       keydir.BtreeTypeKeydir,
 		btreeDegree:      32,
+		loadWorkers:      runtime.NumCPU(),
+		logger:           nopLogger{},
+		eventListener:    NopEventListener{},
 	}
 }
 
+// newKeydir create an empty keydir of the keydir type, it is used by the keyspaces
+func (o *options) newKeydir() keydir.Keydir {
+	if o.keydirType == keydir.SkipListTypeKeydir {
+		return keydir.NewSkipList()
+	}
+	return keydir.NewBTree(o.btreeDegree)
+}
+
 //var defaultOptions = &options{}
 
 type Option func(*options)
@@ -62,6 +111,46 @@ var defaultIOManagerCreator = func(filePath string) (fio.IOManager, error) {
 	return fio.NewFIleIO(filePath)
 }
 
+// WithFS keep the files of the db in fsys, the file lock is fsys.Locker if WithFileLock is not used.
+// fio.BufferedIO is only used with fio.OSFS.
+func WithFS(fsys fio.FS) Option {
+	return func(o *options) {
+		if fsys == nil {
+			panic(ErrNoFS)
+		}
+		o.fs = fsys
+	}
+}
+
+// WithMemFS keep the files of the db in memFS, the db never touches the disk.
+// open the db on the same memFS to reopen it.
+func WithMemFS(memFS *fio.MemFS) Option {
+	if memFS == nil {
+		memFS = fio.NewMemFS()
+	}
+	return WithFS(memFS)
+}
+
+// WithBufferedIO use fio.BufferedIO with a buffer of bufferSize instead of fio.FileIO,
+// the new data files are preallocated to the data file size.
+// it replaces the io manager creator.
+func WithBufferedIO(bufferSize int) Option {
+	return func(o *options) {
+		if bufferSize <= 0 {
+			bufferSize = fio.DefaultBufferSize
+		}
+		o.bufferSize = bufferSize
+	}
+}
+
+// bufferedIOManagerCreator preallocate the files to preallocSize if it is positive,
+// it is only used for the new active data files
+func bufferedIOManagerCreator(preallocSize int64, bufferSize int) func(filePath string) (fio.IOManager, error) {
+	return func(filePath string) (fio.IOManager, error) {
+		return fio.NewBufferedIO(filePath, preallocSize, bufferSize)
+	}
+}
+
 func WithDirPath(dirPath string) Option {
 	return func(o *options) {
 		o.dirPath = dirPath
@@ -74,6 +163,16 @@ func WithDataFileSize(size int64) Option {
 	}
 }
 
+// WithSyncFrequency sync the active data file every fre writes, 1 syncs every write
+func WithSyncFrequency(fre int64) Option {
+	return func(o *options) {
+		if fre <= 0 {
+			fre = 1
+		}
+		o.syncFre = fre
+	}
+}
+
 func WithCodec(codec codec.Codec) Option {
 	return func(o *options) {
 		o.codec = codec
@@ -102,6 +201,86 @@ func WithFastOpen() Option {
 	}
 }
 
+// WithBlobThreshold write the values not smaller than size to the blob files,
+// the data files only keep the pointers, so merge never rewrites the big values
+func WithBlobThreshold(size int64) Option {
+	return func(o *options) {
+		o.blobThreshold = size
+	}
+}
+
+// WithMetrics record the metrics of the engine in registry,
+// they can be exposed in the prometheus text format by registry.Handler
+func WithMetrics(registry *metrics.Registry) Option {
+	return func(o *options) {
+		o.metrics = registry
+	}
+}
+
+// WithMaxDiskBytes limit the size of the data files and the blob files to size,
+// the writes exceeding it fail with ErrQuotaExceeded, but the reads, the deletes and merge are allowed
+func WithMaxDiskBytes(size int64) Option {
+	return func(o *options) {
+		o.maxDiskBytes = size
+	}
+}
+
+// WithReadOnly reject the writes and merge with ErrReadOnly
+func WithReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+// WithLogger log the events of the db by logger, nothing is logged by default
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		if logger != nil {
+			o.logger = logger
+		}
+	}
+}
+
+// WithEventListener notify listener of the events of the db
+func WithEventListener(listener EventListener) Option {
+	return func(o *options) {
+		if listener != nil {
+			o.eventListener = listener
+		}
+	}
+}
+
+// WithInlineValueSize keep the values smaller than size in keydir,
+// Get and Fold return them without reading the data file
+func WithInlineValueSize(size int64) Option {
+	return func(o *options) {
+		o.inlineValueSize = size
+	}
+}
+
+// WithLoadWorkers set the number of data files decoded concurrently when opening,
+// the default value is the number of CPUs
+func WithLoadWorkers(workers int) Option {
+	return func(o *options) {
+		o.loadWorkers = workers
+	}
+}
+
+// WithRetainVersions let merge keep the last n versions of every live key,
+// so they can be read by GetVersions and GetAt
+func WithRetainVersions(n int) Option {
+	return func(o *options) {
+		o.retainVersions = n
+	}
+}
+
+// WithCompactionFilter let merge keep, drop or rewrite every live record by filter
+func WithCompactionFilter(filter CompactionFilter) Option {
+	return func(o *options) {
+		o.compactionFilter = filter
+	}
+}
+
 type WriteBatchOption func(*writeBatchOptions)
 
 type writeBatchOptions struct {
@@ -0,0 +1,160 @@
+package cqkv
+
+import (
+	"github.com/cqkv/cqkv/model"
+	"math"
+)
+
+/*
+quota: the size of the data files and the blob files is limited by WithMaxDiskBytes.
+	- the writes exceeding the quota fail with ErrQuotaExceeded
+	- the reads, the deletes, merge and GCBlobs are allowed, so the space can be reclaimed
+	- the preallocated space of the active data file is on the disk, so it is counted
+	- the sealed files moved to the object storage are not on the disk, so they are not counted
+a failed write is rolled back, so the db can be written again once the space is freed.
+a failed sync is not rolled back, the file system may have dropped the data not synced
+and the next sync may succeed without it, so the db is read only until it is opened again.
+*/
+
+// checkQuota check whether the record of size can be written, the caller should hold the lock.
+// the record fitting in the preallocated space of the active file takes no more space,
+// and the new active file takes the preallocated size
+func (db *DB) checkQuota(size int64) error {
+	if db.options.maxDiskBytes <= 0 {
+		return nil
+	}
+
+	size += model.MaxHeaderSize
+	used, growth := db.diskBytes, size
+	if db.activeFile != nil && db.activeFile.WriteOffset+size <= db.options.dataFileSize {
+		diskSize, err := db.activeFile.DiskSize()
+		if err != nil {
+			return err
+		}
+		if free := diskSize - db.activeFile.WriteOffset; free > 0 {
+			used += free
+			// the big value is written to the blob file which is not preallocated
+			if !db.isBlobSize(size) {
+				growth = max(size-free, 0)
+			}
+		}
+	} else if db.options.bufferSize > 0 && growth < db.options.dataFileSize {
+		// the preallocated space of the old active file is released when it is sealed
+		growth = db.options.dataFileSize
+	}
+
+	if used+growth <= db.options.maxDiskBytes {
+		return nil
+	}
+	// the sealed files may have been moved to the object storage since the usage was computed
+	diskBytes, err := db.diskUsage()
+	if err != nil {
+		return err
+	}
+	used += diskBytes - db.diskBytes
+	db.diskBytes = diskBytes
+	if used+growth > db.options.maxDiskBytes {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// diskUsage return the size of the data files and the blob files on the disk, the caller should hold the lock
+func (db *DB) diskUsage() (int64, error) {
+	var size int64
+	sealedFiles := make([]*model.DataFile, 0, len(db.olderFiles)+len(db.blobFiles))
+	for _, dataFile := range db.olderFiles {
+		sealedFiles = append(sealedFiles, dataFile)
+	}
+	for _, blobFile := range db.blobFiles {
+		sealedFiles = append(sealedFiles, blobFile)
+	}
+	for _, dataFile := range sealedFiles {
+		fileSize, err := dataFile.DiskSize()
+		if err != nil {
+			return 0, err
+		}
+		size += fileSize
+	}
+
+	// the preallocated space of the active data file is counted by checkQuota
+	if db.activeFile != nil {
+		fileSize, err := db.activeFile.IoManager.Size()
+		if err != nil {
+			return 0, err
+		}
+		size += fileSize
+	}
+	return size, nil
+}
+
+// rollback remove the partial record written after offset when the write failed, e.g. ENOSPC,
+// so the next record is appended right after the last good one
+func (db *DB) rollback(dataFile *model.DataFile, offset int64) {
+	if err := dataFile.Truncate(offset); err != nil {
+		db.options.logger.Error("roll back the failed write failed", "fid", dataFile.Fid, "offset", offset, "err", err)
+		// the next record would be appended after the partial one
+		_ = db.fail(err)
+	}
+}
+
+// writeMark is the end of the active files before the records of a write batch are written
+type writeMark struct {
+	fid        uint32
+	offset     int64
+	blobFid    uint32
+	blobOffset int64
+}
+
+// markActiveFiles return the end of the active files, the caller should hold the lock
+func (db *DB) markActiveFiles() *writeMark {
+	// the file opened after the mark only has the records written after it
+	mark := &writeMark{fid: math.MaxUint32, blobFid: math.MaxUint32}
+	if db.activeFile != nil {
+		mark.fid, mark.offset = db.activeFile.Fid, db.activeFile.WriteOffset
+	}
+	if db.activeBlobFile != nil {
+		mark.blobFid, mark.blobOffset = db.activeBlobFile.Fid, db.activeBlobFile.WriteOffset
+	}
+	return mark
+}
+
+// rollbackTo remove the records written to the active files after the mark, the caller should hold the lock.
+// the records in the files sealed after the mark are kept, they are not committed and merge clears them
+func (db *DB) rollbackTo(mark *writeMark) {
+	// the records may be synced partly by a failed sync
+	if db.failed != nil {
+		return
+	}
+	if db.activeFile != nil {
+		var offset int64
+		if db.activeFile.Fid == mark.fid {
+			offset = mark.offset
+		}
+		db.rollback(db.activeFile, offset)
+	}
+	if db.activeBlobFile != nil {
+		var offset int64
+		if db.activeBlobFile.Fid == mark.blobFid {
+			offset = mark.blobOffset
+		}
+		db.rollback(db.activeBlobFile, offset)
+	}
+
+	diskBytes, err := db.diskUsage()
+	if err != nil {
+		db.options.logger.Error("get the disk usage failed", "err", err)
+		return
+	}
+	db.diskBytes = diskBytes
+}
+
+// fail reject the writes after the data files may differ from what was written, it returns err.
+// the caller should hold the lock
+func (db *DB) fail(err error) error {
+	if db.failed == nil {
+		db.failed = err
+		db.options.logger.Error("the db is read only until it is opened again", "err", err)
+	}
+	return err
+}
@@ -0,0 +1,284 @@
+package cqkv
+
+import (
+	"context"
+	"fmt"
+	"github.com/cqkv/cqkv/fio"
+	"github.com/cqkv/cqkv/model"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+func TestDB_WithMaxDiskBytes(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(512), WithMaxDiskBytes(2048))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// overwrite the key until the quota is exceeded
+	var i int
+	for ; i < 100; i++ {
+		err = db.Put([]byte("key"), []byte(fmt.Sprintf("value-%02d", i)))
+		if err != nil {
+			break
+		}
+	}
+	assert.Equal(t, ErrQuotaExceeded, err)
+	assert.True(t, db.Stat().DiskSize <= 2048)
+
+	// the reads and the deletes keep working
+	value, err := db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf("value-%02d", i-1), string(value))
+	err = db.Delete([]byte("key"))
+	assert.Nil(t, err)
+	wb := db.NewWriteBatch()
+	err = wb.Put([]byte("key"), []byte("value"))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Equal(t, ErrQuotaExceeded, err)
+
+	// merge reclaims the space
+	err = db.MergeWithContext(context.Background(), MergeOptions{})
+	assert.Nil(t, err)
+	err = db.Put([]byte("key"), []byte("value"))
+	assert.Nil(t, err)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", WithDataFileSize(512), WithMaxDiskBytes(2048))
+	assert.Nil(t, err)
+	value, err = db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(value))
+}
+
+// fullIOManager write only half of the data with ENOSPC if the disk is full (full is 1),
+// the disk is full after full-1 writes if full > 1. and fail the sync with EIO if syncErr is set
+type fullIOManager struct {
+	fio.IOManager
+	full    *int32
+	syncErr *int32
+}
+
+func (f *fullIOManager) Write(data []byte) (int, error) {
+	if full := atomic.LoadInt32(f.full); full > 1 {
+		atomic.AddInt32(f.full, -1)
+	} else if full == 1 {
+		n, _ := f.IOManager.Write(data[:len(data)/2])
+		return n, syscall.ENOSPC
+	}
+	return f.IOManager.Write(data)
+}
+
+func (f *fullIOManager) Sync() error {
+	if f.syncErr != nil && atomic.LoadInt32(f.syncErr) == 1 {
+		return syscall.EIO
+	}
+	return f.IOManager.Sync()
+}
+
+func (f *fullIOManager) Truncate(size int64) error {
+	return fio.Truncate(f.IOManager, size)
+}
+
+func TestDB_ENOSPC(t *testing.T) {
+	var full int32
+	ioManagerCreator := func(filePath string) (fio.IOManager, error) {
+		ioManager, err := fio.NewFIleIO(filePath)
+		if err != nil {
+			return nil, err
+		}
+		return &fullIOManager{IOManager: ioManager, full: &full}, nil
+	}
+	err := os.MkdirAll("./tmp/", os.ModePerm)
+	assert.Nil(t, err)
+	opts := []Option{WithIOManagerCreator(ioManagerCreator), WithFileLock(fio.NewFlock("./tmp/"))}
+	db, err := Open("./tmp/", opts...)
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put([]byte("key-1"), []byte("value"))
+	assert.Nil(t, err)
+	size := db.Stat().DiskSize
+
+	// the partial record is rolled back
+	atomic.StoreInt32(&full, 1)
+	err = db.Put([]byte("key-2"), []byte("value"))
+	assert.Equal(t, syscall.ENOSPC, err)
+	fileSize, err := db.activeFile.IoManager.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, size, fileSize)
+	assert.Equal(t, size, db.activeFile.WriteOffset)
+	value, err := db.Get([]byte("key-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(value))
+
+	// the space is freed
+	atomic.StoreInt32(&full, 0)
+	err = db.Put([]byte("key-3"), []byte("value"))
+	assert.Nil(t, err)
+
+	check := func(db *DB) {
+		assert.Equal(t, [][]byte{[]byte("key-1"), []byte("key-3")}, db.defaultKeyspace.ListKeys())
+		value, err := db.Get([]byte("key-3"))
+		assert.Nil(t, err)
+		assert.Equal(t, "value", string(value))
+	}
+	check(db)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	err = os.Remove(model.GetDataFileName("./tmp/", model.SnapshotFileType, 0))
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", opts...)
+	assert.Nil(t, err)
+	check(db)
+
+	// the records of the batch written before the failed one are rolled back
+	size = db.Stat().DiskSize
+	atomic.StoreInt32(&full, 3)
+	wb := db.NewWriteBatch()
+	for i := 0; i < 3; i++ {
+		err = wb.Put([]byte(fmt.Sprintf("batch-%d", i)), []byte("value"))
+		assert.Nil(t, err)
+	}
+	err = wb.Commit()
+	assert.Equal(t, syscall.ENOSPC, err)
+	atomic.StoreInt32(&full, 0)
+	fileSize, err = db.activeFile.IoManager.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, size, fileSize)
+	assert.Equal(t, size, db.activeFile.WriteOffset)
+	assert.Equal(t, size, db.Stat().DiskSize)
+	check(db)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_SyncError(t *testing.T) {
+	var full, syncErr int32
+	ioManagerCreator := func(filePath string) (fio.IOManager, error) {
+		ioManager, err := fio.NewFIleIO(filePath)
+		if err != nil {
+			return nil, err
+		}
+		return &fullIOManager{IOManager: ioManager, full: &full, syncErr: &syncErr}, nil
+	}
+	err := os.MkdirAll("./tmp/", os.ModePerm)
+	assert.Nil(t, err)
+	opts := []Option{WithIOManagerCreator(ioManagerCreator), WithFileLock(fio.NewFlock("./tmp/"))}
+	db, err := Open("./tmp/", append(opts, WithSyncFrequency(1))...)
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put([]byte("key-1"), []byte("value"))
+	assert.Nil(t, err)
+	size := db.Stat().DiskSize
+
+	// the db is read only after the sync fails, the record is not rolled back
+	atomic.StoreInt32(&syncErr, 1)
+	err = db.Put([]byte("key-2"), []byte("value"))
+	assert.Equal(t, syscall.EIO, err)
+	atomic.StoreInt32(&syncErr, 0)
+	fileSize, err := db.activeFile.IoManager.Size()
+	assert.Nil(t, err)
+	assert.True(t, fileSize > size)
+	err = db.Put([]byte("key-3"), []byte("value"))
+	assert.Equal(t, ErrDBFailed, err)
+	wb := db.NewWriteBatch()
+	err = wb.Put([]byte("key-3"), []byte("value"))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Equal(t, ErrDBFailed, err)
+	value, err := db.Get([]byte("key-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(value))
+
+	// the snapshot is not written, the data files are replayed
+	err = db.Close()
+	assert.Nil(t, err)
+	_, err = os.Stat(model.GetDataFileName("./tmp/", model.SnapshotFileType, 0))
+	assert.True(t, os.IsNotExist(err))
+
+	// the batch failing to sync fails the db too
+	db, err = Open("./tmp/", opts...)
+	assert.Nil(t, err)
+	err = db.Put([]byte("key-3"), []byte("value"))
+	assert.Nil(t, err)
+	atomic.StoreInt32(&syncErr, 1)
+	wb = db.NewWriteBatch(WithSync(true))
+	err = wb.Put([]byte("key-4"), []byte("value"))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Equal(t, syscall.EIO, err)
+	atomic.StoreInt32(&syncErr, 0)
+	_, err = db.Get([]byte("key-4"))
+	assert.Equal(t, ErrNoRecord, err)
+	err = db.Put([]byte("key-5"), []byte("value"))
+	assert.Equal(t, ErrDBFailed, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// the failed writes may be applied after opening again
+	db, err = Open("./tmp/", opts...)
+	assert.Nil(t, err)
+	for _, key := range []string{"key-1", "key-3"} {
+		value, err = db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, "value", string(value))
+	}
+	err = db.Put([]byte("key-5"), []byte("value"))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_WithMaxDiskBytes_Preallocate(t *testing.T) {
+	opts := []Option{WithDataFileSize(1024), WithBufferedIO(128), WithMaxDiskBytes(1536)}
+	db, err := Open("./tmp/", opts...)
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	var i int
+	for ; i < 100; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%02d", i)))
+		if err != nil {
+			break
+		}
+	}
+	assert.Equal(t, ErrQuotaExceeded, err)
+
+	// the preallocated files on the disk are in the quota
+	entries, err := os.ReadDir("./tmp/")
+	assert.Nil(t, err)
+	var diskSize int64
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != model.DataFileSuffix {
+			continue
+		}
+		info, err := entry.Info()
+		assert.Nil(t, err)
+		diskSize += info.Size()
+	}
+	assert.True(t, diskSize <= 1536, "disk size %d", diskSize)
+
+	err = db.Close()
+	assert.Nil(t, err)
+}
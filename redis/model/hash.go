@@ -1,14 +1,12 @@
 package model
 
-import "encoding/binary"
-
 /*
 	hash type
 	metadata:
-		key: key
+		key: meta key
 		value: type | expire | version
 	data:
-		key: key | version | filedId
+		key: data key (key | version | filedId)
 		value: value
 */
 
@@ -25,16 +23,5 @@ func NewHash(key []byte, version int64) *Hash {
 }
 
 func (h *Hash) MarshalHashKey(fieldId []byte) []byte {
-	buf := make([]byte, len(h.key)+len(fieldId)+8)
-
-	// key
-	copy(buf[:len(h.key)], h.key)
-
-	// version
-	binary.BigEndian.PutUint64(buf[len(h.key):len(h.key)+8], uint64(h.version))
-
-	// field id
-	copy(buf[len(h.key)+8:], fieldId)
-
-	return buf
+	return MarshalDataKey(h.key, h.version, fieldId)
 }
@@ -0,0 +1,62 @@
+package model
+
+import "encoding/binary"
+
+const (
+	metaKeyPrefix byte = 'm'
+	dataKeyPrefix byte = 'd'
+)
+
+/*
+	keys of the redis types
+		meta key: metaKeyPrefix | key (string value and metadata)
+		data key: dataKeyPrefix | key size (uvarint) | key | version | suffix
+	the data key can be parsed to find its metadata
+*/
+
+func MarshalMetaKey(key []byte) []byte {
+	buf := make([]byte, 1+len(key))
+	buf[0] = metaKeyPrefix
+	copy(buf[1:], key)
+	return buf
+}
+
+func MarshalDataKey(key []byte, version int64, suffix []byte) []byte {
+	buf := make([]byte, 1+binary.MaxVarintLen64+len(key)+8+len(suffix))
+	buf[0] = dataKeyPrefix
+
+	idx := 1
+	idx += binary.PutUvarint(buf[idx:], uint64(len(key)))
+
+	// key
+	idx += copy(buf[idx:], key)
+
+	// version
+	binary.BigEndian.PutUint64(buf[idx:idx+8], uint64(version))
+	idx += 8
+
+	// suffix
+	idx += copy(buf[idx:], suffix)
+
+	return buf[:idx]
+}
+
+// UnmarshalDataKey return the key and version of the data key, ok is false if it is not a data key
+func UnmarshalDataKey(buf []byte) (key []byte, version int64, ok bool) {
+	if len(buf) == 0 || buf[0] != dataKeyPrefix {
+		return nil, 0, false
+	}
+
+	idx := 1
+	keySize, n := binary.Uvarint(buf[idx:])
+	if n <= 0 || uint64(len(buf)-idx-n) < keySize+8 {
+		return nil, 0, false
+	}
+	idx += n
+
+	key = buf[idx : idx+int(keySize)]
+	idx += int(keySize)
+
+	version = int64(binary.BigEndian.Uint64(buf[idx : idx+8]))
+	return key, version, true
+}
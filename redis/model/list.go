@@ -12,10 +12,10 @@ const (
 /*
 	list type
 		metadata:
-			key: key
+			key: meta key
 			value: type | expire | version | head | tail (the data that tail points to is invalid, tail - 1 is valid)
 		data:
-			key: key | version | idx
+			key: data key (key | version | idx)
 			value: value
 */
 
@@ -32,13 +32,7 @@ func NewList(version int64, idx uint64) *List {
 }
 
 func (l *List) MarshalListKey(key []byte) []byte {
-	buf := make([]byte, len(key)+8+8)
-
-	copy(buf[:len(key)], key)
-
-	binary.BigEndian.PutUint64(buf[len(key):len(key)+8], uint64(l.version))
-
-	binary.BigEndian.PutUint64(buf[len(key)+8:], l.idx)
-
-	return buf
+	idx := make([]byte, 8)
+	binary.BigEndian.PutUint64(idx, l.idx)
+	return MarshalDataKey(key, l.version, idx)
 }
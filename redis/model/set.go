@@ -1,14 +1,12 @@
 package model
 
-import "encoding/binary"
-
 /*
   	set type
 		metadata:
-			key: key
+			key: meta key
 			value: type | expire | version
 		data:
-			key: key | version | member
+			key: data key (key | version | member)
 			value: nil
 */
 
@@ -21,13 +19,5 @@ func NewSet(version int64) *Set {
 }
 
 func (s *Set) MarshalKey(key, member []byte) []byte {
-	buf := make([]byte, len(key)+8+len(member))
-
-	copy(buf[:len(key)], key)
-
-	binary.BigEndian.PutUint64(buf[len(key):len(key)+8], uint64(s.version))
-
-	copy(buf[len(key)+8:], member)
-
-	return buf
+	return MarshalDataKey(key, s.version, member)
 }
@@ -13,19 +13,24 @@ type RdsServer struct {
 }
 
 func NewRdsServer(dir string, ops ...cqkv.Option) (*RdsServer, error) {
+	rds := &RdsServer{}
+	// the data of the deleted keys are cleared by merge
+	ops = append(ops, cqkv.WithCompactionFilter(rds.compactionFilter))
 	db, err := cqkv.Open(dir, ops...)
 	if err != nil {
 		return nil, err
 	}
-	return &RdsServer{db: db}, nil
+	rds.db = db
+	return rds, nil
 }
 
+// Del only delete the metadata, the data of the key is cleared by merge
 func (rds *RdsServer) Del(key []byte) error {
-	return rds.db.Delete(key)
+	return rds.db.Delete(model.MarshalMetaKey(key))
 }
 
 func (rds *RdsServer) Type(key []byte) (string, error) {
-	meta, err := rds.db.Get(key)
+	meta, err := rds.db.Get(model.MarshalMetaKey(key))
 	if err != nil {
 		if errors.Is(err, cqkv.ErrNoRecord) {
 			return "none", nil
@@ -57,11 +62,11 @@ func (rds *RdsServer) Set(key []byte, value []byte, ttl time.Duration) error {
 
 	v := str.Marshal(ttl, value)
 
-	return rds.db.Put(key, v)
+	return rds.db.Put(model.MarshalMetaKey(key), v)
 }
 
 func (rds *RdsServer) Get(key []byte) ([]byte, error) {
-	encodeValue, err := rds.db.Get(key)
+	encodeValue, err := rds.db.Get(model.MarshalMetaKey(key))
 	if err != nil {
 		return nil, err
 	}
@@ -97,7 +102,7 @@ func (rds *RdsServer) HSet(key, fieldId, value []byte) (bool, error) {
 	wb := rds.db.NewWriteBatch()
 	if !metaExist {
 		// write metadata first
-		_ = wb.Put(key, model.MarshalMetadata(meta))
+		_ = wb.Put(model.MarshalMetaKey(key), model.MarshalMetadata(meta))
 	}
 	_ = wb.Put(hk, value)
 	if err = wb.Commit(); err != nil {
@@ -174,7 +179,7 @@ func (rds *RdsServer) SAdd(key, member []byte) (bool, error) {
 
 	wb := rds.db.NewWriteBatch()
 	if !metaExist {
-		_ = wb.Put(key, model.MarshalMetadata(meta))
+		_ = wb.Put(model.MarshalMetaKey(key), model.MarshalMetadata(meta))
 	}
 	if !exist {
 		_ = wb.Put(sk, nil)
@@ -269,7 +274,7 @@ func (rds *RdsServer) push(key, element []byte, isLeft bool) (uint32, error) {
 	lk := l.MarshalListKey(key)
 
 	wb := rds.db.NewWriteBatch()
-	_ = wb.Put(key, model.MarshalMetadata(meta))
+	_ = wb.Put(model.MarshalMetaKey(key), model.MarshalMetadata(meta))
 	_ = wb.Put(lk, element)
 
 	if err = wb.Commit(); err != nil {
@@ -307,7 +312,7 @@ func (rds *RdsServer) pop(key []byte, isLeft bool) ([]byte, error) {
 	}
 
 	// update metadata
-	if err = rds.db.Put(key, model.MarshalMetadata(meta)); err != nil {
+	if err = rds.db.Put(model.MarshalMetaKey(key), model.MarshalMetadata(meta)); err != nil {
 		return nil, err
 	}
 
@@ -338,7 +343,7 @@ func (rds *RdsServer) ZScore() {
 }
 
 func (rds *RdsServer) getMetadata(key []byte, dataType model.RdsType) (*model.Metadata, error) {
-	metaData, err := rds.db.Get(key)
+	metaData, err := rds.db.Get(model.MarshalMetaKey(key))
 	if err != nil {
 		return nil, err
 	}
@@ -357,3 +362,25 @@ func (rds *RdsServer) getMetadata(key []byte, dataType model.RdsType) (*model.Me
 
 	return meta, nil
 }
+
+// compactionFilter drop the data whose metadata is deleted or has a different version
+func (rds *RdsServer) compactionFilter(key, value []byte) cqkv.Decision {
+	userKey, version, ok := model.UnmarshalDataKey(key)
+	if !ok {
+		return cqkv.Decision{Action: cqkv.CompactionKeep}
+	}
+
+	metaData, err := rds.db.Get(model.MarshalMetaKey(userKey))
+	if err != nil {
+		if errors.Is(err, cqkv.ErrNoRecord) {
+			return cqkv.Decision{Action: cqkv.CompactionDrop}
+		}
+		return cqkv.Decision{Action: cqkv.CompactionKeep}
+	}
+
+	meta := model.UnmarshalMetadata(metaData)
+	if meta.DataType == model.StringType || meta.Version != version {
+		return cqkv.Decision{Action: cqkv.CompactionDrop}
+	}
+	return cqkv.Decision{Action: cqkv.CompactionKeep}
+}
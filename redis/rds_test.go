@@ -1 +1,53 @@
 package redis
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/cqkv/cqkv"
+	"github.com/cqkv/cqkv/redis/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRdsServer_CompactionFilter(t *testing.T) {
+	rds, err := NewRdsServer("./tmp/", cqkv.WithDataFileSize(1024))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, rds)
+
+	for i := 0; i < 20; i++ {
+		_, err = rds.HSet([]byte("deleted"), []byte(fmt.Sprintf("field-%v", i)), []byte("value"))
+		assert.Nil(t, err)
+		_, err = rds.HSet([]byte("live"), []byte(fmt.Sprintf("field-%v", i)), []byte("value"))
+		assert.Nil(t, err)
+	}
+	err = rds.Del([]byte("deleted"))
+	assert.Nil(t, err)
+
+	// the old fields are invisible to the new version
+	_, err = rds.HSet([]byte("deleted"), []byte("field-new"), []byte("value"))
+	assert.Nil(t, err)
+
+	err = rds.db.MergeWithContext(context.Background(), cqkv.MergeOptions{})
+	assert.Nil(t, err)
+
+	// the fields of the old version are cleared
+	var dataKeys int
+	for _, key := range rds.db.ListKeys() {
+		if _, _, ok := model.UnmarshalDataKey(key[1:]); ok {
+			dataKeys++
+		}
+	}
+	assert.Equal(t, 21, dataKeys)
+
+	value, err := rds.HGet([]byte("live"), []byte("field-0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(value))
+	value, err = rds.HGet([]byte("deleted"), []byte("field-new"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(value))
+}
@@ -0,0 +1,825 @@
+package cqkv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/cqkv/cqkv/fio"
+	"github.com/cqkv/cqkv/model"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+replication: the primary ships the records appended to its data files to the followers over tcp.
+	- a follower connects with the end of its active data file and the crc of the bytes before it,
+	  the primary streams its data files from there in frames of whole records (fid, offset, bytes)
+	- the follower appends the frames to its own data files at the same fid and offset,
+	  and applies them to its keydir, so it resumes from the last applied position after a restart.
+	  the frames are synced by WithSyncFrequency of the follower
+	- if the primary does not have the data of the position any more, e.g. the file is merged,
+	  the follower is bootstrapped from a backup of the primary, the db of the follower is closed
+	  and opened again on the backup, so Follower.DB should be called for every read
+the primary keeps the data file being streamed open, so merge never changes the data sent in the middle of a file.
+the blob files are not replicated, the primary can not use WithBlobThreshold.
+*/
+
+const (
+	replicationMagic = "CQRP"
+	// replicationFrameSize is the size of the records in a frame, a bigger record is sent alone
+	replicationFrameSize = 1024 * 1024
+	// replicationCheckSize is the size of the data before the position checked by crc
+	replicationCheckSize = 4096
+	replicationHeartbeat = time.Second
+	replicationRetry     = time.Second
+)
+
+const (
+	frameRecords      byte = iota + 1 // the records appended at fid, offset
+	frameHeartbeat                    // nothing is appended
+	frameBootstrap                    // the backup files follow
+	frameBackupFile                   // a part of the backup data file fid at offset
+	frameBootstrapEnd                 // the backup files end
+)
+
+// frame: type(1) | fid(4) | offset(8) | size(4) | data
+const frameHeaderSize = 17
+
+type replicationFrame struct {
+	typ    byte
+	fid    uint32
+	offset int64
+	data   []byte
+}
+
+func writeFrame(w io.Writer, frame *replicationFrame) error {
+	header := make([]byte, frameHeaderSize)
+	header[0] = frame.typ
+	binary.BigEndian.PutUint32(header[1:], frame.fid)
+	binary.BigEndian.PutUint64(header[5:], uint64(frame.offset))
+	binary.BigEndian.PutUint32(header[13:], uint32(len(frame.data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(frame.data)
+	return err
+}
+
+// readFrame read a frame whose data is at most maxSize, the bigger size is not trusted
+func readFrame(r io.Reader, maxSize int64) (*replicationFrame, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[13:])
+	if int64(size) > maxSize {
+		return nil, ErrReplicationFrame
+	}
+	frame := &replicationFrame{
+		typ:    header[0],
+		fid:    binary.BigEndian.Uint32(header[1:]),
+		offset: int64(binary.BigEndian.Uint64(header[5:])),
+		data:   make([]byte, size),
+	}
+	if _, err := io.ReadFull(r, frame.data); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// maxFrameSize return the max size of the records in a frame,
+// the records of replicationFrameSize are followed by at most one record, which is not bigger than a data file
+func (db *DB) maxFrameSize() int64 {
+	return replicationFrameSize + model.MaxHeaderSize + db.options.dataFileSize
+}
+
+// replicationHello is the position of the follower: magic(4) | empty(1) | fid(4) | offset(8) | crc(4)
+type replicationHello struct {
+	empty  bool // the follower has no data file
+	fid    uint32
+	offset int64
+	crc    uint32
+}
+
+const helloSize = 21
+
+func writeHello(w io.Writer, hello *replicationHello) error {
+	buf := make([]byte, helloSize)
+	copy(buf, replicationMagic)
+	if hello.empty {
+		buf[4] = 1
+	}
+	binary.BigEndian.PutUint32(buf[5:], hello.fid)
+	binary.BigEndian.PutUint64(buf[9:], uint64(hello.offset))
+	binary.BigEndian.PutUint32(buf[17:], hello.crc)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readHello(r io.Reader) (*replicationHello, error) {
+	buf := make([]byte, helloSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if string(buf[:4]) != replicationMagic {
+		return nil, ErrReplicaPosition
+	}
+	return &replicationHello{
+		empty:  buf[4] == 1,
+		fid:    binary.BigEndian.Uint32(buf[5:]),
+		offset: int64(binary.BigEndian.Uint64(buf[9:])),
+		crc:    binary.BigEndian.Uint32(buf[17:]),
+	}, nil
+}
+
+// tailCrc return the crc of the data before offset of the data file
+func tailCrc(dataFile *model.DataFile, offset int64) (uint32, error) {
+	start := offset - replicationCheckSize
+	if start < 0 {
+		start = 0
+	}
+	crc := crc32.NewIEEE()
+	if _, err := io.CopyN(crc, dataFile.NewReader(start, offset-start), offset-start); err != nil {
+		return 0, err
+	}
+	return crc.Sum32(), nil
+}
+
+// appendWaiter return the channel closed by the next append, the caller should hold the lock
+func (db *DB) appendWaiter() <-chan struct{} {
+	atomic.StoreInt32(&db.appendWaiting, 1)
+	return db.appendCh
+}
+
+// notifyAppend wake up the replication waiting for the appends, the caller should hold the lock
+func (db *DB) notifyAppend() {
+	if atomic.SwapInt32(&db.appendWaiting, 0) == 1 {
+		close(db.appendCh)
+		db.appendCh = make(chan struct{})
+	}
+}
+
+// dataFileEnd return the end of the records in the data file, the caller should hold the lock
+func (db *DB) dataFileEnd(dataFile *model.DataFile) (int64, error) {
+	if dataFile == db.activeFile {
+		return dataFile.WriteOffset, nil
+	}
+	return dataFile.IoManager.Size()
+}
+
+// firstFid return the smallest fid, the caller should hold the lock
+func (db *DB) firstFid() (uint32, bool) {
+	if db.getDataFile(0) != nil {
+		return 0, true
+	}
+	return db.nextFid(0)
+}
+
+// nextFid return the smallest fid after fid, the caller should hold the lock
+func (db *DB) nextFid(fid uint32) (uint32, bool) {
+	var next uint32
+	var ok bool
+	for id := range db.olderFiles {
+		if id > fid && (!ok || id < next) {
+			next, ok = id, true
+		}
+	}
+	if db.activeFile != nil && db.activeFile.Fid > fid && (!ok || db.activeFile.Fid < next) {
+		next, ok = db.activeFile.Fid, true
+	}
+	return next, ok
+}
+
+// ReplicationServer stream the records appended to the db to the followers
+type ReplicationServer struct {
+	db *DB
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+	closed    bool
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+func NewReplicationServer(db *DB) (*ReplicationServer, error) {
+	if db.options.blobThreshold > 0 {
+		return nil, ErrReplicationNotSupported
+	}
+	return &ReplicationServer{
+		db:    db,
+		conns: make(map[net.Conn]struct{}),
+		done:  make(chan struct{}),
+	}, nil
+}
+
+// Serve accept the followers from ln until the server is closed
+func (s *ReplicationServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.listeners = append(s.listeners, ln)
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return nil
+			default:
+				return err
+			}
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			if err := s.serveConn(conn); err != nil {
+				s.db.options.logger.Warn("replication stream failed", "follower", conn.RemoteAddr().String(), "err", err)
+			}
+			_ = conn.Close()
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stop accepting the followers and disconnect them
+func (s *ReplicationServer) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	for _, ln := range s.listeners {
+		_ = ln.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+func (s *ReplicationServer) serveConn(conn net.Conn) error {
+	hello, err := readHello(bufio.NewReader(conn))
+	if err != nil {
+		return err
+	}
+
+	stream := &replicationStream{db: s.db, w: bufio.NewWriter(conn), done: s.done}
+	defer stream.release()
+	ok, err := stream.seek(hello)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		s.db.options.logger.Info("bootstrap the follower", "follower", conn.RemoteAddr().String(), "fid", hello.fid, "offset", hello.offset)
+		if err = stream.bootstrap(); err != nil {
+			return err
+		}
+	}
+	return stream.run()
+}
+
+// replicationStream send the data files from the position to a follower
+type replicationStream struct {
+	db   *DB
+	w    *bufio.Writer
+	done <-chan struct{}
+
+	// start from the first data file
+	start  bool
+	fid    uint32
+	offset int64
+	// the data file of fid, it is referenced while it is streamed
+	cur *model.DataFile
+}
+
+func (s *replicationStream) release() {
+	if s.cur != nil {
+		_ = s.cur.Unref()
+		s.cur = nil
+	}
+}
+
+// seek move to the position of the follower, ok is false if the primary does not have the data of it
+func (s *replicationStream) seek(hello *replicationHello) (bool, error) {
+	db := s.db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if hello.empty {
+		s.start = true
+		return true, nil
+	}
+	dataFile := db.getDataFile(hello.fid)
+	if dataFile == nil {
+		return false, nil
+	}
+	end, err := db.dataFileEnd(dataFile)
+	if err != nil {
+		return false, err
+	}
+	if hello.offset > end {
+		return false, nil
+	}
+	crc, err := tailCrc(dataFile, hello.offset)
+	if err != nil || crc != hello.crc {
+		return false, err
+	}
+
+	dataFile.Ref()
+	s.cur, s.fid, s.offset = dataFile, hello.fid, hello.offset
+	return true, nil
+}
+
+// bootstrap send the backup of the data files, the stream continues from the end of it
+func (s *replicationStream) bootstrap() error {
+	s.release()
+	files, err := s.db.backupFiles()
+	if err != nil {
+		return err
+	}
+	defer releaseBackupFiles(files)
+
+	if err = writeFrame(s.w, &replicationFrame{typ: frameBootstrap}); err != nil {
+		return err
+	}
+	var last *backupFile
+	for _, file := range files {
+		if file.fileType != model.DataFileType {
+			continue
+		}
+		var offset int64
+		for {
+			n := file.size - offset
+			if n > replicationFrameSize {
+				n = replicationFrameSize
+			}
+			data := make([]byte, n)
+			if _, err = io.ReadFull(file.dataFile.NewReader(offset, n), data); err != nil {
+				return err
+			}
+			if err = writeFrame(s.w, &replicationFrame{typ: frameBackupFile, fid: file.dataFile.Fid, offset: offset, data: data}); err != nil {
+				return err
+			}
+			if offset += n; offset >= file.size {
+				break
+			}
+		}
+		last = file
+	}
+	if err = writeFrame(s.w, &replicationFrame{typ: frameBootstrapEnd}); err != nil {
+		return err
+	}
+
+	if last == nil {
+		s.start = true
+		return nil
+	}
+	last.dataFile.Ref()
+	s.cur, s.fid, s.offset = last.dataFile, last.dataFile.Fid, last.size
+	return nil
+}
+
+func (s *replicationStream) run() error {
+	for {
+		frame, wait, err := s.next()
+		if err != nil {
+			return err
+		}
+		if frame != nil {
+			if err = writeFrame(s.w, frame); err != nil {
+				return err
+			}
+			continue
+		}
+		if wait == nil {
+			continue
+		}
+
+		// caught up with the primary
+		if err = s.w.Flush(); err != nil {
+			return err
+		}
+		timer := time.NewTimer(replicationHeartbeat)
+		select {
+		case <-wait:
+		case <-s.done:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+			if err = writeFrame(s.w, &replicationFrame{typ: frameHeartbeat}); err != nil {
+				return err
+			}
+		}
+		timer.Stop()
+	}
+}
+
+// next return the next frame, or the channel closed when there are new records.
+// both are nil if the stream moves to the next data file
+func (s *replicationStream) next() (*replicationFrame, <-chan struct{}, error) {
+	db := s.db
+	db.mu.RLock()
+	if s.cur == nil {
+		if s.start {
+			fid, ok := db.firstFid()
+			if !ok {
+				wait := db.appendWaiter()
+				db.mu.RUnlock()
+				return nil, wait, nil
+			}
+			s.start, s.fid, s.offset = false, fid, 0
+		}
+		if s.cur = db.getDataFile(s.fid); s.cur == nil {
+			db.mu.RUnlock()
+			return nil, nil, ErrReplicaPosition
+		}
+		s.cur.Ref()
+	}
+
+	end, err := db.dataFileEnd(s.cur)
+	if err != nil {
+		db.mu.RUnlock()
+		return nil, nil, err
+	}
+	if s.offset < end {
+		db.mu.RUnlock()
+		return s.readRecords(end)
+	}
+	if s.cur == db.activeFile {
+		wait := db.appendWaiter()
+		db.mu.RUnlock()
+		return nil, wait, nil
+	}
+
+	// the data file is sealed, move to the next one
+	next, ok := db.nextFid(s.fid)
+	db.mu.RUnlock()
+	if !ok {
+		return nil, nil, ErrReplicaPosition
+	}
+	s.release()
+	s.fid, s.offset = next, 0
+	return nil, nil, nil
+}
+
+// readRecords read the whole records from the offset to at most end
+func (s *replicationStream) readRecords(end int64) (*replicationFrame, <-chan struct{}, error) {
+	offset := s.offset
+	for offset < end && offset-s.offset < replicationFrameSize {
+		_, size, err := s.db.getRecordFromDataFile(s.cur, offset)
+		if err != nil {
+			return nil, nil, err
+		}
+		offset += size
+	}
+
+	data := make([]byte, offset-s.offset)
+	if _, err := io.ReadFull(s.cur.NewReader(s.offset, offset-s.offset), data); err != nil {
+		return nil, nil, err
+	}
+	frame := &replicationFrame{typ: frameRecords, fid: s.fid, offset: s.offset, data: data}
+	s.offset = offset
+	return frame, nil, nil
+}
+
+// replicaHello return the position of the follower
+func (db *DB) replicaHello() (*replicationHello, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.activeFile == nil {
+		return &replicationHello{empty: true}, nil
+	}
+	crc, err := tailCrc(db.activeFile, db.activeFile.WriteOffset)
+	if err != nil {
+		return nil, err
+	}
+	return &replicationHello{fid: db.activeFile.Fid, offset: db.activeFile.WriteOffset, crc: crc}, nil
+}
+
+// applyReplicated append the records of the primary at fid and offset, and apply them to the keydir
+func (db *DB) applyReplicated(loader *keydirLoader, fid uint32, offset int64, data []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.activeFile == nil || db.activeFile.Fid != fid {
+		if offset != 0 || (db.activeFile != nil && fid < db.activeFile.Fid) {
+			return ErrReplicaPosition
+		}
+		if err := db.openActiveDataFile(fid); err != nil {
+			return err
+		}
+	}
+	if offset != db.activeFile.WriteOffset {
+		return ErrReplicaPosition
+	}
+	if db.failed != nil {
+		return ErrDBFailed
+	}
+
+	if err := db.activeFile.Write(data); err != nil {
+		db.rollback(db.activeFile, offset)
+		return err
+	}
+	db.diskBytes += int64(len(data))
+	// the frames are synced like the writes of the follower,
+	// the frames lost by a crash are sent again from the end of the active file
+	db.activeFile.WriteTimes++
+	if db.activeFile.WriteTimes%db.options.syncFre == 0 {
+		if err := db.syncDataFile(db.activeFile); err != nil {
+			return db.fail(err)
+		}
+	}
+
+	entries, end, err := db.decodeDataFile(db.activeFile, offset)
+	if err != nil {
+		return err
+	}
+	if end != db.activeFile.WriteOffset {
+		return ErrDataFileCorrupted
+	}
+	var catalogChanged bool
+	for _, entry := range entries {
+		if err = loader.load(entry); err != nil {
+			return err
+		}
+		if entry.pos.Seq > db.recordSeq {
+			db.recordSeq = entry.pos.Seq
+		}
+		catalogChanged = catalogChanged || entry.keyspace == catalogKeyspaceID
+	}
+	db.txSeq = loader.txSeq
+
+	if catalogChanged {
+		return db.loadKeyspaceNames()
+	}
+	return nil
+}
+
+// Follower replicate the db of the primary to its dir, the db of the follower is read only
+type Follower struct {
+	dirPath string
+	addr    string
+	options []Option
+
+	mu     sync.RWMutex
+	db     *DB
+	loader *keydirLoader
+	conn   net.Conn
+
+	closed chan struct{}
+	done   chan struct{}
+}
+
+// NewFollower open the db on dirPath and replicate the primary at addr in background,
+// it reconnects if the connection is broken
+func NewFollower(dirPath, addr string, ops ...Option) (*Follower, error) {
+	ops = append(ops[:len(ops):len(ops)], WithReadOnly())
+	db, err := Open(dirPath, ops...)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Follower{
+		dirPath: dirPath,
+		addr:    addr,
+		options: ops,
+		db:      db,
+		loader:  db.newKeydirLoader(),
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go f.run()
+	return f, nil
+}
+
+// DB return the read only db of the follower.
+// it is closed and replaced when the follower is bootstrapped from the primary,
+// so the db should not be kept, call DB again for the next read
+func (f *Follower) DB() *DB {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.db
+}
+
+// Position return the end of the records applied
+func (f *Follower) Position() (uint32, int64) {
+	db := f.DB()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.activeFile == nil {
+		return 0, 0
+	}
+	return db.activeFile.Fid, db.activeFile.WriteOffset
+}
+
+// Close stop the replication and close the db
+func (f *Follower) Close() error {
+	f.mu.Lock()
+	select {
+	case <-f.closed:
+		f.mu.Unlock()
+		return nil
+	default:
+	}
+	close(f.closed)
+	if f.conn != nil {
+		_ = f.conn.Close()
+	}
+	f.mu.Unlock()
+
+	<-f.done
+	return f.DB().Close()
+}
+
+func (f *Follower) run() {
+	defer close(f.done)
+	for {
+		err := f.replicate()
+		select {
+		case <-f.closed:
+			return
+		default:
+		}
+		f.DB().options.logger.Warn("replication failed", "primary", f.addr, "err", err)
+
+		select {
+		case <-f.closed:
+			return
+		case <-time.After(replicationRetry):
+		}
+	}
+}
+
+// replicate connect to the primary and apply the frames until the connection is broken
+func (f *Follower) replicate() error {
+	conn, err := net.DialTimeout("tcp", f.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	select {
+	case <-f.closed:
+		f.mu.Unlock()
+		return conn.Close()
+	default:
+	}
+	f.conn = conn
+	f.mu.Unlock()
+	defer conn.Close()
+
+	hello, err := f.DB().replicaHello()
+	if err != nil {
+		return err
+	}
+	if err = writeHello(conn, hello); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		if err = conn.SetReadDeadline(time.Now().Add(3 * replicationHeartbeat)); err != nil {
+			return err
+		}
+		frame, err := readFrame(r, f.DB().maxFrameSize())
+		if err != nil {
+			return err
+		}
+
+		switch frame.typ {
+		case frameRecords:
+			f.mu.RLock()
+			err = f.db.applyReplicated(f.loader, frame.fid, frame.offset, frame.data)
+			f.mu.RUnlock()
+		case frameHeartbeat:
+		case frameBootstrap:
+			err = f.bootstrap(conn, r)
+		default:
+			err = ErrReplicaPosition
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// bootstrap receive the backup of the primary to a temp dir, then replace the data files with it
+func (f *Follower) bootstrap(conn net.Conn, r io.Reader) error {
+	fs := f.DB().options.fs
+	tempDir := filepath.Clean(f.dirPath) + "-cqkv-bootstrap"
+	if err := fs.RemoveAll(tempDir); err != nil {
+		return err
+	}
+	if err := fs.MkdirAll(tempDir, os.ModePerm); err != nil {
+		return err
+	}
+	defer fs.RemoveAll(tempDir)
+
+	files := make(map[uint32]*model.DataFile)
+	defer func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}()
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(3 * replicationHeartbeat)); err != nil {
+			return err
+		}
+		frame, err := readFrame(r, replicationFrameSize)
+		if err != nil {
+			return err
+		}
+		if frame.typ == frameBootstrapEnd {
+			break
+		}
+		if frame.typ != frameBackupFile {
+			return ErrReplicaPosition
+		}
+
+		file, ok := files[frame.fid]
+		if !ok {
+			ioManager, err := fs.OpenFile(model.GetDataFileName(tempDir, model.DataFileType, frame.fid))
+			if err != nil {
+				return err
+			}
+			file = model.OpenDataFile(frame.fid, ioManager)
+			files[frame.fid] = file
+		}
+		if frame.offset != file.WriteOffset {
+			return ErrReplicaPosition
+		}
+		if err = file.Write(frame.data); err != nil {
+			return err
+		}
+	}
+	for _, file := range files {
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+	return f.replaceFiles(fs, tempDir)
+}
+
+// replaceFiles close the db, move the files of tempDir to the dir of the db and open it again
+func (f *Follower) replaceFiles(fs fio.FS, tempDir string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.db.Close(); err != nil {
+		return err
+	}
+
+	entries, err := fs.ReadDir(f.dirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == fio.FlockName {
+			continue
+		}
+		if err = fs.Remove(filepath.Join(f.dirPath, entry.Name())); err != nil {
+			return err
+		}
+	}
+	entries, err = fs.ReadDir(tempDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = fs.Rename(filepath.Join(tempDir, entry.Name()), filepath.Join(f.dirPath, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	db, err := Open(f.dirPath, f.options...)
+	if err != nil {
+		return errors.Join(ErrReplicaPosition, err)
+	}
+	f.db, f.loader = db, db.newKeydirLoader()
+	return nil
+}
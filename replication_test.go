@@ -0,0 +1,199 @@
+package cqkv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDB_Backup(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(512))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+		_ = os.RemoveAll("./tmp-backup/")
+	}()
+	assert.Nil(t, err)
+
+	for i := 0; i < 50; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%v", i)))
+		assert.Nil(t, err)
+	}
+	err = db.Backup("./tmp-backup/")
+	assert.Nil(t, err)
+	// the writes after the backup are not in it
+	err = db.Put([]byte("key-50"), []byte("value-50"))
+	assert.Nil(t, err)
+
+	backup, err := Open("./tmp-backup/", WithDataFileSize(512))
+	assert.Nil(t, err)
+	assert.Equal(t, 50, len(backup.ListKeys()))
+	value, err := backup.Get([]byte("key-49"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value-49", string(value))
+	assert.Nil(t, backup.Close())
+	assert.Nil(t, db.Close())
+}
+
+// waitReplicated wait until the follower has the value of the key
+func waitReplicated(t *testing.T, follower *Follower, key, value string) {
+	assert.Eventually(t, func() bool {
+		v, err := follower.DB().Get([]byte(key))
+		return err == nil && string(v) == value
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReplication(t *testing.T) {
+	opts := []Option{WithDataFileSize(1024)}
+	primary, err := Open("./tmp/", opts...)
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+		_ = os.RemoveAll("./tmp-follower/")
+	}()
+	assert.Nil(t, err)
+	for i := 0; i < 30; i++ {
+		err = primary.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%v", i)))
+		assert.Nil(t, err)
+	}
+
+	server, err := NewReplicationServer(primary)
+	assert.Nil(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go server.Serve(ln)
+	addr := ln.Addr().String()
+
+	// the new follower replicates from the first data file
+	follower, err := NewFollower("./tmp-follower/", addr, opts...)
+	assert.Nil(t, err)
+	waitReplicated(t, follower, "key-29", "value-29")
+	assert.Equal(t, 30, len(follower.DB().ListKeys()))
+
+	// the appends are streamed, including the batches and the keyspaces
+	wb := primary.NewWriteBatch()
+	assert.Nil(t, wb.Put([]byte("batch"), []byte("value")))
+	assert.Nil(t, wb.Delete([]byte("key-00")))
+	assert.Nil(t, wb.Commit())
+	ks, err := primary.Keyspace("users")
+	assert.Nil(t, err)
+	assert.Nil(t, ks.Put([]byte("alice"), []byte("1")))
+	assert.Nil(t, primary.Put([]byte("last"), []byte("1")))
+	waitReplicated(t, follower, "last", "1")
+	_, err = follower.DB().Get([]byte("key-00"))
+	assert.Equal(t, ErrNoRecord, err)
+	followerKs, err := follower.DB().Keyspace("users")
+	assert.Nil(t, err)
+	value, err := followerKs.Get([]byte("alice"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(value))
+
+	// the follower is read only
+	err = follower.DB().Put([]byte("key"), []byte("value"))
+	assert.Equal(t, ErrReadOnly, err)
+
+	// the follower resumes from its position after a restart
+	assert.Nil(t, follower.Close())
+	assert.Nil(t, primary.Put([]byte("last"), []byte("2")))
+	follower, err = NewFollower("./tmp-follower/", addr, opts...)
+	assert.Nil(t, err)
+	waitReplicated(t, follower, "last", "2")
+	assert.Nil(t, follower.Close())
+
+	// the follower falls behind a merge and is bootstrapped
+	for i := 0; i < 30; i++ {
+		err = primary.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("new-%v", i)))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, primary.MergeWithContext(context.Background(), MergeOptions{}))
+	assert.Nil(t, primary.Put([]byte("last"), []byte("3")))
+	follower, err = NewFollower("./tmp-follower/", addr, opts...)
+	assert.Nil(t, err)
+	opened := follower.DB()
+	waitReplicated(t, follower, "last", "3")
+	assert.NotSame(t, opened, follower.DB())
+	assert.Equal(t, primary.ListKeys(), follower.DB().ListKeys())
+	value, err = follower.DB().Get([]byte("key-00"))
+	assert.Nil(t, err)
+	assert.Equal(t, "new-0", string(value))
+
+	// and keeps streaming after the bootstrap
+	assert.Nil(t, primary.Put([]byte("last"), []byte("4")))
+	waitReplicated(t, follower, "last", "4")
+
+	assert.Nil(t, follower.Close())
+	assert.Nil(t, server.Close())
+	assert.Nil(t, primary.Close())
+}
+
+func TestReplication_Sync(t *testing.T) {
+	primary, err := Open("./tmp/")
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-follower/")
+	}()
+	assert.Nil(t, err)
+	server, err := NewReplicationServer(primary)
+	assert.Nil(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go server.Serve(ln)
+
+	// the frames are synced by the sync frequency of the follower
+	for _, fre := range []int64{1024, 1} {
+		listener := &testListener{}
+		follower, err := NewFollower("./tmp-follower/", ln.Addr().String(),
+			WithSyncFrequency(fre), WithEventListener(listener))
+		assert.Nil(t, err)
+		for i := 0; i < 10; i++ {
+			value := fmt.Sprintf("value-%v-%v", fre, i)
+			assert.Nil(t, primary.Put([]byte("key"), []byte(value)))
+			waitReplicated(t, follower, "key", value)
+		}
+		listener.mu.Lock()
+		if fre == 1 {
+			assert.True(t, listener.syncs >= 10)
+		} else {
+			assert.Equal(t, 0, listener.syncs)
+		}
+		listener.mu.Unlock()
+		assert.Nil(t, follower.Close())
+	}
+
+	assert.Nil(t, server.Close())
+	assert.Nil(t, primary.Close())
+}
+
+func TestNewReplicationServer_Blob(t *testing.T) {
+	db, err := Open("./tmp/", WithBlobThreshold(1024))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	_, err = NewReplicationServer(db)
+	assert.Equal(t, ErrReplicationNotSupported, err)
+	assert.Nil(t, db.Close())
+}
+
+func TestReadFrame(t *testing.T) {
+	buf := new(bytes.Buffer)
+	frame := &replicationFrame{typ: frameRecords, fid: 1, offset: 10, data: []byte("records")}
+	err := writeFrame(buf, frame)
+	assert.Nil(t, err)
+	read, err := readFrame(buf, replicationFrameSize)
+	assert.Nil(t, err)
+	assert.Equal(t, frame, read)
+
+	// the size is checked before the data is allocated
+	header := make([]byte, frameHeaderSize)
+	header[0] = frameRecords
+	binary.BigEndian.PutUint32(header[13:], replicationFrameSize+1)
+	_, err = readFrame(bytes.NewReader(header), replicationFrameSize)
+	assert.Equal(t, ErrReplicationFrame, err)
+}
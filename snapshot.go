@@ -0,0 +1,294 @@
+package cqkv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/cqkv/cqkv/model"
+	"os"
+)
+
+const (
+	snapshotMetaKey = "snapshot.meta"
+
+	// snapshotFlushSize is the buffer size before writing the snapshot file
+	snapshotFlushSize = 4 * 1024 * 1024
+)
+
+/*
+keydir snapshot:
+	- meta record: key = snapshot.meta, value = fid | offset | txSeq | count | recordSeq (varint)
+	- count pos records: key = key, keyspace = keyspace of the key, value = record pos,
+	  the tombstone of a deleted key is a delete record, value = the pos of the tombstone
+every record has its own crc, a snapshot with missing records is corrupted.
+the snapshot covers all the data before the (fid, offset).
+*/
+
+// snapshotMeta record the position the snapshot covers
+type snapshotMeta struct {
+	fid    uint32
+	offset int64
+	txSeq  uint64
+	count  int64
+
+	recordSeq uint64
+}
+
+func marshalSnapshotMeta(meta *snapshotMeta) []byte {
+	buf := make([]byte, binary.MaxVarintLen32+binary.MaxVarintLen64*4)
+	var index = 0
+	index += binary.PutUvarint(buf[index:], uint64(meta.fid))
+	index += binary.PutVarint(buf[index:], meta.offset)
+	index += binary.PutUvarint(buf[index:], meta.txSeq)
+	index += binary.PutVarint(buf[index:], meta.count)
+	index += binary.PutUvarint(buf[index:], meta.recordSeq)
+	return buf[:index]
+}
+
+func unmarshalSnapshotMeta(buf []byte) (*snapshotMeta, bool) {
+	var index = 0
+	fid, n := binary.Uvarint(buf[index:])
+	if n <= 0 {
+		return nil, false
+	}
+	index += n
+	offset, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, false
+	}
+	index += n
+	txSeq, n := binary.Uvarint(buf[index:])
+	if n <= 0 {
+		return nil, false
+	}
+	index += n
+	count, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, false
+	}
+	index += n
+	// the snapshot written before the record sequence has no recordSeq
+	recordSeq, _ := binary.Uvarint(buf[index:])
+
+	return &snapshotMeta{
+		fid:       uint32(fid),
+		offset:    offset,
+		txSeq:     txSeq,
+		count:     count,
+		recordSeq: recordSeq,
+	}, true
+}
+
+// writeSnapshot persist the keydir, the caller should hold the lock
+func (db *DB) writeSnapshot() error {
+	snapshotFileName := model.GetDataFileName(db.options.dirPath, model.SnapshotFileType, 0)
+	// remove the old snapshot first, the data file is opened in append mode
+	if err := db.options.fs.Remove(snapshotFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	snapshotIoManager, err := db.options.ioManagerCreator(snapshotFileName)
+	if err != nil {
+		return err
+	}
+	defer snapshotIoManager.Close()
+	snapshotFile := model.OpenDataFile(0, snapshotIoManager)
+
+	db.ksMu.RLock()
+	defer db.ksMu.RUnlock()
+	var count int
+	for _, ks := range db.keyspaces {
+		count += ks.keydir.Size() + len(ks.tombstones)
+	}
+
+	// write the meta record first
+	meta := &snapshotMeta{
+		fid:    db.activeFile.Fid,
+		offset: db.activeFile.WriteOffset,
+		txSeq:  db.txSeq,
+		count:  int64(count),
+
+		recordSeq: db.recordSeq,
+	}
+	metaData, _, err := db.marshalRecord(&model.Record{
+		Key:   []byte(snapshotMetaKey),
+		Value: marshalSnapshotMeta(meta),
+	})
+	if err != nil {
+		return err
+	}
+
+	buf := bytes.NewBuffer(metaData)
+	for _, ks := range db.keyspaces {
+		if err = db.writeKeyspaceSnapshot(snapshotFile, buf, ks); err != nil {
+			return err
+		}
+	}
+
+	if buf.Len() > 0 {
+		if err = snapshotFile.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return snapshotFile.Sync()
+}
+
+// writeKeyspaceSnapshot write the pos records of the keyspace
+func (db *DB) writeKeyspaceSnapshot(snapshotFile *model.DataFile, buf *bytes.Buffer, ks *Keyspace) error {
+	iterator := ks.keydir.Iterator()
+	defer iterator.Close()
+
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		posRecordData, err := db.marshalPosRecord(ks.id, iterator.Key(), iterator.Value())
+		if err != nil {
+			return err
+		}
+		buf.Write(posRecordData)
+
+		if err = flushSnapshot(snapshotFile, buf); err != nil {
+			return err
+		}
+	}
+
+	for key, tombstone := range ks.tombstones {
+		posValue, err := db.options.codec.MarshalRecordPos(&model.RecordPos{
+			Fid:    tombstone.Fid,
+			Offset: tombstone.Offset,
+			Seq:    tombstone.Seq,
+		})
+		if err != nil {
+			return err
+		}
+		tombstoneData, _, err := db.marshalRecord(&model.Record{
+			Key:      []byte(key),
+			Value:    posValue,
+			IsDelete: true,
+			Keyspace: ks.id,
+		})
+		if err != nil {
+			return err
+		}
+		buf.Write(tombstoneData)
+
+		if err = flushSnapshot(snapshotFile, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushSnapshot write the buffer to the snapshot file if it is full
+func flushSnapshot(snapshotFile *model.DataFile, buf *bytes.Buffer) error {
+	if buf.Len() < snapshotFlushSize {
+		return nil
+	}
+	if err := snapshotFile.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	buf.Reset()
+	return nil
+}
+
+// loadKeydirFromSnapshot load the keydir from the snapshot and return the position it covers,
+// ok is false if the snapshot is missing or corrupted
+func (db *DB) loadKeydirFromSnapshot() (fid uint32, offset int64, ok bool, err error) {
+	snapshotFileName := model.GetDataFileName(db.options.dirPath, model.SnapshotFileType, 0)
+	if _, err = db.options.fs.Stat(snapshotFileName); os.IsNotExist(err) {
+		return 0, 0, false, nil
+	}
+
+	snapshotIoManager, err := db.options.ioManagerCreator(snapshotFileName)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer snapshotIoManager.Close()
+	snapshotFile := model.OpenDataFile(0, snapshotIoManager)
+
+	// read the meta record
+	metaRecord, size, err := db.getRecordFromDataFile(snapshotFile, 0)
+	if err != nil || !bytes.Equal(metaRecord.Key, []byte(snapshotMetaKey)) {
+		return 0, 0, false, nil
+	}
+	meta, valid := unmarshalSnapshotMeta(metaRecord.Value)
+	if !valid || !db.snapshotCovered(meta) {
+		return 0, 0, false, nil
+	}
+
+	// read all the records before updating the keydir,
+	// the keydir is untouched if the snapshot is corrupted
+	keys := make([][]byte, 0, meta.count)
+	keyspaces := make([]uint32, 0, meta.count)
+	positions := make([]*model.RecordPos, 0, meta.count)
+	isDeletes := make([]bool, 0, meta.count)
+	readOffset := size
+	for i := int64(0); i < meta.count; i++ {
+		record, size, err := db.getRecordFromDataFile(snapshotFile, readOffset)
+		if err != nil {
+			return 0, 0, false, nil
+		}
+
+		pos := new(model.RecordPos)
+		if err = db.options.codec.UnmarshalRecordPos(record.Value, pos); err != nil {
+			return 0, 0, false, nil
+		}
+		keys = append(keys, record.Key)
+		keyspaces = append(keyspaces, record.Keyspace)
+		positions = append(positions, pos)
+		isDeletes = append(isDeletes, record.IsDelete)
+		readOffset += size
+	}
+
+	for i, pos := range positions {
+		if isDeletes[i] {
+			db.loadKeyspace(keyspaces[i]).setTombstone(keys[i], pos)
+			continue
+		}
+		// the inline value size may be changed since the snapshot was written
+		if int64(len(pos.Value)) >= db.options.inlineValueSize {
+			pos.Value = nil
+		}
+		if err = db.fillInlineValue(keys[i], pos); err != nil {
+			return 0, 0, false, err
+		}
+
+		if !db.loadKeyspace(keyspaces[i]).putKeydir(keys[i], pos) {
+			return 0, 0, false, ErrUpdateKeydir
+		}
+	}
+	db.txSeq = meta.txSeq
+	db.recordSeq = meta.recordSeq
+
+	return meta.fid, meta.offset, true, nil
+}
+
+// snapshotCovered check whether the data files covered by the snapshot still exist
+func (db *DB) snapshotCovered(meta *snapshotMeta) bool {
+	if db.activeFile == nil {
+		return false
+	}
+
+	var dataFile *model.DataFile
+	if meta.fid == db.activeFile.Fid {
+		dataFile = db.activeFile
+	} else {
+		dataFile = db.olderFiles[meta.fid]
+	}
+	if dataFile == nil {
+		return false
+	}
+
+	fileSize, err := dataFile.IoManager.Size()
+	if err != nil {
+		return false
+	}
+	return fileSize >= meta.offset
+}
+
+// removeSnapshot remove the keydir snapshot, it is invalid after the data files are changed
+func (db *DB) removeSnapshot() error {
+	snapshotFileName := model.GetDataFileName(db.options.dirPath, model.SnapshotFileType, 0)
+	if err := db.options.fs.Remove(snapshotFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
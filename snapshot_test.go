@@ -0,0 +1,109 @@
+package cqkv
+
+import (
+	"fmt"
+	"github.com/cqkv/cqkv/model"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestDB_Snapshot(t *testing.T) {
+	db, err := Open("./tmp/")
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%v", i)), []byte(fmt.Sprintf("value-%v", i)))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 10; i++ {
+		err = db.Delete([]byte(fmt.Sprintf("key-%v", i)))
+		assert.Nil(t, err)
+	}
+
+	// close write the snapshot
+	err = db.Close()
+	assert.Nil(t, err)
+	_, err = os.Stat(model.GetDataFileName("./tmp/", model.SnapshotFileType, 0))
+	assert.Nil(t, err)
+
+	db, err = Open("./tmp/")
+	assert.Nil(t, err)
+	assert.Equal(t, 90, len(db.ListKeys()))
+
+	value, err := db.Get([]byte("key-50"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value-50", string(value))
+
+	// the data after the snapshot is replayed
+	err = db.Put([]byte("key-50"), []byte("new-value"))
+	assert.Nil(t, err)
+	err = db.Delete([]byte("key-51"))
+	assert.Nil(t, err)
+	err = db.Sync()
+	assert.Nil(t, err)
+
+	// reopen without close
+	releaseLock(t, db)
+	db, err = Open("./tmp/")
+	assert.Nil(t, err)
+	assert.Equal(t, 89, len(db.ListKeys()))
+
+	value, err = db.Get([]byte("key-50"))
+	assert.Nil(t, err)
+	assert.Equal(t, "new-value", string(value))
+
+	_, err = db.Get([]byte("key-51"))
+	assert.Equal(t, ErrNoRecord, err)
+
+	// the new data can be appended after the replayed data
+	err = db.Put([]byte("key-52"), []byte("new-value"))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = Open("./tmp/")
+	assert.Nil(t, err)
+	value, err = db.Get([]byte("key-52"))
+	assert.Nil(t, err)
+	assert.Equal(t, "new-value", string(value))
+}
+
+func TestDB_Snapshot_Corrupted(t *testing.T) {
+	db, err := Open("./tmp/")
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%v", i)), []byte(fmt.Sprintf("value-%v", i)))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// truncate the snapshot
+	snapshotFileName := model.GetDataFileName("./tmp/", model.SnapshotFileType, 0)
+	info, err := os.Stat(snapshotFileName)
+	assert.Nil(t, err)
+	err = os.Truncate(snapshotFileName, info.Size()/2)
+	assert.Nil(t, err)
+
+	db, err = Open("./tmp/")
+	assert.Nil(t, err)
+	_, _, ok, err := db.loadKeydirFromSnapshot()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// fall back to a full scan
+	assert.Equal(t, 100, len(db.ListKeys()))
+	value, err := db.Get([]byte("key-99"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value-99", string(value))
+}
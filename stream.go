@@ -0,0 +1,329 @@
+package cqkv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/cqkv/cqkv/codec"
+	"github.com/cqkv/cqkv/model"
+	"github.com/cqkv/cqkv/utils"
+	"hash"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+/*
+stream: the big value is written and read in chunks, it is never all in memory.
+	- PutStream spools the value to a temp file of the db on fio.FS before holding the lock,
+	  the crc of the value is generated while spooling and combined with the crc of the header,
+	  because the crc in the header covers the value and has to be known before the value is written
+	- GetReader reads the value on demand and checks the crc when the value is read to the end
+the streamed value is stored as a normal record, so it requires the default codec.
+*/
+
+// PutStream write size bytes of r as the value of the key
+func (db *DB) PutStream(key []byte, r io.Reader, size int64) error {
+	return db.defaultKeyspace.PutStream(key, r, size)
+}
+
+// GetReader return a reader of the value of the key, the reader should be closed
+func (db *DB) GetReader(key []byte) (io.ReadCloser, error) {
+	return db.defaultKeyspace.GetReader(key)
+}
+
+// PutStream write size bytes of r as the value of the key
+func (ks *Keyspace) PutStream(key []byte, r io.Reader, size int64) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if size < 0 {
+		return ErrInvalidSize
+	}
+	if _, ok := ks.db.options.codec.(*codec.CodecImpl); !ok {
+		return ErrStreamNotSupported
+	}
+	if ks.db.options.readOnly {
+		return ErrReadOnly
+	}
+
+	// read the value before holding the lock, the reader may be slow
+	db := ks.db
+	spool, valueCrc, release, err := db.spoolValue(r, size)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if ks.dropped {
+		return ErrKeyspaceDropped
+	}
+	if err = db.checkQuota(int64(len(key)) + size); err != nil {
+		return err
+	}
+
+	pos, err := db.appendStream(&model.Record{
+		Key:      addTxSeqPrefix(key, noTransactionSeq),
+		Keyspace: ks.id,
+		Prev:     ks.prevVersion(key),
+	}, spool, valueCrc, size)
+	if err != nil {
+		return err
+	}
+
+	if !ks.putKeydir(key, pos) {
+		return ErrUpdateKeydir
+	}
+	return nil
+}
+
+// streamSpoolPrefix is the name prefix of the temp files PutStream spools the values to
+const streamSpoolPrefix = "cqkv-stream-"
+
+// spoolValue copy size bytes of r to a temp file in the dir of the db and return the crc of the value.
+// release should be called after the spool is used
+func (db *DB) spoolValue(r io.Reader, size int64) (*model.DataFile, uint32, func(), error) {
+	fs := db.options.fs
+	name := filepath.Join(db.options.dirPath, fmt.Sprintf("%s%d", streamSpoolPrefix, atomic.AddUint64(&db.spoolSeq, 1)))
+	ioManager, err := fs.OpenFile(name)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	release := func() {
+		_ = ioManager.Close()
+		_ = fs.Remove(name)
+	}
+
+	spool := model.OpenDataFile(0, ioManager)
+	crc := crc32.NewIEEE()
+	if err = spool.WriteFrom(io.TeeReader(r, crc), size); err != nil {
+		release()
+		if err == io.EOF {
+			return nil, 0, nil, io.ErrUnexpectedEOF
+		}
+		return nil, 0, nil, err
+	}
+	return spool, crc.Sum32(), release, nil
+}
+
+// appendStream append the record whose value is the size bytes of spool and its crc is valueCrc,
+// the caller should hold the lock
+func (db *DB) appendStream(record *model.Record, spool *model.DataFile, valueCrc uint32, size int64) (*model.RecordPos, error) {
+	db.assignRecordSeq(record)
+
+	// the big value is written to the blob file, the record keeps the pointer
+	if db.isBlobSize(size) {
+		blobRecord := &model.Record{
+			Key:      record.Key,
+			Seq:      record.Seq,
+			Keyspace: record.Keyspace,
+		}
+		data, total, err := db.marshalStreamRecord(blobRecord, valueCrc, size)
+		if err != nil {
+			return nil, err
+		}
+		if err = db.prepareBlobFile(total); err != nil {
+			return nil, err
+		}
+
+		offset := db.activeBlobFile.WriteOffset
+		if err = writeStream(db.activeBlobFile, data, spool, size); err != nil {
+			db.rollback(db.activeBlobFile, offset)
+			return nil, err
+		}
+		db.diskBytes += total
+		record.Value = marshalBlobPointer(db.activeBlobFile.Fid, offset)
+		record.IsBlob = true
+		return db.appendRecord(record)
+	}
+
+	data, total, err := db.marshalStreamRecord(record, valueCrc, size)
+	if err != nil {
+		return nil, err
+	}
+	return db.writeRecord(record, total, func(dataFile *model.DataFile) error {
+		return writeStream(dataFile, data, spool, size)
+	})
+}
+
+// marshalStreamRecord return the header and the key of the record whose value is size bytes with valueCrc,
+// and the size of the whole record
+func (db *DB) marshalStreamRecord(record *model.Record, valueCrc uint32, size int64) ([]byte, int64, error) {
+	header := &model.RecordHeader{
+		KeySize:   int64(len(record.Key)),
+		ValueSize: size,
+		Seq:       record.Seq,
+		Prev:      record.Prev,
+		Timestamp: record.Timestamp,
+		ExpireAt:  record.ExpireAt,
+		Keyspace:  record.Keyspace,
+	}
+	headerData, headerSize, err := db.options.codec.MarshalRecordHeader(header)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	data := make([]byte, headerSize+int64(len(record.Key)))
+	copy(data, headerData[:headerSize])
+	copy(data[headerSize:], record.Key)
+
+	// the crc covers the value, the crc of the value is generated while spooling
+	crc := utils.CombineCrc(crc32.ChecksumIEEE(data[4:]), valueCrc, size)
+	binary.BigEndian.PutUint32(data[:4], crc)
+
+	return data, int64(len(data)) + size, nil
+}
+
+// writeStream write the header and the key, then copy the value from spool
+func writeStream(dataFile *model.DataFile, data []byte, spool *model.DataFile, size int64) error {
+	if err := dataFile.Write(data); err != nil {
+		return err
+	}
+	return dataFile.WriteFrom(spool.NewReader(0, size), size)
+}
+
+// GetReader return a reader of the value of the key, the reader should be closed
+func (ks *Keyspace) GetReader(key []byte) (io.ReadCloser, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+
+	db := ks.db
+	db.mu.RLock()
+	pos := ks.keydir.Get(key)
+	if pos == nil || pos.IsExpired(time.Now().UnixNano()) {
+		db.mu.RUnlock()
+		return nil, ErrNoRecord
+	}
+
+	// small value is inlined in keydir
+	if pos.Value != nil {
+		value := append([]byte{}, pos.Value...)
+		db.mu.RUnlock()
+		return io.NopCloser(bytes.NewReader(value)), nil
+	}
+
+	dataFile := db.getDataFile(pos.Fid)
+	if dataFile == nil {
+		db.mu.RUnlock()
+		return nil, ErrNoDataFile
+	}
+	// the reader keeps the data file open until it is closed
+	dataFile.Ref()
+	db.mu.RUnlock()
+
+	reader, header, err := db.newValueReader(dataFile, pos.Offset)
+	if err != nil {
+		_ = dataFile.Unref()
+		return nil, err
+	}
+	if header.IsDelete {
+		_ = reader.Close()
+		return nil, ErrNoRecord
+	}
+	if !header.IsBlob {
+		return reader, nil
+	}
+
+	// the pointer is small, read the value from the blob file
+	pointer, err := io.ReadAll(reader)
+	_ = reader.Close()
+	if err != nil {
+		return nil, err
+	}
+	blobReader, err := db.newBlobReader(pointer)
+	if err == ErrNoBlobFile && ks.isMoved(key, pos) {
+		// the value is moved by GCBlobs, read the new pointer
+		return ks.GetReader(key)
+	}
+	return blobReader, err
+}
+
+// newBlobReader return a reader of the value the blob pointer points to
+func (db *DB) newBlobReader(pointer []byte) (io.ReadCloser, error) {
+	fid, offset, err := unmarshalBlobPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	blobFile := db.blobFiles[fid]
+	if blobFile == nil {
+		db.mu.RUnlock()
+		return nil, ErrNoBlobFile
+	}
+	blobFile.Ref()
+	db.mu.RUnlock()
+
+	reader, _, err := db.newValueReader(blobFile, offset)
+	if err != nil {
+		_ = blobFile.Unref()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// newValueReader read the header and the key of the record at offset,
+// and return a reader of the value which takes over the reference of the data file
+func (db *DB) newValueReader(dataFile *model.DataFile, offset int64) (*valueReader, *model.RecordHeader, error) {
+	headerData, err := dataFile.ReadRecordHeader(offset)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := new(model.RecordHeader)
+	headerSize, err := db.options.codec.UnmarshalRecordHeader(headerData, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header.Crc == 0 && header.KeySize == 0 && header.ValueSize == 0 {
+		return nil, nil, io.EOF
+	}
+
+	key, err := dataFile.ReadRecord(offset+headerSize, header.KeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the crc is generated while the value is read
+	crc := crc32.NewIEEE()
+	crc.Write(headerData[4:headerSize])
+	crc.Write(key)
+
+	return &valueReader{
+		dataFile: dataFile,
+		reader:   dataFile.NewReader(offset+headerSize+header.KeySize, header.ValueSize),
+		crc:      crc,
+		expected: header.Crc,
+	}, header, nil
+}
+
+// valueReader read the value in the data file and check the crc at the end
+type valueReader struct {
+	dataFile *model.DataFile
+	reader   io.Reader
+	crc      hash.Hash32
+	expected uint32
+	closed   bool
+}
+
+func (vr *valueReader) Read(p []byte) (int, error) {
+	n, err := vr.reader.Read(p)
+	vr.crc.Write(p[:n])
+	if err == io.EOF && vr.crc.Sum32() != vr.expected {
+		return n, ErrWrongCrc
+	}
+	return n, err
+}
+
+// Close release the data file, it can be called more than once
+func (vr *valueReader) Close() error {
+	if vr.closed {
+		return nil
+	}
+	vr.closed = true
+	return vr.dataFile.Unref()
+}
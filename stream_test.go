@@ -0,0 +1,126 @@
+package cqkv
+
+import (
+	"bytes"
+	"github.com/cqkv/cqkv/model"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDB_PutStream(t *testing.T) {
+	db, err := Open("./tmp/")
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	value := bytes.Repeat([]byte("0123456789"), 300*1024)
+	err = db.PutStream([]byte("big"), bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+	err = db.PutStream([]byte("small"), bytes.NewReader([]byte("value")), 5)
+	assert.Nil(t, err)
+
+	// the reader is shorter than the size
+	err = db.PutStream([]byte("short"), bytes.NewReader([]byte("value")), 10)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	err = db.PutStream([]byte("short"), bytes.NewReader([]byte("value")), -1)
+	assert.Equal(t, ErrInvalidSize, err)
+
+	check := func(db *DB) {
+		reader, err := db.GetReader([]byte("big"))
+		assert.Nil(t, err)
+		data, err := io.ReadAll(reader)
+		assert.Nil(t, err)
+		assert.Equal(t, value, data)
+		assert.Nil(t, reader.Close())
+
+		data, err = db.Get([]byte("small"))
+		assert.Nil(t, err)
+		assert.Equal(t, "value", string(data))
+		_, err = db.GetReader([]byte("short"))
+		assert.Equal(t, ErrNoRecord, err)
+	}
+	check(db)
+
+	// the spools are removed after the values are written
+	entries, err := os.ReadDir("./tmp/")
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		assert.False(t, strings.HasPrefix(entry.Name(), streamSpoolPrefix))
+	}
+
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// the spool left by a crash is removed on open
+	spoolName := filepath.Join("./tmp/", streamSpoolPrefix+"1")
+	err = os.WriteFile(spoolName, value[:100], 0644)
+	assert.Nil(t, err)
+	db, err = Open("./tmp/")
+	assert.Nil(t, err)
+	check(db)
+	_, err = os.Stat(spoolName)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDB_PutStream_Blob(t *testing.T) {
+	db, err := Open("./tmp/", WithBlobThreshold(1024))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	value := bytes.Repeat([]byte("a"), 100*1024)
+	err = db.PutStream([]byte("key"), bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, db.Stat().BlobFileNum)
+
+	reader, err := db.GetReader([]byte("key"))
+	assert.Nil(t, err)
+	data, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, value, data)
+	assert.Nil(t, reader.Close())
+
+	// the value put at once can be read by the reader too
+	err = db.Put([]byte("key"), []byte("value"))
+	assert.Nil(t, err)
+	reader, err = db.GetReader([]byte("key"))
+	assert.Nil(t, err)
+	data, err = io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(data))
+}
+
+func TestDB_GetReader_WrongCrc(t *testing.T) {
+	db, err := Open("./tmp/", WithInlineValueSize(0))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	value := bytes.Repeat([]byte("a"), 1024)
+	err = db.PutStream([]byte("key"), bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+
+	// corrupt the last byte of the value
+	fileName := model.GetDataFileName("./tmp/", model.DataFileType, 0)
+	data, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	data[len(data)-1] = 'b'
+	err = os.WriteFile(fileName, data, 0644)
+	assert.Nil(t, err)
+
+	reader, err := db.GetReader([]byte("key"))
+	assert.Nil(t, err)
+	_, err = io.ReadAll(reader)
+	assert.Equal(t, ErrWrongCrc, err)
+	assert.Nil(t, reader.Close())
+}
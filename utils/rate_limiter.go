@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"context"
+	"time"
+)
+
+// RateLimiter limit the bytes per second, it is not concurrency-safe
+type RateLimiter struct {
+	bytesPerSec int64
+	start       time.Time
+	bytes       int64
+}
+
+// NewRateLimiter return a limiter allow bytesPerSec bytes per second,
+// bytesPerSec <= 0 means no limit
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	return &RateLimiter{
+		bytesPerSec: bytesPerSec,
+		start:       time.Now(),
+	}
+}
+
+// WaitN block until n more bytes are allowed or the ctx is done
+func (rl *RateLimiter) WaitN(ctx context.Context, n int64) error {
+	if rl.bytesPerSec <= 0 {
+		return ctx.Err()
+	}
+
+	rl.bytes += n
+	// the time these bytes are allowed
+	allowed := rl.start.Add(time.Duration(float64(rl.bytes) / float64(rl.bytesPerSec) * float64(time.Second)))
+	wait := time.Until(allowed)
+	if wait <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
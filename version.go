@@ -0,0 +1,227 @@
+package cqkv
+
+import (
+	"bytes"
+	"github.com/cqkv/cqkv/model"
+	"io"
+)
+
+// noRecordSeq is the seq of the records written before the record sequence is added
+const noRecordSeq uint64 = 0
+
+// Version is a value of the key written at Seq
+type Version struct {
+	Seq   uint64
+	Value []byte
+}
+
+// GetVersions return at most limit versions of the key from the newest one,
+// limit <= 0 means all the versions that have not been cleared by merge.
+// the versions before a delete are reachable after the key is written again,
+// the versions before a range delete are not reachable.
+func (db *DB) GetVersions(key []byte, limit int) ([]*Version, error) {
+	return db.defaultKeyspace.GetVersions(key, limit)
+}
+
+// GetAt return the value of the key at seq, which is the newest version written before or at seq
+func (db *DB) GetAt(key []byte, seq uint64) ([]byte, error) {
+	return db.defaultKeyspace.GetAt(key, seq)
+}
+
+// GetVersions return at most limit versions of the key from the newest one
+func (ks *Keyspace) GetVersions(key []byte, limit int) ([]*Version, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+
+	var versions []*Version
+	err := ks.walkVersions(key, func(record *model.Record) bool {
+		if record.IsDelete {
+			return true
+		}
+		versions = append(versions, &Version{Seq: record.Seq, Value: record.Value})
+		return limit <= 0 || len(versions) < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// GetAt return the value of the key at seq
+func (ks *Keyspace) GetAt(key []byte, seq uint64) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+
+	var value []byte
+	var found bool
+	err := ks.walkVersions(key, func(record *model.Record) bool {
+		if record.Seq <= seq {
+			// the key was deleted at seq
+			value, found = record.Value, !record.IsDelete
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNoRecord
+	}
+	return value, nil
+}
+
+// walkVersions call fn with the versions of the key from the newest one until fn return false,
+// the tombstones between the versions are passed to fn too
+func (ks *Keyspace) walkVersions(key []byte, fn func(record *model.Record) bool) error {
+	db := ks.db
+	db.mu.RLock()
+	pos := ks.keydir.Get(key)
+	if pos == nil {
+		db.mu.RUnlock()
+		return ErrNoRecord
+	}
+	record, err := db.get(pos)
+	if err == nil {
+		err = db.resolveBlob(record)
+	}
+	db.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	for record != nil && fn(record) {
+		if record.Prev == nil {
+			return nil
+		}
+		if record, err = db.readVersion(ks.id, key, record.Prev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readVersion read the version of the key, it returns nil if the version has been cleared by merge.
+// the data file is read without holding the lock
+func (db *DB) readVersion(keyspace uint32, key []byte, version *model.RecordVersion) (*model.Record, error) {
+	db.mu.RLock()
+	dataFile := db.getDataFile(version.Fid)
+	if dataFile == nil {
+		db.mu.RUnlock()
+		return nil, nil
+	}
+	// the active file is never merged, the version is not moved
+	active := dataFile == db.activeFile
+	// keep the data file open until the read is finished
+	dataFile.Ref()
+	db.mu.RUnlock()
+	defer dataFile.Unref()
+
+	record, _, err := db.getRecordFromDataFile(dataFile, version.Offset)
+	if err == nil && isVersionOf(record, keyspace, key, version.Seq) {
+		return db.resolveVersion(record)
+	}
+	if active {
+		return nil, err
+	}
+
+	// the data file may be merged and the version is moved, search it
+	var offset int64
+	for {
+		record, size, err := db.getRecordFromDataFile(dataFile, offset)
+		if err != nil {
+			if err == io.EOF {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if isVersionOf(record, keyspace, key, version.Seq) {
+			return db.resolveVersion(record)
+		}
+		offset += size
+	}
+}
+
+// resolveVersion read the blob value of the version, the version is cleared if its blob file is removed
+func (db *DB) resolveVersion(record *model.Record) (*model.Record, error) {
+	if !record.IsBlob {
+		return record, nil
+	}
+	value, err := db.readBlobValue(record.Value)
+	if err != nil {
+		if err == ErrNoBlobFile {
+			return nil, nil
+		}
+		return nil, err
+	}
+	record.Value, record.IsBlob = value, false
+	return record, nil
+}
+
+func isVersionOf(record *model.Record, keyspace uint32, key []byte, seq uint64) bool {
+	if record.IsRangeDelete || record.Seq != seq || record.Keyspace != keyspace {
+		return false
+	}
+	realKey, _ := parseTxSeqPrefix(record.Key)
+	return bytes.Equal(realKey, key)
+}
+
+// mergedVersions record the versions moved by merge, so the back-pointers can be fixed
+type mergedVersions struct {
+	fids  map[uint32]bool                 // the merged files
+	moved map[uint64]*model.RecordVersion // seq -> new position
+	// retained is the seqs of the versions merge keeps by the key, the versions of a key are walked once
+	retained map[batchKey]map[uint64]bool
+}
+
+func newMergedVersions() *mergedVersions {
+	return &mergedVersions{
+		fids:     make(map[uint32]bool),
+		moved:    make(map[uint64]*model.RecordVersion),
+		retained: make(map[batchKey]map[uint64]bool),
+	}
+}
+
+// isRetained check whether the version of the key is one of the newest versions merge should keep.
+// the versions written while merging only make the retained ones older, so keeping them is safe
+func (mv *mergedVersions) isRetained(ks *Keyspace, key []byte, seq uint64) (bool, error) {
+	// the record written without seq can not be found in the versions
+	if seq == noRecordSeq {
+		return false, nil
+	}
+
+	k := batchKey{keyspace: ks, key: string(key)}
+	seqs, ok := mv.retained[k]
+	if !ok {
+		seqs = make(map[uint64]bool)
+		// the tombstones between the versions are kept to link them
+		var values int
+		err := ks.walkVersions(key, func(record *model.Record) bool {
+			seqs[record.Seq] = true
+			if !record.IsDelete {
+				values++
+			}
+			return values < ks.db.options.retainVersions
+		})
+		if err != nil && err != ErrNoRecord {
+			return false, err
+		}
+		mv.retained[k] = seqs
+	}
+	return seqs[seq], nil
+}
+
+// remap return the new position of the previous version,
+// nil if the previous version has been cleared.
+// the previous version is always written before, so it has been merged.
+func (mv *mergedVersions) remap(prev *model.RecordVersion) *model.RecordVersion {
+	if moved, ok := mv.moved[prev.Seq]; ok {
+		return moved
+	}
+	if mv.fids[prev.Fid] {
+		return nil
+	}
+	return prev
+}
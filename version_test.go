@@ -0,0 +1,259 @@
+package cqkv
+
+import (
+	"context"
+	"fmt"
+	"github.com/cqkv/cqkv/model"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func versionValues(versions []*Version) []string {
+	values := make([]string, 0, len(versions))
+	for _, version := range versions {
+		values = append(values, string(version.Value))
+	}
+	return values
+}
+
+func TestDB_GetVersions(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(256))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 5; i++ {
+		err = db.Put([]byte("key"), []byte(fmt.Sprintf("value-%v", i)))
+		assert.Nil(t, err)
+		err = db.Put([]byte(fmt.Sprintf("other-%v", i)), []byte("value"))
+		assert.Nil(t, err)
+	}
+	wb := db.NewWriteBatch()
+	err = wb.Put([]byte("key"), []byte("value-5"))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	versions, err := db.GetVersions([]byte("key"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"value-5", "value-4", "value-3", "value-2", "value-1", "value-0"}, versionValues(versions))
+	for i := 1; i < len(versions); i++ {
+		assert.True(t, versions[i].Seq < versions[i-1].Seq)
+	}
+
+	versions, err = db.GetVersions([]byte("key"), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"value-5", "value-4"}, versionValues(versions))
+
+	// time travel
+	all, err := db.GetVersions([]byte("key"), 0)
+	assert.Nil(t, err)
+	value, err := db.GetAt([]byte("key"), all[3].Seq)
+	assert.Nil(t, err)
+	assert.Equal(t, "value-2", string(value))
+	value, err = db.GetAt([]byte("key"), all[3].Seq+1)
+	assert.Nil(t, err)
+	assert.Equal(t, "value-2", string(value))
+	_, err = db.GetAt([]byte("key"), all[5].Seq-1)
+	assert.Equal(t, ErrNoRecord, err)
+
+	// the versions are kept after reopening
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", WithDataFileSize(256))
+	assert.Nil(t, err)
+	versions, err = db.GetVersions([]byte("key"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(versions))
+
+	// the sequence keeps increasing after reopening without snapshot
+	err = os.Remove(model.GetDataFileName("./tmp/", model.SnapshotFileType, 0))
+	assert.Nil(t, err)
+	releaseLock(t, db)
+	db, err = Open("./tmp/", WithDataFileSize(256))
+	assert.Nil(t, err)
+	err = db.Put([]byte("key"), []byte("value-6"))
+	assert.Nil(t, err)
+	versions, err = db.GetVersions([]byte("key"), 2)
+	assert.Nil(t, err)
+	assert.True(t, versions[0].Seq > versions[1].Seq)
+
+	// the key written again after the delete links to the versions before it
+	err = db.Delete([]byte("key"))
+	assert.Nil(t, err)
+	_, err = db.GetVersions([]byte("key"), 0)
+	assert.Equal(t, ErrNoRecord, err)
+	err = db.Put([]byte("key"), []byte("new-value"))
+	assert.Nil(t, err)
+	versions, err = db.GetVersions([]byte("key"), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"new-value", "value-6"}, versionValues(versions))
+	// the key is deleted at the seq of the tombstone
+	_, err = db.GetAt([]byte("key"), versions[0].Seq-1)
+	assert.Equal(t, ErrNoRecord, err)
+	value, err = db.GetAt([]byte("key"), versions[1].Seq)
+	assert.Nil(t, err)
+	assert.Equal(t, "value-6", string(value))
+}
+
+func TestDB_GetVersions_Delete(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(256), WithRetainVersions(3))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 3; i++ {
+		err = db.Put([]byte("key"), []byte(fmt.Sprintf("value-%v", i)))
+		assert.Nil(t, err)
+	}
+	wb := db.NewWriteBatch()
+	assert.Nil(t, wb.Delete([]byte("key")))
+	assert.Nil(t, wb.Commit())
+	for i := 0; i < 10; i++ {
+		err = db.Put([]byte(fmt.Sprintf("other-%v", i)), []byte("value"))
+		assert.Nil(t, err)
+	}
+	check := func(db *DB, expected []string) {
+		err := db.Put([]byte("key"), []byte("new-value"))
+		assert.Nil(t, err)
+		versions, err := db.GetVersions([]byte("key"), 0)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, versionValues(versions))
+		err = db.Delete([]byte("key"))
+		assert.Nil(t, err)
+	}
+	all := []string{"new-value", "value-2", "value-1", "value-0"}
+	check(db, all)
+
+	// the tombstones are kept by the snapshot and by the data files
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", WithDataFileSize(256), WithRetainVersions(3))
+	assert.Nil(t, err)
+	check(db, append([]string{"new-value"}, all...))
+	err = os.Remove(model.GetDataFileName("./tmp/", model.SnapshotFileType, 0))
+	assert.Nil(t, err)
+	releaseLock(t, db)
+	db, err = Open("./tmp/", WithDataFileSize(256), WithRetainVersions(3))
+	assert.Nil(t, err)
+	check(db, append([]string{"new-value", "new-value"}, all...))
+
+	// merge keeps the tombstones between the retained versions
+	err = db.Put([]byte("key"), []byte("last-value"))
+	assert.Nil(t, err)
+	err = db.MergeWithContext(context.Background(), MergeOptions{})
+	assert.Nil(t, err)
+	versions, err := db.GetVersions([]byte("key"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"last-value", "new-value", "new-value"}, versionValues(versions))
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_GetVersions_Merge(t *testing.T) {
+	db, err := Open("./tmp/", WithDataFileSize(256), WithRetainVersions(10))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+		_ = os.RemoveAll("./tmp-cqkv-merge")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// the garbage make the versions in the first data file moved by merge
+	err = db.Put([]byte("garbage"), []byte("value"))
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 3; j++ {
+			err = db.Put([]byte(fmt.Sprintf("key-%v", j)), []byte(fmt.Sprintf("value-%v", i)))
+			assert.Nil(t, err)
+		}
+	}
+	err = db.Delete([]byte("garbage"))
+	assert.Nil(t, err)
+
+	// only merge the first data file, the other files point to the moved versions
+	err = db.MergeWithContext(context.Background(), MergeOptions{MaxFiles: 1})
+	assert.Nil(t, err)
+	versions, err := db.GetVersions([]byte("key-0"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"value-9", "value-8", "value-7", "value-6", "value-5",
+		"value-4", "value-3", "value-2", "value-1", "value-0"}, versionValues(versions))
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// merge all the files, the last 3 versions are kept
+	db, err = Open("./tmp/", WithDataFileSize(256), WithRetainVersions(3))
+	assert.Nil(t, err)
+	err = db.MergeWithContext(context.Background(), MergeOptions{})
+	assert.Nil(t, err)
+	check := func(db *DB) {
+		for j := 0; j < 3; j++ {
+			versions, err := db.GetVersions([]byte(fmt.Sprintf("key-%v", j)), 0)
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"value-9", "value-8", "value-7"}, versionValues(versions))
+		}
+	}
+	check(db)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", WithDataFileSize(256), WithRetainVersions(3))
+	assert.Nil(t, err)
+	check(db)
+
+	// the old versions are cleared without retaining
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open("./tmp/", WithDataFileSize(256))
+	assert.Nil(t, err)
+	err = db.Put([]byte("key-0"), []byte("value-10"))
+	assert.Nil(t, err)
+	err = db.MergeWithContext(context.Background(), MergeOptions{})
+	assert.Nil(t, err)
+	versions, err = db.GetVersions([]byte("key-0"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"value-10"}, versionValues(versions))
+}
+
+func TestMergedVersions_IsRetained(t *testing.T) {
+	db, err := Open("./tmp/", WithRetainVersions(3))
+	defer func() {
+		_ = os.RemoveAll("./tmp/")
+	}()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 5; i++ {
+		err = db.Put([]byte("key"), []byte(fmt.Sprintf("value-%v", i)))
+		assert.Nil(t, err)
+	}
+	versions, err := db.GetVersions([]byte("key"), 0)
+	assert.Nil(t, err)
+
+	mv := newMergedVersions()
+	for i, version := range versions {
+		retained, err := mv.isRetained(db.defaultKeyspace, []byte("key"), version.Seq)
+		assert.Nil(t, err)
+		assert.Equal(t, i < 3, retained)
+	}
+	retained, err := mv.isRetained(db.defaultKeyspace, []byte("key"), noRecordSeq)
+	assert.Nil(t, err)
+	assert.False(t, retained)
+
+	// the versions are walked once, the new version does not drop the retained ones
+	err = db.Put([]byte("key"), []byte("value-5"))
+	assert.Nil(t, err)
+	retained, err = mv.isRetained(db.defaultKeyspace, []byte("key"), versions[2].Seq)
+	assert.Nil(t, err)
+	assert.True(t, retained)
+	assert.Equal(t, 1, len(mv.retained))
+
+	err = db.Close()
+	assert.Nil(t, err)
+}